@@ -2,15 +2,22 @@ package btc
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,12 +25,21 @@ type BitcoinRPCConfig struct {
 	Host     string
 	User     string
 	Password string
+	// unlocks an encrypted wallet before signing, empty if not encrypted
+	WalletPassphrase string
+	// connect over https with this config, nil means plain http
+	TLSConfig *tls.Config
 }
 
 type BitcoinRPCClient struct {
 	config     *BitcoinRPCConfig
 	httpClient *http.Client
 	wallet     string
+
+	// outpoints this client locked in the wallet and hasn't spent or
+	// unlocked yet
+	locked    map[Outpoint]struct{}
+	lockedMtx sync.Mutex
 }
 
 type rpcRequest struct {
@@ -35,15 +51,75 @@ type rpcRequest struct {
 
 type rpcResponse struct {
 	Result json.RawMessage `json:"result"`
-	Error  *rpcError       `json:"error"`
+	Error  *RPCError       `json:"error"`
 	ID     string          `json:"id"`
 }
 
-type rpcError struct {
+// RPCError is an error reported by bitcoind itself, as opposed to a
+// transport or decoding failure
+type RPCError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
 
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// bitcoind RPC error codes, see src/rpc/protocol.h
+const (
+	RPCErrWalletError               = -4
+	RPCErrInvalidAddressOrKey       = -5
+	RPCErrClientNotConnected        = -9
+	RPCErrClientInInitialDownload   = -10
+	RPCErrWalletInsufficientFunds   = -6
+	RPCErrWalletKeypoolRanOut       = -12
+	RPCErrWalletPassphraseIncorrect = -14
+	RPCErrWalletWrongEncState       = -15
+	RPCErrWalletNotFound            = -18
+	RPCErrInWarmup                  = -28
+)
+
+var ErrWalletPassphraseIncorrect = errors.New("wallet passphrase is incorrect")
+
+// WalletUnlockSeconds is how long each unlock before signing lasts
+const WalletUnlockSeconds = 60
+
+// IsRPCError reports whether err is, or wraps, a bitcoind error with code
+func IsRPCError(err error, code int) bool {
+	var rpcErr *RPCError
+	return errors.As(err, &rpcErr) && rpcErr.Code == code
+}
+
+// IsInsufficientFunds reports whether bitcoind couldn't fund a transaction
+// from the wallet's unlocked, spendable coins. fundrawtransaction reports it
+// as a generic wallet error on recent versions, so the message is checked too.
+func IsInsufficientFunds(err error) bool {
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+	switch rpcErr.Code {
+	case RPCErrWalletInsufficientFunds:
+		return true
+	case RPCErrWalletError:
+		return strings.Contains(strings.ToLower(rpcErr.Message), "insufficient funds")
+	}
+	return false
+}
+
+// IsNodeUnavailable reports whether bitcoind refused a call because it isn't
+// ready, still starting up, syncing or without peers
+func IsNodeUnavailable(err error) bool {
+	return IsRPCError(err, RPCErrInWarmup) || IsRPCError(err, RPCErrClientNotConnected) || IsRPCError(err, RPCErrClientInInitialDownload)
+}
+
+// IsKeypoolRanOut reports whether a legacy wallet had no keys left to hand
+// out a new address, keypoolrefill tops it up again
+func IsKeypoolRanOut(err error) bool {
+	return IsRPCError(err, RPCErrWalletKeypoolRanOut)
+}
+
 type BlockchainInfo struct {
 	Chain                string  `json:"chain"`
 	Blocks               int64   `json:"blocks"`
@@ -65,21 +141,114 @@ type Balances struct {
 	Mine WalletBalance `json:"mine"`
 }
 
+type Outpoint struct {
+	TxID string `json:"txid"`
+	Vout int    `json:"vout"`
+}
+
+type DecodedTransaction struct {
+	TxID string     `json:"txid"`
+	Vin  []Outpoint `json:"vin"`
+}
+
+type SendResult struct {
+	TxID   string
+	Inputs []Outpoint
+	FeeBTC float64
+	// the signed transaction as broadcast
+	Hex string
+}
+
 var (
 	DustLimitBTC           = 0.00001 // 1000 sats
 	FeeSatsPerVBLowerLimit = 0.1
+
+	ConsolidationFeeRateSatsPerVB = 0.15
 )
 
+// MaxOpReturnBytes is Bitcoin Core's default -datacarriersize, transactions
+// with more OP_RETURN data aren't relayed
+const MaxOpReturnBytes = 80
+
+var ErrOpReturnTooLong = fmt.Errorf("OP_RETURN data longer than %d bytes", MaxOpReturnBytes)
+
+// sanitizeOpReturn returns the bytes to embed for s. Anything but printable
+// ASCII is dropped so only plain text ends up on chain, data that is still
+// over MaxOpReturnBytes is rejected rather than cut mid message.
+func sanitizeOpReturn(s string) ([]byte, error) {
+	data := make([]byte, 0, len(s))
+	for _, c := range s {
+		if c >= 0x20 && c <= 0x7e {
+			data = append(data, byte(c))
+		}
+	}
+	if len(data) > MaxOpReturnBytes {
+		return nil, ErrOpReturnTooLong
+	}
+	return data, nil
+}
+
+// SendVSizeEstimate is a generous vsize for a single payout with a few segwit
+// inputs, change and an OP_RETURN, used to check a send is affordable before
+// the wallet funds it
+const SendVSizeEstimate = 300
+
+// EstimateSendFeeBTC is the fee of a SendVSizeEstimate sized transaction
+func EstimateSendFeeBTC(feeRateSatsPerVB float64) float64 {
+	return feeRateSatsPerVB * SendVSizeEstimate / 100_000_000
+}
+
 func NewBitcoinRPCClient(config *BitcoinRPCConfig) *BitcoinRPCClient {
+	httpClient := &http.Client{}
+	if config.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config.TLSConfig
+		httpClient.Transport = transport
+	}
+
 	return &BitcoinRPCClient{
-		config: config,
-		httpClient: &http.Client{
-			Timeout: 5 * time.Second,
-		},
+		config:     config,
+		httpClient: httpClient,
+		locked:     make(map[Outpoint]struct{}),
+	}
+}
+
+// LoadTLSConfig builds the TLS config for an RPC endpoint behind TLS. caFile is
+// a PEM bundle to trust instead of the system roots, skipVerify accepts any
+// certificate and is only meant for self-signed setups on trusted networks.
+func LoadTLSConfig(caFile string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify,
 	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
 }
 
-func (c *BitcoinRPCClient) call(method string, params []any) (json.RawMessage, error) {
+// DefaultCallTimeout bounds a single RPC call when ctx carries no deadline.
+// Callers that expect a slow call, funding from a large wallet for example,
+// pass a ctx with their own deadline.
+const DefaultCallTimeout = 5 * time.Second
+
+func (c *BitcoinRPCClient) call(ctx context.Context, method string, params []any) (json.RawMessage, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
 	reqBody := rpcRequest{
 		Jsonrpc: "1.0",
 		ID:      "faucet",
@@ -92,12 +261,17 @@ func (c *BitcoinRPCClient) call(method string, params []any) (json.RawMessage, e
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	url := fmt.Sprintf("http://%s/", c.config.Host)
+	scheme := "http"
+	if c.config.TLSConfig != nil {
+		scheme = "https"
+	}
+
+	url := fmt.Sprintf("%s://%s/", scheme, c.config.Host)
 	if c.wallet != "" {
-		url = fmt.Sprintf("http://%s/wallet/%s", c.config.Host, c.wallet)
+		url = fmt.Sprintf("%s://%s/wallet/%s", scheme, c.config.Host, c.wallet)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -105,7 +279,9 @@ func (c *BitcoinRPCClient) call(method string, params []any) (json.RawMessage, e
 	req.SetBasicAuth(c.config.User, c.config.Password)
 	req.Header.Set("Content-Type", "application/json")
 
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
+	slog.Debug("bitcoin rpc call", "method", method, "wallet", c.wallet, "duration", time.Since(start))
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request to %s: %w", url, err)
 	}
@@ -125,6 +301,11 @@ func (c *BitcoinRPCClient) call(method string, params []any) (json.RawMessage, e
 	}
 
 	if resp.StatusCode != 200 {
+		// bitcoind answers RPC errors with a 500 and the error in the body
+		var rpcResp rpcResponse
+		if json.Unmarshal(body, &rpcResp) == nil && rpcResp.Error != nil {
+			return nil, rpcResp.Error
+		}
 		preview := string(body)
 		if len(preview) > 200 {
 			preview = preview[:200] + "..."
@@ -142,52 +323,94 @@ func (c *BitcoinRPCClient) call(method string, params []any) (json.RawMessage, e
 	}
 
 	if rpcResp.Error != nil {
-		return nil, fmt.Errorf("RPC error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+		return nil, rpcResp.Error
 	}
 
-	//	log.Printf("RPC [method=%s] response: %+v", method, string(rpcResp.Result))
-
 	return rpcResp.Result, nil
 }
 
-func (c *BitcoinRPCClient) SendToAddressWithOpReturn(address string, amountBTC float64, feeRateSatsPerVB float64, opReturnData string) (string, error) {
-	log.Printf("Sending %.8f btc to %s  [fees=%.8f sats/vb]", amountBTC, address, feeRateSatsPerVB)
+// BeforeBroadcast is called with the txid of a signed transaction right
+// before it is broadcast, an error aborts the send. Recording the txid here
+// means a crash during the broadcast can't leave the payout looking unsent.
+type BeforeBroadcast func(txid string) error
+
+func (c *BitcoinRPCClient) SendToAddressWithOpReturn(ctx context.Context, address string, amountBTC float64, feeRateSatsPerVB float64, opReturnData string) (*SendResult, error) {
+	return c.SendToAddressWithHook(ctx, address, amountBTC, feeRateSatsPerVB, opReturnData, nil)
+}
+
+// SendToAddressWithHook is SendToAddressWithOpReturn calling beforeBroadcast
+// once the transaction is signed
+func (c *BitcoinRPCClient) SendToAddressWithHook(ctx context.Context, address string, amountBTC float64, feeRateSatsPerVB float64, opReturnData string, beforeBroadcast BeforeBroadcast) (*SendResult, error) {
+	slog.Info("sending transaction", "address", address, "amount_btc", amountBTC, "fee_rate_sat_vb", feeRateSatsPerVB)
 	if amountBTC < DustLimitBTC {
-		return "", fmt.Errorf("Amount too low")
+		return nil, fmt.Errorf("Amount too low")
 	}
 
-	outputs := map[string]string{
-		address: fmt.Sprintf("%.8f", amountBTC),
+	return c.sendOutputs(ctx, map[string]float64{address: amountBTC}, feeRateSatsPerVB, opReturnData, beforeBroadcast)
+}
+
+// SendManyWithHook pays every address in outputs (amounts in BTC) from a
+// single transaction, so the base size and change output are only paid once.
+// beforeBroadcast is called once the transaction is signed.
+func (c *BitcoinRPCClient) SendManyWithHook(ctx context.Context, outputs map[string]float64, feeRateSatsPerVB float64, opReturnData string, beforeBroadcast BeforeBroadcast) (*SendResult, error) {
+	total := 0.0
+	for address, amountBTC := range outputs {
+		if amountBTC < DustLimitBTC {
+			return nil, fmt.Errorf("Amount too low for %s", address)
+		}
+		total += amountBTC
+	}
+	slog.Info("sending batch transaction", "outputs", len(outputs), "amount_btc", total, "fee_rate_sat_vb", feeRateSatsPerVB)
+
+	return c.sendOutputs(ctx, outputs, feeRateSatsPerVB, opReturnData, beforeBroadcast)
+}
+
+func (c *BitcoinRPCClient) sendOutputs(ctx context.Context, amounts map[string]float64, feeRateSatsPerVB float64, opReturnData string, beforeBroadcast BeforeBroadcast) (*SendResult, error) {
+	if len(amounts) == 0 {
+		return nil, fmt.Errorf("no outputs")
+	}
+
+	opReturn, err := sanitizeOpReturn(opReturnData)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make(map[string]string, len(amounts)+1)
+	for address, amountBTC := range amounts {
+		outputs[address] = fmt.Sprintf("%.8f", amountBTC)
 	}
 
-	if len(opReturnData) > 0 {
-		outputs["data"] = hex.EncodeToString([]byte(opReturnData))
+	if len(opReturn) > 0 {
+		outputs["data"] = hex.EncodeToString(opReturn)
 	}
 
 	createParams := []any{[]any{}, outputs}
-	rawTx, err := c.call("createrawtransaction", createParams)
+	rawTx, err := c.call(ctx, "createrawtransaction", createParams)
 	if err != nil {
-		return "", fmt.Errorf("createrawtransaction failed: %w", err)
+		return nil, fmt.Errorf("createrawtransaction failed: %w", err)
 	}
 
 	var rawTxHex string
 	if err := json.Unmarshal(rawTx, &rawTxHex); err != nil {
-		return "", fmt.Errorf("failed to unmarshal raw tx: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal raw tx: %w", err)
 	}
 
-	fundParams := []any{
-		rawTxHex,
+	/*
+	  lockUnspents makes the wallet lock the inputs it picked until the tx is
+	  broadcast, otherwise two sends funded concurrently can select the same
+	  UTXO and one of them fails at sendrawtransaction
+	*/
+	fundOptions := map[string]any{
+		"lockUnspents": true,
 	}
-
 	if feeRateSatsPerVB > 0 {
-		fundParams = append(fundParams, map[string]string{
-			"fee_rate": fmt.Sprintf("%.8f", feeRateSatsPerVB),
-		})
+		fundOptions["fee_rate"] = fmt.Sprintf("%.8f", feeRateSatsPerVB)
 	}
+	fundParams := []any{rawTxHex, fundOptions}
 
-	fundedTx, err := c.call("fundrawtransaction", fundParams)
+	fundedTx, err := c.call(ctx, "fundrawtransaction", fundParams)
 	if err != nil {
-		return "", fmt.Errorf("fundrawtransaction failed: %w", err)
+		return nil, fmt.Errorf("fundrawtransaction failed: %w", err)
 	}
 
 	var fundResult struct {
@@ -195,13 +418,45 @@ func (c *BitcoinRPCClient) SendToAddressWithOpReturn(address string, amountBTC f
 		Fee float64 `json:"fee"`
 	}
 	if err := json.Unmarshal(fundedTx, &fundResult); err != nil {
-		return "", fmt.Errorf("failed to unmarshal funded tx: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal funded tx: %w", err)
 	}
 
-	signParams := []any{fundResult.Hex}
-	signedTx, err := c.call("signrawtransactionwithwallet", signParams)
+	// the inputs fundrawtransaction picked are locked from here on, they
+	// stay tracked until the tx is broadcast or they are unlocked again
+	var inputs []Outpoint
+	if decoded, err := c.DecodeRawTransaction(ctx, fundResult.Hex); err != nil {
+		slog.Warn("failed to decode funded tx, its inputs stay locked if the send fails", "err", err)
+	} else {
+		inputs = decoded.Vin
+		c.trackLocks(inputs)
+	}
+
+	txid, signedHex, err := c.signAndSend(ctx, fundResult.Hex, beforeBroadcast)
 	if err != nil {
-		return "", fmt.Errorf("signrawtransactionwithwallet failed: %w", err)
+		// still unlock when the send failed because ctx was cancelled
+		if err := c.UnlockUnspent(context.WithoutCancel(ctx), inputs); err != nil {
+			slog.Error("failed to unlock inputs", "inputs", len(inputs), "err", err)
+		}
+		return nil, err
+	}
+	c.forgetLocks(inputs)
+
+	return &SendResult{TxID: txid, FeeBTC: fundResult.Fee, Inputs: inputs, Hex: signedHex}, nil
+}
+
+// signAndSend signs txHex with the wallet and broadcasts it, returning the
+// txid and the signed hex so the caller can keep it for a rebroadcast
+func (c *BitcoinRPCClient) signAndSend(ctx context.Context, txHex string, beforeBroadcast BeforeBroadcast) (string, string, error) {
+	if c.config.WalletPassphrase != "" {
+		if err := c.WalletPassphrase(ctx, c.config.WalletPassphrase, WalletUnlockSeconds); err != nil {
+			return "", "", err
+		}
+	}
+
+	signParams := []any{txHex}
+	signedTx, err := c.call(ctx, "signrawtransactionwithwallet", signParams)
+	if err != nil {
+		return "", "", fmt.Errorf("signrawtransactionwithwallet failed: %w", err)
 	}
 
 	var signResult struct {
@@ -209,15 +464,34 @@ func (c *BitcoinRPCClient) SendToAddressWithOpReturn(address string, amountBTC f
 		Complete bool   `json:"complete"`
 	}
 	if err := json.Unmarshal(signedTx, &signResult); err != nil {
-		return "", fmt.Errorf("failed to unmarshal signed tx: %w", err)
+		return "", "", fmt.Errorf("failed to unmarshal signed tx: %w", err)
 	}
 
 	if !signResult.Complete {
-		return "", fmt.Errorf("transaction signing incomplete")
+		return "", "", fmt.Errorf("transaction signing incomplete")
+	}
+
+	if beforeBroadcast != nil {
+		decoded, err := c.DecodeRawTransaction(ctx, signResult.Hex)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to decode signed tx: %w", err)
+		}
+		if err := beforeBroadcast(decoded.TxID); err != nil {
+			return "", "", fmt.Errorf("not broadcasting %s: %w", decoded.TxID, err)
+		}
 	}
 
-	sendParams := []any{signResult.Hex}
-	txidResult, err := c.call("sendrawtransaction", sendParams)
+	txid, err := c.SendRawTransaction(ctx, signResult.Hex)
+	if err != nil {
+		return "", "", err
+	}
+	return txid, signResult.Hex, nil
+}
+
+// SendRawTransaction broadcasts an already signed transaction and returns
+// its txid
+func (c *BitcoinRPCClient) SendRawTransaction(ctx context.Context, signedHex string) (string, error) {
+	txidResult, err := c.call(ctx, "sendrawtransaction", []any{signedHex})
 	if err != nil {
 		return "", fmt.Errorf("sendrawtransaction failed: %w", err)
 	}
@@ -230,8 +504,95 @@ func (c *BitcoinRPCClient) SendToAddressWithOpReturn(address string, amountBTC f
 	return txid, nil
 }
 
-func (c *BitcoinRPCClient) GetBlockCount() (int64, error) {
-	result, err := c.call("getblockcount", []any{})
+// LockUnspent locks outpoints in the wallet so coin selection of concurrent
+// sends skips them. It fails if one of them is already locked or spent.
+func (c *BitcoinRPCClient) LockUnspent(ctx context.Context, outpoints []Outpoint) error {
+	if len(outpoints) == 0 {
+		return nil
+	}
+	if err := c.lockUnspent(ctx, false, outpoints); err != nil {
+		return err
+	}
+	c.trackLocks(outpoints)
+	return nil
+}
+
+// UnlockUnspent releases outpoints locked for a tx that never made it to the
+// mempool, so they can be picked again
+func (c *BitcoinRPCClient) UnlockUnspent(ctx context.Context, outpoints []Outpoint) error {
+	if len(outpoints) == 0 {
+		return nil
+	}
+	if err := c.lockUnspent(ctx, true, outpoints); err != nil {
+		return err
+	}
+	c.forgetLocks(outpoints)
+	return nil
+}
+
+// ReleaseLocks unlocks every outpoint this client still holds a lock on and
+// returns how many there were. Meant for shutdown, once no send is running.
+func (c *BitcoinRPCClient) ReleaseLocks(ctx context.Context) (int, error) {
+	c.lockedMtx.Lock()
+	outpoints := make([]Outpoint, 0, len(c.locked))
+	for o := range c.locked {
+		outpoints = append(outpoints, o)
+	}
+	c.lockedMtx.Unlock()
+
+	return len(outpoints), c.UnlockUnspent(ctx, outpoints)
+}
+
+func (c *BitcoinRPCClient) lockUnspent(ctx context.Context, unlock bool, outpoints []Outpoint) error {
+	result, err := c.call(ctx, "lockunspent", []any{unlock, outpoints})
+	if err != nil {
+		return fmt.Errorf("lockunspent failed: %w", err)
+	}
+
+	var ok bool
+	if err := json.Unmarshal(result, &ok); err != nil {
+		return fmt.Errorf("failed to unmarshal lockunspent result: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("lockunspent returned false")
+	}
+	return nil
+}
+
+func (c *BitcoinRPCClient) trackLocks(outpoints []Outpoint) {
+	c.lockedMtx.Lock()
+	defer c.lockedMtx.Unlock()
+	for _, o := range outpoints {
+		c.locked[o] = struct{}{}
+	}
+}
+
+// forgetLocks drops outpoints from tracking without touching the wallet, for
+// inputs that got spent or unlocked
+func (c *BitcoinRPCClient) forgetLocks(outpoints []Outpoint) {
+	c.lockedMtx.Lock()
+	defer c.lockedMtx.Unlock()
+	for _, o := range outpoints {
+		delete(c.locked, o)
+	}
+}
+
+func (c *BitcoinRPCClient) DecodeRawTransaction(ctx context.Context, txHex string) (*DecodedTransaction, error) {
+	result, err := c.call(ctx, "decoderawtransaction", []any{txHex})
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded DecodedTransaction
+	if err := json.Unmarshal(result, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal decoded tx: %w", err)
+	}
+
+	return &decoded, nil
+}
+
+func (c *BitcoinRPCClient) GetBlockCount(ctx context.Context) (int64, error) {
+	result, err := c.call(ctx, "getblockcount", []any{})
 	if err != nil {
 		return 0, err
 	}
@@ -244,8 +605,8 @@ func (c *BitcoinRPCClient) GetBlockCount() (int64, error) {
 	return count, nil
 }
 
-func (c *BitcoinRPCClient) GetBlockchainInfo() (*BlockchainInfo, error) {
-	result, err := c.call("getblockchaininfo", []any{})
+func (c *BitcoinRPCClient) GetBlockchainInfo(ctx context.Context) (*BlockchainInfo, error) {
+	result, err := c.call(ctx, "getblockchaininfo", []any{})
 	if err != nil {
 		return nil, err
 	}
@@ -258,8 +619,8 @@ func (c *BitcoinRPCClient) GetBlockchainInfo() (*BlockchainInfo, error) {
 	return &info, nil
 }
 
-func (c *BitcoinRPCClient) ListWallets() ([]string, error) {
-	result, err := c.call("listwallets", []any{})
+func (c *BitcoinRPCClient) ListWallets(ctx context.Context) ([]string, error) {
+	result, err := c.call(ctx, "listwallets", []any{})
 	if err != nil {
 		return nil, err
 	}
@@ -272,28 +633,65 @@ func (c *BitcoinRPCClient) ListWallets() ([]string, error) {
 	return wallets, nil
 }
 
-func (c *BitcoinRPCClient) LoadWallet(walletName string) error {
-	_, err := c.call("loadwallet", []any{walletName})
+func (c *BitcoinRPCClient) LoadWallet(ctx context.Context, walletName string) error {
+	_, err := c.call(ctx, "loadwallet", []any{walletName})
+	return err
+}
+
+// WalletPassphrase unlocks the wallet for timeout seconds. Unlocking an already
+// unlocked wallet just extends the timeout, a wallet that isn't encrypted at
+// all is not treated as an error.
+func (c *BitcoinRPCClient) WalletPassphrase(ctx context.Context, passphrase string, timeout int) error {
+	_, err := c.call(ctx, "walletpassphrase", []any{passphrase, timeout})
+	switch {
+	case err == nil:
+		return nil
+	case IsRPCError(err, RPCErrWalletWrongEncState):
+		return nil
+	case IsRPCError(err, RPCErrWalletPassphraseIncorrect):
+		return ErrWalletPassphraseIncorrect
+	}
+	return fmt.Errorf("walletpassphrase failed: %w", err)
+}
+
+// CreateWallet creates and loads a new wallet with private keys enabled
+func (c *BitcoinRPCClient) CreateWallet(ctx context.Context, walletName string, descriptors bool) error {
+	// wallet_name, disable_private_keys, blank, passphrase, avoid_reuse, descriptors
+	_, err := c.call(ctx, "createwallet", []any{walletName, false, false, "", false, descriptors})
 	return err
 }
 
-func (c *BitcoinRPCClient) Consolidate(inputs []UTXO, totalAmountBTC float64, address string, opReturnData string) (string, error) {
+// Consolidate sweeps inputs at the static ConsolidationFeeRateSatsPerVB
+func (c *BitcoinRPCClient) Consolidate(ctx context.Context, inputs []UTXO, totalAmountBTC float64, address string, opReturnData string) (*SendResult, error) {
+	return c.SweepUTXOs(ctx, inputs, totalAmountBTC, address, opReturnData, ConsolidationFeeRateSatsPerVB)
+}
+
+// SweepUTXOs spends all inputs into a single output to address, minus the
+// fee estimated for feeRateSatPerVB. FeeBTC in the result is that estimate.
+func (c *BitcoinRPCClient) SweepUTXOs(ctx context.Context, inputs []UTXO, totalAmountBTC float64, address string, opReturnData string, feeRateSatPerVB float64) (*SendResult, error) {
+	opReturn, err := sanitizeOpReturn(opReturnData)
+	if err != nil {
+		return nil, err
+	}
+
 	var txInputs []map[string]any
 	sort.Slice(inputs, func(i, j int) bool {
 		return inputs[i].Amount > inputs[j].Amount
 	})
 
+	outpoints := make([]Outpoint, 0, len(inputs))
 	for _, input := range inputs {
 		i := map[string]any{
 			"txid": input.TxID,
 			"vout": input.Vout,
 		}
 		txInputs = append(txInputs, i)
+		outpoints = append(outpoints, Outpoint{TxID: input.TxID, Vout: input.Vout})
 	}
 
 	numInputs := len(txInputs)
 	numOutputs := 1
-	if len(opReturnData) > 0 {
+	if len(opReturn) > 0 {
 		numOutputs = 2
 	}
 
@@ -302,75 +700,95 @@ func (c *BitcoinRPCClient) Consolidate(inputs []UTXO, totalAmountBTC float64, ad
 	  - base: 10.5 vBytes
 	  - per input: 148 vBytes (P2WPKH)
 	  - per output: 31 vBytes (P2WPKH)
-	  - fee rate: 0.15 sat/vB
-	  - formula: (10.5 + inputs*148 + outputs*31) * 1 sat/vB
+	  - formula: (10.5 + inputs*148 + outputs*31) * fee rate
 	*/
 	estimatedVBytes := 10.5 + float64(numInputs)*148 + float64(numOutputs)*31.0
-	feeRateSatPerVB := 0.15
 	feeSats := estimatedVBytes * feeRateSatPerVB
 	estimatedFeeBTC := feeSats / 100_000_000
 
 	outputAmount := totalAmountBTC - estimatedFeeBTC
 	if outputAmount <= 0 {
-		return "", fmt.Errorf("total amount too small to cover fees")
+		return nil, fmt.Errorf("total amount %.8f BTC too small to cover fees of %.8f BTC (%.3f sat/vB for %.1f vB)",
+			totalAmountBTC, estimatedFeeBTC, feeRateSatPerVB, estimatedVBytes)
 	}
 
 	outputs := map[string]string{
 		address: fmt.Sprintf("%.8f", outputAmount),
 	}
 
-	if len(opReturnData) > 0 {
-		outputs["data"] = hex.EncodeToString([]byte(opReturnData))
+	if len(opReturn) > 0 {
+		outputs["data"] = hex.EncodeToString(opReturn)
 	}
 
-	createParams := []any{txInputs, outputs}
-	rawTx, err := c.call("createrawtransaction", createParams)
-	if err != nil {
-		return "", fmt.Errorf("createrawtransaction failed: %w", err)
+	/*
+	  the inputs are picked by us and not by fundrawtransaction, lock them so
+	  a payout funded while this one is signed can't select them too. Failing
+	  to lock means something else already holds one of them.
+	*/
+	if err := c.LockUnspent(ctx, outpoints); err != nil {
+		return nil, err
 	}
 
-	var rawTxHex string
-	if err := json.Unmarshal(rawTx, &rawTxHex); err != nil {
-		return "", fmt.Errorf("failed to unmarshal raw tx: %w", err)
+	txid, signedHex, err := c.sweep(ctx, txInputs, outputs)
+	if err != nil {
+		if err := c.UnlockUnspent(context.WithoutCancel(ctx), outpoints); err != nil {
+			slog.Error("failed to unlock inputs", "inputs", len(outpoints), "err", err)
+		}
+		return nil, err
 	}
+	c.forgetLocks(outpoints)
+
+	slog.Info("swept utxos",
+		"inputs", len(inputs),
+		"amount_btc", totalAmountBTC,
+		"estimated_vbytes", estimatedVBytes,
+		"fee_rate_sat_vb", feeRateSatPerVB,
+		"fee_sats", feeSats,
+		"output_btc", outputAmount,
+		"address", address,
+		"txid", txid,
+	)
+
+	return &SendResult{TxID: txid, Inputs: outpoints, FeeBTC: estimatedFeeBTC, Hex: signedHex}, nil
+}
 
-	signParams := []any{rawTxHex}
-	signedTx, err := c.call("signrawtransactionwithwallet", signParams)
+func (c *BitcoinRPCClient) sweep(ctx context.Context, txInputs []map[string]any, outputs map[string]string) (string, string, error) {
+	createParams := []any{txInputs, outputs}
+	rawTx, err := c.call(ctx, "createrawtransaction", createParams)
 	if err != nil {
-		return "", fmt.Errorf("signrawtransactionwithwallet failed: %w", err)
+		return "", "", fmt.Errorf("createrawtransaction failed: %w", err)
 	}
 
-	var signResult struct {
-		Hex      string `json:"hex"`
-		Complete bool   `json:"complete"`
-	}
-	if err := json.Unmarshal(signedTx, &signResult); err != nil {
-		return "", fmt.Errorf("failed to unmarshal signed tx: %w", err)
+	var rawTxHex string
+	if err := json.Unmarshal(rawTx, &rawTxHex); err != nil {
+		return "", "", fmt.Errorf("failed to unmarshal raw tx: %w", err)
 	}
 
-	if !signResult.Complete {
-		return "", fmt.Errorf("transaction signing incomplete")
-	}
+	return c.signAndSend(ctx, rawTxHex, nil)
+}
 
-	sendParams := []any{signResult.Hex}
-	txidResult, err := c.call("sendrawtransaction", sendParams)
+// EstimateSmartFee returns the fee rate in sat/vB the node estimates for
+// confirmation within confTarget blocks
+func (c *BitcoinRPCClient) EstimateSmartFee(ctx context.Context, confTarget int) (float64, error) {
+	result, err := c.call(ctx, "estimatesmartfee", []any{confTarget})
 	if err != nil {
-		return "", fmt.Errorf("sendrawtransaction failed: %w", err)
+		return 0, err
 	}
 
-	var txid string
-	if err := json.Unmarshal(txidResult, &txid); err != nil {
-		return "", fmt.Errorf("failed to unmarshal txid: %w", err)
+	var estimate struct {
+		FeeRate float64  `json:"feerate"`
+		Errors  []string `json:"errors"`
+	}
+	if err := json.Unmarshal(result, &estimate); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal fee estimate: %w", err)
 	}
 
-	log.Printf(
-		"[inputs: %d] [%.8f BTC] [estimated tx size: %.1f vB] [fee rate: %.3f sat/vB] [fee: %.0f sats] [output: %.8f] [addr: %s] [txid: %s]",
-		len(inputs),
-		totalAmountBTC, estimatedVBytes, feeRateSatPerVB, feeSats, outputAmount,
-		address, txid,
-	)
+	if estimate.FeeRate <= 0 {
+		return 0, fmt.Errorf("no fee estimate available: %s", strings.Join(estimate.Errors, ", "))
+	}
 
-	return txid, nil
+	// feerate is BTC/kvB
+	return estimate.FeeRate * 100_000_000 / 1000, nil
 }
 
 func (c *BitcoinRPCClient) WithWallet(walletName string) *BitcoinRPCClient {
@@ -378,7 +796,7 @@ func (c *BitcoinRPCClient) WithWallet(walletName string) *BitcoinRPCClient {
 	return c
 }
 
-func (c *BitcoinRPCClient) GetNewAddress(label string, addressType string) (string, error) {
+func (c *BitcoinRPCClient) GetNewAddress(ctx context.Context, label string, addressType string) (string, error) {
 	params := []any{}
 	if label != "" || addressType != "" {
 		params = append(params, label)
@@ -387,7 +805,7 @@ func (c *BitcoinRPCClient) GetNewAddress(label string, addressType string) (stri
 		}
 	}
 
-	result, err := c.call("getnewaddress", params)
+	result, err := c.call(ctx, "getnewaddress", params)
 	if err != nil {
 		return "", err
 	}
@@ -400,8 +818,28 @@ func (c *BitcoinRPCClient) GetNewAddress(label string, addressType string) (stri
 	return address, nil
 }
 
-func (c *BitcoinRPCClient) GetBalances() (*Balances, error) {
-	result, err := c.call("getbalances", []any{})
+// KeypoolRefill tops the wallet's keypool up to newSize keys, 0 keeps
+// bitcoind's -keypool size. An encrypted wallet is unlocked first, new keys
+// can't be derived while it is locked.
+func (c *BitcoinRPCClient) KeypoolRefill(ctx context.Context, newSize int) error {
+	if c.config.WalletPassphrase != "" {
+		if err := c.WalletPassphrase(ctx, c.config.WalletPassphrase, WalletUnlockSeconds); err != nil {
+			return err
+		}
+	}
+
+	params := []any{}
+	if newSize > 0 {
+		params = append(params, newSize)
+	}
+	if _, err := c.call(ctx, "keypoolrefill", params); err != nil {
+		return fmt.Errorf("keypoolrefill failed: %w", err)
+	}
+	return nil
+}
+
+func (c *BitcoinRPCClient) GetBalances(ctx context.Context) (*Balances, error) {
+	result, err := c.call(ctx, "getbalances", []any{})
 	if err != nil {
 		return nil, err
 	}
@@ -414,6 +852,61 @@ func (c *BitcoinRPCClient) GetBalances() (*Balances, error) {
 	return &balances, nil
 }
 
+type WalletTransaction struct {
+	TxID          string `json:"txid"`
+	Confirmations int    `json:"confirmations"`
+	BlockHash     string `json:"blockhash"`
+	Time          int64  `json:"time"`
+	TimeReceived  int64  `json:"timereceived"`
+}
+
+func (c *BitcoinRPCClient) GetTransaction(ctx context.Context, txid string) (*WalletTransaction, error) {
+	result, err := c.call(ctx, "gettransaction", []any{txid})
+	if err != nil {
+		return nil, err
+	}
+
+	var tx WalletTransaction
+	if err := json.Unmarshal(result, &tx); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transaction: %w", err)
+	}
+
+	return &tx, nil
+}
+
+type AddressInfo struct {
+	Address string `json:"address"`
+	IsMine  bool   `json:"ismine"`
+}
+
+// GetAddressInfo asks the wallet about address, IsMine tells whether the
+// wallet can spend what is sent to it
+func (c *BitcoinRPCClient) GetAddressInfo(ctx context.Context, address string) (*AddressInfo, error) {
+	result, err := c.call(ctx, "getaddressinfo", []any{address})
+	if err != nil {
+		return nil, err
+	}
+
+	var info AddressInfo
+	if err := json.Unmarshal(result, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal address info: %w", err)
+	}
+
+	return &info, nil
+}
+
+// IsInMempool reports whether the node's mempool currently holds txid
+func (c *BitcoinRPCClient) IsInMempool(ctx context.Context, txid string) (bool, error) {
+	_, err := c.call(ctx, "getmempoolentry", []any{txid})
+	if IsRPCError(err, RPCErrInvalidAddressOrKey) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 type UTXO struct {
 	TxID          string  `json:"txid"`
 	Vout          int     `json:"vout"`
@@ -425,9 +918,14 @@ type UTXO struct {
 	Safe          bool    `json:"safe"`
 }
 
-func (c *BitcoinRPCClient) ListUnspent(minConf, maxConf int) ([]UTXO, error) {
+// ListUnspent lists the wallet's UTXOs, only those paying to addresses when
+// any are given
+func (c *BitcoinRPCClient) ListUnspent(ctx context.Context, minConf, maxConf int, addresses ...string) ([]UTXO, error) {
 	params := []any{minConf, maxConf}
-	result, err := c.call("listunspent", params)
+	if len(addresses) > 0 {
+		params = append(params, addresses)
+	}
+	result, err := c.call(ctx, "listunspent", params)
 	if err != nil {
 		return nil, err
 	}
@@ -440,13 +938,37 @@ func (c *BitcoinRPCClient) ListUnspent(minConf, maxConf int) ([]UTXO, error) {
 	return utxos, nil
 }
 
+const (
+	NetworkSignet  = "signet"
+	NetworkTestnet = "testnet"
+	NetworkRegtest = "regtest"
+)
+
 var (
-	bech32Regex = regexp.MustCompile(`^tb1[a-z0-9]{39,87}$`)
-	p2shRegex   = regexp.MustCompile(`^2[a-km-zA-HJ-NP-Z1-9]{25,34}$`)
-	p2pkhRegex  = regexp.MustCompile(`^[mn][a-km-zA-HJ-NP-Z1-9]{25,34}$`)
+	Networks = []string{NetworkSignet, NetworkTestnet, NetworkRegtest}
+
+	// chain names reported by getblockchaininfo for each network
+	networkChains = map[string][]string{
+		NetworkSignet:  {"signet"},
+		NetworkTestnet: {"test", "testnet4"},
+		NetworkRegtest: {"regtest"},
+	}
 )
 
-func ValidateSignetAddress(address string) error {
+// IsNetworkChain reports whether chain, as returned by getblockchaininfo,
+// belongs to network
+func IsNetworkChain(network, chain string) bool {
+	return slices.Contains(networkChains[network], chain)
+}
+
+var (
+	testnetBech32Regex = regexp.MustCompile(`^tb1[a-z0-9]{39,87}$`)
+	regtestBech32Regex = regexp.MustCompile(`^bcrt1[a-z0-9]{39,87}$`)
+	p2shRegex          = regexp.MustCompile(`^2[a-km-zA-HJ-NP-Z1-9]{25,34}$`)
+	p2pkhRegex         = regexp.MustCompile(`^[mn][a-km-zA-HJ-NP-Z1-9]{25,34}$`)
+)
+
+func ValidateAddress(address string, network string) error {
 	address = strings.TrimSpace(address)
 
 	if address == "" {
@@ -457,9 +979,19 @@ func ValidateSignetAddress(address string) error {
 		return fmt.Errorf("mainnet address?")
 	}
 
+	var bech32Regex *regexp.Regexp
+	switch network {
+	case NetworkSignet, NetworkTestnet:
+		bech32Regex = testnetBech32Regex
+	case NetworkRegtest:
+		bech32Regex = regtestBech32Regex
+	default:
+		return fmt.Errorf("unknown network: %s", network)
+	}
+
 	if bech32Regex.MatchString(address) || p2shRegex.MatchString(address) || p2pkhRegex.MatchString(address) {
 		return nil
 	}
 
-	return fmt.Errorf("invalid signet address format")
+	return fmt.Errorf("invalid %s address format", network)
 }
@@ -1,13 +1,23 @@
 package btc
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 // ---------------------------------------------------------------------------
@@ -58,7 +68,7 @@ func (m *mockRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	handler, ok := m.handlers[req.Method]
 	if !ok {
-		w.WriteHeader(200)
+		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]any{
 			"result": nil,
 			"error":  &mockRPCErr{Code: -32601, Message: "Method not found: " + req.Method},
@@ -69,7 +79,12 @@ func (m *mockRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	result, rpcErr := handler(req.Params)
 	resp := map[string]any{"id": req.ID, "result": result, "error": rpcErr}
-	w.WriteHeader(200)
+	// like bitcoind, errors come with a 500
+	if rpcErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 	json.NewEncoder(w).Encode(resp)
 }
 
@@ -96,6 +111,9 @@ func fullMockRPC() *mockRPC {
 	m.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *mockRPCErr) {
 		return "abc123txid", nil
 	}
+	m.handlers["lockunspent"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return true, nil
+	}
 	return m
 }
 
@@ -110,7 +128,7 @@ func TestCall_BasicAuth(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	client.call("test", []any{})
+	client.call(t.Context(), "test", []any{})
 	if !m.lastAuthOK {
 		t.Error("expected basic auth to be set")
 	}
@@ -123,7 +141,7 @@ func TestCall_URLWithoutWallet(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	client.call("test", []any{})
+	client.call(t.Context(), "test", []any{})
 	if m.lastPath != "/" {
 		t.Errorf("expected path /, got %s", m.lastPath)
 	}
@@ -136,7 +154,7 @@ func TestCall_URLWithWallet(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv).WithWallet("mywallet")
 
-	client.call("test", []any{})
+	client.call(t.Context(), "test", []any{})
 	if m.lastPath != "/wallet/mywallet" {
 		t.Errorf("expected /wallet/mywallet, got %s", m.lastPath)
 	}
@@ -151,7 +169,7 @@ func TestCall_RPCError(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.call("fail", []any{})
+	_, err := client.call(t.Context(), "fail", []any{})
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -167,7 +185,7 @@ func TestCall_HTTP401(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.call("test", []any{})
+	_, err := client.call(t.Context(), "test", []any{})
 	if err == nil || !strings.Contains(err.Error(), "authentication failed (401)") {
 		t.Errorf("expected 401 auth error, got: %v", err)
 	}
@@ -180,7 +198,7 @@ func TestCall_HTTP403(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.call("test", []any{})
+	_, err := client.call(t.Context(), "test", []any{})
 	if err == nil || !strings.Contains(err.Error(), "forbidden (403)") {
 		t.Errorf("expected 403 error, got: %v", err)
 	}
@@ -194,12 +212,30 @@ func TestCall_HTTP500(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.call("test", []any{})
+	_, err := client.call(t.Context(), "test", []any{})
 	if err == nil || !strings.Contains(err.Error(), "HTTP 500") {
 		t.Errorf("expected HTTP 500 error, got: %v", err)
 	}
 }
 
+func TestCall_RPCErrorOnHTTP500(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		w.Write([]byte(`{"result":null,"error":{"code":-6,"message":"Insufficient funds"},"id":"faucet"}`))
+	}))
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	_, err := client.call(t.Context(), "test", []any{})
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != RPCErrWalletInsufficientFunds {
+		t.Fatalf("expected RPC error -6, got: %v", err)
+	}
+	if !IsInsufficientFunds(err) {
+		t.Error("expected IsInsufficientFunds to match")
+	}
+}
+
 func TestCall_InvalidJSON(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -208,7 +244,7 @@ func TestCall_InvalidJSON(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.call("test", []any{})
+	_, err := client.call(t.Context(), "test", []any{})
 	if err == nil || !strings.Contains(err.Error(), "failed to unmarshal response") {
 		t.Errorf("expected unmarshal error, got: %v", err)
 	}
@@ -219,24 +255,159 @@ func TestCall_ServerDown(t *testing.T) {
 	srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.call("test", []any{})
+	_, err := client.call(t.Context(), "test", []any{})
 	if err == nil || !strings.Contains(err.Error(), "failed to send request") {
 		t.Errorf("expected connection error, got: %v", err)
 	}
 }
 
+func TestCall_ContextCancelled(t *testing.T) {
+	srv := httptest.NewServer(newMockRPC())
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err := client.call(ctx, "getblockchaininfo", []any{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestCall_ContextDeadline(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	client := newTestClient(srv)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.call(ctx, "test", []any{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultCallTimeout {
+		t.Errorf("call took %s, caller deadline was not honored", elapsed)
+	}
+}
+
 func TestCall_MethodNotFound(t *testing.T) {
 	m := newMockRPC()
 	srv := httptest.NewServer(m)
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.call("nonexistent", []any{})
+	_, err := client.call(t.Context(), "nonexistent", []any{})
 	if err == nil || !strings.Contains(err.Error(), "Method not found") {
 		t.Errorf("expected method not found, got: %v", err)
 	}
 }
 
+// ---------------------------------------------------------------------------
+// TLS
+// ---------------------------------------------------------------------------
+
+func newTLSTestClient(t *testing.T, srv *httptest.Server, tlsConfig *tls.Config) *BitcoinRPCClient {
+	t.Helper()
+	u, _ := url.Parse(srv.URL)
+	return NewBitcoinRPCClient(&BitcoinRPCConfig{
+		Host:      u.Host,
+		User:      "testuser",
+		Password:  "testpass",
+		TLSConfig: tlsConfig,
+	})
+}
+
+func TestCall_TLSWithCA(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["getblockcount"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return 100, nil
+	}
+	srv := httptest.NewTLSServer(m)
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig, err := LoadTLSConfig(caFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := newTLSTestClient(t, srv, tlsConfig).GetBlockCount(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Errorf("expected 100, got %d", count)
+	}
+}
+
+func TestCall_TLSUnknownCA(t *testing.T) {
+	srv := httptest.NewTLSServer(newMockRPC())
+	defer srv.Close()
+
+	tlsConfig, err := LoadTLSConfig("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTLSTestClient(t, srv, tlsConfig).GetBlockCount(t.Context()); err == nil {
+		t.Error("expected certificate verification error")
+	}
+}
+
+func TestCall_TLSSkipVerify(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["getblockcount"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return 100, nil
+	}
+	srv := httptest.NewTLSServer(m)
+	defer srv.Close()
+
+	tlsConfig, err := LoadTLSConfig("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTLSTestClient(t, srv, tlsConfig).GetBlockCount(t.Context()); err != nil {
+		t.Errorf("expected self-signed cert to be accepted, got %v", err)
+	}
+}
+
+func TestCall_PlainHTTPAgainstTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(newMockRPC())
+	defer srv.Close()
+
+	if _, err := newTestClient(srv).GetBlockCount(t.Context()); err == nil {
+		t.Error("expected plain http to fail against a TLS server")
+	}
+}
+
+func TestLoadTLSConfig_BadCAFile(t *testing.T) {
+	if _, err := LoadTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), false); err == nil {
+		t.Error("expected error for missing CA file")
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0600)
+	if _, err := LoadTLSConfig(notPEM, false); err == nil {
+		t.Error("expected error for CA file without certificates")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // WithWallet
 // ---------------------------------------------------------------------------
@@ -263,7 +434,7 @@ func TestGetBlockCount(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	count, err := client.GetBlockCount()
+	count, err := client.GetBlockCount(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -281,7 +452,7 @@ func TestGetBlockCount_Error(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.GetBlockCount()
+	_, err := client.GetBlockCount(t.Context())
 	if err == nil {
 		t.Error("expected error")
 	}
@@ -308,7 +479,7 @@ func TestGetBlockchainInfo(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	info, err := client.GetBlockchainInfo()
+	info, err := client.GetBlockchainInfo(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -329,7 +500,7 @@ func TestGetBlockchainInfo_Error(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.GetBlockchainInfo()
+	_, err := client.GetBlockchainInfo(t.Context())
 	if err == nil {
 		t.Error("expected error for unregistered method")
 	}
@@ -348,7 +519,7 @@ func TestListWallets(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	wallets, err := client.ListWallets()
+	wallets, err := client.ListWallets(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -373,7 +544,7 @@ func TestLoadWallet(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	err := client.LoadWallet("faucet")
+	err := client.LoadWallet(t.Context(), "faucet")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -394,12 +565,201 @@ func TestLoadWallet_Error(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	err := client.LoadWallet("missing")
+	err := client.LoadWallet(t.Context(), "missing")
 	if err == nil || !strings.Contains(err.Error(), "Wallet file not found") {
 		t.Errorf("expected wallet not found error, got: %v", err)
 	}
 }
 
+// ---------------------------------------------------------------------------
+// CreateWallet
+// ---------------------------------------------------------------------------
+
+func TestCreateWallet(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["createwallet"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return map[string]any{"name": "faucet"}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	if err := client.CreateWallet(t.Context(), "faucet", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var p []any
+	json.Unmarshal(m.lastParams, &p)
+	if len(p) != 6 || p[0] != "faucet" || p[1] != false || p[5] != true {
+		t.Errorf("unexpected createwallet params: %v", p)
+	}
+}
+
+func TestIsRPCError(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["loadwallet"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, &mockRPCErr{Code: RPCErrWalletNotFound, Message: "Wallet file not found"}
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	err := client.LoadWallet(t.Context(), "missing")
+	if !IsRPCError(fmt.Errorf("wrapped: %w", err), RPCErrWalletNotFound) {
+		t.Errorf("expected wallet not found rpc error, got: %v", err)
+	}
+	if IsRPCError(err, -4) {
+		t.Error("expected code mismatch to not match")
+	}
+	if IsRPCError(fmt.Errorf("connection refused"), RPCErrWalletNotFound) {
+		t.Error("expected non rpc error to not match")
+	}
+}
+
+func TestIsInsufficientFunds(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&RPCError{Code: RPCErrWalletInsufficientFunds, Message: "Insufficient funds"}, true},
+		{fmt.Errorf("fundrawtransaction failed: %w", &RPCError{Code: RPCErrWalletError, Message: "Insufficient funds"}), true},
+		{&RPCError{Code: RPCErrWalletError, Message: "Transaction too large"}, false},
+		{&RPCError{Code: RPCErrInvalidAddressOrKey, Message: "Invalid address"}, false},
+		{errors.New("Insufficient funds"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsInsufficientFunds(tt.err); got != tt.want {
+			t.Errorf("IsInsufficientFunds(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// WalletPassphrase
+// ---------------------------------------------------------------------------
+
+func TestWalletPassphrase(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["walletpassphrase"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	if err := client.WalletPassphrase(t.Context(), "hunter2", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	var p []any
+	json.Unmarshal(m.lastParams, &p)
+	if p[0] != "hunter2" || p[1] != 60.0 {
+		t.Errorf("unexpected walletpassphrase params: %v", p)
+	}
+}
+
+func TestWalletPassphrase_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		rpcErr  *mockRPCErr
+		wantErr error
+		wantNil bool
+	}{
+		{"incorrect", &mockRPCErr{Code: RPCErrWalletPassphraseIncorrect, Message: "The wallet passphrase entered was incorrect."}, ErrWalletPassphraseIncorrect, false},
+		{"not encrypted", &mockRPCErr{Code: RPCErrWalletWrongEncState, Message: "running with an unencrypted wallet, but walletpassphrase was called"}, nil, true},
+		{"other", &mockRPCErr{Code: -1, Message: "boom"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockRPC()
+			m.handlers["walletpassphrase"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+				return nil, tt.rpcErr
+			}
+			srv := httptest.NewServer(m)
+			defer srv.Close()
+			client := newTestClient(srv)
+
+			err := client.WalletPassphrase(t.Context(), "hunter2", 60)
+			switch {
+			case tt.wantNil && err != nil:
+				t.Errorf("expected nil, got %v", err)
+			case !tt.wantNil && err == nil:
+				t.Error("expected error")
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err != nil && strings.Contains(err.Error(), "hunter2") {
+				t.Errorf("passphrase leaked into error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSendToAddress_UnlocksEncryptedWallet(t *testing.T) {
+	var order []string
+	m := fullMockRPC()
+	m.handlers["walletpassphrase"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		order = append(order, "walletpassphrase")
+		return nil, nil
+	}
+	sign := m.handlers["signrawtransactionwithwallet"]
+	m.handlers["signrawtransactionwithwallet"] = func(p json.RawMessage) (any, *mockRPCErr) {
+		order = append(order, "sign")
+		return sign(p)
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.config.WalletPassphrase = "hunter2"
+
+	if _, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(order, []string{"walletpassphrase", "sign"}) {
+		t.Errorf("expected unlock before signing, got %v", order)
+	}
+}
+
+func TestSendToAddress_WrongPassphrase(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["walletpassphrase"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, &mockRPCErr{Code: RPCErrWalletPassphraseIncorrect, Message: "The wallet passphrase entered was incorrect."}
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.config.WalletPassphrase = "wrong"
+
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, "")
+	if !errors.Is(err, ErrWalletPassphraseIncorrect) {
+		t.Errorf("expected incorrect passphrase error, got %v", err)
+	}
+	if m.methodCalls["signrawtransactionwithwallet"] != 0 {
+		t.Error("expected no signing attempt with a wrong passphrase")
+	}
+}
+
+func TestConsolidate_UnlocksEncryptedWallet(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["walletpassphrase"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+	client.config.WalletPassphrase = "hunter2"
+
+	inputs := []UTXO{{TxID: "a", Vout: 0, Amount: 0.01}, {TxID: "b", Vout: 1, Amount: 0.02}}
+	if _, err := client.Consolidate(t.Context(), inputs, 0.03, "tb1qdest", ""); err != nil {
+		t.Fatal(err)
+	}
+	if m.methodCalls["walletpassphrase"] != 1 {
+		t.Errorf("expected one unlock, got %d", m.methodCalls["walletpassphrase"])
+	}
+}
+
 // ---------------------------------------------------------------------------
 // GetBalances
 // ---------------------------------------------------------------------------
@@ -419,7 +779,7 @@ func TestGetBalances(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	bal, err := client.GetBalances()
+	bal, err := client.GetBalances(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -447,7 +807,7 @@ func TestGetNewAddress(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	addr, err := client.GetNewAddress("mylabel", "bech32")
+	addr, err := client.GetNewAddress(t.Context(), "mylabel", "bech32")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -471,7 +831,7 @@ func TestGetNewAddress_NoParams(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	addr, err := client.GetNewAddress("", "")
+	addr, err := client.GetNewAddress(t.Context(), "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -493,7 +853,7 @@ func TestGetNewAddress_LabelOnly(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	client.GetNewAddress("label", "")
+	client.GetNewAddress(t.Context(), "label", "")
 	var p []any
 	json.Unmarshal(m.lastParams, &p)
 	if len(p) != 1 || p[0].(string) != "label" {
@@ -501,127 +861,444 @@ func TestGetNewAddress_LabelOnly(t *testing.T) {
 	}
 }
 
-// ---------------------------------------------------------------------------
-// ListUnspent
-// ---------------------------------------------------------------------------
-
-func TestListUnspent(t *testing.T) {
+func TestKeypoolRefill(t *testing.T) {
+	var order []string
 	m := newMockRPC()
-	m.handlers["listunspent"] = func(params json.RawMessage) (any, *mockRPCErr) {
-		return []map[string]any{
-			{"txid": "aaa", "vout": 0, "address": "tb1q1", "amount": 0.5, "confirmations": 10, "spendable": true},
-			{"txid": "bbb", "vout": 1, "address": "tb1q2", "amount": 1.0, "confirmations": 0, "spendable": false},
-		}, nil
+	m.handlers["walletpassphrase"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		order = append(order, "walletpassphrase")
+		return nil, nil
+	}
+	m.handlers["keypoolrefill"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		order = append(order, "keypoolrefill")
+		return nil, nil
 	}
 	srv := httptest.NewServer(m)
 	defer srv.Close()
 	client := newTestClient(srv)
+	client.config.WalletPassphrase = "hunter2"
 
-	utxos, err := client.ListUnspent(0, 9999)
-	if err != nil {
+	if err := client.KeypoolRefill(t.Context(), 500); err != nil {
 		t.Fatal(err)
 	}
-	if len(utxos) != 2 {
-		t.Fatalf("expected 2 utxos, got %d", len(utxos))
-	}
-	if utxos[0].TxID != "aaa" || utxos[0].Amount != 0.5 || !utxos[0].Spendable {
-		t.Errorf("unexpected utxo[0]: %+v", utxos[0])
+	if !slices.Equal(order, []string{"walletpassphrase", "keypoolrefill"}) {
+		t.Errorf("expected unlock before keypoolrefill, got %v", order)
 	}
-	if utxos[1].Spendable {
-		t.Error("expected utxo[1] not spendable")
+	var p []any
+	json.Unmarshal(m.lastParams, &p)
+	if len(p) != 1 || p[0] != 500.0 {
+		t.Errorf("expected [500], got %v", p)
 	}
 
-	var p []any
+	// 0 leaves the size to bitcoind
+	client.config.WalletPassphrase = ""
+	if err := client.KeypoolRefill(t.Context(), 0); err != nil {
+		t.Fatal(err)
+	}
 	json.Unmarshal(m.lastParams, &p)
-	if p[0].(float64) != 0 || p[1].(float64) != 9999 {
-		t.Errorf("unexpected params: %v", p)
+	if len(p) != 0 || len(order) != 3 {
+		t.Errorf("expected a bare keypoolrefill, got %v after %v", p, order)
 	}
 }
 
-func TestListUnspent_Empty(t *testing.T) {
+func TestIsKeypoolRanOut(t *testing.T) {
 	m := newMockRPC()
-	m.handlers["listunspent"] = func(_ json.RawMessage) (any, *mockRPCErr) { return []any{}, nil }
+	m.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, &mockRPCErr{Code: RPCErrWalletKeypoolRanOut, Message: "Error: Keypool ran out, please call keypoolrefill first"}
+	}
 	srv := httptest.NewServer(m)
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	utxos, err := client.ListUnspent(1, 100)
-	if err != nil {
-		t.Fatal(err)
+	_, err := client.GetNewAddress(t.Context(), "", "bech32")
+	if !IsKeypoolRanOut(err) {
+		t.Errorf("expected keypool error, got %v", err)
 	}
-	if len(utxos) != 0 {
-		t.Errorf("expected 0 utxos, got %d", len(utxos))
+	if IsKeypoolRanOut(&RPCError{Code: RPCErrWalletError, Message: "boom"}) || IsKeypoolRanOut(nil) {
+		t.Error("expected only -12 to count as keypool ran out")
 	}
 }
 
 // ---------------------------------------------------------------------------
-// SendToAddressWithOpReturn
+// ListUnspent
 // ---------------------------------------------------------------------------
 
-func TestSendToAddress_Success(t *testing.T) {
-	m := fullMockRPC()
+func TestGetTransaction(t *testing.T) {
+	m := newMockRPC()
+	var gotParams []any
+	m.handlers["gettransaction"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		json.Unmarshal(params, &gotParams)
+		return map[string]any{
+			"txid":          "aaa",
+			"confirmations": 0,
+			"time":          1700000000,
+			"timereceived":  1700000005,
+		}, nil
+	}
 	srv := httptest.NewServer(m)
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	txid, err := client.SendToAddressWithOpReturn("tb1qaddr", 0.05, 1.0, "hello")
+	tx, err := client.GetTransaction(t.Context(), "aaa")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if txid != "abc123txid" {
-		t.Errorf("expected abc123txid, got %s", txid)
-	}
-	if m.methodCalls["createrawtransaction"] != 1 {
-		t.Error("expected createrawtransaction to be called")
-	}
-	if m.methodCalls["fundrawtransaction"] != 1 {
-		t.Error("expected fundrawtransaction to be called")
-	}
-	if m.methodCalls["signrawtransactionwithwallet"] != 1 {
-		t.Error("expected signrawtransactionwithwallet to be called")
+	if len(gotParams) != 1 || gotParams[0] != "aaa" {
+		t.Errorf("unexpected params: %v", gotParams)
 	}
-	if m.methodCalls["sendrawtransaction"] != 1 {
-		t.Error("expected sendrawtransaction to be called")
+	if tx.TxID != "aaa" || tx.Time != 1700000000 || tx.TimeReceived != 1700000005 {
+		t.Errorf("unexpected tx: %+v", tx)
 	}
 }
 
-func TestSendToAddress_NoOpReturn(t *testing.T) {
-	m := fullMockRPC()
+func TestGetAddressInfo(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["getaddressinfo"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		return map[string]any{"address": p[0], "ismine": p[0] == "tb1qmine"}, nil
+	}
 	srv := httptest.NewServer(m)
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	txid, err := client.SendToAddressWithOpReturn("tb1qaddr", 0.05, 1.0, "")
-	if err != nil {
-		t.Fatal(err)
+	info, err := client.GetAddressInfo(t.Context(), "tb1qmine")
+	if err != nil || !info.IsMine || info.Address != "tb1qmine" {
+		t.Errorf("expected tb1qmine to be ours, got %+v %v", info, err)
 	}
-	if txid != "abc123txid" {
-		t.Errorf("expected abc123txid, got %s", txid)
+	info, err = client.GetAddressInfo(t.Context(), "tb1qother")
+	if err != nil || info.IsMine {
+		t.Errorf("expected tb1qother not to be ours, got %+v %v", info, err)
 	}
 }
 
-func TestSendToAddress_NoFeeRate(t *testing.T) {
-	m := fullMockRPC()
+func TestIsInMempool(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["getmempoolentry"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		switch p[0] {
+		case "inmempool":
+			return map[string]any{"vsize": 141}, nil
+		case "gone":
+			return nil, &mockRPCErr{Code: -5, Message: "Transaction not in mempool"}
+		}
+		return nil, &mockRPCErr{Code: -1, Message: "boom"}
+	}
 	srv := httptest.NewServer(m)
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	txid, err := client.SendToAddressWithOpReturn("tb1qaddr", 0.05, 0, "")
-	if err != nil {
-		t.Fatal(err)
+	if ok, err := client.IsInMempool(t.Context(), "inmempool"); err != nil || !ok {
+		t.Errorf("expected true, got %v %v", ok, err)
+	}
+	if ok, err := client.IsInMempool(t.Context(), "gone"); err != nil || ok {
+		t.Errorf("expected false without error, got %v %v", ok, err)
 	}
-	if txid != "abc123txid" {
-		t.Errorf("expected abc123txid, got %s", txid)
+	if _, err := client.IsInMempool(t.Context(), "other"); err == nil {
+		t.Error("expected other RPC errors to be returned")
 	}
 }
 
-func TestSendToAddress_DustAmount(t *testing.T) {
-	m := fullMockRPC()
-	srv := httptest.NewServer(m)
-	defer srv.Close()
-	client := newTestClient(srv)
-
-	_, err := client.SendToAddressWithOpReturn("tb1qaddr", 0.000001, 1.0, "")
+func TestListUnspent(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["listunspent"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		return []map[string]any{
+			{"txid": "aaa", "vout": 0, "address": "tb1q1", "amount": 0.5, "confirmations": 10, "spendable": true},
+			{"txid": "bbb", "vout": 1, "address": "tb1q2", "amount": 1.0, "confirmations": 0, "spendable": false},
+		}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	utxos, err := client.ListUnspent(t.Context(), 0, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 2 {
+		t.Fatalf("expected 2 utxos, got %d", len(utxos))
+	}
+	if utxos[0].TxID != "aaa" || utxos[0].Amount != 0.5 || !utxos[0].Spendable {
+		t.Errorf("unexpected utxo[0]: %+v", utxos[0])
+	}
+	if utxos[1].Spendable {
+		t.Error("expected utxo[1] not spendable")
+	}
+
+	var p []any
+	json.Unmarshal(m.lastParams, &p)
+	if p[0].(float64) != 0 || p[1].(float64) != 9999 {
+		t.Errorf("unexpected params: %v", p)
+	}
+}
+
+func TestListUnspent_Addresses(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["listunspent"] = func(_ json.RawMessage) (any, *mockRPCErr) { return []any{}, nil }
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	if _, err := client.ListUnspent(t.Context(), 0, 9999, "tb1q1", "tb1q2"); err != nil {
+		t.Fatal(err)
+	}
+	var p []any
+	json.Unmarshal(m.lastParams, &p)
+	if len(p) != 3 || fmt.Sprint(p[2]) != "[tb1q1 tb1q2]" {
+		t.Errorf("expected the address filter as third param, got %v", p)
+	}
+
+	if _, err := client.ListUnspent(t.Context(), 0, 9999); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(m.lastParams, &p)
+	if len(p) != 2 {
+		t.Errorf("expected no address filter without addresses, got %v", p)
+	}
+}
+
+func TestListUnspent_Empty(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["listunspent"] = func(_ json.RawMessage) (any, *mockRPCErr) { return []any{}, nil }
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	utxos, err := client.ListUnspent(t.Context(), 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 {
+		t.Errorf("expected 0 utxos, got %d", len(utxos))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// SendToAddressWithOpReturn
+// ---------------------------------------------------------------------------
+
+func TestSendToAddress_Success(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	result, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TxID != "abc123txid" {
+		t.Errorf("expected abc123txid, got %s", result.TxID)
+	}
+	if result.FeeBTC != 0.00001 {
+		t.Errorf("expected fee 0.00001, got %f", result.FeeBTC)
+	}
+	if result.Hex != "signedhex000" {
+		t.Errorf("expected the signed hex, got %q", result.Hex)
+	}
+	if m.methodCalls["createrawtransaction"] != 1 {
+		t.Error("expected createrawtransaction to be called")
+	}
+	if m.methodCalls["fundrawtransaction"] != 1 {
+		t.Error("expected fundrawtransaction to be called")
+	}
+	if m.methodCalls["signrawtransactionwithwallet"] != 1 {
+		t.Error("expected signrawtransactionwithwallet to be called")
+	}
+	if m.methodCalls["sendrawtransaction"] != 1 {
+		t.Error("expected sendrawtransaction to be called")
+	}
+}
+
+func TestSendToAddress_NoOpReturn(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	result, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TxID != "abc123txid" {
+		t.Errorf("expected abc123txid, got %s", result.TxID)
+	}
+}
+
+func TestSendToAddress_OpReturnTooLong(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, strings.Repeat("x", MaxOpReturnBytes+1))
+	if !errors.Is(err, ErrOpReturnTooLong) {
+		t.Fatalf("expected ErrOpReturnTooLong, got %v", err)
+	}
+	if m.methodCalls["createrawtransaction"] != 0 {
+		t.Error("should not build a transaction with an oversized OP_RETURN")
+	}
+}
+
+func TestSanitizeOpReturn(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"faucet.coinbin.org", "faucet.coinbin.org"},
+		{"héllo wörld", "hllo wrld"},
+		{"tab\there\n", "tabhere"},
+		{"\u26a1 zap", " zap"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeOpReturn(tt.in)
+		if err != nil {
+			t.Errorf("sanitizeOpReturn(%q): %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("sanitizeOpReturn(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeOpReturn_Length(t *testing.T) {
+	if _, err := sanitizeOpReturn(strings.Repeat("a", MaxOpReturnBytes)); err != nil {
+		t.Errorf("expected %d bytes to be allowed, got %v", MaxOpReturnBytes, err)
+	}
+	if _, err := sanitizeOpReturn(strings.Repeat("a", MaxOpReturnBytes+1)); !errors.Is(err, ErrOpReturnTooLong) {
+		t.Errorf("expected ErrOpReturnTooLong, got %v", err)
+	}
+
+	// stripped characters don't count towards the limit
+	s := strings.Repeat("a", MaxOpReturnBytes) + "ü"
+	got, err := sanitizeOpReturn(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != MaxOpReturnBytes {
+		t.Errorf("expected %d bytes, got %d", MaxOpReturnBytes, len(got))
+	}
+}
+
+func TestSendToAddress_NoFeeRate(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	result, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TxID != "abc123txid" {
+		t.Errorf("expected abc123txid, got %s", result.TxID)
+	}
+}
+
+func TestSendToAddress_RecordsInputs(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["decoderawtransaction"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		if string(params) != `["fundedhex000"]` {
+			return nil, &mockRPCErr{Code: -22, Message: "unexpected hex " + string(params)}
+		}
+		return map[string]any{
+			"txid": "abc123txid",
+			"vin":  []map[string]any{{"txid": "in1", "vout": 2}},
+		}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	result, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Inputs) != 1 || result.Inputs[0].TxID != "in1" || result.Inputs[0].Vout != 2 {
+		t.Errorf("unexpected inputs: %+v", result.Inputs)
+	}
+}
+
+func TestSendToAddress_DecodeFailureStillSucceeds(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	result, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TxID != "abc123txid" {
+		t.Errorf("expected abc123txid, got %s", result.TxID)
+	}
+	if result.Inputs != nil {
+		t.Errorf("expected no inputs without decoderawtransaction, got %+v", result.Inputs)
+	}
+}
+
+func TestSendToAddressWithHook(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["decoderawtransaction"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		if string(params) == `["signedhex000"]` {
+			return map[string]any{"txid": "abc123txid", "vin": []map[string]any{{"txid": "in1", "vout": 0}}}, nil
+		}
+		return map[string]any{"txid": "unsignedtxid", "vin": []map[string]any{{"txid": "in1", "vout": 0}}}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	var hookTxID string
+	var sentBeforeHook int
+	result, err := client.SendToAddressWithHook(t.Context(), "tb1qaddr", 0.05, 1.0, "", func(txid string) error {
+		hookTxID = txid
+		sentBeforeHook = m.methodCalls["sendrawtransaction"]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hookTxID != "abc123txid" || result.TxID != hookTxID {
+		t.Errorf("expected hook to see the signed txid, got %q (sent %q)", hookTxID, result.TxID)
+	}
+	if sentBeforeHook != 0 {
+		t.Error("expected hook to run before the broadcast")
+	}
+}
+
+func TestSendToAddressWithHook_ErrorAborts(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["decoderawtransaction"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return map[string]any{"txid": "abc123txid", "vin": []map[string]any{{"txid": "in1", "vout": 0}}}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	_, err := client.SendManyWithHook(t.Context(), map[string]float64{"tb1qa": 0.01, "tb1qb": 0.02}, 1.0, "", func(string) error {
+		return fmt.Errorf("db down")
+	})
+	if err == nil || !strings.Contains(err.Error(), "db down") {
+		t.Fatalf("expected hook error, got %v", err)
+	}
+	if m.methodCalls["sendrawtransaction"] != 0 {
+		t.Error("expected no broadcast after the hook failed")
+	}
+	if m.methodCalls["lockunspent"] != 1 {
+		t.Errorf("expected the inputs to be unlocked, got %d lockunspent calls", m.methodCalls["lockunspent"])
+	}
+}
+
+func TestSendToAddress_DustAmount(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.000001, 1.0, "")
 	if err == nil || !strings.Contains(err.Error(), "Amount too low") {
 		t.Errorf("expected dust error, got: %v", err)
 	}
@@ -636,7 +1313,7 @@ func TestSendToAddress_CreateRawFails(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.SendToAddressWithOpReturn("tb1q", 0.05, 1.0, "")
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1q", 0.05, 1.0, "")
 	if err == nil || !strings.Contains(err.Error(), "createrawtransaction failed") {
 		t.Errorf("expected createrawtransaction error, got: %v", err)
 	}
@@ -651,7 +1328,7 @@ func TestSendToAddress_FundRawFails(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.SendToAddressWithOpReturn("tb1q", 0.05, 1.0, "")
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1q", 0.05, 1.0, "")
 	if err == nil || !strings.Contains(err.Error(), "fundrawtransaction failed") {
 		t.Errorf("expected fundrawtransaction error, got: %v", err)
 	}
@@ -666,7 +1343,7 @@ func TestSendToAddress_SignFails(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.SendToAddressWithOpReturn("tb1q", 0.05, 1.0, "")
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1q", 0.05, 1.0, "")
 	if err == nil || !strings.Contains(err.Error(), "signrawtransactionwithwallet failed") {
 		t.Errorf("expected sign error, got: %v", err)
 	}
@@ -681,7 +1358,7 @@ func TestSendToAddress_SignIncomplete(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.SendToAddressWithOpReturn("tb1q", 0.05, 1.0, "")
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1q", 0.05, 1.0, "")
 	if err == nil || !strings.Contains(err.Error(), "signing incomplete") {
 		t.Errorf("expected signing incomplete, got: %v", err)
 	}
@@ -696,12 +1373,149 @@ func TestSendToAddress_SendRawFails(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.SendToAddressWithOpReturn("tb1q", 0.05, 1.0, "")
+	_, err := client.SendToAddressWithOpReturn(t.Context(), "tb1q", 0.05, 1.0, "")
 	if err == nil || !strings.Contains(err.Error(), "sendrawtransaction failed") {
 		t.Errorf("expected sendrawtransaction error, got: %v", err)
 	}
 }
 
+func TestSendToAddress_LocksFundedInputs(t *testing.T) {
+	m := fullMockRPC()
+	var fundParams []json.RawMessage
+	m.handlers["fundrawtransaction"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		json.Unmarshal(params, &fundParams)
+		return map[string]any{"hex": "fundedhex000", "fee": 0.00001}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	if _, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fundParams) != 2 {
+		t.Fatalf("expected 2 fundrawtransaction params, got %d", len(fundParams))
+	}
+	var opts map[string]any
+	json.Unmarshal(fundParams[1], &opts)
+	if opts["lockUnspents"] != true {
+		t.Errorf("expected lockUnspents=true, got %v", opts["lockUnspents"])
+	}
+	if opts["fee_rate"] != "1.00000000" {
+		t.Errorf("expected fee_rate=1.00000000, got %v", opts["fee_rate"])
+	}
+	if m.methodCalls["lockunspent"] != 0 {
+		t.Error("expected no unlock on successful send")
+	}
+	if n, _ := client.ReleaseLocks(t.Context()); n != 0 {
+		t.Errorf("expected broadcast inputs to no longer be tracked, got %d", n)
+	}
+}
+
+func TestSendToAddress_UnlocksInputsOnFailure(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, &mockRPCErr{Code: -25, Message: "missing inputs"}
+	}
+	m.handlers["decoderawtransaction"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return map[string]any{
+			"vin": []map[string]any{{"txid": "in1", "vout": 0}, {"txid": "in2", "vout": 3}},
+		}, nil
+	}
+	var unlockParams []json.RawMessage
+	m.handlers["lockunspent"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		json.Unmarshal(params, &unlockParams)
+		return true, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	if _, err := client.SendToAddressWithOpReturn(t.Context(), "tb1qaddr", 0.05, 1.0, ""); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if m.methodCalls["lockunspent"] != 1 {
+		t.Fatalf("expected lockunspent to be called once, got %d", m.methodCalls["lockunspent"])
+	}
+	if string(unlockParams[0]) != "true" {
+		t.Errorf("expected unlock flag true, got %s", unlockParams[0])
+	}
+	var inputs []map[string]any
+	json.Unmarshal(unlockParams[1], &inputs)
+	if len(inputs) != 2 || inputs[1]["txid"] != "in2" || inputs[1]["vout"].(float64) != 3 {
+		t.Errorf("unexpected unlock inputs: %v", inputs)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// SendManyWithHook
+// ---------------------------------------------------------------------------
+
+func TestSendMany_Success(t *testing.T) {
+	var outputs map[string]string
+	m := fullMockRPC()
+	m.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		json.Unmarshal(p[1], &outputs)
+		return "rawhex000", nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	result, err := client.SendManyWithHook(t.Context(), map[string]float64{
+		"tb1qaddr1": 0.01,
+		"tb1qaddr2": 0.025,
+	}, 1.0, "hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TxID != "abc123txid" {
+		t.Errorf("expected abc123txid, got %s", result.TxID)
+	}
+	if len(outputs) != 3 || outputs["tb1qaddr1"] != "0.01000000" || outputs["tb1qaddr2"] != "0.02500000" {
+		t.Errorf("unexpected outputs: %v", outputs)
+	}
+	if outputs["data"] != hex.EncodeToString([]byte("hello")) {
+		t.Errorf("expected OP_RETURN output, got %v", outputs)
+	}
+	if m.methodCalls["sendrawtransaction"] != 1 {
+		t.Errorf("expected a single broadcast, got %d", m.methodCalls["sendrawtransaction"])
+	}
+}
+
+func TestSendMany_DustAmount(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	_, err := client.SendManyWithHook(t.Context(), map[string]float64{
+		"tb1qaddr1": 0.01,
+		"tb1qaddr2": 0.000001,
+	}, 1.0, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "tb1qaddr2") {
+		t.Errorf("expected dust error naming the address, got %v", err)
+	}
+	if m.callCount != 0 {
+		t.Errorf("expected no RPC calls, got %d", m.callCount)
+	}
+}
+
+func TestSendMany_Empty(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	if _, err := client.SendManyWithHook(t.Context(), nil, 1.0, "", nil); err == nil {
+		t.Error("expected error for no outputs")
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Consolidate
 // ---------------------------------------------------------------------------
@@ -717,12 +1531,18 @@ func TestConsolidate_Success(t *testing.T) {
 		{TxID: "tx2", Vout: 1, Amount: 0.002},
 	}
 
-	txid, err := client.Consolidate(utxos, 0.003, "tb1qconsolidated", "faucet")
+	result, err := client.Consolidate(t.Context(), utxos, 0.003, "tb1qconsolidated", "faucet")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if txid != "abc123txid" {
-		t.Errorf("expected abc123txid, got %s", txid)
+	if result.TxID != "abc123txid" {
+		t.Errorf("expected abc123txid, got %s", result.TxID)
+	}
+	if result.Hex != "signedhex000" {
+		t.Errorf("expected the signed hex, got %q", result.Hex)
+	}
+	if len(result.Inputs) != 2 {
+		t.Errorf("expected both inputs in the result, got %v", result.Inputs)
 	}
 
 	if m.methodCalls["createrawtransaction"] != 1 {
@@ -746,12 +1566,28 @@ func TestConsolidate_NoOpReturn(t *testing.T) {
 	client := newTestClient(srv)
 
 	utxos := []UTXO{{TxID: "tx1", Vout: 0, Amount: 0.001}}
-	_, err := client.Consolidate(utxos, 0.001, "tb1q", "")
+	_, err := client.Consolidate(t.Context(), utxos, 0.001, "tb1q", "")
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestConsolidate_OpReturnTooLong(t *testing.T) {
+	m := fullMockRPC()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	utxos := []UTXO{{TxID: "tx1", Vout: 0, Amount: 0.001}}
+	_, err := client.Consolidate(t.Context(), utxos, 0.001, "tb1q", strings.Repeat("x", MaxOpReturnBytes+1))
+	if !errors.Is(err, ErrOpReturnTooLong) {
+		t.Fatalf("expected ErrOpReturnTooLong, got %v", err)
+	}
+	if m.methodCalls["createrawtransaction"] != 0 {
+		t.Error("should not build a transaction with an oversized OP_RETURN")
+	}
+}
+
 func TestConsolidate_AmountTooSmall(t *testing.T) {
 	m := fullMockRPC()
 	srv := httptest.NewServer(m)
@@ -759,7 +1595,7 @@ func TestConsolidate_AmountTooSmall(t *testing.T) {
 	client := newTestClient(srv)
 
 	utxos := []UTXO{{TxID: "tx1", Vout: 0, Amount: 0.00000001}}
-	_, err := client.Consolidate(utxos, 0.00000001, "tb1q", "faucet")
+	_, err := client.Consolidate(t.Context(), utxos, 0.00000001, "tb1q", "faucet")
 	if err == nil || !strings.Contains(err.Error(), "too small to cover fees") {
 		t.Errorf("expected fee error, got: %v", err)
 	}
@@ -782,7 +1618,7 @@ func TestConsolidate_SortsInputsByAmount(t *testing.T) {
 		{TxID: "med", Vout: 0, Amount: 0.003},
 	}
 
-	client.Consolidate(utxos, 0.009, "tb1q", "")
+	client.Consolidate(t.Context(), utxos, 0.009, "tb1q", "")
 
 	var p []json.RawMessage
 	json.Unmarshal(capturedParams, &p)
@@ -806,7 +1642,7 @@ func TestConsolidate_CreateRawFails(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.Consolidate([]UTXO{{TxID: "t", Amount: 0.01}}, 0.01, "tb1q", "")
+	_, err := client.Consolidate(t.Context(), []UTXO{{TxID: "t", Amount: 0.01}}, 0.01, "tb1q", "")
 	if err == nil || !strings.Contains(err.Error(), "createrawtransaction failed") {
 		t.Errorf("expected error, got: %v", err)
 	}
@@ -821,7 +1657,7 @@ func TestConsolidate_SignIncomplete(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.Consolidate([]UTXO{{TxID: "t", Amount: 0.01}}, 0.01, "tb1q", "")
+	_, err := client.Consolidate(t.Context(), []UTXO{{TxID: "t", Amount: 0.01}}, 0.01, "tb1q", "")
 	if err == nil || !strings.Contains(err.Error(), "signing incomplete") {
 		t.Errorf("expected signing incomplete, got: %v", err)
 	}
@@ -836,17 +1672,190 @@ func TestConsolidate_SendFails(t *testing.T) {
 	defer srv.Close()
 	client := newTestClient(srv)
 
-	_, err := client.Consolidate([]UTXO{{TxID: "t", Amount: 0.01}}, 0.01, "tb1q", "")
+	_, err := client.Consolidate(t.Context(), []UTXO{{TxID: "t", Amount: 0.01}}, 0.01, "tb1q", "")
 	if err == nil || !strings.Contains(err.Error(), "sendrawtransaction failed") {
 		t.Errorf("expected error, got: %v", err)
 	}
 }
 
 // ---------------------------------------------------------------------------
-// ValidateSignetAddress
+// SweepUTXOs / EstimateSmartFee
 // ---------------------------------------------------------------------------
 
-func TestValidateSignetAddress(t *testing.T) {
+func TestSweepUTXOs_UsesFeeRate(t *testing.T) {
+	m := fullMockRPC()
+	var createParams []json.RawMessage
+	m.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		json.Unmarshal(params, &createParams)
+		return "rawhex000", nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	utxos := []UTXO{{TxID: "tx1", Vout: 0, Amount: 0.01}}
+	if _, err := client.SweepUTXOs(t.Context(), utxos, 0.01, "tb1qcold", "", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// (10.5 + 148 + 31) vB * 10 sat/vB = 1895 sats
+	var outputs map[string]string
+	json.Unmarshal(createParams[1], &outputs)
+	if outputs["tb1qcold"] != "0.00998105" {
+		t.Errorf("expected output 0.00998105, got %s", outputs["tb1qcold"])
+	}
+	if _, ok := outputs["data"]; ok {
+		t.Error("expected no OP_RETURN output")
+	}
+}
+
+func TestSweepUTXOs_LocksInputs(t *testing.T) {
+	m := fullMockRPC()
+	var lockCalls []string
+	m.handlers["lockunspent"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		lockCalls = append(lockCalls, string(p[0]))
+		return true, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	utxos := []UTXO{{TxID: "tx1", Vout: 0, Amount: 0.01}, {TxID: "tx2", Vout: 1, Amount: 0.02}}
+	if _, err := client.SweepUTXOs(t.Context(), utxos, 0.03, "tb1qcold", "", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(lockCalls, []string{"false"}) {
+		t.Errorf("expected the inputs to be locked once and not unlocked, got %v", lockCalls)
+	}
+	if n, err := client.ReleaseLocks(t.Context()); err != nil || n != 0 {
+		t.Errorf("expected no locks left after broadcast, got %d, %v", n, err)
+	}
+}
+
+func TestSweepUTXOs_UnlocksOnFailure(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, &mockRPCErr{Code: -26, Message: "min relay fee not met"}
+	}
+	var lockCalls []string
+	m.handlers["lockunspent"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		lockCalls = append(lockCalls, string(p[0]))
+		return true, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	utxos := []UTXO{{TxID: "tx1", Vout: 0, Amount: 0.01}}
+	if _, err := client.SweepUTXOs(t.Context(), utxos, 0.01, "tb1qcold", "", 10); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if !slices.Equal(lockCalls, []string{"false", "true"}) {
+		t.Errorf("expected lock then unlock, got %v", lockCalls)
+	}
+	if n, _ := client.ReleaseLocks(t.Context()); n != 0 {
+		t.Errorf("expected no locks left, got %d", n)
+	}
+}
+
+func TestSweepUTXOs_InputAlreadyLocked(t *testing.T) {
+	m := fullMockRPC()
+	m.handlers["lockunspent"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return nil, &mockRPCErr{Code: -8, Message: "Invalid parameter, output already locked"}
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	utxos := []UTXO{{TxID: "tx1", Vout: 0, Amount: 0.01}}
+	if _, err := client.SweepUTXOs(t.Context(), utxos, 0.01, "tb1qcold", "", 10); err == nil {
+		t.Fatal("expected error")
+	}
+	if m.methodCalls["createrawtransaction"] != 0 {
+		t.Error("should not build a transaction from inputs someone else holds")
+	}
+}
+
+func TestReleaseLocks(t *testing.T) {
+	m := fullMockRPC()
+	var unlocked []Outpoint
+	m.handlers["lockunspent"] = func(params json.RawMessage) (any, *mockRPCErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		if string(p[0]) == "true" {
+			json.Unmarshal(p[1], &unlocked)
+		}
+		return true, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	held := []Outpoint{{TxID: "tx1", Vout: 0}, {TxID: "tx2", Vout: 3}}
+	if err := client.LockUnspent(t.Context(), held); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := client.ReleaseLocks(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(unlocked) != 2 {
+		t.Errorf("expected 2 outpoints unlocked, got %d (%v)", n, unlocked)
+	}
+
+	if n, _ := client.ReleaseLocks(t.Context()); n != 0 || m.methodCalls["lockunspent"] != 2 {
+		t.Errorf("expected nothing left to release, got %d after %d calls", n, m.methodCalls["lockunspent"])
+	}
+}
+
+func TestEstimateSmartFee(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["estimatesmartfee"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return map[string]any{"feerate": 0.00002, "blocks": 6}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	rate, err := client.EstimateSmartFee(t.Context(), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%.3f", rate) != "2.000" {
+		t.Errorf("expected 2 sat/vB, got %f", rate)
+	}
+	if string(m.lastParams) != "[6]" {
+		t.Errorf("expected params [6], got %s", m.lastParams)
+	}
+}
+
+func TestEstimateSmartFee_NoData(t *testing.T) {
+	m := newMockRPC()
+	m.handlers["estimatesmartfee"] = func(_ json.RawMessage) (any, *mockRPCErr) {
+		return map[string]any{"errors": []string{"Insufficient data or no feerate found"}, "blocks": 0}, nil
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	client := newTestClient(srv)
+
+	_, err := client.EstimateSmartFee(t.Context(), 6)
+	if err == nil || !strings.Contains(err.Error(), "Insufficient data") {
+		t.Errorf("expected no estimate error, got: %v", err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// ValidateAddress
+// ---------------------------------------------------------------------------
+
+func TestValidateAddress_Signet(t *testing.T) {
 	tests := []struct {
 		addr    string
 		wantErr bool
@@ -877,25 +1886,83 @@ func TestValidateSignetAddress(t *testing.T) {
 
 		// whitespace trimming
 		{"  tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx  ", false, "trimmed bech32"},
+
+		// regtest bech32 rejected
+		{"bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", true, "regtest bech32"},
+	}
+
+	for _, tt := range tests {
+		err := ValidateAddress(tt.addr, NetworkSignet)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidateAddress(%q) error=%v, wantErr=%v", tt.desc, tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateAddress_Regtest(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+		desc    string
+	}{
+		{"bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080", false, "valid regtest bech32"},
+		{"2N1rjhumXA3ephUQTDMfGhufxGaN1Lap4Ji", false, "valid P2SH"},
+		{"mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn", false, "valid P2PKH"},
+		{"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", true, "signet bech32"},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", true, "mainnet bech32"},
 	}
 
 	for _, tt := range tests {
-		err := ValidateSignetAddress(tt.addr)
+		err := ValidateAddress(tt.addr, NetworkRegtest)
 		if (err != nil) != tt.wantErr {
-			t.Errorf("%s: ValidateSignetAddress(%q) error=%v, wantErr=%v", tt.desc, tt.addr, err, tt.wantErr)
+			t.Errorf("%s: ValidateAddress(%q) error=%v, wantErr=%v", tt.desc, tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateAddress_Testnet(t *testing.T) {
+	if err := ValidateAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", NetworkTestnet); err != nil {
+		t.Errorf("expected testnet bech32 to be valid, got %v", err)
+	}
+}
+
+func TestValidateAddress_UnknownNetwork(t *testing.T) {
+	err := ValidateAddress("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", "mainnet")
+	if err == nil || !strings.Contains(err.Error(), "unknown network") {
+		t.Errorf("expected unknown network error, got: %v", err)
+	}
+}
+
+func TestIsNetworkChain(t *testing.T) {
+	tests := []struct {
+		network string
+		chain   string
+		want    bool
+	}{
+		{NetworkSignet, "signet", true},
+		{NetworkTestnet, "test", true},
+		{NetworkTestnet, "testnet4", true},
+		{NetworkRegtest, "regtest", true},
+		{NetworkSignet, "main", false},
+		{NetworkRegtest, "signet", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsNetworkChain(tt.network, tt.chain); got != tt.want {
+			t.Errorf("IsNetworkChain(%q, %q) = %v, want %v", tt.network, tt.chain, got, tt.want)
 		}
 	}
 }
 
-func TestValidateSignetAddress_MainnetError(t *testing.T) {
-	err := ValidateSignetAddress("bc1qtest")
+func TestValidateAddress_MainnetError(t *testing.T) {
+	err := ValidateAddress("bc1qtest", NetworkSignet)
 	if err == nil || !strings.Contains(err.Error(), "mainnet") {
 		t.Errorf("expected mainnet error, got: %v", err)
 	}
 }
 
-func TestValidateSignetAddress_EmptyError(t *testing.T) {
-	err := ValidateSignetAddress("")
+func TestValidateAddress_EmptyError(t *testing.T) {
+	err := ValidateAddress("", NetworkSignet)
 	if err == nil || !strings.Contains(err.Error(), "cannot be empty") {
 		t.Errorf("expected empty error, got: %v", err)
 	}
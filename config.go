@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// every flag can also be set from the environment as FAUCET_<NAME>, e.g.
+// -admin-password as FAUCET_ADMIN_PASSWORD
+const envPrefix = "FAUCET_"
+
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyConfigSources fills in the flags that weren't given on the command
+// line, from the environment first and then from configFile, so the
+// precedence is flags > env > file > defaults
+func applyConfigSources(fs *flag.FlagSet, configFile string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var fileValues map[string]any
+	if configFile != "" {
+		var err error
+		if fileValues, err = readConfigFile(configFile); err != nil {
+			return err
+		}
+	}
+
+	// sorted so errors for a broken file come out the same on every run
+	names := make([]string, 0, len(fileValues))
+	for name := range fileValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", configFile, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if _, ok := os.LookupEnv(flagEnvName(name)); ok {
+			continue
+		}
+
+		values, err := configValueStrings(fileValues[name], isRepeatable(f))
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", configFile, name, err)
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %s: %w", configFile, name, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if envErr != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		envName := flagEnvName(f.Name)
+		v, ok := os.LookupEnv(envName)
+		if !ok {
+			return
+		}
+
+		values := []string{v}
+		if isRepeatable(f) {
+			values = strings.Split(v, ",")
+		}
+		for _, v := range values {
+			if err := fs.Set(f.Name, strings.TrimSpace(v)); err != nil {
+				envErr = fmt.Errorf("%s: %w", envName, err)
+				return
+			}
+		}
+	})
+	return envErr
+}
+
+// readConfigFile reads a flat map of flag names to values, as YAML for .yaml
+// and .yml files and as JSON otherwise
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	return values, nil
+}
+
+// isRepeatable reports whether the flag collects one value per occurrence,
+// like -admin-ip, instead of taking a comma separated list
+func isRepeatable(f *flag.Flag) bool {
+	_, ok := f.Value.(*stringSlice)
+	return ok
+}
+
+// configValueStrings turns a config file value into what would have been
+// passed on the command line. Lists become one value per entry for
+// repeatable flags and a comma separated value for the rest.
+func configValueStrings(v any, repeatable bool) ([]string, error) {
+	list, ok := v.([]any)
+	if !ok {
+		s, err := configScalarString(v)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+
+	values := make([]string, 0, len(list))
+	for _, item := range list {
+		s, err := configScalarString(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	if !repeatable {
+		return []string{strings.Join(values, ",")}, nil
+	}
+	return values, nil
+}
+
+func configScalarString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
@@ -15,10 +17,55 @@ type Transaction struct {
 	CreatedAt    time.Time `gorm:"index"`
 	Address      string    `gorm:"index;not null"`
 	IPAddress    string    `gorm:"index"`
+	IPPrefix     string    `gorm:"index"`
 	OnchainTxnID string    `gorm:"column:onchain_txn_id;index"`
 	AmountBTC    float64   `gorm:"not null;default:0"`
+	FeeBTC       float64   `gorm:"not null;default:0"`
 	Status       string    `gorm:"index;not null"`
 	ErrorMsg     string    `gorm:"type:text"`
+
+	// optional user supplied OP_RETURN message, empty means the configured -op-return
+	OpReturn string `gorm:"column:op_return"`
+
+	// JSON encoded list of the outpoints that funded the payout
+	FundingInputs string `gorm:"type:text"`
+
+	// ID of the API key the request was made with, empty for browser requests
+	APIKeyID string `gorm:"column:api_key_id;index"`
+
+	// sends that failed for lack of spendable funds and were put back in the
+	// queue, the processor leaves the row alone until NextRetryAt
+	RetryCount  int `gorm:"not null;default:0"`
+	NextRetryAt *time.Time
+
+	// when the row last moved to processing, the processor resets rows that
+	// sit there too long without a txid
+	ProcessingAt *time.Time
+
+	// one of the TxnPriority values, the processor pays higher ones first
+	Priority int `gorm:"index;not null;default:0"`
+
+	// the signed transaction as broadcast, kept so an admin can rebroadcast
+	// it after a mempool reset
+	RawTx string `gorm:"type:text"`
+}
+
+type TxnInput struct {
+	TxID string `json:"txid"`
+	Vout int    `json:"vout"`
+}
+
+func (tx Transaction) FundingInputList() []TxnInput {
+	if tx.FundingInputs == "" {
+		return nil
+	}
+
+	var inputs []TxnInput
+	if err := json.Unmarshal([]byte(tx.FundingInputs), &inputs); err != nil {
+		slog.Warn("failed to decode funding inputs", "txn_id", tx.ID, "err", err)
+		return nil
+	}
+	return inputs
 }
 
 const (
@@ -26,6 +73,18 @@ const (
 	TxnStatusProcessing = "processing"
 	TxnStatusFailed     = "failed"
 	TxnStatusBroadcast  = "broadcast"
+	// broadcast but dropped from the mempool without confirming
+	TxnStatusExpired = "expired"
+	// stopped by an admin before it was sent
+	TxnStatusCancelled = "cancelled"
+)
+
+// queue priorities, stored as ints so they sort in SQL. Rows from before the
+// column existed are normal.
+const (
+	TxnPriorityLow    = -1
+	TxnPriorityNormal = 0
+	TxnPriorityHigh   = 1
 )
 
 type AdminSession struct {
@@ -37,20 +96,131 @@ type AdminSession struct {
 	ExpiresAt time.Time `gorm:"index"`
 }
 
-func InitDB(dataDir string) (*gorm.DB, error) {
+// AuditLog records a privileged admin action and how it ended
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	Action    string    `gorm:"index;not null"`
+	Outcome   string    `gorm:"not null"`
+	IPAddress string
+	UserAgent string `gorm:"type:text"`
+	Detail    string `gorm:"type:text"`
+}
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	// rejected by password or 2FA check
+	AuditOutcomeDenied = "denied"
+)
+
+// GetAuditLogs returns a page of audit entries, newest first, and the total
+// number of entries
+func GetAuditLogs(db *gorm.DB, limit, offset int) ([]AuditLog, int64, error) {
+	var total int64
+	if err := db.Model(&AuditLog{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var logs []AuditLog
+	err := db.Order("id DESC").Limit(limit).Offset(offset).Find(&logs).Error
+	return logs, total, err
+}
+
+// BalanceSnapshot is the wallet balance at one refresh, kept for charting
+type BalanceSnapshot struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	Trusted   float64   `gorm:"not null;default:0"`
+	Pending   float64   `gorm:"not null;default:0"`
+	Immature  float64   `gorm:"not null;default:0"`
+}
+
+// GetBalanceSnapshots returns the snapshots taken after since, oldest first
+func GetBalanceSnapshots(db *gorm.DB, since time.Time) ([]BalanceSnapshot, error) {
+	var snapshots []BalanceSnapshot
+	err := db.Where("created_at > ?", since).Order("created_at ASC").Find(&snapshots).Error
+	return snapshots, err
+}
+
+// DeleteBalanceSnapshotsBefore removes snapshots older than cutoff and
+// returns how many were removed
+func DeleteBalanceSnapshotsBefore(db *gorm.DB, cutoff time.Time) (int64, error) {
+	res := db.Where("created_at < ?", cutoff).Delete(&BalanceSnapshot{})
+	return res.RowsAffected, res.Error
+}
+
+// Setting is a runtime override of a startup flag, Value is JSON encoded
+type Setting struct {
+	Key       string `gorm:"primaryKey"`
+	Value     string `gorm:"type:text;not null"`
+	UpdatedAt time.Time
+}
+
+func GetSettings(db *gorm.DB) (map[string]string, error) {
+	var settings []Setting
+	if err := db.Find(&settings).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(settings))
+	for _, s := range settings {
+		result[s.Key] = s.Value
+	}
+	return result, nil
+}
+
+func SaveSettings(db *gorm.DB, values map[string]string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for key, value := range values {
+			if err := tx.Save(&Setting{Key: key, Value: value}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Options tunes the connection pool InitDB sets up
+type Options struct {
+	// connections open at once, 0 is unlimited. SQLite allows a single
+	// writer, with more than one connection concurrent writes fail with
+	// "database is locked" unless BusyTimeout covers the wait.
+	MaxOpenConns int
+
+	// how long a connection waits for a lock held by another one before
+	// giving up, 0 fails right away
+	BusyTimeout time.Duration
+}
+
+func InitDB(dataDir string, opts Options) (*gorm.DB, error) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, err
 	}
 
 	dbPath := filepath.Join(dataDir, "faucet.db")
-	log.Printf("Using database: %s", dbPath)
+	slog.Info("using database", "path", dbPath, "max_open_conns", opts.MaxOpenConns, "busy_timeout", opts.BusyTimeout)
+
+	dsn := dbPath
+	if opts.BusyTimeout > 0 {
+		dsn += fmt.Sprintf("?_busy_timeout=%d", opts.BusyTimeout.Milliseconds())
+	}
 
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.AutoMigrate(&Transaction{}, &AdminSession{}); err != nil {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxOpenConns > 0 {
+		sqlDB.SetMaxIdleConns(opts.MaxOpenConns)
+	}
+
+	if err := Migrate(db); err != nil {
 		return nil, err
 	}
 
@@ -63,12 +233,74 @@ func GetTransactionCount(db *gorm.DB, status string) int64 {
 	return count
 }
 
+// GetTotalRequestCount counts every queued request regardless of status
+func GetTotalRequestCount(db *gorm.DB) int64 {
+	var count int64
+	db.Model(&Transaction{}).Count(&count)
+	return count
+}
+
+func GetRequestCountSince(db *gorm.DB, since time.Time) int64 {
+	var count int64
+	db.Model(&Transaction{}).Where("created_at > ?", since).Count(&count)
+	return count
+}
+
+// GetOldestPendingCreatedAt returns when the longest waiting pending payout
+// was requested, false if the queue is empty
+func GetOldestPendingCreatedAt(db *gorm.DB) (time.Time, bool) {
+	var txns []Transaction
+	db.Select("created_at").Where("status = ?", TxnStatusPending).Order("created_at ASC").Limit(1).Find(&txns)
+	if len(txns) == 0 {
+		return time.Time{}, false
+	}
+	return txns[0].CreatedAt, true
+}
+
+func GetUniqueAddressCount(db *gorm.DB) int64 {
+	var count int64
+	db.Model(&Transaction{}).Distinct("address").Count(&count)
+	return count
+}
+
 func GetTotalAmountSentBTC(db *gorm.DB) float64 {
 	var totalAmount float64
 	db.Model(&Transaction{}).Where("status = ?", TxnStatusBroadcast).Select("COALESCE(SUM(amount_btc), 0)").Row().Scan(&totalAmount)
 	return totalAmount
 }
 
+// GetTotalSentToAddress sums what address has been paid or is queued to be
+// paid, failed and cancelled payouts don't count
+func GetTotalSentToAddress(db *gorm.DB, address string) (float64, error) {
+	var total float64
+	err := db.Model(&Transaction{}).
+		Where("address = ? AND status IN ?", address, []string{TxnStatusPending, TxnStatusProcessing, TxnStatusBroadcast}).
+		Select("COALESCE(SUM(amount_btc), 0)").Row().Scan(&total)
+	return total, err
+}
+
+// HasInFlightTransaction reports whether address already has a payout that is
+// queued or being sent
+func HasInFlightTransaction(db *gorm.DB, address string) (bool, error) {
+	var count int64
+	err := db.Model(&Transaction{}).
+		Where("address = ? AND status IN ?", address, []string{TxnStatusPending, TxnStatusProcessing}).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func GetAverageAmountSentBTC(db *gorm.DB) float64 {
+	var avgAmount float64
+	db.Model(&Transaction{}).Where("status = ?", TxnStatusBroadcast).Select("COALESCE(AVG(amount_btc), 0)").Row().Scan(&avgAmount)
+	return avgAmount
+}
+
+func GetTotalFeesPaidBTC(db *gorm.DB) float64 {
+	var totalFees float64
+	db.Model(&Transaction{}).Where("status = ?", TxnStatusBroadcast).Select("COALESCE(SUM(fee_btc), 0)").Row().Scan(&totalFees)
+	return totalFees
+}
+
 func GetTransactions(db *gorm.DB, status string, order string, limit int) ([]Transaction, error) {
 	q := db
 	if status != "" {
@@ -85,7 +317,7 @@ func GetTransactions(db *gorm.DB, status string, order string, limit int) ([]Tra
 
 	var result []Transaction
 	if err := q.Find(&result).Error; err != nil {
-		log.Printf("Failed to query transactions: %v", err)
+		slog.Error("failed to query transactions", "status", status, "err", err)
 		return nil, err
 	}
 
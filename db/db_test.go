@@ -1,6 +1,8 @@
 package db
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,7 +16,7 @@ func setupTestDB(t *testing.T) *gorm.DB {
 	if err != nil {
 		t.Fatalf("failed to open test db: %v", err)
 	}
-	if err := db.AutoMigrate(&Transaction{}, &AdminSession{}); err != nil {
+	if err := Migrate(db); err != nil {
 		t.Fatalf("failed to migrate: %v", err)
 	}
 	return db
@@ -31,7 +33,7 @@ func seedTransactions(t *testing.T, db *gorm.DB, txns []Transaction) {
 
 func TestInitDB(t *testing.T) {
 	dir := t.TempDir()
-	database, err := InitDB(dir)
+	database, err := InitDB(dir, Options{MaxOpenConns: 1, BusyTimeout: time.Second})
 	if err != nil {
 		t.Fatalf("InitDB failed: %v", err)
 	}
@@ -47,8 +49,45 @@ func TestInitDB(t *testing.T) {
 	}
 }
 
+func TestInitDB_ConcurrentWrites(t *testing.T) {
+	for _, opts := range []Options{
+		{MaxOpenConns: 1},
+		{MaxOpenConns: 4, BusyTimeout: 5 * time.Second},
+	} {
+		t.Run(fmt.Sprintf("conns=%d", opts.MaxOpenConns), func(t *testing.T) {
+			database, err := InitDB(t.TempDir(), opts)
+			if err != nil {
+				t.Fatalf("InitDB failed: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 20)
+			for i := range 20 {
+				wg.Go(func() {
+					errs <- database.Transaction(func(tx *gorm.DB) error {
+						return tx.Create(&Transaction{Address: fmt.Sprintf("tb1q%d", i), Status: TxnStatusPending}).Error
+					})
+				})
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				if err != nil {
+					t.Errorf("concurrent write failed: %v", err)
+				}
+			}
+			var count int64
+			database.Model(&Transaction{}).Count(&count)
+			if count != 20 {
+				t.Errorf("expected 20 rows, got %d", count)
+			}
+		})
+	}
+}
+
 func TestInitDB_InvalidPath(t *testing.T) {
-	_, err := InitDB("/dev/null/impossible")
+	_, err := InitDB("/dev/null/impossible", Options{})
 	if err == nil {
 		t.Fatal("expected error for invalid path")
 	}
@@ -106,6 +145,92 @@ func TestGetTotalAmountSentBTC(t *testing.T) {
 	}
 }
 
+func TestGetTotalFeesPaidBTC(t *testing.T) {
+	db := setupTestDB(t)
+
+	if got := GetTotalFeesPaidBTC(db); got != 0 {
+		t.Errorf("expected 0 for empty db, got %f", got)
+	}
+
+	seedTransactions(t, db, []Transaction{
+		{Address: "a1", Status: TxnStatusBroadcast, AmountBTC: 0.5, FeeBTC: 0.00000125},
+		{Address: "a2", Status: TxnStatusBroadcast, AmountBTC: 1.5, FeeBTC: 0.00000375},
+		{Address: "a3", Status: TxnStatusFailed, AmountBTC: 1.0, FeeBTC: 0.001},
+	})
+
+	got := GetTotalFeesPaidBTC(db)
+	want := 0.000005
+	if fmt.Sprintf("%.8f", got) != fmt.Sprintf("%.8f", want) {
+		t.Errorf("GetTotalFeesPaidBTC = %.8f, want %.8f", got, want)
+	}
+}
+
+func TestGetRequestCounts(t *testing.T) {
+	db := setupTestDB(t)
+
+	if got := GetTotalRequestCount(db); got != 0 {
+		t.Errorf("expected 0 for empty db, got %d", got)
+	}
+	if got := GetUniqueAddressCount(db); got != 0 {
+		t.Errorf("expected 0 unique addresses for empty db, got %d", got)
+	}
+
+	seedTransactions(t, db, []Transaction{
+		{Address: "a1", Status: TxnStatusBroadcast, CreatedAt: time.Now().Add(-48 * time.Hour)},
+		{Address: "a1", Status: TxnStatusPending},
+		{Address: "a2", Status: TxnStatusFailed},
+		{Address: "a3", Status: TxnStatusBroadcast, CreatedAt: time.Now().Add(-2 * time.Hour)},
+	})
+
+	if got := GetTotalRequestCount(db); got != 4 {
+		t.Errorf("GetTotalRequestCount = %d, want 4", got)
+	}
+	if got := GetUniqueAddressCount(db); got != 3 {
+		t.Errorf("GetUniqueAddressCount = %d, want 3", got)
+	}
+	if got := GetRequestCountSince(db, time.Now().Add(-24*time.Hour)); got != 3 {
+		t.Errorf("GetRequestCountSince(24h) = %d, want 3", got)
+	}
+}
+
+func TestGetAverageAmountSentBTC(t *testing.T) {
+	db := setupTestDB(t)
+
+	if got := GetAverageAmountSentBTC(db); got != 0 {
+		t.Errorf("expected 0 for empty db, got %f", got)
+	}
+
+	seedTransactions(t, db, []Transaction{
+		{Address: "a1", Status: TxnStatusBroadcast, AmountBTC: 0.5},
+		{Address: "a2", Status: TxnStatusBroadcast, AmountBTC: 1.5},
+		{Address: "a3", Status: TxnStatusPending, AmountBTC: 9.0},
+	})
+
+	if got := GetAverageAmountSentBTC(db); got != 1.0 {
+		t.Errorf("GetAverageAmountSentBTC = %f, want 1.0", got)
+	}
+}
+
+func TestGetOldestPendingCreatedAt(t *testing.T) {
+	db := setupTestDB(t)
+
+	if _, ok := GetOldestPendingCreatedAt(db); ok {
+		t.Error("expected no pending transaction in an empty db")
+	}
+
+	oldest := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	seedTransactions(t, db, []Transaction{
+		{Address: "a1", Status: TxnStatusBroadcast, CreatedAt: oldest.Add(-time.Hour)},
+		{Address: "a2", Status: TxnStatusPending, CreatedAt: oldest.Add(time.Hour)},
+		{Address: "a3", Status: TxnStatusPending, CreatedAt: oldest},
+	})
+
+	got, ok := GetOldestPendingCreatedAt(db)
+	if !ok || !got.Equal(oldest) {
+		t.Errorf("GetOldestPendingCreatedAt = %v, %v, want %v", got, ok, oldest)
+	}
+}
+
 func TestGetTransactions_NoFilter(t *testing.T) {
 	db := setupTestDB(t)
 	seedTransactions(t, db, []Transaction{
@@ -295,3 +420,223 @@ func TestTransaction_AddressQuery(t *testing.T) {
 		t.Errorf("expected 2 transactions for address tb1qaddr1, got %d", count)
 	}
 }
+
+func TestTransaction_FundingInputList(t *testing.T) {
+	tx := Transaction{FundingInputs: `[{"txid":"aaa","vout":1},{"txid":"bbb","vout":0}]`}
+	inputs := tx.FundingInputList()
+	if len(inputs) != 2 {
+		t.Fatalf("expected 2 inputs, got %d", len(inputs))
+	}
+	if inputs[0].TxID != "aaa" || inputs[0].Vout != 1 {
+		t.Errorf("unexpected first input: %+v", inputs[0])
+	}
+
+	if (Transaction{}).FundingInputList() != nil {
+		t.Error("expected nil inputs for empty column")
+	}
+	if (Transaction{FundingInputs: "garbage"}).FundingInputList() != nil {
+		t.Error("expected nil inputs for invalid json")
+	}
+}
+
+func TestSaveSettings_Upsert(t *testing.T) {
+	db := setupTestDB(t)
+
+	settings, err := GetSettings(db)
+	if err != nil {
+		t.Fatalf("GetSettings: %v", err)
+	}
+	if len(settings) != 0 {
+		t.Errorf("expected no settings, got %v", settings)
+	}
+
+	if err := SaveSettings(db, map[string]string{"min_balance": "0.5", "default_amount_range": "2"}); err != nil {
+		t.Fatalf("SaveSettings: %v", err)
+	}
+	if err := SaveSettings(db, map[string]string{"min_balance": "1"}); err != nil {
+		t.Fatalf("SaveSettings: %v", err)
+	}
+
+	settings, err = GetSettings(db)
+	if err != nil {
+		t.Fatalf("GetSettings: %v", err)
+	}
+	if len(settings) != 2 || settings["min_balance"] != "1" || settings["default_amount_range"] != "2" {
+		t.Errorf("unexpected settings: %v", settings)
+	}
+}
+
+func TestGetAuditLogs_Paginated(t *testing.T) {
+	db := setupTestDB(t)
+
+	for _, action := range []string{"login", "send", "drain", "logout", "login"} {
+		if err := db.Create(&AuditLog{Action: action, Outcome: AuditOutcomeSuccess}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logs, total, err := GetAuditLogs(db, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 || len(logs) != 2 {
+		t.Fatalf("expected 2 of 5 entries, got %d of %d", len(logs), total)
+	}
+	if logs[0].ID != 5 || logs[1].ID != 4 {
+		t.Errorf("expected newest first, got ids %d, %d", logs[0].ID, logs[1].ID)
+	}
+
+	logs, _, err = GetAuditLogs(db, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].ID != 1 {
+		t.Errorf("expected the oldest entry on the last page, got %+v", logs)
+	}
+}
+
+func TestBalanceSnapshots(t *testing.T) {
+	db := setupTestDB(t)
+
+	now := time.Now()
+	for _, age := range []time.Duration{48 * time.Hour, 2 * time.Hour, time.Hour} {
+		if err := db.Create(&BalanceSnapshot{CreatedAt: now.Add(-age), Trusted: age.Hours()}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := GetBalanceSnapshots(db, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Trusted != 2 || snapshots[1].Trusted != 1 {
+		t.Errorf("expected the last day oldest first, got %+v", snapshots)
+	}
+
+	deleted, err := DeleteBalanceSnapshotsBefore(db, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 deleted, got %d", deleted)
+	}
+
+	var count int64
+	db.Model(&BalanceSnapshot{}).Count(&count)
+	if count != 2 {
+		t.Errorf("expected 2 left, got %d", count)
+	}
+}
+
+func TestGetTotalSentToAddress(t *testing.T) {
+	db := setupTestDB(t)
+	seedTransactions(t, db, []Transaction{
+		{Address: "addr1", AmountBTC: 0.1, Status: TxnStatusBroadcast},
+		{Address: "addr1", AmountBTC: 0.2, Status: TxnStatusPending},
+		{Address: "addr1", AmountBTC: 0.4, Status: TxnStatusProcessing},
+		{Address: "addr1", AmountBTC: 1.0, Status: TxnStatusFailed},
+		{Address: "addr1", AmountBTC: 1.0, Status: TxnStatusCancelled},
+		{Address: "addr2", AmountBTC: 5.0, Status: TxnStatusBroadcast},
+	})
+
+	total, err := GetTotalSentToAddress(db, "addr1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total < 0.69999999 || total > 0.70000001 {
+		t.Errorf("expected 0.7, got %f", total)
+	}
+
+	if total, _ := GetTotalSentToAddress(db, "unknown"); total != 0 {
+		t.Errorf("expected 0 for an unknown address, got %f", total)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := setupTestDB(t)
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := migrations[len(migrations)-1].version; version != want {
+		t.Errorf("expected schema version %d, got %d", want, version)
+	}
+
+	// running again applies nothing
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var applied int64
+	db.Model(&SchemaMigration{}).Count(&applied)
+	if applied != int64(len(migrations)) {
+		t.Errorf("expected %d recorded migrations, got %d", len(migrations), applied)
+	}
+}
+
+func TestMigrate_ExistingDatabase(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a database created before migrations existed
+	if err := db.AutoMigrate(&Transaction{}, &AdminSession{}, &Setting{}, &AuditLog{}, &BalanceSnapshot{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&Transaction{Address: "tb1qexisting", Status: TxnStatusBroadcast})
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Model(&Transaction{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected existing rows to be kept, got %d", count)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	db := setupTestDB(t)
+
+	if err := MigrateDown(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasColumn(&Transaction{}, "ProcessingAt") {
+		t.Error("expected processing_at to be dropped")
+	}
+	if db.Migrator().HasColumn(&Transaction{}, "Priority") {
+		t.Error("expected priority to be dropped")
+	}
+	if db.Migrator().HasColumn(&Transaction{}, "RawTx") {
+		t.Error("expected raw_tx to be dropped")
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Migrator().HasColumn(&Transaction{}, "ProcessingAt") {
+		t.Error("expected processing_at to be added back")
+	}
+	if !db.Migrator().HasColumn(&Transaction{}, "Priority") || !db.Migrator().HasIndex(&Transaction{}, "Priority") {
+		t.Error("expected priority and its index to be added back")
+	}
+	if !db.Migrator().HasColumn(&Transaction{}, "RawTx") {
+		t.Error("expected raw_tx to be added back")
+	}
+
+	if err := MigrateDown(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := SchemaVersion(db); version != 0 {
+		t.Errorf("expected version 0, got %d", version)
+	}
+	if db.Migrator().HasTable(&Transaction{}) {
+		t.Error("expected transactions table to be dropped")
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Migrator().HasTable(&Transaction{}) {
+		t.Error("expected transactions table to be recreated")
+	}
+}
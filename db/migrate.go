@@ -0,0 +1,165 @@
+package db
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaMigration records a migration that has been applied
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// migrations run in version order, each in its own transaction together with
+// its schema_migrations row. Never edit one that has shipped, add a new one
+// instead. A later migration that changes a model must not rely on the model
+// struct as it is by then, migration 1 already creates tables from the current
+// structs on a fresh database, so check with the Migrator before adding or
+// dropping columns and indexes.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		// the schema AutoMigrate used to create on every start, on an
+		// existing database this only records the version
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Transaction{}, &AdminSession{}, &Setting{}, &AuditLog{}, &BalanceSnapshot{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&Transaction{}, &AdminSession{}, &Setting{}, &AuditLog{}, &BalanceSnapshot{})
+		},
+	},
+	{
+		version: 2,
+		name:    "transactions processing_at",
+		up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&Transaction{}, "ProcessingAt") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&Transaction{}, "ProcessingAt")
+		},
+		down: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&Transaction{}, "ProcessingAt") {
+				return nil
+			}
+			return tx.Migrator().DropColumn(&Transaction{}, "ProcessingAt")
+		},
+	},
+	{
+		version: 3,
+		name:    "transactions priority",
+		up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&Transaction{}, "Priority") {
+				if err := tx.Migrator().AddColumn(&Transaction{}, "Priority"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&Transaction{}, "Priority") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&Transaction{}, "Priority")
+		},
+		down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasIndex(&Transaction{}, "Priority") {
+				if err := tx.Migrator().DropIndex(&Transaction{}, "Priority"); err != nil {
+					return err
+				}
+			}
+			if !tx.Migrator().HasColumn(&Transaction{}, "Priority") {
+				return nil
+			}
+			return tx.Migrator().DropColumn(&Transaction{}, "Priority")
+		},
+	},
+	{
+		version: 4,
+		name:    "transactions raw_tx",
+		up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&Transaction{}, "RawTx") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&Transaction{}, "RawTx")
+		},
+		down: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&Transaction{}, "RawTx") {
+				return nil
+			}
+			return tx.Migrator().DropColumn(&Transaction{}, "RawTx")
+		},
+	},
+}
+
+// SchemaVersion returns the latest applied migration, 0 for a new database
+func SchemaVersion(db *gorm.DB) (int, error) {
+	var version int
+	err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// Migrate applies every migration newer than the database's schema version
+func Migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		slog.Info("applied database migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
+
+// MigrateDown reverts applied migrations, newest first, until the schema is
+// at version
+func MigrateDown(db *gorm.DB, version int) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= version || m.version > current {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		slog.Info("reverted database migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
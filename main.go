@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -15,6 +17,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/lnliz/faucet.coinbin.org/btc"
 	"github.com/lnliz/faucet.coinbin.org/db"
 	"github.com/lnliz/faucet.coinbin.org/service"
 )
@@ -30,68 +33,327 @@ func (s *stringSlice) Set(value string) error {
 	return nil
 }
 
-func getEnvOrFlag(flagVal, envName string) string {
-	if flagVal != "" {
-		return flagVal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// runCheck is -check, it prints what the faucet sees of bitcoind and returns
+// the exit code
+func runCheck(cfg *service.Config) int {
+	fmt.Printf("bitcoind:   %s (wallet %s)\n", cfg.BitcoinRPC.Host, cfg.BitcoinCoreWalletName)
+
+	status, err := service.NewService(cfg, nil).CheckBitcoinConnection(context.Background())
+	if status != nil {
+		fmt.Printf("chain:      %s\n", status.Chain)
+		fmt.Printf("blocks:     %d (headers %d)\n", status.Blocks, status.Headers)
+		fmt.Printf("sync:       %.2f%%\n", status.VerificationProgress*100)
+	}
+	if err != nil {
+		fmt.Printf("FAILED:     %v\n", err)
+		return 1
 	}
-	return os.Getenv(envName)
+	fmt.Printf("balance:    %.8f BTC (%.8f unconfirmed, %.8f immature)\n", status.Balance.Trusted, status.Balance.Untrusted, status.Balance.Immature)
+	fmt.Printf("utxos:      %d\n", status.UTXOs)
+	if status.VerificationProgress < cfg.MinSyncProgress || (cfg.MaxBlockLag > 0 && status.Headers-status.Blocks > cfg.MaxBlockLag) {
+		fmt.Println("WARNING:    node is not caught up, payouts are skipped until it is")
+	}
+	fmt.Println("OK")
+	return 0
 }
 
 func main() {
 	var cfg service.Config
 	var adminAllowlistIP stringSlice
 	var adminAllowlistCIDR stringSlice
+	var noOpReturnAddresses stringSlice
+	var apiKeysStr string
+	var apiKeysFile string
 	var enabledAmountRangesStr string
+	var trustedProxiesStr string
 	var batchIntervalStr string
+	var payoutBreakerCooldownStr string
 	var autoConsolidationIntervalStr string
-
+	var minFormFillTimeStr string
+	var maxFormAgeStr string
+	var broadcastExpiryStr string
+	var staleProcessingTimeoutStr string
+	var balanceRefreshIntervalStr string
+	var keypoolRefillIntervalStr string
+	var insufficientFundsBackoffStr string
+	var shutdownTimeoutStr string
+	var httpReadTimeoutStr string
+	var httpWriteTimeoutStr string
+	var dbOpts db.Options
+	var dbBusyTimeoutStr string
+	var balanceHistoryRetentionStr string
+	var rpcTLS bool
+	var rpcTLSCAFile string
+	var rpcTLSSkipVerify bool
+	var logFormat string
+	var logLevel string
+	var configFile string
+	var checkOnly bool
+
+	flag.StringVar(&configFile, "config", "", "JSON or YAML file (.yaml/.yml) with flag values keyed by flag name, e.g. batch-interval: 5m. Flags win over FAUCET_* environment variables, which win over the file")
+	flag.BoolVar(&checkOnly, "check", false, "Check the bitcoind connection and wallet, print their status and exit (1 on failure), uses the same flags as a normal start")
 	flag.StringVar(&cfg.ListenAddr, "listen", ":8080", "HTTP server listen address")
+	flag.StringVar(&httpReadTimeoutStr, "http-read-timeout", "15s", "How long the HTTP server waits for a whole request, body included (0 = no limit)")
+	flag.StringVar(&httpWriteTimeoutStr, "http-write-timeout", "60s", "How long a response may take from the end of the request headers, the live payout feed is exempt (0 = no limit)")
+	flag.Int64Var(&cfg.MaxRequestBodyBytes, "max-request-body", 64<<10, "Largest JSON request body accepted by the API and admin endpoints, in bytes")
 	flag.StringVar(&cfg.MetricsAddr, "metrics-addr", "0.0.0.0:9222", "Metrics server listen address")
+	flag.StringVar(&cfg.MetricsAuthToken, "metrics-auth-token", "", "Require this token on /metrics, as \"Authorization: Bearer <token>\" or the basic auth password (empty = no auth)")
 	flag.StringVar(&cfg.DataDir, "data-dir", "./data", "Directory for data files (database, etc)")
-
-	flag.StringVar(&cfg.BitcoinRPC.Host, "bitcoin-rpc-host", "localhost:38332", "Bitcoin Signet RPC host")
+	flag.IntVar(&dbOpts.MaxOpenConns, "db-max-open-conns", 1, "Maximum open database connections, SQLite takes one writer at a time so more only help with -db-busy-timeout set (0 = unlimited)")
+	flag.StringVar(&dbBusyTimeoutStr, "db-busy-timeout", "5s", "How long a database write waits for a lock held by another connection before failing (0 = fail right away)")
+	flag.BoolVar(&cfg.DevTemplates, "dev-templates", false, "Re-parse html templates on every request (local development)")
+	flag.StringVar(&logFormat, "log-format", service.LogFormatText, "Log output format (text, json)")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum log level (debug, info, warn, error)")
+	flag.StringVar(&shutdownTimeoutStr, "shutdown-timeout", "30s", "How long to wait for in-flight requests and the current batch send on shutdown")
+
+	flag.StringVar(&cfg.Network, "network", btc.NetworkSignet, "Bitcoin network (signet, testnet, regtest)")
+	flag.StringVar(&cfg.BitcoinRPC.Host, "bitcoin-rpc-host", "localhost:38332", "Bitcoin RPC host")
 	flag.StringVar(&cfg.BitcoinRPC.User, "bitcoin-rpc-user", "", "Bitcoin RPC username")
 	flag.StringVar(&cfg.BitcoinRPC.Password, "bitcoin-rpc-password", "", "Bitcoin RPC password")
+	flag.BoolVar(&rpcTLS, "bitcoin-rpc-tls", false, "Connect to Bitcoin RPC over https (e.g. bitcoind behind stunnel)")
+	flag.StringVar(&rpcTLSCAFile, "bitcoin-rpc-tls-ca", "", "PEM CA bundle to verify the Bitcoin RPC certificate (default: system roots)")
+	flag.BoolVar(&rpcTLSSkipVerify, "bitcoin-rpc-tls-skip-verify", false, "Don't verify the Bitcoin RPC certificate (self-signed certs only, insecure)")
+	flag.StringVar(&cfg.BitcoinRPC.WalletPassphrase, "wallet-passphrase", "", "Passphrase to unlock an encrypted wallet before signing")
 	flag.StringVar(&cfg.BitcoinCoreWalletName, "bitcoin-wallet-name", "faucet", "Bitcoin wallet name, will be loaded at start")
+	flag.BoolVar(&cfg.CreateWallet, "create-wallet", false, "Create the wallet (descriptor, with private keys) if it doesn't exist yet")
+	flag.StringVar(&cfg.AddressLabelTemplate, "address-label-template", service.DefaultAddressLabelTemplate, "Wallet label for addresses the faucet generates, {purpose} (deposit, consolidation, donation), {date} and {time} are filled in (empty = no label)")
+	flag.StringVar(&cfg.UnavailableMessage, "unavailable-message", service.DefaultUnavailableMessage, "Banner shown on the page while the node is behind, the wallet is low or payouts are paused")
+	flag.StringVar(&cfg.DonationAddress, "donation-address", "", "Refill address shown on the public page (default: generate one from the wallet once and keep it)")
 
 	flag.StringVar(&batchIntervalStr, "batch-interval", "1m", "Batch processing interval (e.g., 1m, 5m, 30s)")
+	flag.IntVar(&cfg.BatchSize, "batch-size", 50, "Most pending payouts picked up per batch run")
+	flag.StringVar(&cfg.BatchOrder, "batch-order", service.BatchOrderFIFO, "Order pending payouts are picked up in: fifo, smallest-first or largest-first")
+	flag.IntVar(&cfg.BatchFlushThreshold, "batch-flush-threshold", 0, "Run a batch right away once this many payouts are pending instead of waiting for the next -batch-interval tick (0 = disabled)")
+	flag.IntVar(&cfg.BatchConcurrency, "batch-concurrency", 1, "Number of batch transactions sent in parallel")
+	flag.IntVar(&cfg.BatchMaxOutputs, "batch-max-outputs", 10, "Maximum payouts combined into one multi-output transaction (1 = one transaction per payout)")
+	flag.IntVar(&cfg.PayoutBreakerThreshold, "payout-breaker-threshold", 5, "Consecutive send failures the node is to blame for (unreachable, timing out, not ready) that pause payouts (0 = disabled)")
+	flag.StringVar(&payoutBreakerCooldownStr, "payout-breaker-cooldown", "5m", "How long payouts stay paused before a health check may resume them")
+	flag.Float64Var(&cfg.MinSyncProgress, "min-sync-progress", 0.9999, "Skip payouts while the node's verification progress is below this (0-1, 0 = disabled)")
+	flag.Int64Var(&cfg.MaxBlockLag, "max-block-lag", 2, "Skip payouts while the node has more headers than validated blocks by this many (0 = disabled)")
+	flag.StringVar(&cfg.OpReturn, "op-return", service.DefaultOpReturn, "OP_RETURN data attached to payouts and consolidations (empty = none, user messages are still sent)")
+	flag.Var(&noOpReturnAddresses, "no-op-return-address", "Destination address that gets payouts without any OP_RETURN, a trailing * matches a prefix (can be specified multiple times)")
+	flag.StringVar(&broadcastExpiryStr, "broadcast-expiry", "6h", "Mark payouts expired when their transaction is unconfirmed and gone from the mempool this long after the request (0 = disabled)")
+	flag.StringVar(&staleProcessingTimeoutStr, "stale-processing-timeout", "15m", "Put payouts back in the queue that have been processing this long without a txid (0 = disabled)")
+	flag.StringVar(&balanceRefreshIntervalStr, "balance-refresh-interval", "5m", "How often the wallet balance shown on the public page is refreshed")
+	flag.BoolVar(&cfg.StoreRawTx, "store-raw-tx", true, "Keep the signed transaction of every payout in the database, needed for /admin/rebroadcast (a few hundred bytes per payout)")
+	flag.IntVar(&cfg.InsufficientFundsRetries, "insufficient-funds-retries", 3, "Times a payout the wallet can't fund is put back in the queue before it is marked failed (0 = fail right away)")
+	flag.StringVar(&insufficientFundsBackoffStr, "insufficient-funds-backoff", "5m", "Wait before the first retry of a payout the wallet couldn't fund, doubles with every retry up to 24h")
+	flag.BoolVar(&cfg.PartialBatch, "partial-batch", service.DefaultPartialBatch, "Pay out as much of a batch as the balance covers (in -batch-order) instead of skipping the whole batch, false = all or nothing")
 	flag.StringVar(&enabledAmountRangesStr, "enabled-amount-ranges", "1,2,3", "Comma-separated amount ranges to enable (1=0.001-0.009, 2=0.01-0.09, 3=0.1-0.9, 4=1.0-2.0)")
+	flag.StringVar(&cfg.AmountMode, "amount-mode", service.AmountModeFixed, "How payout amounts are picked: fixed-range (random in range) or balance-scaled (range shrinks as the wallet drains)")
+	flag.StringVar(&cfg.AmountDistribution, "amount-distribution", service.AmountDistributionUniform, "How random payout amounts spread over the range: uniform, triangular or exponential (the last two favor small amounts)")
+	flag.Float64Var(&cfg.AmountTargetBalance, "amount-target-balance", 10, "Wallet balance (BTC) at or above which balance-scaled mode pays from the full range")
 	flag.IntVar(&cfg.DefaultAmountRange, "default-amount-range", 2, "Default selected amount range (1-4)")
-	flag.Float64Var(&cfg.MinBalance, "min-balance", 0.1, "Minimum wallet balance threshold (BTC)")
+	flag.Float64Var(&cfg.DepositAlertThreshold, "deposit-alert-threshold", 0.01, "Log and count a deposit when the wallet grows by at least this much BTC between balance refreshes (0 = disabled)")
+	flag.StringVar(&cfg.DepositWebhookURL, "deposit-webhook-url", "", "URL that gets a JSON POST for every detected deposit (optional)")
+	flag.StringVar(&balanceHistoryRetentionStr, "balance-history-retention", "2160h", "How long wallet balance snapshots are kept for /admin/balance-history (0 = forever)")
+	flag.Float64Var(&cfg.MinBalance, "min-balance", 0.1, "Wallet balance (BTC) batch and fast lane payouts stop at, also the low balance alert threshold. Admin sends and drains can still go below it")
+	flag.IntVar(&cfg.MinSpendConfirmations, "min-spend-confirmations", 1, "Confirmations a UTXO needs before it counts towards the spendable balance (0 = include unconfirmed change)")
+	flag.Float64Var(&cfg.ReserveBalance, "reserve-balance", 0, "Wallet balance (BTC) batches never pay out, kept for fees and manual sends")
 	flag.Float64Var(&cfg.ConsolidationAmountThresholdBTC, "consolidation-amount-threshold", 0.001, "UTXO consolidation threshold (BTC) - UTXOs smaller than this will be consolidated")
 	flag.IntVar(&cfg.MaxConsolidationUTXOs, "consolidation-max-utxos", 5, "Maximum number of UTXOs to consolidate in a single transaction")
 	flag.IntVar(&cfg.MinConsolidationUTXOs, "consolidation-min-utxos", 2, "Minimum number of UTXOs required before consolidation runs")
+	flag.Float64Var(&cfg.ConsolidationFeeRate, "consolidation-fee-rate", 0, "Consolidation fee rate in sat/vB (0 = use estimatesmartfee)")
+	flag.IntVar(&cfg.ConsolidationMinConfirmations, "consolidation-min-confirmations", 1, "Minimum confirmations a UTXO needs before it is consolidated")
+	flag.StringVar(&cfg.ConsolidationTargetAddress, "consolidation-target-address", "", "Consolidate into this wallet address (default: a new address for every consolidation)")
 	flag.StringVar(&autoConsolidationIntervalStr, "auto-consolidation-interval", "", "Auto-consolidation interval (e.g., 5m, 1h) - disabled by default")
+	flag.StringVar(&keypoolRefillIntervalStr, "keypool-refill-interval", "1h", "How often to top up the wallet keypool with keypoolrefill (0 = disabled)")
+	flag.IntVar(&cfg.KeypoolRefillSize, "keypool-refill-size", 0, "Keys to keep in the wallet keypool (0 = bitcoind's -keypool setting)")
 
 	flag.IntVar(&cfg.MaxWithdrawalsPerIP24h, "max-withdrawals-per-ip-24h", 2, "Maximum number of withdrawals per IP per 24h")
+	flag.IntVar(&cfg.RateLimitIPv4Prefix, "rate-limit-ipv4-prefix", 32, "IPv4 prefix length withdrawals are counted on (e.g. 24 to limit per /24)")
+	flag.IntVar(&cfg.RateLimitIPv6Prefix, "rate-limit-ipv6-prefix", 64, "IPv6 prefix length withdrawals are counted on")
 	flag.IntVar(&cfg.MaxDepositsPerAddress, "max-deposits-per-address", 5, "Maximum number of deposits per address")
-
-	flag.StringVar(&cfg.TurnstileSecret, "turnstile-secret", "", "Cloudflare Turnstile secret key (optional)")
-	flag.StringVar(&cfg.TurnstileSiteKey, "turnstile-site-key", "", "Cloudflare Turnstile site key (optional)")
+	flag.Float64Var(&cfg.MaxLifetimePerAddress, "max-lifetime-per-address", 0, "Maximum total BTC a single address can ever receive (0 = unlimited)")
+	flag.StringVar(&cfg.AddressDenylistFile, "address-denylist", "", "File with addresses that are refused, one per line (reloaded on SIGHUP)")
+	flag.StringVar(&cfg.AddressAllowlistFile, "address-allowlist", "", "File with the only addresses that are accepted, one per line (reloaded on SIGHUP)")
+	flag.IntVar(&cfg.RecentPayoutsMax, "recent-payouts-max", 50, "Most payouts /api/recent returns, also enables the /api/recent/stream live feed (0 = disabled)")
+	flag.IntVar(&cfg.MaxQueueDepth, "max-queue-depth", 1000, "Reject new requests with 503 once this many are pending (0 = unlimited)")
+
+	flag.StringVar(&cfg.CaptchaProvider, "captcha-provider", service.CaptchaProviderTurnstile, "Captcha shown on the request form: turnstile or hcaptcha")
+	flag.StringVar(&cfg.CaptchaSecret, "captcha-secret", "", "Captcha secret key, enables the captcha (optional)")
+	flag.StringVar(&cfg.CaptchaSiteKey, "captcha-site-key", "", "Captcha site key (optional)")
+	flag.StringVar(&cfg.CaptchaExpectedHostname, "captcha-expected-hostname", "", "Reject captcha tokens solved on any other hostname (e.g. faucet.coinbin.org)")
+	flag.StringVar(&cfg.TurnstileExpectedAction, "turnstile-expected-action", "", "Turnstile widget action, set on the widget and required on every token (optional)")
+	// names from before hCaptcha support
+	flag.StringVar(&cfg.CaptchaSecret, "turnstile-secret", "", "Deprecated, use -captcha-secret")
+	flag.StringVar(&cfg.CaptchaSiteKey, "turnstile-site-key", "", "Deprecated, use -captcha-site-key")
+	flag.StringVar(&cfg.CaptchaExpectedHostname, "turnstile-expected-hostname", "", "Deprecated, use -captcha-expected-hostname")
+	flag.BoolVar(&cfg.BotCheck, "bot-check", false, "Reject submissions that fill a hidden honeypot field or come in faster than -min-form-fill-time after page load")
+	flag.BoolVar(&cfg.FastLane, "fast-lane", false, "Send requests from admin IPs or with a valid API key immediately, without OP_RETURN, instead of queueing them for the batch")
+	flag.StringVar(&apiKeysStr, "api-keys", "", "Comma-separated API keys (name:key or key) accepted as \"Authorization: Bearer <key>\" on /api/submit, skipping the captcha")
+	flag.StringVar(&apiKeysFile, "api-keys-file", "", "File with API keys, one per line (name:key or key)")
+	flag.IntVar(&cfg.APIKeyMaxWithdrawals24h, "api-key-max-withdrawals-24h", 20, "Maximum number of withdrawals per API key per 24h")
+	flag.StringVar(&minFormFillTimeStr, "min-form-fill-time", "3s", "Minimum time between page load and submit when -bot-check is enabled")
+	flag.StringVar(&maxFormAgeStr, "max-form-age", "1h", "Maximum time between page load and submit when -bot-check is enabled (0 = no limit)")
 
 	flag.StringVar(&cfg.AdminPassword, "admin-password", "", "Admin dashboard password (required)")
 	flag.StringVar(&cfg.AdminPath, "admin-path", "", "Admin dashboard URL path (default: /admin)")
+	flag.StringVar(&cfg.BasePath, "base-path", "", "URL prefix the faucet is served under behind a reverse proxy, e.g. /faucet (default: served at /)")
 	flag.StringVar(&cfg.AdminCookieSecret, "admin-cookie-secret", "", "Admin cookie signing secret (required, 32+ chars)")
-	flag.StringVar(&cfg.Admin2FASecret, "admin-2fa-secret", "", "Admin 2FA TOTP secret (optional, base32 encoded)")
+	flag.StringVar(&cfg.Admin2FASecret, "admin-2fa-secret", "", "Admin 2FA TOTP secret (optional, base32 encoded, a secret rotated from the dashboard takes precedence)")
+	flag.IntVar(&cfg.AdminSessionHours, "admin-session-hours", 4, "Admin session idle timeout in hours, extended on each authenticated request")
+	flag.IntVar(&cfg.AdminSessionMaxHours, "admin-session-max-hours", 24, "Admin session absolute maximum lifetime in hours")
+	flag.IntVar(&cfg.AdminLoginRateLimit, "admin-login-rate-limit", 20, "Requests per minute one IP may make to the admin login page, GET and POST together (0 = unlimited)")
 	flag.Var(&adminAllowlistIP, "admin-ip", "Allowed IP for admin access (can be specified multiple times, default: 127.0.0.1)")
 	flag.Var(&adminAllowlistCIDR, "admin-cidr", "Allowed CIDR for admin access (e.g. 192.168.1.0/24, can be specified multiple times)")
+	flag.StringVar(&trustedProxiesStr, "trusted-proxies", "127.0.0.1/32,::1/128", "Comma-separated proxy IPs/CIDRs whose CF-Connecting-IP, X-Forwarded-For and X-Real-IP headers are trusted")
 
 	flag.Parse()
 
-	cfg.BitcoinRPC.User = getEnvOrFlag(cfg.BitcoinRPC.User, "FAUCET_BITCOIN_RPC_USER")
-	cfg.BitcoinRPC.Password = getEnvOrFlag(cfg.BitcoinRPC.Password, "FAUCET_BITCOIN_RPC_PASSWORD")
-	cfg.TurnstileSecret = getEnvOrFlag(cfg.TurnstileSecret, "FAUCET_TURNSTILE_SECRET")
-	cfg.TurnstileSiteKey = getEnvOrFlag(cfg.TurnstileSiteKey, "FAUCET_TURNSTILE_SITE_KEY")
-	cfg.AdminPassword = getEnvOrFlag(cfg.AdminPassword, "FAUCET_ADMIN_PASSWORD")
-	cfg.AdminPath = getEnvOrFlag(cfg.AdminPath, "FAUCET_ADMIN_PATH")
+	if err := applyConfigSources(flag.CommandLine, configFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	logger, err := service.NewLogger(os.Stderr, logFormat, logLevel)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	slog.SetDefault(logger)
+
 	if cfg.AdminPath == "" {
 		cfg.AdminPath = "/admin"
 	}
-	cfg.AdminCookieSecret = getEnvOrFlag(cfg.AdminCookieSecret, "FAUCET_ADMIN_COOKIE_SECRET")
-	cfg.Admin2FASecret = getEnvOrFlag(cfg.Admin2FASecret, "FAUCET_ADMIN_2FA_SECRET")
+	cfg.BasePath = strings.TrimSuffix(cfg.BasePath, "/")
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		cfg.BasePath = "/" + cfg.BasePath
+	}
+	for k := range strings.SplitSeq(apiKeysStr, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			cfg.APIKeys = append(cfg.APIKeys, service.ParseAPIKey(k))
+		}
+	}
+	if apiKeysFile != "" {
+		keys, err := service.ReadAPIKeysFile(apiKeysFile)
+		if err != nil {
+			fatal("failed to read -api-keys-file", "err", err)
+		}
+		cfg.APIKeys = append(cfg.APIKeys, keys...)
+	}
+
+	if !slices.Contains(btc.Networks, cfg.Network) {
+		fatal("invalid -network value", "network", cfg.Network, "allowed", strings.Join(btc.Networks, ", "))
+	}
 
 	if cfg.MinConsolidationUTXOs > cfg.MaxConsolidationUTXOs {
-		log.Fatalf("invalid consolidation cfg, min: %d > max: %d", cfg.MinConsolidationUTXOs, cfg.MaxConsolidationUTXOs)
+		fatal("invalid consolidation cfg, min > max", "min", cfg.MinConsolidationUTXOs, "max", cfg.MaxConsolidationUTXOs)
+	}
+
+	if cfg.RateLimitIPv4Prefix < 0 || cfg.RateLimitIPv4Prefix > 32 {
+		fatal("-rate-limit-ipv4-prefix must be between 0 and 32", "value", cfg.RateLimitIPv4Prefix)
+	}
+	if cfg.RateLimitIPv6Prefix < 0 || cfg.RateLimitIPv6Prefix > 128 {
+		fatal("-rate-limit-ipv6-prefix must be between 0 and 128", "value", cfg.RateLimitIPv6Prefix)
+	}
+
+	if cfg.MaxLifetimePerAddress < 0 {
+		fatal("-max-lifetime-per-address can't be negative")
+	}
+
+	if cfg.ReserveBalance < 0 {
+		fatal("-reserve-balance can't be negative")
+	}
+
+	if cfg.MinSpendConfirmations < 0 {
+		fatal("-min-spend-confirmations can't be negative")
+	}
+
+	if cfg.ConsolidationFeeRate < 0 {
+		fatal("-consolidation-fee-rate can't be negative")
+	}
+
+	if cfg.ConsolidationMinConfirmations < 0 {
+		fatal("-consolidation-min-confirmations can't be negative")
+	}
+
+	if cfg.ConsolidationTargetAddress != "" {
+		if err := btc.ValidateAddress(cfg.ConsolidationTargetAddress, cfg.Network); err != nil {
+			fatal("invalid -consolidation-target-address", "address", cfg.ConsolidationTargetAddress, "err", err)
+		}
+	}
+
+	if cfg.RecentPayoutsMax < 0 {
+		fatal("-recent-payouts-max can't be negative")
+	}
+
+	if cfg.BatchSize < 1 {
+		fatal("-batch-size must be at least 1")
+	}
+
+	switch cfg.CaptchaProvider {
+	case service.CaptchaProviderTurnstile:
+	case service.CaptchaProviderHCaptcha:
+		if cfg.TurnstileExpectedAction != "" {
+			fatal("-turnstile-expected-action only works with -captcha-provider=turnstile")
+		}
+	default:
+		fatal("invalid -captcha-provider", "value", cfg.CaptchaProvider)
+	}
+
+	switch cfg.BatchOrder {
+	case service.BatchOrderFIFO, service.BatchOrderSmallestFirst, service.BatchOrderLargestFirst:
+	default:
+		fatal("invalid -batch-order", "value", cfg.BatchOrder)
+	}
+
+	if cfg.BatchFlushThreshold < 0 {
+		fatal("-batch-flush-threshold can't be negative")
+	}
+
+	if cfg.BatchConcurrency < 1 {
+		fatal("-batch-concurrency must be at least 1")
+	}
+
+	if cfg.BatchMaxOutputs < 1 {
+		fatal("-batch-max-outputs must be at least 1")
+	}
+
+	if len(cfg.OpReturn) > btc.MaxOpReturnBytes {
+		fatal("-op-return is too long", "length", len(cfg.OpReturn), "max", btc.MaxOpReturnBytes)
+	}
+	for _, address := range noOpReturnAddresses {
+		if strings.TrimSpace(strings.TrimSuffix(address, "*")) == "" {
+			fatal("invalid -no-op-return-address value", "value", address)
+		}
+		cfg.NoOpReturnAddresses = append(cfg.NoOpReturnAddresses, address)
+	}
+
+	if cfg.MaxQueueDepth < 0 {
+		fatal("-max-queue-depth can't be negative")
+	}
+
+	if cfg.APIKeyMaxWithdrawals24h < 0 {
+		fatal("-api-key-max-withdrawals-24h can't be negative")
+	}
+
+	if cfg.PayoutBreakerThreshold < 0 {
+		fatal("-payout-breaker-threshold can't be negative")
+	}
+
+	if cfg.DepositAlertThreshold < 0 {
+		fatal("-deposit-alert-threshold can't be negative")
+	}
+
+	if cfg.MinSyncProgress < 0 || cfg.MinSyncProgress > 1 {
+		fatal("-min-sync-progress must be between 0 and 1", "value", cfg.MinSyncProgress)
+	}
+	if cfg.MaxBlockLag < 0 {
+		fatal("-max-block-lag can't be negative")
+	}
+
+	if cfg.AdminSessionHours < 1 {
+		fatal("-admin-session-hours must be at least 1")
+	}
+	if cfg.AdminSessionMaxHours < cfg.AdminSessionHours {
+		fatal("invalid admin session cfg, max < idle", "max", cfg.AdminSessionMaxHours, "idle", cfg.AdminSessionHours)
+	}
+	if cfg.AdminLoginRateLimit < 0 {
+		fatal("-admin-login-rate-limit can't be negative")
 	}
 
 	if len(adminAllowlistIP) == 0 && len(adminAllowlistCIDR) == 0 {
@@ -100,18 +362,37 @@ func main() {
 	for _, ip := range adminAllowlistIP {
 		_, ipNet, err := net.ParseCIDR(ip + "/32")
 		if err != nil {
-			log.Fatalf("Error: invalid -admin-ip value: %s (%v)", ip, err)
+			fatal("invalid -admin-ip value", "value", ip, "err", err)
 		}
 		cfg.AdminAllowlist = append(cfg.AdminAllowlist, *ipNet)
 	}
 	for _, cidr := range adminAllowlistCIDR {
 		_, ipNet, err := net.ParseCIDR(cidr)
 		if err != nil {
-			log.Fatalf("Error: invalid -admin-cidr value: %s (%v)", cidr, err)
+			fatal("invalid -admin-cidr value", "value", cidr, "err", err)
 		}
 		cfg.AdminAllowlist = append(cfg.AdminAllowlist, *ipNet)
 	}
 
+	for p := range strings.SplitSeq(trustedProxiesStr, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			fatal("invalid -trusted-proxies value", "value", p, "err", err)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, *ipNet)
+	}
+
 	for r := range strings.SplitSeq(enabledAmountRangesStr, ",") {
 		r = strings.TrimSpace(r)
 		if r == "" {
@@ -119,72 +400,244 @@ func main() {
 		}
 		rangeID, err := strconv.Atoi(r)
 		if err != nil || rangeID < 1 || rangeID > 4 {
-			log.Fatalf("Error: invalid -enabled-amount-ranges value: %s (must be 1-4)", r)
+			fatal("invalid -enabled-amount-ranges value (must be 1-4)", "value", r)
 		}
 		cfg.EnabledAmountRanges = append(cfg.EnabledAmountRanges, rangeID)
 	}
 
 	validDefault := slices.Contains(cfg.EnabledAmountRanges, cfg.DefaultAmountRange)
 	if !validDefault {
-		log.Fatalf("Error: -default-amount-range %d is not in enabled amount ranges", cfg.DefaultAmountRange)
+		fatal("-default-amount-range is not in enabled amount ranges", "value", cfg.DefaultAmountRange)
 	}
 
-	if cfg.AdminPassword == "" {
-		log.Fatal("Error: admin password required (use -admin-password or FAUCET_ADMIN_PASSWORD)")
+	switch cfg.AmountMode {
+	case service.AmountModeFixed:
+	case service.AmountModeBalanceScaled:
+		if cfg.AmountTargetBalance <= 0 {
+			fatal("-amount-target-balance must be greater than 0 with -amount-mode balance-scaled")
+		}
+	default:
+		fatal("invalid -amount-mode", "value", cfg.AmountMode)
 	}
-	if cfg.AdminCookieSecret == "" {
-		log.Fatal("Error: admin cookie secret required (use -admin-cookie-secret or FAUCET_ADMIN_COOKIE_SECRET)")
+
+	switch cfg.AmountDistribution {
+	case service.AmountDistributionUniform, service.AmountDistributionTriangular, service.AmountDistributionExponential:
+	default:
+		fatal("invalid -amount-distribution", "value", cfg.AmountDistribution)
 	}
-	if len(cfg.AdminCookieSecret) < 32 {
-		log.Fatal("Error: admin cookie secret must be at least 32 characters")
+
+	// -check never serves the dashboard, don't make operators invent secrets
+	// just to test their bitcoind settings
+	if !checkOnly {
+		if cfg.AdminPassword == "" {
+			fatal("admin password required (use -admin-password or FAUCET_ADMIN_PASSWORD)")
+		}
+		if cfg.AdminCookieSecret == "" {
+			fatal("admin cookie secret required (use -admin-cookie-secret or FAUCET_ADMIN_COOKIE_SECRET)")
+		}
+		if len(cfg.AdminCookieSecret) < 32 {
+			fatal("admin cookie secret must be at least 32 characters")
+		}
 	}
 	if cfg.BitcoinRPC.User == "" {
-		log.Fatal("Error: bitcoin RPC user required (use -bitcoin-rpc-user or FAUCET_BITCOIN_RPC_USER)")
+		fatal("bitcoin RPC user required (use -bitcoin-rpc-user or FAUCET_BITCOIN_RPC_USER)")
 	}
 	if cfg.BitcoinRPC.Password == "" {
-		log.Fatal("Error: bitcoin RPC password required (use -bitcoin-rpc-password or FAUCET_BITCOIN_RPC_PASSWORD)")
+		fatal("bitcoin RPC password required (use -bitcoin-rpc-password or FAUCET_BITCOIN_RPC_PASSWORD)")
+	}
+
+	if !rpcTLS && (rpcTLSCAFile != "" || rpcTLSSkipVerify) {
+		fatal("-bitcoin-rpc-tls-ca and -bitcoin-rpc-tls-skip-verify require -bitcoin-rpc-tls")
+	}
+	if rpcTLS {
+		tlsConfig, err := btc.LoadTLSConfig(rpcTLSCAFile, rpcTLSSkipVerify)
+		if err != nil {
+			fatal("invalid bitcoin RPC TLS config", "err", err)
+		}
+		if rpcTLSSkipVerify {
+			slog.Warn("bitcoin RPC certificate verification is disabled")
+		}
+		cfg.BitcoinRPC.TLSConfig = tlsConfig
+	}
+
+	if checkOnly {
+		os.Exit(runCheck(&cfg))
 	}
 
 	batchInterval, err := time.ParseDuration(batchIntervalStr)
 	if err != nil {
-		log.Fatalf("Error: invalid -batch-interval: %v", err)
+		fatal("invalid -batch-interval", "err", err)
 	}
 	cfg.BatchInterval = batchInterval
 
+	payoutBreakerCooldown, err := time.ParseDuration(payoutBreakerCooldownStr)
+	if err != nil || payoutBreakerCooldown <= 0 {
+		fatal("invalid -payout-breaker-cooldown", "value", payoutBreakerCooldownStr)
+	}
+	cfg.PayoutBreakerCooldown = payoutBreakerCooldown
+
+	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutStr)
+	if err != nil || shutdownTimeout <= 0 {
+		fatal("invalid -shutdown-timeout", "value", shutdownTimeoutStr)
+	}
+
+	cfg.HTTPReadTimeout, err = time.ParseDuration(httpReadTimeoutStr)
+	if err != nil || cfg.HTTPReadTimeout < 0 {
+		fatal("invalid -http-read-timeout", "value", httpReadTimeoutStr)
+	}
+	cfg.HTTPWriteTimeout, err = time.ParseDuration(httpWriteTimeoutStr)
+	if err != nil || cfg.HTTPWriteTimeout < 0 {
+		fatal("invalid -http-write-timeout", "value", httpWriteTimeoutStr)
+	}
+	if cfg.MaxRequestBodyBytes <= 0 {
+		fatal("-max-request-body must be positive")
+	}
+
+	dbOpts.BusyTimeout, err = time.ParseDuration(dbBusyTimeoutStr)
+	if err != nil || dbOpts.BusyTimeout < 0 {
+		fatal("invalid -db-busy-timeout", "value", dbBusyTimeoutStr)
+	}
+	if dbOpts.MaxOpenConns < 0 {
+		fatal("-db-max-open-conns can't be negative")
+	}
+
+	broadcastExpiry, err := time.ParseDuration(broadcastExpiryStr)
+	if err != nil || broadcastExpiry < 0 {
+		fatal("invalid -broadcast-expiry", "value", broadcastExpiryStr)
+	}
+	cfg.BroadcastExpiry = broadcastExpiry
+
+	staleProcessingTimeout, err := time.ParseDuration(staleProcessingTimeoutStr)
+	if err != nil || staleProcessingTimeout < 0 {
+		fatal("invalid -stale-processing-timeout", "value", staleProcessingTimeoutStr)
+	}
+	cfg.StaleProcessingTimeout = staleProcessingTimeout
+
+	balanceRefreshInterval, err := time.ParseDuration(balanceRefreshIntervalStr)
+	if err != nil || balanceRefreshInterval <= 0 {
+		fatal("invalid -balance-refresh-interval", "value", balanceRefreshIntervalStr)
+	}
+	cfg.BalanceRefreshInterval = balanceRefreshInterval
+
+	keypoolRefillInterval, err := time.ParseDuration(keypoolRefillIntervalStr)
+	if err != nil || keypoolRefillInterval < 0 {
+		fatal("invalid -keypool-refill-interval", "value", keypoolRefillIntervalStr)
+	}
+	cfg.KeypoolRefillInterval = keypoolRefillInterval
+	if cfg.KeypoolRefillSize < 0 {
+		fatal("-keypool-refill-size can't be negative")
+	}
+
+	if cfg.InsufficientFundsRetries < 0 {
+		fatal("-insufficient-funds-retries can't be negative")
+	}
+	insufficientFundsBackoff, err := time.ParseDuration(insufficientFundsBackoffStr)
+	if err != nil || insufficientFundsBackoff <= 0 {
+		fatal("invalid -insufficient-funds-backoff", "value", insufficientFundsBackoffStr)
+	}
+	cfg.InsufficientFundsBackoff = insufficientFundsBackoff
+
+	balanceHistoryRetention, err := time.ParseDuration(balanceHistoryRetentionStr)
+	if err != nil || balanceHistoryRetention < 0 {
+		fatal("invalid -balance-history-retention", "value", balanceHistoryRetentionStr)
+	}
+	cfg.BalanceHistoryRetention = balanceHistoryRetention
+
+	minFormFillTime, err := time.ParseDuration(minFormFillTimeStr)
+	if err != nil || minFormFillTime < 0 {
+		fatal("invalid -min-form-fill-time", "value", minFormFillTimeStr)
+	}
+	cfg.MinFormFillTime = minFormFillTime
+
+	maxFormAge, err := time.ParseDuration(maxFormAgeStr)
+	if err != nil || maxFormAge < 0 || (maxFormAge > 0 && maxFormAge <= minFormFillTime) {
+		fatal("invalid -max-form-age", "value", maxFormAgeStr)
+	}
+	cfg.MaxFormAge = maxFormAge
+
 	if autoConsolidationIntervalStr != "" {
 		autoConsolidationInterval, err := time.ParseDuration(autoConsolidationIntervalStr)
 		if err != nil {
-			log.Fatalf("Error: invalid -auto-consolidation-interval: %v", err)
+			fatal("invalid -auto-consolidation-interval", "err", err)
 		}
 		cfg.AutoConsolidationInterval = autoConsolidationInterval
 	}
 
-	log.Printf("Signet Bitcoin Faucet starting...")
-	log.Printf("CommitHash: %s", service.CommitHash)
-	log.Printf("Listen address: %s", cfg.ListenAddr)
-	log.Printf("Metrics address: %s", cfg.MetricsAddr)
-	log.Printf("Data directory: %s", cfg.DataDir)
-	log.Printf("Batch interval: %s", cfg.BatchInterval)
-	log.Printf("Enabled amount ranges: %v (default: %d)", cfg.EnabledAmountRanges, cfg.DefaultAmountRange)
-	log.Printf("Admin path: %s", cfg.AdminPath)
-	if cfg.Admin2FASecret != "" {
-		log.Printf("2FA enabled for admin login and send funds")
-	}
-
-	database, err := db.InitDB(cfg.DataDir)
+	slog.Info("bitcoin faucet starting",
+		"commit", service.CommitHash,
+		"network", cfg.Network,
+		"listen_addr", cfg.ListenAddr,
+		"metrics_addr", cfg.MetricsAddr,
+		"data_dir", cfg.DataDir,
+		"batch_interval", cfg.BatchInterval,
+		"batch_size", cfg.BatchSize,
+		"recent_payouts_max", cfg.RecentPayoutsMax,
+		"batch_order", cfg.BatchOrder,
+		"batch_flush_threshold", cfg.BatchFlushThreshold,
+		"batch_concurrency", cfg.BatchConcurrency,
+		"enabled_amount_ranges", cfg.EnabledAmountRanges,
+		"default_amount_range", cfg.DefaultAmountRange,
+		"admin_path", cfg.AdminPath,
+		"admin_2fa", cfg.Admin2FASecret != "",
+		"bitcoin_rpc_tls", rpcTLS,
+		"bot_check", cfg.BotCheck,
+		"captcha_provider", cfg.CaptchaProvider,
+		"captcha_enabled", cfg.CaptchaSecret != "",
+		"captcha_expected_hostname", cfg.CaptchaExpectedHostname,
+		"fast_lane", cfg.FastLane,
+		"api_keys", len(cfg.APIKeys),
+	)
+
+	database, err := db.InitDB(cfg.DataDir, dbOpts)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		fatal("failed to initialize database", "err", err)
 	}
-	log.Println("Database initialized successfully")
+	slog.Info("database initialized")
 
 	svc := service.NewService(&cfg, database)
 
-	if err := svc.CheckAndLoadBitcoinCoreWallet(); err != nil {
-		log.Fatalf("Bitcoin RPC connection failed: %v", err)
+	if err := svc.LoadTemplates(); err != nil {
+		fatal("failed to parse templates", "err", err)
+	}
+
+	if err := svc.LoadSettings(); err != nil {
+		fatal("failed to load settings", "err", err)
+	}
+
+	if err := svc.Load2FASecret(); err != nil {
+		fatal("failed to load 2FA secret", "err", err)
+	}
+
+	if err := svc.LoadAddressLists(); err != nil {
+		fatal("failed to load address lists", "err", err)
 	}
-	log.Printf("Bitcoin RPC connection verified, wallet [%s] loaded", cfg.BitcoinCoreWalletName)
 
 	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := svc.CheckBitcoinNetwork(ctx); err != nil {
+		fatal("bitcoin network check failed", "err", err)
+	}
+
+	if err := svc.SetupBitcoinCoreWallet(ctx); err != nil {
+		fatal("bitcoin RPC connection failed", "err", err)
+	}
+	if err := svc.CheckWalletPassphrase(ctx); err != nil {
+		fatal("failed to unlock wallet", "wallet", cfg.BitcoinCoreWalletName, "err", err)
+	}
+	slog.Info("bitcoin RPC connection verified", "wallet", cfg.BitcoinCoreWalletName, "encrypted", cfg.BitcoinRPC.WalletPassphrase != "")
+
+	if err := svc.CheckConsolidationTarget(ctx); err != nil {
+		fatal("invalid -consolidation-target-address", "address", cfg.ConsolidationTargetAddress, "err", err)
+	}
+
+	if err := svc.SetupDonationAddress(ctx); err != nil {
+		fatal("failed to set up donation address", "err", err)
+	}
+
+	if _, err := svc.ReconcileTransactions(ctx); err != nil {
+		fatal("failed to reconcile stuck transactions", "err", err)
+	}
+
 	var wg sync.WaitGroup
 
 	svc.StartBatchProcessor(ctx, &wg)
@@ -192,29 +645,52 @@ func main() {
 	if cfg.AutoConsolidationInterval > 0 {
 		svc.StartAutoConsolidation(ctx, &wg)
 	}
-	svc.StartMetricsHttpServer()
+	if cfg.BroadcastExpiry > 0 {
+		svc.StartExpiryChecker(ctx, &wg)
+	}
+	if cfg.KeypoolRefillInterval > 0 {
+		svc.StartKeypoolRefiller(ctx, &wg)
+	}
+	metricsServer, err := svc.StartMetricsHttpServer()
+	if err != nil {
+		fatal("failed to start metrics server", "err", err)
+	}
 
 	httpServer := svc.StartService()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			slog.Info("received SIGHUP, reloading address lists")
+			if err := svc.LoadAddressLists(); err != nil {
+				slog.Error("failed to reload address lists, keeping the previous ones", "err", err)
+			}
+		}
+	}()
+
 	go func() {
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
+			fatal("http server error", "err", err)
 		}
 	}()
 
 	<-sigChan
-	log.Println("Received shutdown signal, initiating graceful shutdown...")
+	slog.Info("received shutdown signal, initiating graceful shutdown")
 
 	cancel()
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer shutdownCancel()
 
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
+		slog.Error("http server shutdown error", "err", err)
+	}
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("metrics server shutdown error", "err", err)
 	}
 
 	done := make(chan struct{})
@@ -225,10 +701,11 @@ func main() {
 
 	select {
 	case <-done:
-		log.Println("All background tasks completed")
+		slog.Info("all background tasks completed")
+		svc.ReleaseUTXOLocks(shutdownCtx)
 	case <-shutdownCtx.Done():
-		log.Println("Shutdown timeout exceeded, forcing exit")
+		slog.Warn("shutdown timeout exceeded, forcing exit")
 	}
 
-	log.Println("Shutdown complete")
+	slog.Info("shutdown complete")
 }
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	errAddressDenied     = errors.New("address is on the denylist")
+	errAddressNotAllowed = errors.New("address is not on the allowlist")
+)
+
+// addressLists holds the parsed -address-denylist and -address-allowlist
+// files, a nil allow set means every address not denied is accepted
+type addressLists struct {
+	deny  map[string]struct{}
+	allow map[string]struct{}
+}
+
+// LoadAddressLists (re)reads the configured list files. Either file failing
+// leaves the lists in use untouched, so a bad edit followed by SIGHUP doesn't
+// drop the denylist.
+func (svc *Service) LoadAddressLists() error {
+	var lists addressLists
+
+	if svc.cfg.AddressDenylistFile != "" {
+		deny, err := readAddressList(svc.cfg.AddressDenylistFile)
+		if err != nil {
+			return fmt.Errorf("failed to load denylist: %w", err)
+		}
+		lists.deny = deny
+	}
+
+	if svc.cfg.AddressAllowlistFile != "" {
+		allow, err := readAddressList(svc.cfg.AddressAllowlistFile)
+		if err != nil {
+			return fmt.Errorf("failed to load allowlist: %w", err)
+		}
+		lists.allow = allow
+	}
+
+	svc.addressListsMtx.Lock()
+	svc.addressLists = lists
+	svc.addressListsMtx.Unlock()
+
+	svc.logger.Info("loaded address lists", "denied", len(lists.deny), "allowed", len(lists.allow), "allowlist", lists.allow != nil)
+	return nil
+}
+
+// readAddressList parses one address per line, blank lines and lines starting
+// with # are skipped
+func readAddressList(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	addresses := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addresses[normalizeAddress(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+func (svc *Service) checkAddressLists(address string) error {
+	svc.addressListsMtx.RLock()
+	defer svc.addressListsMtx.RUnlock()
+
+	address = normalizeAddress(address)
+	if _, ok := svc.addressLists.deny[address]; ok {
+		return errAddressDenied
+	}
+	if svc.addressLists.allow != nil {
+		if _, ok := svc.addressLists.allow[address]; !ok {
+			return errAddressNotAllowed
+		}
+	}
+	return nil
+}
+
+func isBech32Address(address string) bool {
+	lower := strings.ToLower(address)
+	return strings.HasPrefix(lower, "bc1") || strings.HasPrefix(lower, "tb1") || strings.HasPrefix(lower, "bcrt1")
+}
+
+// normalizeAddress lower cases bech32 addresses, which are case insensitive,
+// so a listed address matches however it was typed. Base58 is left alone.
+func normalizeAddress(address string) string {
+	address = strings.TrimSpace(address)
+	if isBech32Address(address) {
+		return strings.ToLower(address)
+	}
+	return address
+}
+
+// skipOpReturn reports whether payouts to address must go out without an
+// OP_RETURN, some exchanges reject deposits that carry one. Entries of
+// -no-op-return-address ending in * match by prefix.
+func (svc *Service) skipOpReturn(address string) bool {
+	address = normalizeAddress(address)
+	for _, entry := range svc.cfg.NoOpReturnAddresses {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			if strings.HasPrefix(address, normalizeAddress(prefix)) {
+				return true
+			}
+		} else if address == normalizeAddress(entry) {
+			return true
+		}
+	}
+	return false
+}
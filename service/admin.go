@@ -2,28 +2,48 @@ package service
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/lnliz/faucet.coinbin.org/btc"
 	"github.com/lnliz/faucet.coinbin.org/db"
+	"gorm.io/gorm"
 )
 
 const (
-	adminSessionDurationHours = 4
+	// sliding expiry is only written back once it moved by at least this much,
+	// so a burst of dashboard requests doesn't turn into a burst of db writes
+	adminSessionRefreshInterval = 5 * time.Minute
+
+	// ceiling for a manually chosen fee rate, catches an extra zero or two
+	adminMaxFeeSatsPerVB = 500.0
+
+	// rows /search returns at most, an address can have many requests
+	adminSearchLimit = 100
+)
+
+var (
+	// rate a manual send uses when no fee rate is given
+	adminSendFeeSatsPerVB = btc.FeeSatsPerVBLowerLimit * 1.10
+
+	// confirmation targets /fee-estimate asks the node about
+	feeEstimateConfTargets = []int{1, 3, 6}
 )
 
 func (svc *Service) adminLoginPageHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		data := map[string]any{
-			"Require2FA": svc.cfg.Admin2FASecret != "",
+			"Require2FA": svc.require2FA(),
 		}
 		if err := svc.renderTemplate(w, "admin_login.html", data); err != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			svc.renderError(w, http.StatusInternalServerError, "The login page couldn't be loaded.")
 		}
 		return
 	}
@@ -40,7 +60,7 @@ func (svc *Service) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		data := map[string]any{
 			"Error":      "Invalid request",
-			"Require2FA": svc.cfg.Admin2FASecret != "",
+			"Require2FA": svc.require2FA(),
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		svc.renderTemplate(w, "admin_login.html", data)
@@ -51,17 +71,19 @@ func (svc *Service) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
 	totpCode := r.FormValue("totp_code")
 
 	if password != svc.cfg.AdminPassword {
+		svc.audit(r, AuditActionLogin, db.AuditOutcomeDenied, "invalid password")
 		data := map[string]any{
 			"Error":      "Invalid password",
-			"Require2FA": svc.cfg.Admin2FASecret != "",
+			"Require2FA": svc.require2FA(),
 		}
 		w.WriteHeader(http.StatusUnauthorized)
 		svc.renderTemplate(w, "admin_login.html", data)
 		return
 	}
 
-	if svc.cfg.Admin2FASecret != "" {
+	if svc.require2FA() {
 		if totpCode == "" {
+			svc.audit(r, AuditActionLogin, db.AuditOutcomeDenied, "missing 2FA code")
 			data := map[string]any{
 				"Error":      "2FA code required",
 				"Require2FA": true,
@@ -71,7 +93,8 @@ func (svc *Service) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if !svc.totp.Verify(totpCode, time.Now().Unix()) {
+		if !svc.verify2FA(totpCode) {
+			svc.audit(r, AuditActionLogin, db.AuditOutcomeDenied, "invalid 2FA code")
 			data := map[string]any{
 				"Error":      "Invalid 2FA code",
 				"Require2FA": true,
@@ -83,7 +106,7 @@ func (svc *Service) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sessionID := uuid.New().String()
-	expiresAt := time.Now().Add(time.Duration(adminSessionDurationHours) * time.Hour)
+	expiresAt := time.Now().Add(svc.adminSessionDuration())
 
 	session := db.AdminSession{
 		SessionID: sessionID,
@@ -93,7 +116,8 @@ func (svc *Service) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := svc.db.Create(&session).Error; err != nil {
-		log.Printf("Failed to create admin session: %v", err)
+		svc.logger.Error("failed to create admin session", "err", err)
+		svc.audit(r, AuditActionLogin, db.AuditOutcomeFailure, "failed to create session")
 		data := map[string]any{
 			"Error": "Failed to create session",
 		}
@@ -102,42 +126,81 @@ func (svc *Service) adminLoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	signedCookie := svc.signCookie(sessionID)
-	http.SetCookie(w, &http.Cookie{
-		Name:     "admin_session",
-		Value:    signedCookie,
-		Path:     svc.cfg.AdminPath,
-		MaxAge:   adminSessionDurationHours * 60 * 60,
-		HttpOnly: true,
-	})
+	svc.setSessionCookie(w, svc.signCookie(sessionID), expiresAt)
+	svc.audit(r, AuditActionLogin, db.AuditOutcomeSuccess, "")
 
-	http.Redirect(w, r, svc.cfg.AdminPath+"/", http.StatusFound)
+	http.Redirect(w, r, svc.adminURL("/"), http.StatusFound)
 }
 
 func (svc *Service) adminLogoutHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("admin_session")
-	if err == nil {
-		sessionID, valid := svc.validateSessionCookie(cookie.Value)
-		if valid {
-			svc.db.Where("session_id = ?", sessionID).Delete(&db.AdminSession{})
-		}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
+	if sessionID, valid := svc.sessionIDFromRequest(r); valid {
+		svc.db.Where("session_id = ?", sessionID).Delete(&db.AdminSession{})
+	}
+	svc.audit(r, AuditActionLogout, db.AuditOutcomeSuccess, "")
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     "admin_session",
 		Value:    "",
-		Path:     svc.cfg.AdminPath,
+		Path:     svc.adminURL(""),
 		MaxAge:   -1,
 		HttpOnly: true,
 	})
 
-	http.Redirect(w, r, svc.cfg.AdminPath+"/login", http.StatusFound)
+	http.Redirect(w, r, svc.adminURL("/login"), http.StatusFound)
+}
+
+func (svc *Service) adminSessionDuration() time.Duration {
+	return time.Duration(svc.cfg.AdminSessionHours) * time.Hour
+}
+
+func (svc *Service) setSessionCookie(w http.ResponseWriter, signedCookie string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "admin_session",
+		Value:    signedCookie,
+		Path:     svc.adminURL(""),
+		MaxAge:   int(time.Until(expiresAt).Seconds()),
+		HttpOnly: true,
+	})
+}
+
+// slideAdminSession pushes the session expiry forward on activity, capped at
+// AdminSessionMaxHours after login
+func (svc *Service) slideAdminSession(w http.ResponseWriter, session *db.AdminSession) {
+	newExpiresAt := time.Now().Add(svc.adminSessionDuration())
+	maxExpiresAt := session.CreatedAt.Add(time.Duration(svc.cfg.AdminSessionMaxHours) * time.Hour)
+	if newExpiresAt.After(maxExpiresAt) {
+		newExpiresAt = maxExpiresAt
+	}
+
+	if newExpiresAt.Sub(session.ExpiresAt) < adminSessionRefreshInterval {
+		return
+	}
+
+	if err := svc.db.Model(session).Update("expires_at", newExpiresAt).Error; err != nil {
+		svc.logger.Error("failed to extend admin session", "err", err)
+		return
+	}
+
+	svc.setSessionCookie(w, svc.signCookie(session.SessionID), newExpiresAt)
 }
 
 func (svc *Service) adminDashboardHandler(w http.ResponseWriter, r *http.Request) {
-	balances, err := svc.rpcClient.GetBalances()
+	balances, err := svc.rpcClient.GetBalances(r.Context())
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		svc.logger.Error("failed to get balances for dashboard", "err", err)
+		svc.renderError(w, http.StatusBadGateway, "Bitcoin Core didn't answer, check the node and reload.")
+		return
+	}
+	// the same figure batches go by, only safe utxos count
+	spendable, err := svc.GetSpendableWalletBalance(r.Context())
+	if err != nil {
+		svc.logger.Error("failed to get spendable balance for dashboard", "err", err)
+		svc.renderError(w, http.StatusBadGateway, "Bitcoin Core didn't answer, check the node and reload.")
 		return
 	}
 
@@ -149,39 +212,66 @@ func (svc *Service) adminDashboardHandler(w http.ResponseWriter, r *http.Request
 
 	transactions, err := db.GetTransactions(svc.db, "", "created_at DESC", 50)
 	if err != nil {
-		log.Printf("Failed to get transactions: %v", err)
+		svc.logger.Error("failed to get transactions", "err", err)
 	}
 
+	sessionID, _ := svc.sessionIDFromRequest(r)
+
 	data := map[string]any{
 		"BalanceTrusted":                  balances.Mine.Trusted,
 		"BalancePending":                  balances.Mine.Untrusted,
 		"BalanceImmature":                 balances.Mine.Immature,
 		"BalanceTotal":                    balances.Mine.Trusted + balances.Mine.Untrusted + balances.Mine.Immature,
+		"BalanceSpendable":                spendable,
+		"ReserveBalance":                  svc.cfg.ReserveBalance,
+		"PayoutBreaker":                   svc.PayoutBreaker(),
+		"OpReturn":                        svc.cfg.OpReturn,
+		"PayoutBreakerThreshold":          svc.cfg.PayoutBreakerThreshold,
+		"PayoutBreakerCooldown":           svc.cfg.PayoutBreakerCooldown,
 		"TotalSent":                       totalSent,
 		"TotalPending":                    totalPending,
 		"TotalFailed":                     totalFailed,
 		"TotalAmount":                     totalAmount,
 		"Transactions":                    transactions,
-		"AdminPath":                       svc.cfg.AdminPath,
-		"Require2FA":                      svc.cfg.Admin2FASecret != "",
+		"AdminPath":                       svc.adminURL(""),
+		"Require2FA":                      svc.require2FA(),
 		"CommitHash":                      CommitHash,
+		"CSRFToken":                       svc.csrfToken(sessionID),
+		"ExplorerURL":                     svc.ExplorerURL(),
+		"Network":                         svc.cfg.Network,
 		"ConsolidationAmountThresholdBTC": svc.cfg.ConsolidationAmountThresholdBTC,
 		"MaxConsolidationUTXOs":           svc.cfg.MaxConsolidationUTXOs,
 		"MinConsolidationUTXOs":           svc.cfg.MinConsolidationUTXOs,
+		"ConsolidationMinConfirmations":   svc.cfg.ConsolidationMinConfirmations,
+		"ConsolidationFeeRate":            svc.cfg.ConsolidationFeeRate,
 		"AutoConsolidationInterval":       svc.cfg.AutoConsolidationInterval,
-		"MaxWithdrawalsPerIP24h":          svc.cfg.MaxWithdrawalsPerIP24h,
-		"MaxDepositsPerAddress":           svc.cfg.MaxDepositsPerAddress,
+		"Settings":                        svc.Settings(),
+		"AllAmountRanges":                 AllAmountRanges,
 		"AdminAllowlist":                  formatCIDRs(svc.cfg.AdminAllowlist),
+		"TrustedProxies":                  formatCIDRs(svc.cfg.TrustedProxies),
+		"RateLimitIPv4Prefix":             svc.cfg.RateLimitIPv4Prefix,
+		"RateLimitIPv6Prefix":             svc.cfg.RateLimitIPv6Prefix,
+		"AdminSessionHours":               svc.cfg.AdminSessionHours,
+		"AdminSessionMaxHours":            svc.cfg.AdminSessionMaxHours,
 		"BatchInterval":                   svc.cfg.BatchInterval,
+		"BatchSize":                       svc.cfg.BatchSize,
+		"BatchOrder":                      svc.cfg.BatchOrder,
+		"BatchConcurrency":                svc.cfg.BatchConcurrency,
+		"PartialBatch":                    svc.cfg.PartialBatch,
 	}
 
 	if err := svc.renderTemplate(w, "admin_dashboard.html", data); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		svc.renderError(w, http.StatusInternalServerError, "The dashboard couldn't be loaded.")
 	}
 }
 
 func (svc *Service) adminGetBalanceHandler(w http.ResponseWriter, r *http.Request) {
-	balances, err := svc.rpcClient.GetBalances()
+	balances, err := svc.rpcClient.GetBalances(r.Context())
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	spendable, err := svc.GetSpendableWalletBalance(r.Context())
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -190,24 +280,132 @@ func (svc *Service) adminGetBalanceHandler(w http.ResponseWriter, r *http.Reques
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
-		"trusted":  balances.Mine.Trusted,
-		"pending":  balances.Mine.Untrusted,
-		"immature": balances.Mine.Immature,
-		"total":    balances.Mine.Trusted + balances.Mine.Untrusted + balances.Mine.Immature,
+		"trusted":   balances.Mine.Trusted,
+		"pending":   balances.Mine.Untrusted,
+		"immature":  balances.Mine.Immature,
+		"total":     balances.Mine.Trusted + balances.Mine.Untrusted + balances.Mine.Immature,
+		"reserve":   svc.cfg.ReserveBalance,
+		"spendable": spendable,
+	})
+}
+
+type feeEstimate struct {
+	ConfTarget int     `json:"conf_target"`
+	FeeRate    float64 `json:"fee_rate,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// adminFeeEstimateHandler shows the node's fee estimates next to the rates
+// the faucet actually sends at, so a manual fee rate can be picked with both
+// in view
+func (svc *Service) adminFeeEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	estimates := make([]feeEstimate, 0, len(feeEstimateConfTargets))
+	for _, target := range feeEstimateConfTargets {
+		e := feeEstimate{ConfTarget: target}
+		if feeRate, err := svc.rpcClient.EstimateSmartFee(r.Context(), target); err != nil {
+			e.Error = err.Error()
+		} else {
+			e.FeeRate = feeRate
+		}
+		estimates = append(estimates, e)
+	}
+
+	consolidationFeeRate := svc.cfg.ConsolidationFeeRate
+	if consolidationFeeRate <= 0 {
+		consolidationFeeRate = svc.estimateFeeRate(r.Context(), consolidationFeeConfTarget, btc.ConsolidationFeeRateSatsPerVB)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"estimates":              estimates,
+		"floor":                  btc.FeeSatsPerVBLowerLimit,
+		"payout_fee_rate":        payoutFeeSatsPerVB,
+		"admin_send_fee_rate":    adminSendFeeSatsPerVB,
+		"consolidation_fee_rate": consolidationFeeRate,
+	})
+}
+
+// maxBalanceHistoryDays caps ?days= on /balance-history
+const maxBalanceHistoryDays = 365
+
+func (svc *Service) adminBalanceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 7
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 1 || n > maxBalanceHistoryDays {
+			writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("days must be between 1 and %d", maxBalanceHistoryDays))
+			return
+		}
+		days = n
+	}
+
+	snapshots, err := db.GetBalanceSnapshots(svc.db, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		svc.logger.Error("failed to get balance history", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+		return
+	}
+
+	series := make([]map[string]any, len(snapshots))
+	for i, s := range snapshots {
+		series[i] = map[string]any{
+			"timestamp": s.CreatedAt,
+			"trusted":   s.Trusted,
+			"pending":   s.Pending,
+			"immature":  s.Immature,
+			"total":     s.Trusted + s.Pending + s.Immature,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"days":      days,
+		"snapshots": series,
+	})
+}
+
+// adminRefreshBalanceHandler updates the cached balance the public page and
+// payout amounts use right away instead of at the next BalanceRefreshInterval
+func (svc *Service) adminRefreshBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := svc.refreshWalletBalance(r.Context()); err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeRPCError, "Failed to refresh balance")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"balance": svc.GetCachedWalletBalance(),
 	})
 }
 
 func (svc *Service) adminGetNewAddressHandler(w http.ResponseWriter, r *http.Request) {
-	address, err := svc.rpcClient.GetNewAddress("", "bech32")
+	address, err := svc.newAddress(r.Context(), "deposit")
 	if err != nil {
-		log.Printf("Failed to generate new address: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to generate address"})
+		svc.logger.Error("failed to generate new address", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeRPCError, "Failed to generate address")
 		return
 	}
 
-	log.Printf("Generated new deposit address: %s", address)
+	svc.logger.Info("generated new deposit address", "address", address)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"address": address})
@@ -220,85 +418,248 @@ func (svc *Service) adminSendFundsHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	var req struct {
-		Address   string  `json:"address"`
-		AmountBTC float64 `json:"amount"`
-		TOTPCode  string  `json:"totp_code"`
-		OpReturn  string  `json:"op_return"`
+		Address   string   `json:"address"`
+		AmountBTC float64  `json:"amount"`
+		TOTPCode  string   `json:"totp_code"`
+		OpReturn  string   `json:"op_return"`
+		Force     bool     `json:"force"`
+		FeeRate   *float64 `json:"fee_rate"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+	if !svc.decodeJSONBody(w, r, &req) {
 		return
 	}
 
-	if svc.cfg.Admin2FASecret != "" {
-		if req.TOTPCode == "" || !svc.totp.Verify(req.TOTPCode, time.Now().Unix()) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid 2FA code"})
+	if svc.require2FA() {
+		if !svc.verify2FA(req.TOTPCode) {
+			svc.audit(r, AuditActionSend, db.AuditOutcomeDenied, auditSendDetail(req.Address, req.AmountBTC, ""))
+			writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code")
 			return
 		}
 	}
 
-	if err := btc.ValidateSignetAddress(req.Address); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	if err := btc.ValidateAddress(req.Address, svc.cfg.Network); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAddress, err.Error())
+		return
+	}
+
+	if len(req.OpReturn) > btc.MaxOpReturnBytes {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeMessageTooLong, fmt.Sprintf("OP_RETURN data can't be longer than %d bytes", btc.MaxOpReturnBytes))
 		return
 	}
 
 	if req.AmountBTC <= 0 {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Amount must be greater than 0"})
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAmount, "Amount must be greater than 0")
+		return
+	}
+	if req.AmountBTC < btc.DustLimitBTC {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAmount, fmt.Sprintf("Amount must be at least %.8f BTC (dust limit)", btc.DustLimitBTC))
 		return
 	}
 
-	availBalance := svc.GetAvailableWalletBalance()
-	if req.AmountBTC > availBalance {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient balance"})
+	if req.FeeRate != nil && *req.FeeRate > adminMaxFeeSatsPerVB {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidFeeRate, fmt.Sprintf("Fee rate must not exceed %.0f sat/vB", adminMaxFeeSatsPerVB))
+		return
+	}
+
+	/*
+	 a fee rate at or below the relay minimum would never confirm,
+	 use the default instead
+	*/
+	fees := adminSendFeeSatsPerVB
+	if req.FeeRate != nil && *req.FeeRate > btc.FeeSatsPerVBLowerLimit {
+		fees = *req.FeeRate
+	}
+	estimatedFeeBTC := btc.EstimateSendFeeBTC(fees)
+
+	/*
+	 force lets the admin dip into the reserve
+	*/
+	availBalance, err := svc.GetAvailableWalletBalance(r.Context())
+	if err != nil {
+		svc.logger.Error("failed to get wallet balance", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeRPCError, "Failed to get wallet balance")
+		return
+	}
+	if req.AmountBTC+estimatedFeeBTC > availBalance {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInsufficientBalance, fmt.Sprintf("Insufficient balance for amount plus estimated fee of %.8f BTC", estimatedFeeBTC))
+		return
+	}
+	if !req.Force && req.AmountBTC+estimatedFeeBTC > availBalance-svc.cfg.ReserveBalance {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInsufficientBalance, fmt.Sprintf("Amount would dip into the %.8f BTC reserve, use force to send anyway", svc.cfg.ReserveBalance))
 		return
 	}
 
-	fees := btc.FeeSatsPerVBLowerLimit * 1.10
+	// not cancelled when the admin closes the page half way through
+	sendCtx, cancel := sendContext(r.Context())
+	defer cancel()
 
-	txid, err := svc.rpcClient.SendToAddressWithOpReturn(
+	svc.walletMtx.Lock()
+	sent, err := svc.rpcClient.SendToAddressWithOpReturn(
+		sendCtx,
 		req.Address,
 		req.AmountBTC,
 		fees,
 		req.OpReturn,
 	)
+	svc.walletMtx.Unlock()
 
 	if err != nil {
-		log.Printf("Admin send failed: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to send transaction"})
+		svc.logger.Error("admin send failed", "address", req.Address, "amount_btc", req.AmountBTC, "err", err)
+		svc.audit(r, AuditActionSend, db.AuditOutcomeFailure, auditSendDetail(req.Address, req.AmountBTC, "")+" err="+err.Error())
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeSendFailed, "Failed to send transaction")
 		return
 	}
 
-	log.Printf("Admin sent %.8f BTC to %s (txid: %s)", req.AmountBTC, req.Address, txid)
+	svc.audit(r, AuditActionSend, db.AuditOutcomeSuccess, auditSendDetail(req.Address, req.AmountBTC, sent.TxID))
+	svc.refreshWalletBalance(r.Context())
+	svc.logger.Info("admin sent funds",
+		"address", req.Address,
+		"amount_btc", req.AmountBTC,
+		"txid", sent.TxID,
+		"fee_btc", sent.FeeBTC,
+		"fee_rate", fees)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
-		"success": true,
-		"txid":    txid,
-		"message": "Transaction sent successfully",
+		"success":  true,
+		"txid":     sent.TxID,
+		"fee":      sent.FeeBTC,
+		"fee_rate": fees,
+		"message":  "Transaction sent successfully",
+	})
+}
+
+func adminTransactionJSON(tx db.Transaction) map[string]any {
+	return map[string]any{
+		"id":             tx.ID,
+		"created_at":     tx.CreatedAt,
+		"address":        tx.Address,
+		"ip_address":     tx.IPAddress,
+		"api_key_id":     tx.APIKeyID,
+		"amount":         tx.AmountBTC,
+		"fee":            tx.FeeBTC,
+		"status":         tx.Status,
+		"error_msg":      tx.ErrorMsg,
+		"retry_count":    tx.RetryCount,
+		"next_retry_at":  tx.NextRetryAt,
+		"op_return":      tx.OpReturn,
+		"onchain_txn_id": tx.OnchainTxnID,
+		"funding_inputs": tx.FundingInputList(),
+	}
+}
+
+// adminSearchHandler finds the faucet requests behind a txid or an address,
+// newest first. A batched txid matches every payout it carried.
+func (svc *Service) adminSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	txid := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("txid")))
+	address := strings.TrimSpace(r.URL.Query().Get("address"))
+
+	q := svc.db.Order("id DESC").Limit(adminSearchLimit)
+	switch {
+	case txid != "" && address == "":
+		q = q.Where("onchain_txn_id = ?", txid)
+	case address != "" && txid == "":
+		q = q.Where("address = ?", address)
+	default:
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Give either txid or address")
+		return
+	}
+
+	var txns []db.Transaction
+	if err := q.Find(&txns).Error; err != nil {
+		svc.logger.Error("failed to search transactions", "txid", txid, "address", address, "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+		return
+	}
+	if len(txns) == 0 {
+		writeJSONError(w, r, http.StatusNotFound, errCodeNotFound, "No matching transactions")
+		return
+	}
+
+	results := make([]map[string]any, 0, len(txns))
+	for _, tx := range txns {
+		results = append(results, adminTransactionJSON(tx))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"transactions": results,
 	})
 }
 
+func (svc *Service) adminTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Invalid transaction id")
+		return
+	}
+
+	var tx db.Transaction
+	if err := svc.db.First(&tx, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeJSONError(w, r, http.StatusNotFound, errCodeNotFound, "Transaction not found")
+			return
+		}
+		svc.logger.Error("failed to get transaction", "txn_id", id, "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+		return
+	}
+
+	resp := adminTransactionJSON(tx)
+
+	/*
+	 live lookup, a failure here shouldn't hide the db record
+	*/
+	if tx.Status == db.TxnStatusBroadcast && tx.OnchainTxnID != "" {
+		if onchain, err := svc.rpcClient.GetTransaction(r.Context(), tx.OnchainTxnID); err != nil {
+			resp["onchain_error"] = err.Error()
+		} else {
+			resp["confirmations"] = onchain.Confirmations
+			resp["blockhash"] = onchain.BlockHash
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// adminGetUTXOsHandler lists the wallet's UTXOs, ?address= (repeatable or
+// comma separated) narrows it down to those addresses
 func (svc *Service) adminGetUTXOsHandler(w http.ResponseWriter, r *http.Request) {
-	utxos, err := svc.rpcClient.ListUnspent(0, 9999999)
+	var addresses []string
+	for _, v := range r.URL.Query()["address"] {
+		for a := range strings.SplitSeq(v, ",") {
+			if a = strings.TrimSpace(a); a == "" {
+				continue
+			}
+			if err := btc.ValidateAddress(a, svc.cfg.Network); err != nil {
+				writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAddress, err.Error())
+				return
+			}
+			addresses = append(addresses, a)
+		}
+	}
+
+	utxos, err := svc.rpcClient.ListUnspent(r.Context(), 0, 9999999, addresses...)
 	if err != nil {
-		log.Printf("Failed to list UTXOs: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to list UTXOs"})
+		svc.logger.Error("failed to list utxos", "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeRPCError, "Failed to list UTXOs")
 		return
 	}
 
@@ -329,34 +690,31 @@ func (svc *Service) adminConsolidateUTXOsHandler(w http.ResponseWriter, r *http.
 		TOTPCode string `json:"totp_code"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+	if !svc.decodeJSONBody(w, r, &req) {
 		return
 	}
 
-	if svc.cfg.Admin2FASecret != "" {
-		if req.TOTPCode == "" || !svc.totp.Verify(req.TOTPCode, time.Now().Unix()) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid 2FA code"})
+	if svc.require2FA() {
+		if !svc.verify2FA(req.TOTPCode) {
+			svc.audit(r, AuditActionConsolidate, db.AuditOutcomeDenied, "")
+			writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code")
 			return
 		}
 	}
 
-	result, err := svc.ConsolidateUTXOs()
+	result, err := svc.ConsolidateUTXOs(r.Context())
 
 	w.Header().Set("Content-Type", "application/json")
 
 	if err != nil {
-		log.Printf("Failed to consolidate UTXOs: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		svc.logger.Error("failed to consolidate utxos", "err", err)
+		svc.audit(r, AuditActionConsolidate, db.AuditOutcomeFailure, "err="+err.Error())
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
 		return
 	}
 
 	if result.SkipReason != "" {
+		svc.audit(r, AuditActionConsolidate, db.AuditOutcomeSuccess, "skipped: "+result.SkipReason)
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]any{
 			"message": result.SkipReason,
@@ -365,6 +723,69 @@ func (svc *Service) adminConsolidateUTXOsHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	svc.audit(r, AuditActionConsolidate, db.AuditOutcomeSuccess,
+		fmt.Sprintf("count=%d amount=%.8f address=%s txid=%s", result.Count, result.Amount, result.Address, result.TxID))
+	svc.refreshWalletBalance(r.Context())
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"txid":    result.TxID,
+		"count":   result.Count,
+		"amount":  result.Amount,
+		"address": result.Address,
+		"message": result.Message,
+	})
+}
+
+func (svc *Service) adminDrainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Address  string `json:"address"`
+		TOTPCode string `json:"totp_code"`
+	}
+
+	if !svc.decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if svc.require2FA() {
+		if !svc.verify2FA(req.TOTPCode) {
+			svc.audit(r, AuditActionDrain, db.AuditOutcomeDenied, "address="+req.Address)
+			writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code")
+			return
+		}
+	}
+
+	if err := btc.ValidateAddress(req.Address, svc.cfg.Network); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAddress, err.Error())
+		return
+	}
+
+	result, err := svc.DrainWallet(r.Context(), req.Address)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		svc.logger.Error("failed to drain wallet", "err", err)
+		svc.audit(r, AuditActionDrain, db.AuditOutcomeFailure, "address="+req.Address+" err="+err.Error())
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	svc.audit(r, AuditActionDrain, db.AuditOutcomeSuccess,
+		fmt.Sprintf("count=%d amount=%.8f address=%s txid=%s", result.Count, result.Amount, result.Address, result.TxID))
+	svc.refreshWalletBalance(r.Context())
+	svc.logger.Info("admin drained wallet",
+		"address", result.Address,
+		"count", result.Count,
+		"amount_btc", result.Amount,
+		"txid", result.TxID)
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
 		"success": true,
@@ -376,6 +797,136 @@ func (svc *Service) adminConsolidateUTXOsHandler(w http.ResponseWriter, r *http.
 	})
 }
 
+// adminRebroadcastHandler sends unconfirmed payouts older than
+// min_age_minutes to the node again, DefaultRebroadcastMinAge when left out
+func (svc *Service) adminRebroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		MinAgeMinutes *int   `json:"min_age_minutes"`
+		TOTPCode      string `json:"totp_code"`
+	}
+
+	if !svc.decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	minAge := DefaultRebroadcastMinAge
+	if req.MinAgeMinutes != nil {
+		if *req.MinAgeMinutes < 0 {
+			writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "min_age_minutes can't be negative")
+			return
+		}
+		minAge = time.Duration(*req.MinAgeMinutes) * time.Minute
+	}
+	detail := "min_age=" + minAge.String()
+
+	if svc.require2FA() {
+		if !svc.verify2FA(req.TOTPCode) {
+			svc.audit(r, AuditActionRebroadcast, db.AuditOutcomeDenied, detail)
+			writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code")
+			return
+		}
+	}
+
+	result, err := svc.RebroadcastUnconfirmed(r.Context(), minAge)
+	if err != nil {
+		svc.logger.Error("failed to rebroadcast transactions", "err", err)
+		svc.audit(r, AuditActionRebroadcast, db.AuditOutcomeFailure, detail+" err="+err.Error())
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	svc.audit(r, AuditActionRebroadcast, db.AuditOutcomeSuccess,
+		fmt.Sprintf("%s rebroadcast=%d confirmed=%d failed=%d", detail, result.Rebroadcast, result.Confirmed, result.Failed))
+	svc.logger.Info("admin rebroadcast transactions",
+		"min_age", minAge,
+		"rebroadcast", result.Rebroadcast,
+		"confirmed", result.Confirmed,
+		"failed", result.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":     true,
+		"rebroadcast": result.Rebroadcast,
+		"confirmed":   result.Confirmed,
+		"failed":      result.Failed,
+		"message":     fmt.Sprintf("Rebroadcast %d transactions, %d already confirmed, %d failed", result.Rebroadcast, result.Confirmed, result.Failed),
+	})
+}
+
+// adminCancelHandler stops a payout that hasn't been sent yet. A processing row
+// without a txid is cancelled too, its in-flight send sees the changed row
+// before broadcasting and is aborted, so the payout is never sent.
+func (svc *Service) adminCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID       uint   `json:"id"`
+		TOTPCode string `json:"totp_code"`
+	}
+
+	if !svc.decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	detail := fmt.Sprintf("txn_id=%d", req.ID)
+
+	if svc.require2FA() {
+		if !svc.verify2FA(req.TOTPCode) {
+			svc.audit(r, AuditActionCancel, db.AuditOutcomeDenied, detail)
+			writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	/*
+	 conditional update so a row the batch broadcasts concurrently is never
+	 flipped to cancelled
+	*/
+	res := svc.db.Model(&db.Transaction{}).
+		Where("id = ? AND status IN ? AND onchain_txn_id = ?", req.ID, []string{db.TxnStatusPending, db.TxnStatusProcessing}, "").
+		Updates(map[string]any{
+			"status":    db.TxnStatusCancelled,
+			"error_msg": "cancelled by admin",
+		})
+	if res.Error != nil {
+		svc.logger.Error("failed to cancel transaction", "txn_id", req.ID, "err", res.Error)
+		svc.audit(r, AuditActionCancel, db.AuditOutcomeFailure, detail+" err="+res.Error.Error())
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to cancel transaction")
+		return
+	}
+
+	if res.RowsAffected == 0 {
+		var tx db.Transaction
+		if err := svc.db.First(&tx, req.ID).Error; err != nil {
+			writeJSONError(w, r, http.StatusNotFound, errCodeNotFound, "Transaction not found")
+			return
+		}
+		svc.audit(r, AuditActionCancel, db.AuditOutcomeFailure, detail+" status="+tx.Status)
+		writeJSONError(w, r, http.StatusConflict, errCodeNotCancellable, fmt.Sprintf("Transaction is %s and can no longer be cancelled", tx.Status))
+		return
+	}
+
+	svc.audit(r, AuditActionCancel, db.AuditOutcomeSuccess, detail)
+	svc.logger.Info("admin cancelled transaction", "txn_id", req.ID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"message": "Transaction cancelled",
+	})
+}
+
 func formatCIDRs(nets []net.IPNet) []string {
 	out := make([]string, len(nets))
 	for i, n := range nets {
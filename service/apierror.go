@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrorEnvelopeMediaType opts a client into the {"error": {"code", "message"}}
+// error format when sent in the Accept header. Without it errors keep the
+// original {"error": "message"} shape so existing clients don't break.
+const ErrorEnvelopeMediaType = "application/vnd.faucet.v2+json"
+
+// stable machine readable error codes, clients branch on these and not on
+// the message wording
+const (
+	errCodeInvalidRequest      = "invalid_request"
+	errCodeBodyTooLarge        = "body_too_large"
+	errCodeInvalidAddress      = "invalid_address"
+	errCodeInvalidAmount       = "invalid_amount"
+	errCodeInvalidAmountRange  = "invalid_amount_range"
+	errCodeInvalidFeeRate      = "invalid_fee_rate"
+	errCodeInvalidSettings     = "invalid_settings"
+	errCodeInvalid2FA          = "invalid_2fa"
+	errCodeMessageTooLong      = "message_too_long"
+	errCodeBotCheckFailed      = "bot_check_failed"
+	errCodeTurnstileRequired   = "turnstile_required"
+	errCodeTurnstileFailed     = "turnstile_failed"
+	errCodeAddressBlocked      = "address_blocked"
+	errCodeAddressLimit        = "address_limit_reached"
+	errCodeRequestInProgress   = "request_in_progress"
+	errCodeRateLimited         = "rate_limited"
+	errCodeQueueFull           = "queue_full"
+	errCodeInsufficientBalance = "insufficient_balance"
+	errCodeNotFound            = "not_found"
+	errCodeNotCancellable      = "not_cancellable"
+	errCodeNotConfigured       = "not_configured"
+	errCodeInvalidReceipt      = "invalid_receipt"
+	errCodeSendFailed          = "send_failed"
+	errCodeRPCError            = "rpc_error"
+	errCodeInternal            = "internal_error"
+)
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError writes an error response, as an envelope with code for
+// clients that asked for ErrorEnvelopeMediaType and as a bare message string
+// for everyone else
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if wantsErrorEnvelope(r) {
+		json.NewEncoder(w).Encode(map[string]apiError{"error": {Code: code, Message: msg}})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func wantsErrorEnvelope(r *http.Request) bool {
+	for accept := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), ErrorEnvelopeMediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJSONBody decodes a request body of at most MaxRequestBodyBytes into
+// v. On failure it has already written the error response and returns false.
+func (svc *Service) decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, svc.cfg.MaxRequestBodyBytes)
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, r, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Request body too large")
+		return false
+	}
+	writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
+	return false
+}
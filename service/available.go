@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+// how long /api/available answers from the last check, every page load asks
+const availabilityCacheTTL = 15 * time.Second
+
+// reasons a submission would be turned away right now
+const (
+	unavailableNodeBehind    = "node_behind"
+	unavailableLowBalance    = "low_balance"
+	unavailablePayoutsPaused = "payouts_paused"
+	unavailableQueueFull     = "queue_full"
+)
+
+type availability struct {
+	Available bool     `json:"available"`
+	Reasons   []string `json:"reasons,omitempty"`
+	Message   string   `json:"message,omitempty"`
+}
+
+// checkAvailability tells the page whether a request submitted now would be
+// paid out soon, from the same signals the submit handler and batch processor
+// act on. The result is cached for availabilityCacheTTL.
+func (svc *Service) checkAvailability(ctx context.Context) availability {
+	svc.availabilityMtx.Lock()
+	defer svc.availabilityMtx.Unlock()
+
+	if time.Since(svc.availabilityAt) < availabilityCacheTTL {
+		return svc.availability
+	}
+
+	var reasons []string
+	if err := svc.checkNodeSynced(ctx); err != nil {
+		svc.logger.Debug("faucet unavailable", "reason", unavailableNodeBehind, "err", err)
+		reasons = append(reasons, unavailableNodeBehind)
+	}
+
+	// enough for the smallest payout a user can ask for on top of the reserve
+	smallest := 0.0
+	for i, r := range svc.GetEnabledAmountRanges() {
+		if i == 0 || r.MinBTC < smallest {
+			smallest = r.MinBTC
+		}
+	}
+	if svc.GetCachedWalletBalance()-svc.payoutFloor() < smallest {
+		reasons = append(reasons, unavailableLowBalance)
+	}
+
+	svc.breakerMtx.Lock()
+	paused := svc.breaker.Open
+	svc.breakerMtx.Unlock()
+	if paused {
+		reasons = append(reasons, unavailablePayoutsPaused)
+	}
+
+	if svc.cfg.MaxQueueDepth > 0 && db.GetTransactionCount(svc.db, db.TxnStatusPending) >= int64(svc.cfg.MaxQueueDepth) {
+		reasons = append(reasons, unavailableQueueFull)
+	}
+
+	svc.availability = availability{Available: len(reasons) == 0, Reasons: reasons}
+	if !svc.availability.Available {
+		svc.availability.Message = svc.cfg.UnavailableMessage
+	}
+	svc.availabilityAt = time.Now()
+	return svc.availability
+}
+
+func (svc *Service) availableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	/* the result is cached for everyone, so a client going away must not turn
+	   into node_behind for the next few seconds */
+	json.NewEncoder(w).Encode(svc.checkAvailability(context.WithoutCancel(r.Context())))
+}
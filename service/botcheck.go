@@ -0,0 +1,60 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errHoneypotFilled   = errors.New("honeypot field filled")
+	errInvalidFormToken = errors.New("invalid form token")
+	errFormTooFast      = errors.New("form submitted too fast")
+	errFormExpired      = errors.New("form token expired")
+)
+
+// formToken signs the time the index page was rendered, so submitHandler can
+// tell how long the form was open without keeping any server side state
+func (svc *Service) formToken(renderedAt time.Time) string {
+	ts := strconv.FormatInt(renderedAt.Unix(), 10)
+	return ts + "." + svc.formTokenSignature(ts)
+}
+
+func (svc *Service) formTokenSignature(ts string) string {
+	h := hmac.New(sha256.New, []byte(svc.cfg.AdminCookieSecret))
+	h.Write([]byte("form:" + ts))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checkBot runs the honeypot and form fill time checks, real users never see
+// the honeypot field and need a few seconds to paste an address. Tokens older
+// than MaxFormAge are refused so one scraped from the page can't be replayed
+// forever.
+func (svc *Service) checkBot(honeypot, token string, now time.Time) error {
+	if honeypot != "" {
+		return errHoneypotFilled
+	}
+
+	ts, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(svc.formTokenSignature(ts))) {
+		return errInvalidFormToken
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errInvalidFormToken
+	}
+
+	age := now.Sub(time.Unix(unix, 0))
+	if age < svc.cfg.MinFormFillTime {
+		return errFormTooFast
+	}
+	if svc.cfg.MaxFormAge > 0 && age > svc.cfg.MaxFormAge {
+		return errFormExpired
+	}
+	return nil
+}
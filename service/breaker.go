@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/btc"
+)
+
+var errPayoutsPaused = errors.New("payouts paused, circuit breaker is open")
+
+// PayoutBreakerState is a snapshot of the payout circuit breaker
+type PayoutBreakerState struct {
+	Open                bool
+	ConsecutiveFailures int
+	OpenedAt            time.Time
+	RetryAt             time.Time
+}
+
+func (svc *Service) PayoutBreaker() PayoutBreakerState {
+	svc.breakerMtx.Lock()
+	defer svc.breakerMtx.Unlock()
+	return svc.breaker
+}
+
+func (svc *Service) payoutsPaused() bool {
+	svc.breakerMtx.Lock()
+	defer svc.breakerMtx.Unlock()
+	return svc.breaker.Open
+}
+
+// breakerFailure reports whether a send error says something about the node
+// rather than the payout. Transport errors and timeouts don't come back as an
+// RPC error, of those only the ones where the node isn't ready count. A bad
+// address, a wallet that can't fund the send right now or an OP_RETURN we
+// refused locally would otherwise let a few bad requests pause every payout.
+func breakerFailure(err error) bool {
+	if errors.Is(err, errPayoutChanged) || errors.Is(err, btc.ErrOpReturnTooLong) {
+		return false
+	}
+	var rpcErr *btc.RPCError
+	if errors.As(err, &rpcErr) {
+		return btc.IsNodeUnavailable(err)
+	}
+	return true
+}
+
+// recordSendResult counts consecutive send failures and opens the breaker
+// once PayoutBreakerThreshold is reached, any successful send resets the
+// count and errors caused by the payout itself are ignored
+func (svc *Service) recordSendResult(err error) {
+	if svc.cfg.PayoutBreakerThreshold <= 0 {
+		return
+	}
+
+	if err != nil && !breakerFailure(err) {
+		return
+	}
+
+	svc.breakerMtx.Lock()
+	defer svc.breakerMtx.Unlock()
+
+	if err == nil {
+		svc.breaker.ConsecutiveFailures = 0
+		return
+	}
+
+	svc.breaker.ConsecutiveFailures++
+	if svc.breaker.Open || svc.breaker.ConsecutiveFailures < svc.cfg.PayoutBreakerThreshold {
+		return
+	}
+
+	now := time.Now()
+	svc.breaker.Open = true
+	svc.breaker.OpenedAt = now
+	svc.breaker.RetryAt = now.Add(svc.cfg.PayoutBreakerCooldown)
+	FaucetPayoutsPaused.Set(1)
+
+	svc.logger.Error("pausing payouts after consecutive send failures",
+		"failures", svc.breaker.ConsecutiveFailures,
+		"cooldown", svc.cfg.PayoutBreakerCooldown,
+		"err", err)
+}
+
+// payoutsAllowed reports whether a batch may run. While the breaker is open
+// this waits out the cooldown and then closes it again only if Bitcoin Core
+// answers getblockchaininfo, otherwise the cooldown starts over.
+func (svc *Service) payoutsAllowed(ctx context.Context) bool {
+	svc.breakerMtx.Lock()
+	defer svc.breakerMtx.Unlock()
+
+	if !svc.breaker.Open {
+		return true
+	}
+	if time.Now().Before(svc.breaker.RetryAt) {
+		return false
+	}
+
+	if _, err := svc.rpcClient.GetBlockchainInfo(ctx); err != nil {
+		svc.breaker.RetryAt = time.Now().Add(svc.cfg.PayoutBreakerCooldown)
+		svc.logger.Warn("health check failed, payouts stay paused", "retry_at", svc.breaker.RetryAt, "err", err)
+		return false
+	}
+
+	svc.logger.Info("health check passed, resuming payouts", "paused_for", time.Since(svc.breaker.OpenedAt))
+	svc.breaker = PayoutBreakerState{}
+	FaucetPayoutsPaused.Set(0)
+	return true
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lnliz/go-turnstile"
+)
+
+const (
+	// CaptchaProviderTurnstile is Cloudflare Turnstile, the default
+	CaptchaProviderTurnstile = "turnstile"
+	// CaptchaProviderHCaptcha is hCaptcha, for operators that can't or don't
+	// want to load Cloudflare's widget
+	CaptchaProviderHCaptcha = "hcaptcha"
+
+	hcaptchaSiteverifyURL = "https://api.hcaptcha.com/siteverify"
+
+	// siteverify is on the submit path, don't let a slow provider hold it up
+	captchaVerifyTimeout = 2 * time.Second
+)
+
+// captchaVerifier checks the token a visitor got from solving the captcha
+// widget. ok is false when the provider rejected the token, err is only set
+// when the provider couldn't be asked.
+type captchaVerifier interface {
+	Verify(token string) (ok bool, err error)
+}
+
+func newCaptchaVerifier(cfg *Config, logger *slog.Logger) captchaVerifier {
+	client := &http.Client{Timeout: captchaVerifyTimeout}
+
+	if cfg.CaptchaProvider == CaptchaProviderHCaptcha {
+		return &hcaptchaVerifier{cfg: cfg, logger: logger, endpoint: hcaptchaSiteverifyURL, client: client}
+	}
+
+	t := turnstile.NewTurnstileVerifier(cfg.CaptchaSecret)
+	t.HttpClient = client
+	return &turnstileVerifier{cfg: cfg, logger: logger, client: t}
+}
+
+// checkCaptchaHostname rejects tokens solved on another site, a successful
+// siteverify alone only proves the token is valid for our secret
+func checkCaptchaHostname(cfg *Config, hostname string) error {
+	if cfg.CaptchaExpectedHostname != "" && !strings.EqualFold(hostname, cfg.CaptchaExpectedHostname) {
+		return fmt.Errorf("hostname %q doesn't match %q", hostname, cfg.CaptchaExpectedHostname)
+	}
+	return nil
+}
+
+type turnstileVerifier struct {
+	cfg    *Config
+	logger *slog.Logger
+	client *turnstile.TurnstileVerifier
+}
+
+func (v *turnstileVerifier) Verify(token string) (bool, error) {
+	resp, err := v.client.Verify(token)
+	if err != nil {
+		return false, err
+	}
+	if !resp.Success {
+		return false, nil
+	}
+	if err := v.check(resp); err != nil {
+		v.logger.Warn("rejected turnstile token", "reason", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// check rejects tokens solved on another site or for another widget
+func (v *turnstileVerifier) check(resp *turnstile.TurnstileResponse) error {
+	if err := checkCaptchaHostname(v.cfg, resp.Hostname); err != nil {
+		return err
+	}
+	if v.cfg.TurnstileExpectedAction != "" && resp.Action != v.cfg.TurnstileExpectedAction {
+		return fmt.Errorf("action %q doesn't match %q", resp.Action, v.cfg.TurnstileExpectedAction)
+	}
+	return nil
+}
+
+type hcaptchaVerifier struct {
+	cfg      *Config
+	logger   *slog.Logger
+	endpoint string
+	client   *http.Client
+}
+
+type hcaptchaResponse struct {
+	Success    bool     `json:"success"`
+	Hostname   string   `json:"hostname"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (v *hcaptchaVerifier) Verify(token string) (bool, error) {
+	form := url.Values{
+		"secret":   {v.cfg.CaptchaSecret},
+		"response": {token},
+	}
+	// lets hCaptcha reject tokens solved for another of our site keys
+	if v.cfg.CaptchaSiteKey != "" {
+		form.Set("sitekey", v.cfg.CaptchaSiteKey)
+	}
+
+	res, err := v.client.PostForm(v.endpoint, form)
+	if err != nil {
+		return false, fmt.Errorf("error POST: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("siteverify returned %s", res.Status)
+	}
+
+	var resp hcaptchaResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return false, fmt.Errorf("error decoding response: %w", err)
+	}
+	if !resp.Success {
+		return false, nil
+	}
+	if err := checkCaptchaHostname(v.cfg, resp.Hostname); err != nil {
+		v.logger.Warn("rejected hcaptcha token", "reason", err)
+		return false, nil
+	}
+	return true, nil
+}
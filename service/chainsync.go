@@ -0,0 +1,28 @@
+package service
+
+import (
+	"context"
+	"fmt"
+)
+
+// checkNodeSynced returns an error while the node is still syncing or has
+// fallen behind the headers it knows about. Its UTXO view is stale then, and
+// coins it reports as spendable may already be spent on the real chain.
+func (svc *Service) checkNodeSynced(ctx context.Context) error {
+	if svc.cfg.MinSyncProgress <= 0 && svc.cfg.MaxBlockLag <= 0 {
+		return nil
+	}
+
+	info, err := svc.rpcClient.GetBlockchainInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get blockchain info: %w", err)
+	}
+
+	if svc.cfg.MinSyncProgress > 0 && info.VerificationProgress < svc.cfg.MinSyncProgress {
+		return fmt.Errorf("verification progress %.4f is below %.4f", info.VerificationProgress, svc.cfg.MinSyncProgress)
+	}
+	if lag := info.Headers - info.Blocks; svc.cfg.MaxBlockLag > 0 && lag > svc.cfg.MaxBlockLag {
+		return fmt.Errorf("node is %d blocks behind its headers (max %d)", lag, svc.cfg.MaxBlockLag)
+	}
+	return nil
+}
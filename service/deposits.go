@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/btc"
+)
+
+const depositWebhookTimeout = 10 * time.Second
+
+// depositMonitor spots top ups by comparing the wallet total between balance
+// refreshes. The total includes unconfirmed and immature coins, so change from
+// our own sends never shows up as growth, and the payouts sent since the last
+// refresh are added back so a deposit isn't hidden by them.
+type depositMonitor struct {
+	mtx      sync.Mutex
+	known    bool
+	total    float64
+	outgoing float64
+}
+
+// recordOutgoing notes a payout (amount plus fee) that left the wallet since
+// the last balance refresh. Callers hold walletMtx from the broadcast until
+// it's recorded, so a refresh never sees one without the other.
+func (svc *Service) recordOutgoing(amountBTC float64) {
+	svc.deposits.mtx.Lock()
+	svc.deposits.outgoing += amountBTC
+	svc.deposits.mtx.Unlock()
+}
+
+func walletTotal(balances *btc.Balances) float64 {
+	return balances.Mine.Trusted + balances.Mine.Untrusted + balances.Mine.Immature
+}
+
+// checkDeposit compares balances with the previous refresh and returns the
+// difference once it reaches DepositAlertThreshold. It only does the
+// bookkeeping, reportDeposit announces it.
+func (svc *Service) checkDeposit(balances *btc.Balances) (float64, bool) {
+	total := walletTotal(balances)
+
+	m := &svc.deposits
+	m.mtx.Lock()
+	known, delta := m.known, total-m.total+m.outgoing
+	m.known, m.total, m.outgoing = true, total, 0
+	m.mtx.Unlock()
+
+	// admin sends and consolidation fees aren't tracked, they only ever hide
+	// a deposit and never make one up
+	if !known || svc.cfg.DepositAlertThreshold <= 0 || delta < svc.cfg.DepositAlertThreshold {
+		return 0, false
+	}
+	return delta, true
+}
+
+// reportDeposit counts a deposit found by checkDeposit and posts the webhook,
+// it may take a while so it runs without walletMtx
+func (svc *Service) reportDeposit(amountBTC float64, balances *btc.Balances) {
+	total := walletTotal(balances)
+	FaucetDeposits.Inc()
+	svc.logger.Info("deposit received", "amount_btc", amountBTC, "balance_btc", total)
+
+	if svc.cfg.DepositWebhookURL != "" {
+		if err := svc.postDepositWebhook(amountBTC, total); err != nil {
+			svc.logger.Error("failed to send deposit webhook", "err", err)
+		}
+	}
+}
+
+func (svc *Service) postDepositWebhook(amountBTC, balanceBTC float64) error {
+	body, err := json.Marshal(map[string]any{
+		"event":       "deposit",
+		"amount_btc":  amountBTC,
+		"balance_btc": balanceBTC,
+		"network":     svc.cfg.Network,
+		"time":        time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: depositWebhookTimeout}
+	resp, err := client.Post(svc.cfg.DepositWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lnliz/faucet.coinbin.org/btc"
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+// settings table key the generated donation address is kept under, it's not
+// part of Settings so admins can't change it from the dashboard
+const donationAddressSetting = "donation_address"
+
+// SetupDonationAddress picks the refill address shown on the public page:
+// -donation-address if set, otherwise one generated from the wallet the first
+// time and stored, so every page load shows the same address
+func (svc *Service) SetupDonationAddress(ctx context.Context) error {
+	if svc.cfg.DonationAddress != "" {
+		if err := btc.ValidateAddress(svc.cfg.DonationAddress, svc.cfg.Network); err != nil {
+			return fmt.Errorf("invalid donation address: %w", err)
+		}
+		svc.donationAddress = svc.cfg.DonationAddress
+		return nil
+	}
+
+	values, err := db.GetSettings(svc.db)
+	if err != nil {
+		return fmt.Errorf("failed to load donation address: %w", err)
+	}
+	if v, ok := values[donationAddressSetting]; ok {
+		if err := json.Unmarshal([]byte(v), &svc.donationAddress); err != nil {
+			return fmt.Errorf("failed to decode donation address: %w", err)
+		}
+		return nil
+	}
+
+	address, err := svc.newAddress(ctx, "donation")
+	if err != nil {
+		return fmt.Errorf("failed to generate donation address: %w", err)
+	}
+
+	encoded, _ := json.Marshal(address)
+	if err := db.SaveSettings(svc.db, map[string]string{donationAddressSetting: string(encoded)}); err != nil {
+		return fmt.Errorf("failed to save donation address: %w", err)
+	}
+
+	svc.logger.Info("generated donation address", "address", address)
+	svc.donationAddress = address
+	return nil
+}
+
+// donationURI is a BIP21 URI for the address. Bech32 addresses are case
+// insensitive, upper case lets QR codes use the denser alphanumeric mode.
+func donationURI(address string) string {
+	uri := "bitcoin:" + address
+	if isBech32Address(address) {
+		uri = strings.ToUpper(uri)
+	}
+	return uri
+}
+
+func (svc *Service) donateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if svc.donationAddress == "" {
+		writeJSONError(w, r, http.StatusNotFound, errCodeNotConfigured, "No donation address configured")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"address": svc.donationAddress,
+		"uri":     donationURI(svc.donationAddress),
+	})
+}
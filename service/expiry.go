@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+const expiryCheckInterval = 10 * time.Minute
+
+func (svc *Service) StartExpiryChecker(ctx context.Context, wg *sync.WaitGroup) {
+	svc.logger.Info("starting broadcast expiry checker", "interval", expiryCheckInterval, "expiry", svc.cfg.BroadcastExpiry)
+
+	wg.Go(func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				svc.logger.Info("broadcast expiry checker received shutdown signal")
+				return
+			case <-ticker.C:
+				if _, err := svc.checkExpiredBroadcasts(ctx); err != nil {
+					svc.logger.Error("broadcast expiry check failed", "err", err)
+				}
+			}
+		}
+	})
+}
+
+// checkExpiredBroadcasts marks payouts as expired when their transaction is
+// still unconfirmed BroadcastExpiry after it was sent and no longer in the
+// mempool, and returns how many rows it marked. The age counts from
+// processing_at, a payout that sat in the queue for a while isn't given less
+// time to confirm. Rows are only looked at until they are twice
+// BroadcastExpiry old, so confirmed payouts aren't rechecked forever. Expired rows are not requeued, the wallet may still rebroadcast
+// the original transaction and a second payout would pay the user twice.
+func (svc *Service) checkExpiredBroadcasts(ctx context.Context) (int, error) {
+	now := time.Now()
+
+	var txns []db.Transaction
+	err := svc.db.Where("status = ? AND COALESCE(processing_at, created_at) < ? AND COALESCE(processing_at, created_at) > ?",
+		db.TxnStatusBroadcast,
+		now.Add(-svc.cfg.BroadcastExpiry),
+		now.Add(-2*svc.cfg.BroadcastExpiry)).Find(&txns).Error
+	if err != nil {
+		return 0, err
+	}
+
+	// batched payouts share a txid, look each one up once
+	byTxid := make(map[string][]uint)
+	for _, tx := range txns {
+		byTxid[tx.OnchainTxnID] = append(byTxid[tx.OnchainTxnID], tx.ID)
+	}
+
+	expired := 0
+	for txid, ids := range byTxid {
+		onchain, err := svc.rpcClient.GetTransaction(ctx, txid)
+		if err != nil {
+			svc.logger.Warn("failed to look up broadcast transaction", "txid", txid, "err", err)
+			continue
+		}
+		if onchain.Confirmations > 0 {
+			continue
+		}
+
+		if onchain.Confirmations == 0 {
+			inMempool, err := svc.rpcClient.IsInMempool(ctx, txid)
+			if err != nil {
+				svc.logger.Warn("failed to check mempool", "txid", txid, "err", err)
+				continue
+			}
+			if inMempool {
+				continue
+			}
+		}
+
+		if err := svc.db.Model(&db.Transaction{}).Where("id IN ?", ids).Updates(map[string]any{
+			"status":    db.TxnStatusExpired,
+			"error_msg": "transaction dropped from mempool without confirming",
+		}).Error; err != nil {
+			return expired, err
+		}
+
+		svc.logger.Error("broadcast transaction dropped from mempool, payouts marked expired",
+			"txid", txid,
+			"txn_ids", ids,
+			"confirmations", onchain.Confirmations,
+			"expiry", svc.cfg.BroadcastExpiry)
+		expired += len(ids)
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/btc"
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+var errFastLaneUnavailable = errors.New("fast lane unavailable")
+
+// isFastLane reports whether a submission may skip the batch queue: fast lane
+// has to be enabled and the request has to come from an admin IP or carry one
+// of the configured API keys
+func (svc *Service) isFastLane(apiKey *APIKey, clientIP string) bool {
+	if !svc.cfg.FastLane {
+		return false
+	}
+	return apiKey != nil || svc.isAdminIP(clientIP)
+}
+
+// sendImmediate pays tx right away without an OP_RETURN output. It returns
+// errFastLaneUnavailable when the breaker is open, the spendable balance
+// doesn't cover the amount plus fee or a batch is using the wallet, so the
+// caller can queue the payout for the batch instead.
+func (svc *Service) sendImmediate(ctx context.Context, tx *db.Transaction) (*btc.SendResult, error) {
+	if !svc.payoutsAllowed(ctx) || svc.checkNodeSynced(ctx) != nil {
+		return nil, errFastLaneUnavailable
+	}
+
+	available, err := svc.GetSpendableWalletBalance(ctx)
+	if err != nil || available < tx.AmountBTC+btc.EstimateSendFeeBTC(payoutFeeSatsPerVB) {
+		return nil, errFastLaneUnavailable
+	}
+
+	// a running batch can hold the wallet for a while, don't keep the request waiting on it
+	if !svc.walletMtx.TryLock() {
+		return nil, errFastLaneUnavailable
+	}
+
+	sendCtx, cancel := sendContext(ctx)
+	defer cancel()
+
+	sent, err := svc.rpcClient.SendToAddressWithHook(sendCtx, tx.Address, tx.AmountBTC, payoutFeeSatsPerVB, "", svc.recordTxID(*tx))
+	if err == nil {
+		svc.recordOutgoing(tx.AmountBTC + sent.FeeBTC)
+	}
+	svc.walletMtx.Unlock()
+	svc.recordSendResult(err)
+	if btc.IsInsufficientFunds(err) {
+		// coins locked by a running batch, the queue will get to it
+		return nil, errFastLaneUnavailable
+	}
+	return sent, err
+}
+
+// submitImmediate sends a fast lane payout whose row was created in
+// processing, falling back to the batch queue if it can't be sent right now
+func (svc *Service) submitImmediate(w http.ResponseWriter, r *http.Request, tx *db.Transaction) {
+	sent, err := svc.sendImmediate(r.Context(), tx)
+	if errors.Is(err, errFastLaneUnavailable) {
+		if err := svc.db.Model(tx).Where("status = ?", db.TxnStatusProcessing).Update("status", db.TxnStatusPending).Error; err != nil {
+			svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusPending, "err", err)
+		}
+		svc.logger.Info("fast lane unavailable, address queued", "txn_id", tx.ID, "address", tx.Address)
+		svc.signalBatchFlush()
+		svc.writeQueuedResponse(w, tx)
+		return
+	}
+
+	if err != nil {
+		svc.logger.Error("fast lane send failed", "txn_id", tx.ID, "address", tx.Address, "err", err)
+		if err := svc.db.Model(tx).Where("status = ?", db.TxnStatusProcessing).Updates(map[string]any{
+			"status":    db.TxnStatusFailed,
+			"error_msg": err.Error(),
+		}).Error; err != nil {
+			svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusFailed, "err", err)
+		}
+
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeSendFailed, "Failed to send transaction")
+		return
+	}
+
+	inputs, err := json.Marshal(sent.Inputs)
+	if err != nil {
+		svc.logger.Error("failed to encode funding inputs", "txn_id", tx.ID, "err", err)
+	}
+	updates := map[string]any{
+		"status":         db.TxnStatusBroadcast,
+		"onchain_txn_id": sent.TxID,
+		"funding_inputs": string(inputs),
+		"fee_btc":        sent.FeeBTC,
+	}
+	if svc.cfg.StoreRawTx {
+		updates["raw_tx"] = sent.Hex
+	}
+	if err := svc.db.Model(tx).Where("status = ?", db.TxnStatusProcessing).Updates(updates).Error; err != nil {
+		svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusBroadcast, "err", err)
+	}
+
+	svc.publishPayout(newRecentPayout(*tx, sent.TxID))
+	svc.logger.Info("sent fast lane transaction",
+		"txn_id", tx.ID,
+		"address", tx.Address,
+		"amount_btc", tx.AmountBTC,
+		"txid", sent.TxID,
+		"fee_btc", sent.FeeBTC)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":    true,
+		"txid":       sent.TxID,
+		"message":    "Coins sent!",
+		"amount_btc": tx.AmountBTC,
+		"receipt":    svc.issueReceipt(tx, sent.TxID, time.Now()),
+	})
+}
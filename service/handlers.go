@@ -1,29 +1,88 @@
 package service
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"math"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/lnliz/faucet.coinbin.org/btc"
 	"github.com/lnliz/faucet.coinbin.org/db"
+	"gorm.io/gorm"
 )
 
 func (svc *Service) indexHandler(w http.ResponseWriter, r *http.Request) {
+	formToken := ""
+	if svc.cfg.BotCheck {
+		formToken = svc.formToken(time.Now())
+	}
+
+	walletBalance := svc.GetCachedWalletBalance()
+	enabledRanges := svc.GetEnabledAmountRanges()
+
+	// the smallest and largest payout over all ranges a user can pick
+	var payoutMin, payoutMax float64
+	for i, r := range enabledRanges {
+		if i == 0 || r.MinBTC < payoutMin {
+			payoutMin = r.MinBTC
+		}
+		payoutMax = max(payoutMax, r.MaxBTC)
+	}
+
 	data := map[string]any{
-		"TurnstileSiteKey":    svc.cfg.TurnstileSiteKey,
+		"CaptchaProvider":     svc.cfg.CaptchaProvider,
+		"CaptchaSiteKey":      svc.cfg.CaptchaSiteKey,
+		"TurnstileAction":     svc.cfg.TurnstileExpectedAction,
 		"CommitHash":          CommitHash,
-		"WalletBalance":       svc.GetCachedWalletBalance(),
+		"WalletBalance":       walletBalance,
 		"TotalDistributed":    db.GetTotalAmountSentBTC(svc.db),
-		"EnabledAmountRanges": svc.GetEnabledAmountRanges(),
-		"DefaultAmountRange":  svc.cfg.DefaultAmountRange,
+		"EnabledAmountRanges": enabledRanges,
+		"PayoutMinBTC":        payoutMin,
+		"PayoutMaxBTC":        payoutMax,
+		"PayoutsRemaining":    int64(svc.estimatedPayoutsRemaining(max(walletBalance-svc.payoutFloor(), 0))),
+		"DefaultAmountRange":  svc.Settings().DefaultAmountRange,
+		"BotCheck":            svc.cfg.BotCheck,
+		"FormToken":           formToken,
+		"DonationAddress":     svc.donationAddress,
 	}
 	if err := svc.renderTemplate(w, "index.html", data); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		svc.renderError(w, http.StatusInternalServerError, "Something went wrong loading the faucet, please try again later.")
+	}
+}
+
+const (
+	maxOpReturnMessageLen = 40
+)
+
+// parsePriority maps the submit priority field to a TxnPriority, empty is
+// normal
+func parsePriority(s string) (int, bool) {
+	switch s {
+	case "low":
+		return db.TxnPriorityLow, true
+	case "", "normal":
+		return db.TxnPriorityNormal, true
+	case "high":
+		return db.TxnPriorityHigh, true
+	}
+	return 0, false
+}
+
+// sanitizeOpReturnMessage drops everything that isn't printable ASCII so
+// user supplied messages can't smuggle control chars into the OP_RETURN
+func sanitizeOpReturnMessage(msg string) string {
+	var b strings.Builder
+	for _, c := range msg {
+		if c >= 0x20 && c <= 0x7e {
+			b.WriteRune(c)
+		}
 	}
+	return strings.TrimSpace(b.String())
 }
 
 func (svc *Service) submitHandler(w http.ResponseWriter, r *http.Request) {
@@ -33,130 +92,364 @@ func (svc *Service) submitHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Address        string `json:"address"`
+		Address      string `json:"address"`
+		CaptchaToken string `json:"captcha_token"`
+		// what the page sent before hCaptcha support, still accepted
 		TurnstileToken string `json:"turnstile_token"`
 		AmountRange    int    `json:"amount_range"`
+		// an exact amount within the range, randomized when left out
+		Amount    *float64 `json:"amount"`
+		Message   string   `json:"message"`
+		Website   string   `json:"website"`
+		FormToken string   `json:"form_token"`
+		// low, normal or high, only honored for API key requests
+		Priority string `json:"priority"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+	if !svc.decodeJSONBody(w, r, &req) {
 		return
 	}
 
 	clientIP := svc.getClientIP(r)
+	settings := svc.Settings()
 
-	if svc.cfg.TurnstileSecret != "" {
-		if req.TurnstileToken == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Turnstile verification required"})
+	/*
+	 a valid API key skips the browser checks below and is rate limited per
+	 key instead of per IP, an invalid one is treated as no key at all
+	*/
+	apiKey := svc.apiKeyFromRequest(r)
+
+	message := sanitizeOpReturnMessage(req.Message)
+	if len(message) > maxOpReturnMessageLen {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeMessageTooLong, fmt.Sprintf("Message too long (max %d characters)", maxOpReturnMessageLen))
+		return
+	}
+
+	priority, ok := parsePriority(req.Priority)
+	if !ok {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Invalid priority (low, normal or high)")
+		return
+	}
+	// browser requests can't jump the queue
+	if apiKey == nil {
+		priority = db.TxnPriorityNormal
+	}
+
+	if svc.cfg.BotCheck && apiKey == nil {
+		if err := svc.checkBot(req.Website, req.FormToken, time.Now()); err != nil {
+			svc.logger.Info("rejected submission by bot check", "ip", clientIP, "reason", err)
+			msg := "Invalid request, reload the page and try again"
+			if errors.Is(err, errFormTooFast) {
+				msg = "Submitted too quickly, wait a moment and try again"
+			} else if errors.Is(err, errFormExpired) {
+				msg = "The page has expired, reload it and try again"
+			}
+			writeJSONError(w, r, http.StatusBadRequest, errCodeBotCheckFailed, msg)
 			return
 		}
+	}
 
-		resp, err := svc.turnstile.Verify(req.TurnstileToken)
+	if svc.cfg.CaptchaSecret != "" && apiKey == nil {
+		token := cmp.Or(req.CaptchaToken, req.TurnstileToken)
+		if token == "" {
+			FaucetTurnstileVerifications.WithLabelValues(turnstileResultFailure).Inc()
+			writeJSONError(w, r, http.StatusBadRequest, errCodeTurnstileRequired, "Captcha verification required")
+			return
+		}
+
+		ok, err := svc.captcha.Verify(token)
 		if err != nil {
-			log.Printf("Turnstile verification error: %v", err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Verification failed"})
+			FaucetTurnstileVerifications.WithLabelValues(turnstileResultError).Inc()
+			svc.logger.Error("captcha verification error", "provider", svc.cfg.CaptchaProvider, "ip", clientIP, "err", err)
+			writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Verification failed")
 			return
 		}
 
-		if !resp.Success {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Turnstile verification failed"})
+		if !ok {
+			FaucetTurnstileVerifications.WithLabelValues(turnstileResultFailure).Inc()
+			writeJSONError(w, r, http.StatusBadRequest, errCodeTurnstileFailed, "Captcha verification failed")
 			return
 		}
+		FaucetTurnstileVerifications.WithLabelValues(turnstileResultSuccess).Inc()
 	}
 
-	if err := btc.ValidateSignetAddress(req.Address); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	if err := btc.ValidateAddress(req.Address, svc.cfg.Network); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAddress, err.Error())
 		return
 	}
 
-	if !svc.isAdminIP(clientIP) {
-		var count int64
-		cutoff := time.Now().Add(-24 * time.Hour)
+	if err := svc.checkAddressLists(req.Address); err != nil {
+		svc.logger.Info("rejected listed address", "address", req.Address, "ip", clientIP, "reason", err)
+		msg := "This address is blocked"
+		if errors.Is(err, errAddressNotAllowed) {
+			msg = "This address is not on the allowlist"
+		}
+		writeJSONError(w, r, http.StatusForbidden, errCodeAddressBlocked, msg)
+		return
+	}
+
+	if svc.cfg.MaxQueueDepth > 0 {
+		depth := db.GetTransactionCount(svc.db, db.TxnStatusPending)
+		FaucetQueueDepth.Set(float64(depth))
+		if depth >= int64(svc.cfg.MaxQueueDepth) {
+			svc.logger.Warn("queue full, rejecting request", "depth", depth, "max", svc.cfg.MaxQueueDepth, "ip", clientIP)
+			writeJSONError(w, r, http.StatusServiceUnavailable, errCodeQueueFull, "Faucet temporarily at capacity, try later")
+			return
+		}
+	}
 
-		if err := svc.db.Model(&db.Transaction{}).
-			Where("ip_address = ? AND created_at > ?", clientIP, cutoff).
-			Count(&count).Error; err != nil {
+	ipPrefix := svc.rateLimitPrefix(clientIP)
+
+	if apiKey != nil {
+		count, err := svc.apiKeyUsage(apiKey.ID)
+		if err != nil {
+			svc.logger.Error("failed to count withdrawals", "api_key_id", apiKey.ID, "err", err)
+			writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+			return
+		}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Internal error"})
+		if count >= int64(svc.cfg.APIKeyMaxWithdrawals24h) {
+			msg := fmt.Sprintf("API key rate limit exceeded (max %d per 24h)", svc.cfg.APIKeyMaxWithdrawals24h)
+			writeJSONError(w, r, http.StatusTooManyRequests, errCodeRateLimited, msg)
+			return
+		}
+	} else if !svc.isAdminIP(clientIP) {
+		usage, err := svc.ipUsage(clientIP)
+		if err != nil {
+			svc.logger.Error("failed to count withdrawals", "ip", clientIP, "err", err)
+			writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
 			return
 		}
 
-		if count >= int64(svc.cfg.MaxWithdrawalsPerIP24h) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusTooManyRequests)
-			msg := fmt.Sprintf("Rate limit exceeded (max %d per 24h)", svc.cfg.MaxWithdrawalsPerIP24h)
-			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		if usage.Count >= int64(settings.MaxWithdrawalsPerIP24h) {
+			msg := fmt.Sprintf("Rate limit exceeded (max %d per 24h)", settings.MaxWithdrawalsPerIP24h)
+			writeJSONError(w, r, http.StatusTooManyRequests, errCodeRateLimited, msg)
 			return
 		}
 	}
 
 	amountRange := svc.GetAmountRangeByID(req.AmountRange)
 	if amountRange == nil {
-		amountRange = svc.GetAmountRangeByID(svc.cfg.DefaultAmountRange)
+		amountRange = svc.GetAmountRangeByID(settings.DefaultAmountRange)
 	}
 	if amountRange == nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid amount range"})
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAmountRange, "Invalid amount range")
 		return
 	}
 
 	var addressCount int64
 	svc.db.Model(&db.Transaction{}).Where("address = ?", req.Address).Count(&addressCount)
-	if addressCount >= int64(svc.cfg.MaxDepositsPerAddress) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Address limit reached (max %d)", svc.cfg.MaxDepositsPerAddress)})
+	if addressCount >= int64(settings.MaxDepositsPerAddress) {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeAddressLimit, fmt.Sprintf("Address limit reached (max %d)", settings.MaxDepositsPerAddress))
 		return
 	}
 
-	rangeSats := int((amountRange.MaxBTC - amountRange.MinBTC) * 100_000_000)
-	randSats := rand.Intn(rangeSats)
-	amountBTC := amountRange.MinBTC + 0.00000001*float64(randSats)
+	var amountBTC float64
+	if req.Amount != nil {
+		amountBTC = math.Round(*req.Amount*1e8) / 1e8
+		if amountBTC < amountRange.MinBTC || amountBTC > amountRange.MaxBTC {
+			writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidAmount, fmt.Sprintf("Amount must be between %.8f and %.8f BTC", amountRange.MinBTC, amountRange.MaxBTC))
+			return
+		}
+	} else {
+		amountBTC = svc.payoutAmount(*amountRange, svc.GetCachedWalletBalance())
+	}
+
+	if svc.cfg.MaxLifetimePerAddress > 0 {
+		received, err := db.GetTotalSentToAddress(svc.db, req.Address)
+		if err != nil {
+			svc.logger.Error("failed to sum payouts to address", "address", req.Address, "err", err)
+			writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+			return
+		}
+		if received+amountBTC > svc.cfg.MaxLifetimePerAddress {
+			writeJSONError(w, r, http.StatusBadRequest, errCodeAddressLimit, fmt.Sprintf("Address has reached its lifetime limit of %.8f BTC", svc.cfg.MaxLifetimePerAddress))
+			return
+		}
+	}
+
+	/*
+	 fast lane payouts are sent without an OP_RETURN, requests with a message
+	 still go through the batch so the message isn't dropped
+	*/
+	fastLane := message == "" && svc.isFastLane(apiKey, clientIP)
 
 	tx := db.Transaction{
 		Address:   req.Address,
 		IPAddress: clientIP,
+		IPPrefix:  ipPrefix,
 		AmountBTC: amountBTC,
 		Status:    db.TxnStatusPending,
+		OpReturn:  message,
+		Priority:  priority,
+	}
+	if apiKey != nil {
+		tx.APIKeyID = apiKey.ID
+	}
+	if fastLane {
+		// keeps the batch processor away from it while it's being sent
+		now := time.Now()
+		tx.Status = db.TxnStatusProcessing
+		tx.ProcessingAt = &now
 	}
 
-	if err := svc.db.Create(&tx).Error; err != nil {
-		log.Printf("Failed to create transaction: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to queue address"})
+	/*
+	 nothing in the schema stops a second row for an address, an address
+	 with a payout still queued or being sent is turned away here instead
+	*/
+	svc.submitMtx.Lock()
+	inFlight, err := db.HasInFlightTransaction(svc.db, req.Address)
+	if err != nil {
+		svc.submitMtx.Unlock()
+		svc.logger.Error("failed to check in-flight requests", "address", req.Address, "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
 		return
 	}
+	if inFlight {
+		svc.submitMtx.Unlock()
+		writeJSONError(w, r, http.StatusConflict, errCodeRequestInProgress, "A request for this address is already in progress")
+		return
+	}
+	err = svc.db.Create(&tx).Error
+	svc.submitMtx.Unlock()
+	if err != nil {
+		svc.logger.Error("failed to create transaction", "address", req.Address, "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to queue address")
+		return
+	}
+
+	if fastLane {
+		svc.submitImmediate(w, r, &tx)
+		return
+	}
+
+	svc.logger.Info("address queued",
+		"txn_id", tx.ID,
+		"address", req.Address,
+		"ip", clientIP,
+		"api_key_id", tx.APIKeyID,
+		"amount_btc", amountBTC)
+
+	svc.signalBatchFlush()
+	svc.writeQueuedResponse(w, &tx)
+}
+
+// writeQueuedResponse answers a queued submission with its place in line.
+// The processor pays pending rows by priority and then BatchOrder, BatchSize
+// per BatchInterval, so the rows ahead are the pending ones that sort before
+// this one. That is only a snapshot, later requests with a higher priority or
+// a better place in an amount order may still cut in.
+func (svc *Service) writeQueuedResponse(w http.ResponseWriter, tx *db.Transaction) {
+	samePriority := svc.db.Where("priority = ?", tx.Priority)
+	switch svc.cfg.BatchOrder {
+	case BatchOrderSmallestFirst:
+		samePriority = samePriority.Where("amount_btc < ? OR (amount_btc = ? AND id < ?)", tx.AmountBTC, tx.AmountBTC, tx.ID)
+	case BatchOrderLargestFirst:
+		samePriority = samePriority.Where("amount_btc > ? OR (amount_btc = ? AND id < ?)", tx.AmountBTC, tx.AmountBTC, tx.ID)
+	default:
+		samePriority = samePriority.Where("id < ?", tx.ID)
+	}
+	q := svc.db.Model(&db.Transaction{}).
+		Where("status = ?", db.TxnStatusPending).
+		Where(svc.db.Where("priority > ?", tx.Priority).Or(samePriority))
+
+	var ahead int64
+	if err := q.Count(&ahead).Error; err != nil {
+		svc.logger.Error("failed to count queue position", "txn_id", tx.ID, "err", err)
+	}
 
-	log.Printf("Address queued: %s (IP: %s)", req.Address, clientIP)
+	batches := ahead/int64(svc.cfg.BatchSize) + 1
+	eta := time.Duration(batches) * svc.cfg.BatchInterval
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
-		"success": true,
-		"message": "Address queued, coins are on the way!",
+		"success":                true,
+		"message":                "Address queued, coins are on the way!",
+		"amount_btc":             tx.AmountBTC,
+		"pending_ahead":          ahead,
+		"batch_interval_seconds": svc.cfg.BatchInterval.Seconds(),
+		"eta_seconds":            eta.Seconds(),
+		"receipt":                svc.issueReceipt(tx, "", time.Now()),
 	})
 }
 
+// withdrawalUsage is what counts against the 24h rate limit for an IP
+type withdrawalUsage struct {
+	Count int64
+	// zero if there is nothing in the window
+	Oldest time.Time
+}
+
+// ipUsage counts the withdrawals of the last 24h from clientIP's rate limit
+// subnet, ip_address still matches rows from before ip_prefix was recorded
+func (svc *Service) ipUsage(clientIP string) (withdrawalUsage, error) {
+	var usage withdrawalUsage
+
+	prefix := svc.rateLimitPrefix(clientIP)
+	cutoff := time.Now().Add(-24 * time.Hour)
+	q := func() *gorm.DB {
+		return svc.db.Model(&db.Transaction{}).
+			Where("(ip_prefix = ? OR ip_address = ?) AND created_at > ?", prefix, clientIP, cutoff)
+	}
+
+	if err := q().Count(&usage.Count).Error; err != nil {
+		return usage, err
+	}
+	if usage.Count == 0 {
+		return usage, nil
+	}
+
+	var oldest db.Transaction
+	if err := q().Order("created_at ASC").Limit(1).Find(&oldest).Error; err != nil {
+		return usage, err
+	}
+	usage.Oldest = oldest.CreatedAt
+	return usage, nil
+}
+
+func (svc *Service) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := svc.getClientIP(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	usage, err := svc.ipUsage(clientIP)
+	if err != nil {
+		svc.logger.Error("failed to count withdrawals", "ip", clientIP, "err", err)
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+		return
+	}
+
+	resp := map[string]any{
+		"used":      usage.Count,
+		"unlimited": svc.isAdminIP(clientIP),
+		"resets_at": nil,
+	}
+
+	if !svc.isAdminIP(clientIP) {
+		limit := int64(svc.Settings().MaxWithdrawalsPerIP24h)
+		resp["limit"] = limit
+		resp["remaining"] = max(limit-usage.Count, 0)
+	}
+
+	if !usage.Oldest.IsZero() {
+		resp["resets_at"] = usage.Oldest.Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
 func (svc *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
 	/*
 	 check blockchain
 	*/
-	if _, err := svc.rpcClient.GetBlockchainInfo(); err != nil {
-		log.Printf("Health check: GetBlockchainInfo() err: %v", err)
+	if _, err := svc.rpcClient.GetBlockchainInfo(r.Context()); err != nil {
+		svc.logger.Warn("health check failed", "check", "blockchain", "err", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("unhealthy"))
 		return
@@ -165,8 +458,8 @@ func (svc *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
 	/*
 	 check wallet
 	*/
-	if err := svc.CheckAndLoadBitcoinCoreWallet(); err != nil {
-		log.Printf("Health check: CheckAndLoadBitcoinCoreWallet() err: %v", err)
+	if err := svc.CheckAndLoadBitcoinCoreWallet(r.Context()); err != nil {
+		svc.logger.Warn("health check failed", "check", "wallet", "err", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("unhealthy"))
 		return
@@ -176,7 +469,7 @@ func (svc *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
 	 check DB
 	*/
 	if err := svc.db.Exec("SELECT 1").Error; err != nil {
-		log.Printf("Health check: db access err: %v", err)
+		svc.logger.Warn("health check failed", "check", "db", "err", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("unhealthy"))
 		return
@@ -185,3 +478,53 @@ func (svc *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
+
+const (
+	readyMinVerificationProgress = 0.999
+)
+
+// readyHandler is the readiness counterpart of healthHandler: besides RPC and
+// DB being reachable, the node has to be synced and the wallet loaded
+func (svc *Service) readyHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{
+		"ready":         false,
+		"rpc_ok":        false,
+		"synced":        false,
+		"wallet_loaded": false,
+		"db_ok":         false,
+	}
+
+	if info, err := svc.rpcClient.GetBlockchainInfo(r.Context()); err != nil {
+		svc.logger.Warn("ready check failed", "check", "blockchain", "err", err)
+	} else {
+		resp["rpc_ok"] = true
+		resp["chain"] = info.Chain
+		resp["blocks"] = info.Blocks
+		resp["headers"] = info.Headers
+		resp["verification_progress"] = info.VerificationProgress
+		resp["synced"] = info.VerificationProgress > readyMinVerificationProgress
+	}
+
+	if wallets, err := svc.rpcClient.ListWallets(r.Context()); err != nil {
+		svc.logger.Warn("ready check failed", "check", "wallet", "err", err)
+	} else {
+		resp["wallet_loaded"] = slices.Contains(wallets, svc.cfg.BitcoinCoreWalletName)
+	}
+
+	if err := svc.db.Exec("SELECT 1").Error; err != nil {
+		svc.logger.Warn("ready check failed", "check", "db", "err", err)
+	} else {
+		resp["db_ok"] = true
+	}
+
+	ready := resp["synced"] == true && resp["wallet_loaded"] == true && resp["db_ok"] == true
+	resp["ready"] = ready
+
+	w.Header().Set("Content-Type", "application/json")
+	if ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/btc"
+)
+
+// StartKeypoolRefiller tops the wallet's keypool up every
+// KeypoolRefillInterval, so getnewaddress for consolidations, deposits and
+// the donation address doesn't run dry on a legacy wallet
+func (svc *Service) StartKeypoolRefiller(ctx context.Context, wg *sync.WaitGroup) {
+	svc.logger.Info("starting keypool refiller", "interval", svc.cfg.KeypoolRefillInterval, "size", svc.cfg.KeypoolRefillSize)
+
+	wg.Go(func() {
+		svc.refillKeypool(ctx)
+
+		ticker := time.NewTicker(svc.cfg.KeypoolRefillInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				svc.logger.Info("keypool refiller received shutdown signal")
+				return
+			case <-ticker.C:
+				svc.refillKeypool(ctx)
+			}
+		}
+	})
+}
+
+func (svc *Service) refillKeypool(ctx context.Context) error {
+	if err := svc.rpcClient.KeypoolRefill(ctx, svc.cfg.KeypoolRefillSize); err != nil {
+		FaucetKeypoolRefillErrors.Inc()
+		svc.logger.Error("keypool refill failed", "err", err)
+		return err
+	}
+	svc.logger.Debug("keypool refilled", "size", svc.cfg.KeypoolRefillSize)
+	return nil
+}
+
+// newAddress asks the wallet for a new bech32 address labelled for purpose.
+// When the keypool has run out it is refilled once and the request retried,
+// and the exhaustion is counted so it shows up on a dashboard either way.
+func (svc *Service) newAddress(ctx context.Context, purpose string) (string, error) {
+	address, err := svc.rpcClient.GetNewAddress(ctx, svc.addressLabel(purpose), "bech32")
+	if !btc.IsKeypoolRanOut(err) {
+		return address, err
+	}
+
+	FaucetKeypoolExhausted.WithLabelValues(purpose).Inc()
+	svc.logger.Error("wallet keypool ran out, refilling", "purpose", purpose, "err", err)
+	if refillErr := svc.refillKeypool(ctx); refillErr != nil {
+		return "", err
+	}
+	return svc.rpcClient.GetNewAddress(ctx, svc.addressLabel(purpose), "bech32")
+}
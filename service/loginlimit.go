@@ -0,0 +1,75 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const adminLoginRateWindow = time.Minute
+
+// loginLimiter counts /admin/login requests per client IP in fixed one
+// minute windows
+type loginLimiter struct {
+	mtx       sync.Mutex
+	windows   map[string]*loginWindow
+	nextSweep time.Time
+}
+
+type loginWindow struct {
+	start time.Time
+	count int
+}
+
+// allow counts a request from ip and reports whether it's within limit,
+// retryAfter is when the current window ends
+func (l *loginLimiter) allow(ip string, limit int, now time.Time) (ok bool, retryAfter time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.windows == nil {
+		l.windows = make(map[string]*loginWindow)
+	}
+
+	// drop finished windows now and then so scanners hitting the page from
+	// many addresses don't grow the map forever
+	if now.After(l.nextSweep) {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= adminLoginRateWindow {
+				delete(l.windows, k)
+			}
+		}
+		l.nextSweep = now.Add(adminLoginRateWindow)
+	}
+
+	w, found := l.windows[ip]
+	if !found || now.Sub(w.start) >= adminLoginRateWindow {
+		w = &loginWindow{start: now}
+		l.windows[ip] = w
+	}
+	w.count++
+	return w.count <= limit, w.start.Add(adminLoginRateWindow).Sub(now)
+}
+
+// adminLoginRateLimitMiddleware caps GET and POST requests to the login page
+// per IP, on top of the allowlist this keeps scanners from having every
+// request render the template
+func (svc *Service) adminLoginRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if svc.cfg.AdminLoginRateLimit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientIP := svc.getClientIP(r)
+		ok, retryAfter := svc.loginLimiter.allow(clientIP, svc.cfg.AdminLoginRateLimit, time.Now())
+		if !ok {
+			svc.logger.Warn("admin login rate limited", "ip", clientIP, "method", r.Method)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
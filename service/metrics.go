@@ -1,14 +1,18 @@
 package service
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
-	"log"
+	"math"
+	"net"
 	"net/http"
 	"path"
 	"runtime"
 	"strings"
 	"time"
 
+	"github.com/lnliz/faucet.coinbin.org/btc"
 	"github.com/lnliz/faucet.coinbin.org/db"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -47,6 +51,69 @@ var (
 		},
 	)
 
+	FaucetTotalFeesPaid = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_total_fees_paid_btc",
+			Help: "Total fees paid for broadcast payouts in BTC",
+		},
+	)
+
+	FaucetQueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_queue_depth",
+			Help: "Pending transactions waiting for the next batch",
+		},
+	)
+
+	FaucetRequestsTotal = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_requests_total",
+			Help: "Faucet requests ever queued, any status",
+		},
+	)
+
+	FaucetRequestsLast24h = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_requests_last_24h",
+			Help: "Faucet requests queued in the last 24h",
+		},
+	)
+
+	FaucetUniqueAddressesTotal = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_unique_addresses_total",
+			Help: "Distinct addresses that ever requested coins",
+		},
+	)
+
+	FaucetWalletBalanceBelowThreshold = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_wallet_balance_below_threshold",
+			Help: "Cached wallet balance is below -min-balance (1=below, 0=ok)",
+		},
+	)
+
+	FaucetEstimatedPayoutsRemaining = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_estimated_payouts_remaining",
+			Help: "Estimated number of payouts the cached wallet balance still covers",
+		},
+	)
+
+	FaucetOldestPendingTransactionSeconds = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_oldest_pending_transaction_seconds",
+			Help: "Age of the oldest pending payout request in seconds, 0 if the queue is empty",
+		},
+	)
+
+	FaucetOldestUnconfirmedUTXOSeconds = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_oldest_unconfirmed_utxo_seconds",
+			Help: "Age of the oldest unconfirmed wallet UTXO in seconds, 0 if there is none",
+		},
+	)
+
 	WalletUtxosCounts = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "faucet_wallet_utxos_count",
@@ -55,6 +122,106 @@ var (
 		[]string{"status"},
 	)
 
+	FaucetBatchDeferredTransactions = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_batch_deferred_transactions_total",
+			Help: "Pending transactions left for a later batch due to insufficient balance",
+		},
+	)
+
+	FaucetDeposits = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_deposits_total",
+			Help: "Deposits detected by the balance refresher",
+		},
+	)
+
+	FaucetBatchSkippedNodeBehind = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_batch_skipped_node_behind_total",
+			Help: "Batches skipped because the node wasn't caught up with the chain",
+		},
+	)
+
+	FaucetStaleProcessingReset = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_stale_processing_reset_total",
+			Help: "Transactions stuck in processing that were put back in the queue",
+		},
+	)
+
+	FaucetBatchDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "faucet_batch_duration_seconds",
+			Help:    "Time taken to send a batch of pending transactions",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+		},
+	)
+
+	FaucetBatchSent = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_batch_sent_total",
+			Help: "Transactions broadcast by the batch processor",
+		},
+	)
+
+	FaucetBatchFailed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_batch_failed_total",
+			Help: "Transactions the batch processor failed to send",
+		},
+	)
+
+	FaucetBatchLastSuccess = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_batch_last_success_timestamp_seconds",
+			Help: "Unix time of the last batch that broadcast at least one transaction",
+		},
+	)
+
+	FaucetConsolidations = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_consolidations_total",
+			Help: "Consolidation transactions broadcast, manual and automatic",
+		},
+	)
+
+	FaucetConsolidationUTXOs = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_consolidation_utxos_total",
+			Help: "Small UTXOs swept into consolidation transactions",
+		},
+	)
+
+	FaucetConsolidationErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_consolidation_errors_total",
+			Help: "Consolidation attempts that failed, skipped runs don't count",
+		},
+	)
+
+	FaucetLastConsolidation = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_last_consolidation_timestamp_seconds",
+			Help: "Unix time of the last broadcast consolidation transaction",
+		},
+	)
+
+	FaucetKeypoolExhausted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_keypool_exhausted_total",
+			Help: "getnewaddress calls that failed because the wallet keypool ran out, by purpose",
+		},
+		[]string{"purpose"},
+	)
+
+	FaucetKeypoolRefillErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "faucet_keypool_refill_errors_total",
+			Help: "keypoolrefill calls that failed, scheduled and after the keypool ran out",
+		},
+	)
+
 	FaucetBitcoinHealthy = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "faucet_bitcoin_healthy",
@@ -62,6 +229,21 @@ var (
 		},
 	)
 
+	FaucetPayoutsPaused = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "faucet_payouts_paused",
+			Help: "Payout circuit breaker state (1=paused after repeated send failures, 0=running)",
+		},
+	)
+
+	FaucetTurnstileVerifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faucet_turnstile_verifications_total",
+			Help: "Captcha token checks on submit, Turnstile or hCaptcha (success, failure = token rejected, error = siteverify unreachable)",
+		},
+		[]string{"result"},
+	)
+
 	HttpRequestsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
@@ -80,22 +262,65 @@ var (
 	)
 )
 
-func (svc *Service) CollectMetrics() {
+const (
+	turnstileResultSuccess = "success"
+	turnstileResultFailure = "failure"
+	turnstileResultError   = "error"
+)
+
+func init() {
+	// export every result from the start, also when Turnstile is disabled,
+	// so rate() based alerts have a series to work with
+	for _, result := range []string{turnstileResultSuccess, turnstileResultFailure, turnstileResultError} {
+		FaucetTurnstileVerifications.WithLabelValues(result)
+	}
+}
+
+func (svc *Service) CollectMetrics(ctx context.Context) {
 	totalSentBTC := db.GetTotalAmountSentBTC(svc.db)
 	FaucetTotalAmountSent.Set(totalSentBTC)
+	FaucetTotalFeesPaid.Set(db.GetTotalFeesPaidBTC(svc.db))
+
+	FaucetRequestsTotal.Set(float64(db.GetTotalRequestCount(svc.db)))
+	FaucetRequestsLast24h.Set(float64(db.GetRequestCountSince(svc.db, time.Now().Add(-24*time.Hour))))
+	FaucetUniqueAddressesTotal.Set(float64(db.GetUniqueAddressCount(svc.db)))
 
 	for _, state := range []string{
 		db.TxnStatusBroadcast,
 		db.TxnStatusPending,
 		db.TxnStatusFailed,
+		db.TxnStatusExpired,
+		db.TxnStatusCancelled,
 	} {
 		c := db.GetTransactionCount(svc.db, state)
 		MetricFaucetTransactionCount.WithLabelValues(state).Set(float64(c))
+		if state == db.TxnStatusPending {
+			FaucetQueueDepth.Set(float64(c))
+		}
 	}
 
-	FaucetWalletBalance.Set(svc.GetAvailableWalletBalance())
+	if oldest, ok := db.GetOldestPendingCreatedAt(svc.db); ok {
+		FaucetOldestPendingTransactionSeconds.Set(time.Since(oldest).Seconds())
+	} else {
+		FaucetOldestPendingTransactionSeconds.Set(0)
+	}
 
-	if utxos, err := svc.rpcClient.ListUnspent(0, 9999999); err == nil {
+	if bal, err := svc.GetAvailableWalletBalance(ctx); err != nil {
+		svc.logger.Error("failed to collect wallet balance", "err", err)
+	} else {
+		FaucetWalletBalance.Set(bal)
+	}
+
+	// cached balance, so scrapes don't cost another getbalances call
+	cachedBalance := svc.GetCachedWalletBalance()
+	if cachedBalance < svc.Settings().MinBalance {
+		FaucetWalletBalanceBelowThreshold.Set(1)
+	} else {
+		FaucetWalletBalanceBelowThreshold.Set(0)
+	}
+	FaucetEstimatedPayoutsRemaining.Set(svc.estimatedPayoutsRemaining(cachedBalance))
+
+	if utxos, err := svc.rpcClient.ListUnspent(ctx, 0, 9999999); err == nil {
 		countConfirmed := 0
 		countPending := 0
 		for _, u := range utxos {
@@ -107,9 +332,11 @@ func (svc *Service) CollectMetrics() {
 		}
 		WalletUtxosCounts.WithLabelValues("confirmed").Set(float64(countConfirmed))
 		WalletUtxosCounts.WithLabelValues("pending").Set(float64(countPending))
+
+		FaucetOldestUnconfirmedUTXOSeconds.Set(svc.oldestUnconfirmedUTXOAge(ctx, utxos).Seconds())
 	}
 
-	_, err := svc.rpcClient.GetBlockchainInfo()
+	_, err := svc.rpcClient.GetBlockchainInfo(ctx)
 	if err != nil {
 		FaucetBitcoinHealthy.Set(0)
 	} else {
@@ -117,21 +344,116 @@ func (svc *Service) CollectMetrics() {
 	}
 }
 
-func (svc *Service) StartMetricsHttpServer() {
+// estimatedPayoutsRemaining divides balance by the average payout so far, or
+// by the middle of the default amount range before the first payout
+func (svc *Service) estimatedPayoutsRemaining(balance float64) float64 {
+	avgPayout := db.GetAverageAmountSentBTC(svc.db)
+	if avgPayout <= 0 {
+		if r := svc.GetAmountRangeByID(svc.Settings().DefaultAmountRange); r != nil {
+			avgPayout = (r.MinBTC + r.MaxBTC) / 2
+		}
+	}
+	if avgPayout <= 0 {
+		return 0
+	}
+	return math.Floor(balance / avgPayout)
+}
+
+// oldestUnconfirmedUTXOAge looks up when the wallet received each zero-conf
+// utxo. Receive times are cached per txid, so gettransaction only runs for
+// txids that weren't pending on the previous scrape
+func (svc *Service) oldestUnconfirmedUTXOAge(ctx context.Context, utxos []btc.UTXO) time.Duration {
+	svc.unconfirmedSeenMtx.Lock()
+	defer svc.unconfirmedSeenMtx.Unlock()
+
+	seen := make(map[string]time.Time)
+	for _, u := range utxos {
+		if u.Confirmations > 0 {
+			continue
+		}
+		if _, ok := seen[u.TxID]; ok {
+			continue
+		}
+
+		if t, ok := svc.unconfirmedSeen[u.TxID]; ok {
+			seen[u.TxID] = t
+			continue
+		}
+
+		tx, err := svc.rpcClient.GetTransaction(ctx, u.TxID)
+		if err != nil {
+			svc.logger.Warn("failed to get unconfirmed transaction", "txid", u.TxID, "err", err)
+			continue
+		}
+		seen[u.TxID] = time.Unix(tx.TimeReceived, 0)
+	}
+
+	// drops txids that confirmed since the last scrape
+	svc.unconfirmedSeen = seen
+
+	var oldest time.Duration
+	for _, t := range seen {
+		oldest = max(oldest, time.Since(t))
+	}
+	return oldest
+}
+
+// StartMetricsHttpServer binds MetricsAddr and serves /metrics in the
+// background. Bind errors are returned, the server's Addr is set to the bound
+// address so port 0 can be used, and the caller owns Shutdown.
+func (svc *Service) StartMetricsHttpServer() (*http.Server, error) {
 	FaucetBuildInfo.WithLabelValues(CommitHash, runtime.Version()).Set(1)
 
+	ln, err := net.Listen("tcp", svc.cfg.MetricsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", svc.cfg.MetricsAddr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", svc.MetricsHandler())
+
+	server := &http.Server{
+		Addr:    ln.Addr().String(),
+		Handler: mux,
+	}
+
+	svc.logger.Info("starting metrics server", "addr", server.Addr)
+	if svc.cfg.MetricsAuthToken == "" && !isLoopbackAddr(ln.Addr()) {
+		svc.logger.Warn("metrics server is reachable beyond localhost without auth, set -metrics-auth-token", "addr", server.Addr)
+	}
+
 	go func() {
-		http.Handle("/metrics", svc.MetricsHandler())
-		log.Printf("Starting metrics server: http://%s/metrics", svc.cfg.MetricsAddr)
-		if err := http.ListenAndServe(svc.cfg.MetricsAddr, nil); err != nil {
-			log.Fatalf("Failed to start metrics server: %v", err)
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			svc.logger.Error("metrics server error", "err", err)
 		}
 	}()
+
+	return server, nil
+}
+
+func isLoopbackAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+// metricsAuthorized checks the request against MetricsAuthToken, Prometheus
+// can send it as a bearer token or as the basic auth password
+func (svc *Service) metricsAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, _ = r.BasicAuth()
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(svc.cfg.MetricsAuthToken)) == 1
 }
 
 func (svc *Service) MetricsHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		svc.CollectMetrics()
+		if svc.cfg.MetricsAuthToken != "" && !svc.metricsAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		svc.CollectMetrics(r.Context())
 		promhttp.Handler().ServeHTTP(w, r)
 	})
 }
@@ -146,13 +468,19 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, the live
+// feed needs its Flush
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func normalizeMetricsPath(p string, statusCode int) string {
 	if statusCode == http.StatusNotFound || statusCode == http.StatusTemporaryRedirect {
 		return "/"
 	}
 
 	switch p {
-	case "/", "/api/submit", "/health":
+	case "/", "/api/submit", "/health", "/ready":
 		return p
 	}
 
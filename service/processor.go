@@ -2,22 +2,40 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"slices"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/lnliz/faucet.coinbin.org/btc"
 	"github.com/lnliz/faucet.coinbin.org/db"
+	"gorm.io/gorm"
 )
 
 const (
-	defaultOpReturn = "<3 faucet.coinbin.org <3"
+	drainFeeConfTarget         = 6
+	consolidationFeeConfTarget = 144
 )
 
+// rate batch and fast lane payouts are sent at
+var payoutFeeSatsPerVB = btc.FeeSatsPerVBLowerLimit * 1.15
+
+// payoutSendTimeout bounds one wallet send from funding to broadcast, funding
+// from a wallet with many utxos can take longer than btc.DefaultCallTimeout
+const payoutSendTimeout = 2 * time.Minute
+
+// sendContext detaches a wallet send from ctx, so a send that has started
+// finishes on shutdown instead of stopping between signing and broadcast. The
+// reads around it still stop with ctx.
+func sendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), payoutSendTimeout)
+}
+
 func (svc *Service) StartBatchProcessor(ctx context.Context, wg *sync.WaitGroup) {
-	log.Printf("Starting batch processor with interval: %s", svc.cfg.BatchInterval)
+	svc.logger.Info("starting batch processor", "interval", svc.cfg.BatchInterval)
 
 	wg.Go(func() {
 		ticker := time.NewTicker(svc.cfg.BatchInterval)
@@ -26,19 +44,81 @@ func (svc *Service) StartBatchProcessor(ctx context.Context, wg *sync.WaitGroup)
 		for {
 			select {
 			case <-ctx.Done():
-				log.Println("Batch processor received shutdown signal, finishing current work...")
+				svc.logger.Info("batch processor received shutdown signal, finishing current work")
 				return
 			case <-ticker.C:
-				svc.processBatch()
+				svc.processBatch(ctx)
+			case <-svc.batchFlush:
+				svc.logger.Info("pending payouts reached flush threshold, running batch early", "threshold", svc.cfg.BatchFlushThreshold)
+				svc.processBatch(ctx)
 			}
 		}
 	})
 }
 
-func (svc *Service) processBatch() {
-	pendingTxns, err := db.GetTransactions(svc.db, db.TxnStatusPending, "", 50)
+var errShuttingDown = errors.New("shutting down, payout not attempted")
+
+// errPayoutChanged aborts a send whose rows were cancelled or put back in the
+// queue after they were claimed, broadcasting it could pay them twice
+var errPayoutChanged = errors.New("payout no longer processing")
+
+// readyPending scopes a query to rows the processor may pick up now, pending
+// payouts waiting out a retry backoff are left out
+func (svc *Service) readyPending() *gorm.DB {
+	return svc.db.Where("status = ? AND (next_retry_at IS NULL OR next_retry_at <= ?)", db.TxnStatusPending, time.Now())
+}
+
+// signalBatchFlush wakes the batch processor ahead of its next tick once
+// BatchFlushThreshold payouts are ready, the tick still runs on schedule
+func (svc *Service) signalBatchFlush() {
+	if svc.cfg.BatchFlushThreshold <= 0 {
+		return
+	}
+
+	var ready int64
+	if err := svc.readyPending().Model(&db.Transaction{}).Count(&ready).Error; err != nil {
+		svc.logger.Error("failed to count pending transactions", "err", err)
+		return
+	}
+	if ready < int64(svc.cfg.BatchFlushThreshold) {
+		return
+	}
+
+	select {
+	case svc.batchFlush <- struct{}{}:
+	default:
+		// a flush is already due
+	}
+}
+
+// batchOrderClause is the ORDER BY pending payouts are picked up in. Higher
+// priority always goes first, BatchOrder only orders within a priority and
+// ties on amount go to the older request.
+func batchOrderClause(order string) string {
+	switch order {
+	case BatchOrderSmallestFirst:
+		return "priority DESC, amount_btc ASC, id ASC"
+	case BatchOrderLargestFirst:
+		return "priority DESC, amount_btc DESC, id ASC"
+	default:
+		return "priority DESC, id ASC"
+	}
+}
+
+// processBatch pays out pending transactions. Once ctx is cancelled no new
+// sends are started, the ones in flight finish and the rest go back to pending.
+func (svc *Service) processBatch(ctx context.Context) {
+	if _, err := svc.resetStaleProcessing(); err != nil {
+		svc.logger.Error("failed to reset stale processing transactions", "err", err)
+	}
+
+	if !svc.payoutsAllowed(ctx) {
+		return
+	}
+
+	pendingTxns, err := db.GetTransactions(svc.readyPending(), "", batchOrderClause(svc.cfg.BatchOrder), svc.cfg.BatchSize)
 	if err != nil {
-		log.Printf("Failed to query pending transactions: %v", err)
+		svc.logger.Error("failed to query pending transactions", "err", err)
 		return
 	}
 
@@ -46,61 +126,444 @@ func (svc *Service) processBatch() {
 		return
 	}
 
-	log.Printf("Processing batch of %d transactions", len(pendingTxns))
+	if err := svc.checkNodeSynced(ctx); err != nil {
+		svc.logger.Warn("skipping batch, node not caught up", "transactions", len(pendingTxns), "err", err)
+		FaucetBatchSkippedNodeBehind.Inc()
+		return
+	}
+
+	start := time.Now()
+	svc.logger.Info("processing batch", "transactions", len(pendingTxns))
 
 	totalNeededBTC := 0.0
 	for _, tx := range pendingTxns {
 		totalNeededBTC += tx.AmountBTC
 	}
 
-	availableBalance := svc.GetAvailableWalletBalance()
-	if availableBalance < totalNeededBTC {
-		log.Printf("Insufficient balance: %.8f BTC available - need %.8f BTC for %d transactions",
-			availableBalance, totalNeededBTC, len(pendingTxns))
+	availableBalance, err := svc.GetSpendableWalletBalance(ctx)
+	if err != nil {
+		svc.logger.Error("skipping batch, wallet balance unknown", "transactions", len(pendingTxns), "err", err)
 		return
 	}
+	if availableBalance < totalNeededBTC {
+		if !svc.cfg.PartialBatch {
+			svc.logger.Warn("insufficient balance, skipping batch",
+				"available_btc", availableBalance,
+				"payout_floor_btc", svc.payoutFloor(),
+				"needed_btc", totalNeededBTC,
+				"transactions", len(pendingTxns))
+			FaucetBatchDeferredTransactions.Add(float64(len(pendingTxns)))
+			return
+		}
 
-	sent := 0
-	failed := 0
+		// in FIFO order stop at the first one that doesn't fit, so small late
+		// requests can't jump ahead of a large early one. The amount orders
+		// already chose who goes first, so they keep filling what's left.
+		var affordable []db.Transaction
+		remaining := availableBalance
+		for _, tx := range pendingTxns {
+			if tx.AmountBTC > remaining {
+				if svc.cfg.BatchOrder == BatchOrderFIFO || svc.cfg.BatchOrder == "" {
+					break
+				}
+				continue
+			}
+			remaining -= tx.AmountBTC
+			affordable = append(affordable, tx)
+		}
 
+		deferred := len(pendingTxns) - len(affordable)
+		svc.logger.Warn("insufficient balance, paying partial batch",
+			"available_btc", availableBalance,
+			"payout_floor_btc", svc.payoutFloor(),
+			"needed_btc", totalNeededBTC,
+			"paying", len(affordable),
+			"deferred", deferred)
+		FaucetBatchDeferredTransactions.Add(float64(deferred))
+
+		if len(affordable) == 0 {
+			return
+		}
+		pendingTxns = affordable
+	}
+
+	var queue []db.Transaction
 	for _, tx := range pendingTxns {
-		if err := tx.UpdateStatus(svc.db, db.TxnStatusProcessing); err != nil {
-			log.Printf("Failed to update transaction %d to processing: %v", tx.ID, err)
+		if svc.claimPayout(ctx, &tx) {
+			queue = append(queue, tx)
+		}
+	}
+
+	sent := 0
+	failed := 0
+	requeued := 0
+	retrying := 0
+
+	// RPC sends fan out to the workers, db writes other than recording the
+	// txid before the broadcast stay on this goroutine
+	for res := range svc.sendTransactions(ctx, queue) {
+		tx := res.tx
+		if errors.Is(res.err, errPayoutsPaused) || errors.Is(res.err, errShuttingDown) || errors.Is(res.err, errPayoutChanged) {
+			// never broadcast, back in the queue for the next batch unless an
+			// admin cancelled it in the meantime
+			if err := svc.db.Model(&tx).Where("status = ?", db.TxnStatusProcessing).Update("status", db.TxnStatusPending).Error; err != nil {
+				svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusPending, "err", err)
+			}
+			requeued++
 			continue
 		}
 
-		fees := btc.FeeSatsPerVBLowerLimit * 1.15
-		txid, err := svc.rpcClient.SendToAddressWithOpReturn(
-			tx.Address,
-			tx.AmountBTC,
-			fees,
-			defaultOpReturn,
-		)
+		if btc.IsInsufficientFunds(res.err) && tx.RetryCount < svc.cfg.InsufficientFundsRetries {
+			svc.retryLater(tx, res.err)
+			retrying++
+			continue
+		}
 
-		if err != nil {
-			log.Printf("Failed to send to %s: %v", tx.Address, err)
-			if err := svc.db.Model(&tx).Updates(map[string]any{
+		if res.err != nil {
+			svc.logger.Error("failed to send transaction", "txn_id", tx.ID, "address", tx.Address, "err", res.err)
+			if err := svc.db.Model(&tx).Where("status = ?", db.TxnStatusProcessing).Updates(map[string]any{
 				"status":    db.TxnStatusFailed,
-				"error_msg": err.Error(),
+				"error_msg": res.err.Error(),
 			}).Error; err != nil {
-				log.Printf("Failed to update transaction %d to failed: %v", tx.ID, err)
+				svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusFailed, "err", err)
 			}
 			failed++
 			continue
 		}
 
-		if err := svc.db.Model(&tx).Updates(map[string]any{
+		inputs, err := json.Marshal(res.sent.Inputs)
+		if err != nil {
+			svc.logger.Error("failed to encode funding inputs", "txn_id", tx.ID, "err", err)
+		}
+
+		updates := map[string]any{
 			"status":         db.TxnStatusBroadcast,
-			"onchain_txn_id": txid,
-		}).Error; err != nil {
-			log.Printf("Failed to update transaction %d to sent: %v", tx.ID, err)
+			"onchain_txn_id": res.sent.TxID,
+			"funding_inputs": string(inputs),
+			"fee_btc":        res.sent.FeeBTC,
+		}
+		if svc.cfg.StoreRawTx {
+			updates["raw_tx"] = res.sent.Hex
+		}
+		if err := svc.db.Model(&tx).Where("status = ?", db.TxnStatusProcessing).Updates(updates).Error; err != nil {
+			svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusBroadcast, "err", err)
 		}
 
-		log.Printf("Sent %.8f BTC to %s (txid: %s)", tx.AmountBTC, tx.Address, txid)
+		svc.publishPayout(newRecentPayout(tx, res.sent.TxID))
+		svc.logger.Info("sent transaction",
+			"txn_id", tx.ID,
+			"address", tx.Address,
+			"amount_btc", tx.AmountBTC,
+			"txid", res.sent.TxID,
+			"fee_btc", res.sent.FeeBTC)
 		sent++
 	}
 
-	log.Printf("Batch complete: %d sent, %d failed", sent, failed)
+	duration := time.Since(start)
+	FaucetBatchDuration.Observe(duration.Seconds())
+	FaucetBatchSent.Add(float64(sent))
+	FaucetBatchFailed.Add(float64(failed))
+	if sent > 0 {
+		FaucetBatchLastSuccess.SetToCurrentTime()
+	}
+
+	svc.logger.Info("batch complete", "sent", sent, "failed", failed, "requeued", requeued, "retrying", retrying, "duration", duration)
+}
+
+// claimPayout moves a pending row to processing so it can be sent. A row
+// that already carries a txid was signed by an earlier attempt that may have
+// gone out, it is only sent again if the wallet never saw that transaction.
+func (svc *Service) claimPayout(ctx context.Context, tx *db.Transaction) bool {
+	if tx.OnchainTxnID != "" {
+		onchain, err := svc.rpcClient.GetTransaction(ctx, tx.OnchainTxnID)
+		switch {
+		case btc.IsRPCError(err, btc.RPCErrInvalidAddressOrKey):
+			svc.logger.Warn("earlier attempt was never broadcast, sending again", "txn_id", tx.ID, "txid", tx.OnchainTxnID)
+		case err != nil:
+			svc.logger.Error("failed to look up earlier attempt, leaving payout queued", "txn_id", tx.ID, "txid", tx.OnchainTxnID, "err", err)
+			return false
+		default:
+			status, errMsg := db.TxnStatusBroadcast, ""
+			if onchain.Confirmations < 0 {
+				status, errMsg = db.TxnStatusFailed, "earlier attempt conflicted"
+			}
+			svc.logger.Warn("payout already sent by an earlier attempt, not sending again", "txn_id", tx.ID, "txid", tx.OnchainTxnID, "status", status)
+			if err := svc.db.Model(tx).Where("status = ?", db.TxnStatusPending).Updates(map[string]any{
+				"status":    status,
+				"error_msg": errMsg,
+			}).Error; err != nil {
+				svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", status, "err", err)
+			}
+			return false
+		}
+	}
+
+	// the txid check makes sure nothing recorded one since the row was read
+	now := time.Now()
+	res := svc.db.Model(&db.Transaction{}).
+		Where("id = ? AND status = ? AND onchain_txn_id = ?", tx.ID, db.TxnStatusPending, tx.OnchainTxnID).
+		Updates(map[string]any{"status": db.TxnStatusProcessing, "onchain_txn_id": "", "processing_at": now})
+	if res.Error != nil {
+		svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusProcessing, "err", res.Error)
+		return false
+	}
+	if res.RowsAffected == 0 {
+		svc.logger.Warn("payout changed since it was queried, skipping", "txn_id", tx.ID)
+		return false
+	}
+	tx.Status = db.TxnStatusProcessing
+	tx.OnchainTxnID = ""
+	tx.ProcessingAt = &now
+	return true
+}
+
+// recordTxID returns a hook that stores the txid of a signed transaction on
+// its payout rows before the broadcast. If the process dies before the send is
+// recorded, ReconcileTransactions and claimPayout find the txid and ask the
+// wallet instead of paying out a second time.
+func (svc *Service) recordTxID(txns ...db.Transaction) btc.BeforeBroadcast {
+	ids := make([]uint, len(txns))
+	for i, tx := range txns {
+		ids[i] = tx.ID
+	}
+	return func(txid string) error {
+		return svc.db.Transaction(func(dbtx *gorm.DB) error {
+			res := dbtx.Model(&db.Transaction{}).
+				Where("id IN ? AND status = ?", ids, db.TxnStatusProcessing).
+				Update("onchain_txn_id", txid)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected != int64(len(ids)) {
+				return errPayoutChanged
+			}
+			return nil
+		})
+	}
+}
+
+// retryLater puts a payout the wallet couldn't fund back in the queue. The
+// shortfall is usually temporary, coins locked by another send or change
+// still unconfirmed, so it waits InsufficientFundsBackoff, doubling with
+// every attempt, instead of failing for good.
+func (svc *Service) retryLater(tx db.Transaction, sendErr error) {
+	retryAt := time.Now().Add(svc.retryBackoff(tx.RetryCount))
+
+	svc.logger.Warn("insufficient funds for payout, retrying later",
+		"txn_id", tx.ID,
+		"address", tx.Address,
+		"amount_btc", tx.AmountBTC,
+		"retry", tx.RetryCount+1,
+		"max_retries", svc.cfg.InsufficientFundsRetries,
+		"retry_at", retryAt,
+		"err", sendErr)
+
+	// unless an admin cancelled it in the meantime
+	if err := svc.db.Model(&tx).Where("status = ?", db.TxnStatusProcessing).Updates(map[string]any{
+		"status":        db.TxnStatusPending,
+		"retry_count":   tx.RetryCount + 1,
+		"next_retry_at": retryAt,
+		"error_msg":     sendErr.Error(),
+	}).Error; err != nil {
+		svc.logger.Error("failed to update transaction status", "txn_id", tx.ID, "status", db.TxnStatusPending, "err", err)
+	}
+}
+
+// maxRetryBackoff caps the doubling, a high -insufficient-funds-retries would
+// otherwise push retries out for years or overflow the duration
+const maxRetryBackoff = 24 * time.Hour
+
+// retryBackoff is InsufficientFundsBackoff doubled retryCount times, capped at
+// maxRetryBackoff
+func (svc *Service) retryBackoff(retryCount int) time.Duration {
+	backoff := max(svc.cfg.InsufficientFundsBackoff, 0)
+	for i := 0; i < retryCount && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
+type batchResult struct {
+	tx   db.Transaction
+	sent *btc.SendResult
+	err  error
+}
+
+// sendTransactions broadcasts txns using up to BatchConcurrency parallel
+// workers, the returned channel is closed once every send has finished.
+// The wallet calls themselves take turns on walletMtx, the workers only
+// overlap the bookkeeping around them.
+func (svc *Service) sendTransactions(ctx context.Context, txns []db.Transaction) <-chan batchResult {
+	jobs := make(chan []db.Transaction)
+	results := make(chan batchResult)
+
+	var workers sync.WaitGroup
+	for range max(svc.cfg.BatchConcurrency, 1) {
+		workers.Go(func() {
+			for group := range jobs {
+				var skip error
+				switch {
+				case ctx.Err() != nil:
+					skip = errShuttingDown
+				case svc.payoutsPaused():
+					skip = errPayoutsPaused
+				}
+				if skip != nil {
+					for _, tx := range group {
+						results <- batchResult{tx: tx, err: skip}
+					}
+					continue
+				}
+
+				for _, res := range svc.sendPayoutGroup(ctx, group) {
+					results <- res
+				}
+			}
+		})
+	}
+
+	go func() {
+		for _, group := range groupPayouts(txns, svc.cfg.BatchMaxOutputs) {
+			jobs <- group
+		}
+		close(jobs)
+		workers.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// ReleaseUTXOLocks unlocks the wallet coins this process still holds locked,
+// so they aren't stuck until bitcoind restarts. Only safe once no send can be
+// in flight anymore.
+func (svc *Service) ReleaseUTXOLocks(ctx context.Context) {
+	svc.walletMtx.Lock()
+	defer svc.walletMtx.Unlock()
+
+	n, err := svc.rpcClient.ReleaseLocks(ctx)
+	if err != nil {
+		svc.logger.Error("failed to release utxo locks", "outpoints", n, "err", err)
+		return
+	}
+	if n > 0 {
+		svc.logger.Info("released utxo locks", "outpoints", n)
+	}
+}
+
+// groupPayouts packs txns into groups of at most maxOutputs that can share one
+// transaction. An address can only appear once per transaction, and payouts
+// with their own OP_RETURN message are always sent alone.
+func groupPayouts(txns []db.Transaction, maxOutputs int) [][]db.Transaction {
+	maxOutputs = max(maxOutputs, 1)
+
+	var groups [][]db.Transaction
+	var open []int // indexes of groups that can still take payouts
+
+	for _, tx := range txns {
+		if tx.OpReturn != "" || maxOutputs == 1 {
+			groups = append(groups, []db.Transaction{tx})
+			continue
+		}
+
+		placed := false
+		for i, gi := range open {
+			g := groups[gi]
+			if slices.ContainsFunc(g, func(o db.Transaction) bool { return o.Address == tx.Address }) {
+				continue
+			}
+			groups[gi] = append(g, tx)
+			if len(groups[gi]) == maxOutputs {
+				open = slices.Delete(open, i, i+1)
+			}
+			placed = true
+			break
+		}
+
+		if !placed {
+			groups = append(groups, []db.Transaction{tx})
+			open = append(open, len(groups)-1)
+		}
+	}
+
+	return groups
+}
+
+// sendPayoutGroup pays a group from a single transaction and returns one
+// result per payout, each carrying its share of the fee
+func (svc *Service) sendPayoutGroup(ctx context.Context, group []db.Transaction) []batchResult {
+	ctx, cancel := sendContext(ctx)
+	defer cancel()
+	fees := payoutFeeSatsPerVB
+
+	if len(group) == 1 {
+		tx := group[0]
+		opReturn := tx.OpReturn
+		if opReturn == "" {
+			opReturn = svc.cfg.OpReturn
+		}
+		if opReturn != "" && svc.skipOpReturn(tx.Address) {
+			svc.logger.Info("sending payout without OP_RETURN", "txn_id", tx.ID, "address", tx.Address, "message", tx.OpReturn)
+			opReturn = ""
+		}
+		svc.walletMtx.Lock()
+		sent, err := svc.rpcClient.SendToAddressWithHook(
+			ctx,
+			tx.Address,
+			tx.AmountBTC,
+			fees,
+			opReturn,
+			svc.recordTxID(tx),
+		)
+		if err == nil {
+			svc.recordOutgoing(tx.AmountBTC + sent.FeeBTC)
+		}
+		svc.walletMtx.Unlock()
+		svc.recordSendResult(err)
+		return []batchResult{{tx: tx, sent: sent, err: err}}
+	}
+
+	// one output that mustn't carry an OP_RETURN drops it for the whole group
+	opReturn := svc.cfg.OpReturn
+	outputs := make(map[string]float64, len(group))
+	for _, tx := range group {
+		outputs[tx.Address] = tx.AmountBTC
+		if svc.skipOpReturn(tx.Address) {
+			opReturn = ""
+		}
+	}
+
+	svc.walletMtx.Lock()
+	sent, err := svc.rpcClient.SendManyWithHook(ctx, outputs, fees, opReturn, svc.recordTxID(group...))
+	if err == nil {
+		total := sent.FeeBTC
+		for _, amount := range outputs {
+			total += amount
+		}
+		svc.recordOutgoing(total)
+	}
+	svc.walletMtx.Unlock()
+	if btc.IsRPCError(err, btc.RPCErrInvalidAddressOrKey) {
+		// one bad address sinks the whole transaction, pay the rest one by one
+		svc.logger.Warn("batch transaction rejected an address, sending payouts individually", "outputs", len(group), "err", err)
+		var results []batchResult
+		for _, tx := range group {
+			results = append(results, svc.sendPayoutGroup(ctx, []db.Transaction{tx})...)
+		}
+		return results
+	}
+	svc.recordSendResult(err)
+
+	results := make([]batchResult, len(group))
+	for i, tx := range group {
+		results[i] = batchResult{tx: tx, err: err}
+		if sent != nil {
+			share := *sent
+			share.FeeBTC = sent.FeeBTC / float64(len(group))
+			results[i].sent = &share
+		}
+	}
+	return results
 }
 
 type ConsolidationResult struct {
@@ -112,13 +575,40 @@ type ConsolidationResult struct {
 	SkipReason string
 }
 
-func (svc *Service) ConsolidateUTXOs() (*ConsolidationResult, error) {
-	utxos, err := svc.rpcClient.ListUnspent(0, 9999999)
+// ConsolidateUTXOs sweeps small UTXOs into one output, see consolidateUTXOs,
+// and keeps the consolidation metrics
+func (svc *Service) ConsolidateUTXOs(ctx context.Context) (*ConsolidationResult, error) {
+	result, err := svc.consolidateUTXOs(ctx)
+	if err != nil {
+		FaucetConsolidationErrors.Inc()
+		return nil, err
+	}
+	if result.TxID != "" {
+		FaucetConsolidations.Inc()
+		FaucetConsolidationUTXOs.Add(float64(result.Count))
+		FaucetLastConsolidation.SetToCurrentTime()
+	}
+	return result, nil
+}
+
+func (svc *Service) consolidateUTXOs(ctx context.Context) (*ConsolidationResult, error) {
+	// held from listing to sweeping so no send takes a coin picked here
+	svc.walletMtx.Lock()
+	defer svc.walletMtx.Unlock()
+
+	utxos, err := svc.rpcClient.ListUnspent(ctx, 0, 9999999)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list UTXOs: %w", err)
 	}
 
+	/*
+	 oldest first, then smallest: deeply confirmed coins are the least likely
+	 to be reorged out from under the consolidation tx
+	*/
 	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Confirmations != utxos[j].Confirmations {
+			return utxos[i].Confirmations > utxos[j].Confirmations
+		}
 		return utxos[i].Amount < utxos[j].Amount
 	})
 
@@ -129,6 +619,10 @@ func (svc *Service) ConsolidateUTXOs() (*ConsolidationResult, error) {
 			continue
 		}
 
+		if !utxo.Safe || utxo.Confirmations < svc.cfg.ConsolidationMinConfirmations {
+			continue
+		}
+
 		if utxo.Amount < btc.DustLimitBTC {
 			continue
 		}
@@ -154,23 +648,36 @@ func (svc *Service) ConsolidateUTXOs() (*ConsolidationResult, error) {
 		}, nil
 	}
 
-	newAddress, err := svc.rpcClient.GetNewAddress("consolidated", "bech32")
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate new address: %w", err)
+	// a fixed target keeps the wallet from growing an address per run
+	newAddress := svc.cfg.ConsolidationTargetAddress
+	if newAddress == "" {
+		newAddress, err = svc.newAddress(ctx, "consolidation")
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate new address: %w", err)
+		}
+	}
+
+	feeRate := svc.cfg.ConsolidationFeeRate
+	if feeRate <= 0 {
+		feeRate = svc.estimateFeeRate(ctx, consolidationFeeConfTarget, btc.ConsolidationFeeRateSatsPerVB)
 	}
 
-	txid, err := svc.rpcClient.Consolidate(
+	sendCtx, cancel := sendContext(ctx)
+	defer cancel()
+	sent, err := svc.rpcClient.SweepUTXOs(
+		sendCtx,
 		smallUTXOs,
 		totalAmount,
 		newAddress,
-		defaultOpReturn,
+		svc.cfg.OpReturn,
+		feeRate,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to consolidate: %w", err)
 	}
 
 	return &ConsolidationResult{
-		TxID:    txid,
+		TxID:    sent.TxID,
 		Count:   len(smallUTXOs),
 		Amount:  totalAmount,
 		Address: newAddress,
@@ -178,8 +685,65 @@ func (svc *Service) ConsolidateUTXOs() (*ConsolidationResult, error) {
 	}, nil
 }
 
+// DrainWallet sweeps every spendable UTXO in the wallet to address in a
+// single transaction
+func (svc *Service) DrainWallet(ctx context.Context, address string) (*ConsolidationResult, error) {
+	svc.walletMtx.Lock()
+	defer svc.walletMtx.Unlock()
+
+	utxos, err := svc.rpcClient.ListUnspent(ctx, 0, 9999999)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UTXOs: %w", err)
+	}
+
+	var spendable []btc.UTXO
+	var totalAmount float64
+	for _, utxo := range utxos {
+		if !utxo.Spendable {
+			continue
+		}
+		spendable = append(spendable, utxo)
+		totalAmount += utxo.Amount
+	}
+
+	if len(spendable) == 0 || totalAmount < btc.DustLimitBTC {
+		return nil, fmt.Errorf("wallet balance %.8f BTC is dust, nothing to drain", totalAmount)
+	}
+
+	feeRate := svc.estimateFeeRate(ctx, drainFeeConfTarget, btc.FeeSatsPerVBLowerLimit)
+
+	sendCtx, cancel := sendContext(ctx)
+	defer cancel()
+	sent, err := svc.rpcClient.SweepUTXOs(sendCtx, spendable, totalAmount, address, "", feeRate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to drain wallet: %w", err)
+	}
+
+	return &ConsolidationResult{
+		TxID:    sent.TxID,
+		Count:   len(spendable),
+		Amount:  totalAmount,
+		Address: address,
+		Message: fmt.Sprintf("Drained %d UTXOs (%.8f BTC) to %s", len(spendable), totalAmount, address),
+	}, nil
+}
+
+// estimateFeeRate asks the node for a sat/vB rate for confTarget, falling back
+// to fallback when it has no estimate (common on quiet signets)
+func (svc *Service) estimateFeeRate(ctx context.Context, confTarget int, fallback float64) float64 {
+	feeRate, err := svc.rpcClient.EstimateSmartFee(ctx, confTarget)
+	if err != nil {
+		svc.logger.Warn("fee estimation failed, using fallback",
+			"conf_target", confTarget,
+			"fee_rate_sat_vb", fallback,
+			"err", err)
+		feeRate = fallback
+	}
+	return max(feeRate, btc.FeeSatsPerVBLowerLimit)
+}
+
 func (svc *Service) StartAutoConsolidation(ctx context.Context, wg *sync.WaitGroup) {
-	log.Printf("Starting auto-consolidation with interval: %s", svc.cfg.AutoConsolidationInterval)
+	svc.logger.Info("starting auto-consolidation", "interval", svc.cfg.AutoConsolidationInterval)
 
 	wg.Go(func() {
 		ticker := time.NewTicker(svc.cfg.AutoConsolidationInterval)
@@ -188,15 +752,19 @@ func (svc *Service) StartAutoConsolidation(ctx context.Context, wg *sync.WaitGro
 		for {
 			select {
 			case <-ctx.Done():
-				log.Println("Auto-consolidation received shutdown signal")
+				svc.logger.Info("auto-consolidation received shutdown signal")
 				return
 			case <-ticker.C:
-				result, err := svc.ConsolidateUTXOs()
+				result, err := svc.ConsolidateUTXOs(ctx)
 				if err != nil {
-					log.Printf("Auto-consolidation failed: %v", err)
+					svc.logger.Error("auto-consolidation failed", "err", err)
 					return
 				}
-				log.Printf("Consolidation result: %#v", result)
+				svc.logger.Info("auto-consolidation complete",
+					"txid", result.TxID,
+					"count", result.Count,
+					"amount_btc", result.Amount,
+					"skip_reason", result.SkipReason)
 			}
 		}
 	})
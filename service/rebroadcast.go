@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+// DefaultRebroadcastMinAge is how old a broadcast payout must be before
+// /admin/rebroadcast sends it again, younger ones are likely still propagating
+const DefaultRebroadcastMinAge = 30 * time.Minute
+
+type RebroadcastResult struct {
+	// transactions sent to the node again, a batch counts once
+	Rebroadcast int
+	// confirmed by now, nothing to do
+	Confirmed int
+	Failed    int
+}
+
+// RebroadcastUnconfirmed sends the stored signed transaction of every
+// broadcast payout older than minAge that has no confirmation yet back to the
+// node, for after a signet mempool reset dropped them. Payouts the expiry
+// checker already gave up on are included and go back to broadcast once the
+// node takes them again. It's the same signed transaction, so it can't pay
+// anyone twice. Rows without a raw_tx, sent before it was stored or with
+// -store-raw-tx=false, are skipped.
+func (svc *Service) RebroadcastUnconfirmed(ctx context.Context, minAge time.Duration) (*RebroadcastResult, error) {
+	var txns []db.Transaction
+	err := svc.db.Where("status IN ? AND onchain_txn_id != '' AND raw_tx != '' AND COALESCE(processing_at, created_at) < ?",
+		[]string{db.TxnStatusBroadcast, db.TxnStatusExpired}, time.Now().Add(-minAge)).
+		Order("id ASC").
+		Find(&txns).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to query broadcast transactions: %w", err)
+	}
+
+	result := &RebroadcastResult{}
+	seen := map[string]bool{}
+	for _, tx := range txns {
+		// batched payouts share one transaction
+		if seen[tx.OnchainTxnID] {
+			continue
+		}
+		seen[tx.OnchainTxnID] = true
+
+		if onchain, err := svc.rpcClient.GetTransaction(ctx, tx.OnchainTxnID); err != nil {
+			svc.logger.Warn("failed to look up transaction for rebroadcast", "txn_id", tx.ID, "txid", tx.OnchainTxnID, "err", err)
+		} else if onchain.Confirmations > 0 {
+			svc.unexpire(tx.OnchainTxnID)
+			result.Confirmed++
+			continue
+		}
+
+		if _, err := svc.rpcClient.SendRawTransaction(ctx, tx.RawTx); err != nil {
+			svc.logger.Error("rebroadcast failed", "txn_id", tx.ID, "txid", tx.OnchainTxnID, "err", err)
+			result.Failed++
+			continue
+		}
+		svc.unexpire(tx.OnchainTxnID)
+		svc.logger.Info("rebroadcast transaction", "txn_id", tx.ID, "txid", tx.OnchainTxnID)
+		result.Rebroadcast++
+	}
+
+	return result, nil
+}
+
+// unexpire puts payouts marked expired back to broadcast once their
+// transaction is known to the node again
+func (svc *Service) unexpire(txid string) {
+	err := svc.db.Model(&db.Transaction{}).
+		Where("onchain_txn_id = ? AND status = ?", txid, db.TxnStatusExpired).
+		Updates(map[string]any{"status": db.TxnStatusBroadcast, "error_msg": ""}).Error
+	if err != nil {
+		svc.logger.Error("failed to update transaction status", "txid", txid, "status", db.TxnStatusBroadcast, "err", err)
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+// a receipt for a request that is still queued only proves it was accepted,
+// not that anything was sent
+const (
+	receiptStatusUnconfirmed = "unconfirmed"
+	receiptStatusBroadcast   = "broadcast"
+)
+
+var errInvalidReceipt = errors.New("invalid receipt")
+
+// receipt is what the signed token carries. Amounts are in sats so the
+// signed bytes don't depend on float formatting.
+type receipt struct {
+	Address    string `json:"address"`
+	AmountSats int64  `json:"amount_sats"`
+	TxID       string `json:"txid,omitempty"`
+	IssuedAt   int64  `json:"issued_at"`
+	Status     string `json:"status"`
+}
+
+// receiptResponse is the receipt as submit hands it out and
+// /api/verify-receipt reports it back
+type receiptResponse struct {
+	Address   string  `json:"address"`
+	AmountBTC float64 `json:"amount_btc"`
+	TxID      string  `json:"txid,omitempty"`
+	IssuedAt  int64   `json:"issued_at"`
+	Status    string  `json:"status"`
+	Token     string  `json:"token,omitempty"`
+}
+
+func newReceiptResponse(rc receipt, token string) receiptResponse {
+	return receiptResponse{
+		Address:   rc.Address,
+		AmountBTC: float64(rc.AmountSats) / 1e8,
+		TxID:      rc.TxID,
+		IssuedAt:  rc.IssuedAt,
+		Status:    rc.Status,
+		Token:     token,
+	}
+}
+
+// issueReceipt signs what the user was promised for tx, txid is empty while
+// the request is queued and the receipt is marked unconfirmed
+func (svc *Service) issueReceipt(tx *db.Transaction, txid string, now time.Time) receiptResponse {
+	rc := receipt{
+		Address:    tx.Address,
+		AmountSats: btcToSats(tx.AmountBTC),
+		TxID:       txid,
+		IssuedAt:   now.Unix(),
+		Status:     receiptStatusUnconfirmed,
+	}
+	if txid != "" {
+		rc.Status = receiptStatusBroadcast
+	}
+
+	// can't fail, the struct only holds strings and ints
+	payload, _ := json.Marshal(rc)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return newReceiptResponse(rc, encoded+"."+svc.receiptSignature(encoded))
+}
+
+func (svc *Service) receiptSignature(encoded string) string {
+	h := hmac.New(sha256.New, []byte(svc.cfg.AdminCookieSecret))
+	h.Write([]byte("receipt:" + encoded))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyReceipt checks the signature on a token from issueReceipt and
+// returns what it was issued for
+func (svc *Service) verifyReceipt(token string) (receipt, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(svc.receiptSignature(encoded))) {
+		return receipt{}, errInvalidReceipt
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return receipt{}, errInvalidReceipt
+	}
+	var rc receipt
+	if err := json.Unmarshal(payload, &rc); err != nil {
+		return receipt{}, errInvalidReceipt
+	}
+	return rc, nil
+}
+
+func (svc *Service) verifyReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("receipt")
+	if token == "" {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "Missing receipt")
+		return
+	}
+
+	rc, err := svc.verifyReceipt(token)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidReceipt, "Receipt signature is not valid")
+		return
+	}
+
+	resp := map[string]any{
+		"valid":   true,
+		"receipt": newReceiptResponse(rc, ""),
+	}
+	if rc.Status == receiptStatusUnconfirmed {
+		resp["message"] = "Issued while the request was queued, it does not prove a payout was sent"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+const (
+	// payouts /api/recent returns without ?limit=
+	recentPayoutsDefault = 10
+
+	// live feed connections open at once, each one holds a goroutine
+	maxRecentSubscribers = 100
+
+	// comment line sent on idle streams so proxies don't drop them
+	recentKeepAlive = 30 * time.Second
+)
+
+// recentPayout is the public view of a broadcast payout, the address is
+// shortened and nothing about the requester is included
+type recentPayout struct {
+	Address   string    `json:"address"`
+	AmountBTC float64   `json:"amount"`
+	TxID      string    `json:"txid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newRecentPayout(tx db.Transaction, txid string) recentPayout {
+	return recentPayout{
+		Address:   maskAddress(tx.Address),
+		AmountBTC: tx.AmountBTC,
+		TxID:      txid,
+		CreatedAt: tx.CreatedAt.UTC(),
+	}
+}
+
+// maskAddress keeps the start and end of an address, enough to recognize
+// your own payout in the feed
+func maskAddress(address string) string {
+	if len(address) <= 16 {
+		return address
+	}
+	return address[:8] + "..." + address[len(address)-6:]
+}
+
+func (svc *Service) recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if svc.cfg.RecentPayoutsMax <= 0 {
+		writeJSONError(w, r, http.StatusNotFound, errCodeNotConfigured, "Recent payouts feed is disabled")
+		return
+	}
+
+	limit := min(recentPayoutsDefault, svc.cfg.RecentPayoutsMax)
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(n, svc.cfg.RecentPayoutsMax)
+	}
+
+	txns, err := db.GetTransactions(svc.db, db.TxnStatusBroadcast, "created_at DESC", limit)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+		return
+	}
+
+	payouts := make([]recentPayout, 0, len(txns))
+	for _, tx := range txns {
+		payouts = append(payouts, newRecentPayout(tx, tx.OnchainTxnID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"payouts": payouts,
+	})
+}
+
+// recentStreamHandler pushes every new payout as a server-sent "payout"
+// event, so the landing page can update without polling /api/recent
+func (svc *Service) recentStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if svc.cfg.RecentPayoutsMax <= 0 {
+		writeJSONError(w, r, http.StatusNotFound, errCodeNotConfigured, "Recent payouts feed is disabled")
+		return
+	}
+
+	events, unsubscribe, ok := svc.subscribeRecent()
+	if !ok {
+		writeJSONError(w, r, http.StatusServiceUnavailable, errCodeRateLimited, "Too many live feed connections, try again later")
+		return
+	}
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	// the stream outlives -http-write-timeout, keepalives notice dead clients
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		svc.logger.Warn("failed to clear write deadline for live feed", "err", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		svc.logger.Error("live feed needs a flushable response", "err", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(recentKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-svc.recentDone:
+			return
+		case p := <-events:
+			b, err := json.Marshal(p)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: payout\ndata: %s\n\n", b)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// subscribeRecent registers a live feed listener, ok is false once
+// maxRecentSubscribers are connected
+func (svc *Service) subscribeRecent() (events <-chan recentPayout, unsubscribe func(), ok bool) {
+	svc.recentMtx.Lock()
+	defer svc.recentMtx.Unlock()
+
+	if len(svc.recentSubs) >= maxRecentSubscribers {
+		return nil, nil, false
+	}
+
+	ch := make(chan recentPayout, 16)
+	svc.recentSubs[ch] = struct{}{}
+	return ch, func() {
+		svc.recentMtx.Lock()
+		delete(svc.recentSubs, ch)
+		svc.recentMtx.Unlock()
+	}, true
+}
+
+// publishPayout hands a broadcast payout to the live feed listeners, a slow
+// listener misses events instead of holding up the sender
+func (svc *Service) publishPayout(p recentPayout) {
+	svc.recentMtx.Lock()
+	defer svc.recentMtx.Unlock()
+
+	for ch := range svc.recentSubs {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// stopRecentStreams ends all live feed connections, http.Server.Shutdown
+// would otherwise wait on them until its deadline
+func (svc *Service) stopRecentStreams() {
+	svc.recentDoneOnce.Do(func() {
+		close(svc.recentDone)
+	})
+}
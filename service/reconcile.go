@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/btc"
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+// ReconcileResult counts what ReconcileTransactions did with each stuck row
+type ReconcileResult struct {
+	Pending   int
+	Broadcast int
+	Failed    int
+	Skipped   int
+}
+
+// ReconcileTransactions fixes up rows left in processing by an ungraceful
+// shutdown. It must run before the batch processor starts, otherwise it can't
+// tell a stuck row from one that is being sent right now.
+func (svc *Service) ReconcileTransactions(ctx context.Context) (*ReconcileResult, error) {
+	stuck, err := db.GetTransactions(svc.db, db.TxnStatusProcessing, "id ASC", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReconcileResult{}
+	for _, tx := range stuck {
+		status, errMsg := svc.reconcileStatus(ctx, tx)
+		if status == "" {
+			result.Skipped++
+			continue
+		}
+
+		updates := map[string]any{"status": status}
+		if status == db.TxnStatusPending {
+			updates["onchain_txn_id"] = ""
+		}
+		if errMsg != "" {
+			updates["error_msg"] = errMsg
+		}
+		if err := svc.db.Model(&tx).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+
+		svc.logger.Info("reconciled stuck transaction", "txn_id", tx.ID, "txid", tx.OnchainTxnID, "status", status)
+		switch status {
+		case db.TxnStatusPending:
+			result.Pending++
+		case db.TxnStatusBroadcast:
+			result.Broadcast++
+		case db.TxnStatusFailed:
+			result.Failed++
+		}
+	}
+
+	if len(stuck) > 0 {
+		svc.logger.Warn("reconciled transactions stuck in processing",
+			"total", len(stuck),
+			"pending", result.Pending,
+			"broadcast", result.Broadcast,
+			"failed", result.Failed,
+			"skipped", result.Skipped)
+	}
+
+	return result, nil
+}
+
+// reconcileStatus returns the status a stuck row should move to, or "" if it
+// can't be decided right now and should be left alone
+func (svc *Service) reconcileStatus(ctx context.Context, tx db.Transaction) (string, string) {
+	/*
+	 the txid is recorded before the broadcast, no txid means the crash
+	 happened before anything was signed, so it goes back in the queue
+	*/
+	if tx.OnchainTxnID == "" {
+		return db.TxnStatusPending, ""
+	}
+
+	// the wallet knows every transaction it broadcast, one it never saw was
+	// signed but didn't go out
+	onchain, err := svc.rpcClient.GetTransaction(ctx, tx.OnchainTxnID)
+	if btc.IsRPCError(err, btc.RPCErrInvalidAddressOrKey) {
+		return db.TxnStatusPending, ""
+	}
+	if err != nil {
+		svc.logger.Error("failed to look up stuck transaction", "txn_id", tx.ID, "txid", tx.OnchainTxnID, "err", err)
+		return "", ""
+	}
+
+	// negative confirmations means it conflicts with a confirmed transaction
+	if onchain.Confirmations < 0 {
+		return db.TxnStatusFailed, "transaction conflicted after restart"
+	}
+	return db.TxnStatusBroadcast, ""
+}
+
+// resetStaleProcessing puts rows back in the queue that have been processing
+// for longer than StaleProcessingTimeout, left behind by a send that hung or
+// panicked while the service kept running. A row with a txid was signed and
+// may have gone out, it is only logged and left for ReconcileTransactions on
+// the next start.
+func (svc *Service) resetStaleProcessing() (int, error) {
+	if svc.cfg.StaleProcessingTimeout <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-svc.cfg.StaleProcessingTimeout)
+
+	// rows from before processing_at existed fall back to the request time
+	var stale []db.Transaction
+	err := svc.db.Where("status = ? AND COALESCE(processing_at, created_at) < ?", db.TxnStatusProcessing, cutoff).
+		Order("id ASC").Find(&stale).Error
+	if err != nil {
+		return 0, err
+	}
+
+	reset := 0
+	for _, tx := range stale {
+		if tx.OnchainTxnID != "" {
+			svc.logger.Warn("stale processing transaction has a txid, not resetting", "txn_id", tx.ID, "txid", tx.OnchainTxnID, "processing_at", tx.ProcessingAt)
+			continue
+		}
+
+		// the txid check makes sure a send that finally got through isn't undone
+		res := svc.db.Model(&db.Transaction{}).
+			Where("id = ? AND status = ? AND onchain_txn_id = ?", tx.ID, db.TxnStatusProcessing, "").
+			Updates(map[string]any{"status": db.TxnStatusPending, "processing_at": nil})
+		if res.Error != nil {
+			return reset, res.Error
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+
+		svc.logger.Warn("reset stale processing transaction to pending", "txn_id", tx.ID, "address", tx.Address, "processing_at", tx.ProcessingAt)
+		FaucetStaleProcessingReset.Inc()
+		reset++
+	}
+
+	return reset, nil
+}
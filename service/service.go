@@ -1,24 +1,29 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
+	cryptorand "crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/netip"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/lnliz/faucet.coinbin.org/btc"
 	"github.com/lnliz/faucet.coinbin.org/db"
-	"github.com/lnliz/go-turnstile"
-	"github.com/xlzd/gotp"
 	"gorm.io/gorm"
 )
 
@@ -38,78 +43,396 @@ var AllAmountRanges = []AmountRange{
 
 type Config struct {
 	ListenAddr                      string
+	HTTPReadTimeout                 time.Duration
+	HTTPWriteTimeout                time.Duration
+	MaxRequestBodyBytes             int64
 	MetricsAddr                     string
+	MetricsAuthToken                string
 	DataDir                         string
+	Network                         string
 	BitcoinRPC                      btc.BitcoinRPCConfig
 	BitcoinCoreWalletName           string
+	CreateWallet                    bool
+	DonationAddress                 string
+	AddressLabelTemplate            string
 	BatchInterval                   time.Duration
+	BatchSize                       int
+	BatchOrder                      string
+	BatchFlushThreshold             int
+	BatchConcurrency                int
+	BatchMaxOutputs                 int
+	PartialBatch                    bool
+	InsufficientFundsRetries        int
+	InsufficientFundsBackoff        time.Duration
+	OpReturn                        string
+	NoOpReturnAddresses             []string
+	PayoutBreakerThreshold          int
+	PayoutBreakerCooldown           time.Duration
+	MinSyncProgress                 float64
+	MaxBlockLag                     int64
+	BroadcastExpiry                 time.Duration
+	StaleProcessingTimeout          time.Duration
+	BalanceRefreshInterval          time.Duration
+	StoreRawTx                      bool
 	MinBalance                      float64
-	TurnstileSecret                 string
-	TurnstileSiteKey                string
+	CaptchaProvider                 string
+	CaptchaSecret                   string
+	CaptchaSiteKey                  string
+	CaptchaExpectedHostname         string
+	TurnstileExpectedAction         string
+	BotCheck                        bool
+	MinFormFillTime                 time.Duration
+	MaxFormAge                      time.Duration
 	AdminPassword                   string
 	AdminPath                       string
+	BasePath                        string
 	AdminCookieSecret               string
 	AdminAllowlist                  []net.IPNet
+	TrustedProxies                  []net.IPNet
 	Admin2FASecret                  string
+	AdminSessionHours               int
+	AdminSessionMaxHours            int
+	AdminLoginRateLimit             int
 	ConsolidationAmountThresholdBTC float64
 	MaxConsolidationUTXOs           int
 	MinConsolidationUTXOs           int
+	ConsolidationMinConfirmations   int
+	ConsolidationFeeRate            float64
+	ConsolidationTargetAddress      string
+	ReserveBalance                  float64
+	MinSpendConfirmations           int
 	MaxWithdrawalsPerIP24h          int
+	RateLimitIPv4Prefix             int
+	RateLimitIPv6Prefix             int
 	MaxDepositsPerAddress           int
+	MaxLifetimePerAddress           float64
+	AddressDenylistFile             string
+	AddressAllowlistFile            string
+	MaxQueueDepth                   int
+	RecentPayoutsMax                int
 	AutoConsolidationInterval       time.Duration
+	KeypoolRefillInterval           time.Duration
+	KeypoolRefillSize               int
 	EnabledAmountRanges             []int
 	DefaultAmountRange              int
+	AmountMode                      string
+	AmountDistribution              string
+	AmountTargetBalance             float64
+	BalanceHistoryRetention         time.Duration
+	DepositAlertThreshold           float64
+	DepositWebhookURL               string
+	FastLane                        bool
+	APIKeys                         []APIKey
+	APIKeyMaxWithdrawals24h         int
+	UnavailableMessage              string
+	DevTemplates                    bool
 }
 
 type Service struct {
-	cfg       *Config
-	db        *gorm.DB
-	turnstile *turnstile.TurnstileVerifier
-	totp      *gotp.TOTP
+	cfg     *Config
+	db      *gorm.DB
+	captcha captchaVerifier
 
 	walletBalance    float64
 	walletBalanceMtx sync.RWMutex
 
+	settings    Settings
+	settingsMtx sync.RWMutex
+
+	addressLists    addressLists
+	addressListsMtx sync.RWMutex
+
+	// 2FA secret rotated from the dashboard, overrides cfg.Admin2FASecret
+	totpSecret string
+	pending2FA *pending2FASecret
+	totpMtx    sync.RWMutex
+
+	breaker    PayoutBreakerState
+	breakerMtx sync.Mutex
+
+	// last /api/available answer, see checkAvailability
+	availability    availability
+	availabilityAt  time.Time
+	availabilityMtx sync.Mutex
+
+	loginLimiter loginLimiter
+
+	deposits depositMonitor
+
+	// held across every wallet spending sequence (fund, sign, broadcast and
+	// sweeps) so admin sends, fast lane, batches and consolidation never
+	// pick coins at the same time
+	walletMtx sync.Mutex
+
+	// held from the in-flight address check until the row is created, so
+	// two submits for one address can't both pass the check
+	submitMtx sync.Mutex
+
+	// wakes the batch processor before its next tick, see signalBatchFlush
+	batchFlush chan struct{}
+
+	// live feed listeners of /api/recent/stream
+	recentSubs     map[chan recentPayout]struct{}
+	recentMtx      sync.Mutex
+	recentDone     chan struct{}
+	recentDoneOnce sync.Once
+
+	// txid -> time the wallet first saw it, for unconfirmed utxos only
+	unconfirmedSeen    map[string]time.Time
+	unconfirmedSeenMtx sync.Mutex
+
+	templates     *template.Template
+	templatesOnce sync.Once
+	templatesErr  error
+
 	rpcClient *btc.BitcoinRPCClient
+
+	// refill address shown on the public page, set once at startup
+	donationAddress string
+
+	logger *slog.Logger
 }
 
 var (
 	CommitHash = "<<dev>>"
 )
 
+const (
+	templatesGlob = "templates/*.html"
+
+	// limits of the public server that aren't worth a flag
+	httpReadHeaderTimeout = 10 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+	httpMaxHeaderBytes    = 64 << 10
+
+	DefaultOpReturn = "<3 faucet.coinbin.org <3"
+
+	// DefaultAddressLabelTemplate labels new wallet addresses like
+	// deposit-2024-01-02, see addressLabel
+	DefaultAddressLabelTemplate = "{purpose}-{date}"
+
+	// DefaultUnavailableMessage is shown on the page while new requests
+	// wouldn't be paid out, see checkAvailability
+	DefaultUnavailableMessage = "The faucet is paused right now, please try again later."
+
+	// DefaultPartialBatch pays a batch the balance can't cover in full up to
+	// what it can, -partial-batch=false skips it instead
+	DefaultPartialBatch = true
+
+	// AmountModeFixed pays a uniformly random amount from the whole range
+	AmountModeFixed = "fixed-range"
+	// AmountModeBalanceScaled shrinks the top of the range as the wallet drains
+	AmountModeBalanceScaled = "balance-scaled"
+
+	// AmountDistributionUniform makes every amount in the range equally likely
+	AmountDistributionUniform = "uniform"
+	// AmountDistributionTriangular falls off linearly from the minimum to the
+	// maximum, the average payout is a third of the way up the range
+	AmountDistributionTriangular = "triangular"
+	// AmountDistributionExponential favors small amounts more strongly, see
+	// exponentialRate
+	AmountDistributionExponential = "exponential"
+
+	// BatchOrderFIFO pays pending requests oldest first
+	BatchOrderFIFO = "fifo"
+	// BatchOrderSmallestFirst pays the smallest pending amounts first, so a
+	// short balance covers as many requests as possible
+	BatchOrderSmallestFirst = "smallest-first"
+	// BatchOrderLargestFirst pays the largest pending amounts first
+	BatchOrderLargestFirst = "largest-first"
+)
+
 func NewService(cfg *Config, database *gorm.DB) *Service {
 	rpcClient := btc.NewBitcoinRPCClient(&cfg.BitcoinRPC)
 
-	t := turnstile.NewTurnstileVerifier(cfg.TurnstileSecret)
-	t.HttpClient = &http.Client{Timeout: 2 * time.Second}
-
-	return &Service{
-		cfg:       cfg,
-		db:        database,
-		turnstile: t,
-		totp:      gotp.NewDefaultTOTP(strings.ToUpper(strings.TrimSpace(cfg.Admin2FASecret))),
+	svc := &Service{
+		cfg: cfg,
+		db:  database,
 
 		rpcClient: rpcClient.WithWallet(cfg.BitcoinCoreWalletName),
+		settings:  settingsFromConfig(cfg),
+
+		batchFlush: make(chan struct{}, 1),
+		recentSubs: make(map[chan recentPayout]struct{}),
+		recentDone: make(chan struct{}),
+
+		logger: slog.Default(),
 	}
+	svc.captcha = newCaptchaVerifier(cfg, svc.logger)
+	return svc
+}
+
+// LoadTemplates parses the html templates once, later renders are served from
+// the cached set unless DevTemplates is on
+func (svc *Service) LoadTemplates() error {
+	svc.templatesOnce.Do(func() {
+		svc.templates, svc.templatesErr = svc.parseTemplates()
+	})
+	return svc.templatesErr
 }
 
+// parseTemplates makes {{base}} available to the templates, links to our own
+// pages have to go through it to work under -base-path. Amounts are printed
+// with {{btc}} and {{sats}} so every page formats them the same way.
+func (svc *Service) parseTemplates() (*template.Template, error) {
+	return template.New("").Funcs(template.FuncMap{
+		"base": func() string { return svc.cfg.BasePath },
+		"btc":  formatBTC,
+		"sats": btcToSats,
+	}).ParseGlob(templatesGlob)
+}
+
+// formatBTC prints an amount with at most 8 decimals and no trailing zeros
+func formatBTC(amount float64) string {
+	s := strconv.FormatFloat(amount, 'f', 8, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func btcToSats(amount float64) int64 {
+	return int64(math.Round(amount * 1e8))
+}
+
+// adminURL is the public URL of an admin page, with -base-path in front
+func (svc *Service) adminURL(path string) string {
+	return svc.cfg.BasePath + svc.cfg.AdminPath + path
+}
+
+func (svc *Service) getTemplates() (*template.Template, error) {
+	if svc.cfg.DevTemplates {
+		return svc.parseTemplates()
+	}
+	if err := svc.LoadTemplates(); err != nil {
+		return nil, err
+	}
+	return svc.templates, nil
+}
+
+// renderTemplate renders into a buffer first, so a template that fails half
+// way leaves w untouched and the caller can still send an error page
 func (svc *Service) renderTemplate(w http.ResponseWriter, templateName string, data any) error {
-	tmpl, err := template.ParseGlob("templates/*.html")
+	tmpl, err := svc.getTemplates()
 	if err != nil {
-		log.Printf("Failed to parse templates: %v", err)
+		svc.logger.Error("failed to parse templates", "err", err)
 		return err
 	}
 
-	if err := tmpl.ExecuteTemplate(w, templateName, data); err != nil {
-		log.Printf("Failed to render template %s: %v", templateName, err)
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, templateName, data); err != nil {
+		svc.logger.Error("failed to render template", "template", templateName, "err", err)
 		return err
 	}
 
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// renderError sends the error.html page with status, falling back to plain
+// text when that template can't be rendered either
+func (svc *Service) renderError(w http.ResponseWriter, status int, userMessage string) {
+	tmpl, err := svc.getTemplates()
+	if err == nil {
+		var buf bytes.Buffer
+		err = tmpl.ExecuteTemplate(&buf, "error.html", map[string]any{
+			"Status":     status,
+			"StatusText": http.StatusText(status),
+			"Message":    userMessage,
+			"CommitHash": CommitHash,
+		})
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			buf.WriteTo(w)
+			return
+		}
+	}
+
+	svc.logger.Error("failed to render error page", "err", err)
+	http.Error(w, userMessage, status)
+}
+
+// addressLabel fills in AddressLabelTemplate for a new wallet address.
+// {purpose} is deposit, consolidation or donation, {date} and {time} are UTC.
+func (svc *Service) addressLabel(purpose string) string {
+	now := time.Now().UTC()
+	return strings.NewReplacer(
+		"{purpose}", purpose,
+		"{date}", now.Format(time.DateOnly),
+		"{time}", now.Format("150405"),
+	).Replace(svc.cfg.AddressLabelTemplate)
+}
+
+// CheckBitcoinNetwork makes sure the node runs the chain the faucet is
+// configured for
+func (svc *Service) CheckBitcoinNetwork(ctx context.Context) error {
+	info, err := svc.rpcClient.GetBlockchainInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get blockchain info: %w", err)
+	}
+
+	if !btc.IsNetworkChain(svc.cfg.Network, info.Chain) {
+		return fmt.Errorf("node is on chain '%s', expected %s", info.Chain, svc.cfg.Network)
+	}
+
 	return nil
 }
 
-func (svc *Service) CheckAndLoadBitcoinCoreWallet() error {
-	wallets, err := svc.rpcClient.ListWallets()
+// BitcoinStatus is what CheckBitcoinConnection found out about the node and
+// the faucet wallet
+type BitcoinStatus struct {
+	Chain                string
+	Blocks               int64
+	Headers              int64
+	VerificationProgress float64
+	Wallet               string
+	Balance              btc.WalletBalance
+	UTXOs                int
+}
+
+// CheckBitcoinConnection runs the startup checks against bitcoind without
+// changing anything but loading the wallet, for -check
+func (svc *Service) CheckBitcoinConnection(ctx context.Context) (*BitcoinStatus, error) {
+	info, err := svc.rpcClient.GetBlockchainInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blockchain info: %w", err)
+	}
+	status := &BitcoinStatus{
+		Chain:                info.Chain,
+		Blocks:               info.Blocks,
+		Headers:              info.Headers,
+		VerificationProgress: info.VerificationProgress,
+		Wallet:               svc.cfg.BitcoinCoreWalletName,
+	}
+	if !btc.IsNetworkChain(svc.cfg.Network, info.Chain) {
+		return status, fmt.Errorf("node is on chain '%s', expected %s - check -network and -bitcoin-rpc-host", info.Chain, svc.cfg.Network)
+	}
+
+	if err := svc.CheckAndLoadBitcoinCoreWallet(ctx); err != nil {
+		return status, err
+	}
+
+	balances, err := svc.rpcClient.GetBalances(ctx)
+	if err != nil {
+		return status, fmt.Errorf("failed to get wallet balance: %w", err)
+	}
+	status.Balance = balances.Mine
+
+	utxos, err := svc.rpcClient.ListUnspent(ctx, 0, 9999999)
+	if err != nil {
+		return status, fmt.Errorf("failed to list wallet UTXOs: %w", err)
+	}
+	status.UTXOs = len(utxos)
+
+	return status, nil
+}
+
+func (svc *Service) CheckAndLoadBitcoinCoreWallet(ctx context.Context) error {
+	wallets, err := svc.rpcClient.ListWallets(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to list wallets: %w", err)
 	}
@@ -117,25 +440,73 @@ func (svc *Service) CheckAndLoadBitcoinCoreWallet() error {
 	faucetWalletFound := slices.Contains(wallets, svc.cfg.BitcoinCoreWalletName)
 
 	if !faucetWalletFound {
-		log.Printf("'%s' wallet not loaded, attempting to load it...", svc.cfg.BitcoinCoreWalletName)
-		if err := svc.rpcClient.LoadWallet(svc.cfg.BitcoinCoreWalletName); err != nil {
-			return fmt.Errorf("'%s' wallet not found or failed to load - please create it with: bitcoin-cli -signet createwallet %s (error: %v)",
+		svc.logger.Info("wallet not loaded, attempting to load it", "wallet", svc.cfg.BitcoinCoreWalletName)
+		if err := svc.rpcClient.LoadWallet(ctx, svc.cfg.BitcoinCoreWalletName); err != nil {
+			return fmt.Errorf("'%s' wallet not found or failed to load - please create it with: bitcoin-cli -%s createwallet %s or start with -create-wallet (error: %w)",
 				svc.cfg.BitcoinCoreWalletName,
+				svc.cfg.Network,
 				svc.cfg.BitcoinCoreWalletName,
 				err)
 		}
-		log.Printf("'%s' wallet loaded successfully", svc.cfg.BitcoinCoreWalletName)
+		svc.logger.Info("wallet loaded", "wallet", svc.cfg.BitcoinCoreWalletName)
+	}
+
+	return nil
+}
+
+// CheckWalletPassphrase unlocks the wallet once at startup so a wrong
+// -wallet-passphrase fails right away instead of on the first payout
+func (svc *Service) CheckWalletPassphrase(ctx context.Context) error {
+	if svc.cfg.BitcoinRPC.WalletPassphrase == "" {
+		return nil
 	}
+	return svc.rpcClient.WalletPassphrase(ctx, svc.cfg.BitcoinRPC.WalletPassphrase, btc.WalletUnlockSeconds)
+}
+
+// CheckConsolidationTarget makes sure -consolidation-target-address belongs
+// to the wallet, consolidating into anything else would send the funds away
+func (svc *Service) CheckConsolidationTarget(ctx context.Context) error {
+	if svc.cfg.ConsolidationTargetAddress == "" {
+		return nil
+	}
+	info, err := svc.rpcClient.GetAddressInfo(ctx, svc.cfg.ConsolidationTargetAddress)
+	if err != nil {
+		return err
+	}
+	if !info.IsMine {
+		return fmt.Errorf("%s is not an address of wallet '%s'", svc.cfg.ConsolidationTargetAddress, svc.cfg.BitcoinCoreWalletName)
+	}
+	return nil
+}
+
+// SetupBitcoinCoreWallet loads the wallet at startup and, with -create-wallet,
+// creates it if bitcoind has no wallet by that name. The ready check only
+// ever loads, so a wallet that goes missing later is never silently replaced.
+func (svc *Service) SetupBitcoinCoreWallet(ctx context.Context) error {
+	err := svc.CheckAndLoadBitcoinCoreWallet(ctx)
+	if err == nil || !svc.cfg.CreateWallet || !btc.IsRPCError(err, btc.RPCErrWalletNotFound) {
+		return err
+	}
+
+	svc.logger.Info("wallet does not exist, creating it", "wallet", svc.cfg.BitcoinCoreWalletName)
+	if err := svc.rpcClient.CreateWallet(ctx, svc.cfg.BitcoinCoreWalletName, true); err != nil {
+		return fmt.Errorf("failed to create wallet '%s': %w", svc.cfg.BitcoinCoreWalletName, err)
+	}
+	svc.logger.Info("wallet created", "wallet", svc.cfg.BitcoinCoreWalletName)
 
 	return nil
 }
 
 func (svc *Service) isAdminIP(clientIP string) bool {
-	ip := net.ParseIP(clientIP)
+	return ipInNets(clientIP, svc.cfg.AdminAllowlist)
+}
+
+func ipInNets(s string, nets []net.IPNet) bool {
+	ip := net.ParseIP(normalizeIP(s))
 	if ip == nil {
 		return false
 	}
-	for _, cidr := range svc.cfg.AdminAllowlist {
+	for _, cidr := range nets {
 		if cidr.Contains(ip) {
 			return true
 		}
@@ -148,7 +519,7 @@ func (svc *Service) adminIPAllowlistMiddleware(next http.Handler) http.Handler {
 		clientIP := svc.getClientIP(r)
 
 		if !svc.isAdminIP(clientIP) {
-			log.Printf("Admin - denied access, [ip=%s] [path=%s]", clientIP, r.URL.Path)
+			svc.logger.Warn("admin access denied", "ip", clientIP, "method", r.Method, "path", r.URL.Path)
 			http.Error(w, "Access denied", http.StatusForbidden)
 			return
 		}
@@ -161,26 +532,73 @@ func (svc *Service) adminAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("admin_session")
 		if err != nil {
-			http.Redirect(w, r, svc.cfg.AdminPath+"/login", http.StatusFound)
+			http.Redirect(w, r, svc.adminURL("/login"), http.StatusFound)
 			return
 		}
 
 		sessionID, valid := svc.validateSessionCookie(cookie.Value)
 		if !valid {
-			http.Redirect(w, r, svc.cfg.AdminPath+"/login", http.StatusFound)
+			http.Redirect(w, r, svc.adminURL("/login"), http.StatusFound)
 			return
 		}
 
 		var session db.AdminSession
 		if err := svc.db.Where("session_id = ? AND expires_at > ?", sessionID, time.Now()).First(&session).Error; err != nil {
-			http.Redirect(w, r, svc.cfg.AdminPath+"/login", http.StatusFound)
+			http.Redirect(w, r, svc.adminURL("/login"), http.StatusFound)
 			return
 		}
 
+		svc.slideAdminSession(w, &session)
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// adminCSRFMiddleware rejects state-changing requests that don't carry the
+// CSRF token bound to the caller's admin session
+func (svc *Service) adminCSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !svc.validateCSRF(r) {
+			svc.logger.Warn("admin csrf check failed", "ip", svc.getClientIP(r), "method", r.Method, "path", r.URL.Path)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (svc *Service) sessionIDFromRequest(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie("admin_session")
+	if err != nil {
+		return "", false
+	}
+	return svc.validateSessionCookie(cookie.Value)
+}
+
+func (svc *Service) csrfToken(sessionID string) string {
+	h := hmac.New(sha256.New, []byte(svc.cfg.AdminCookieSecret))
+	h.Write([]byte("csrf:" + sessionID))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (svc *Service) validateCSRF(r *http.Request) bool {
+	sessionID, ok := svc.sessionIDFromRequest(r)
+	if !ok {
+		return false
+	}
+
+	provided := r.Header.Get("X-CSRF-Token")
+	if provided == "" {
+		provided = r.FormValue("csrf_token")
+	}
+	if provided == "" {
+		return false
+	}
+
+	return hmac.Equal([]byte(provided), []byte(svc.csrfToken(sessionID)))
+}
+
 func (svc *Service) signCookie(value string) string {
 	h := hmac.New(sha256.New, []byte(svc.cfg.AdminCookieSecret))
 	h.Write([]byte(value))
@@ -208,24 +626,71 @@ func (svc *Service) validateSessionCookie(cookie string) (string, bool) {
 	return sessionID, true
 }
 
-func (svc *Service) GetAvailableWalletBalance() float64 {
-	balances, err := svc.rpcClient.GetBalances()
+// GetAvailableWalletBalance sums the UTXOs the wallet can fund a payout from
+// right now: spendable, safe and with at least MinSpendConfirmations. The
+// getbalances totals also count change that hasn't confirmed yet, which made
+// batches fail when they tried to spend it.
+func (svc *Service) GetAvailableWalletBalance(ctx context.Context) (float64, error) {
+	utxos, err := svc.rpcClient.ListUnspent(ctx, svc.cfg.MinSpendConfirmations, 9999999)
 	if err != nil {
-		log.Printf("Failed to get balances: %v", err)
-		return 0.0
+		return 0, fmt.Errorf("failed to list unspent: %w", err)
+	}
+
+	total := 0.0
+	for _, u := range utxos {
+		if u.Spendable && u.Safe {
+			total += u.Amount
+		}
+	}
+	return total, nil
+}
+
+// normalizeIP returns the canonical form of an IP, so "[::1]" and
+// "0:0:0:0:0:0:0:1" count as the same client as "::1". Anything that doesn't
+// parse is returned trimmed but otherwise as is.
+func normalizeIP(s string) string {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); ip != nil {
+		return ip.String()
 	}
-	return balances.Mine.Trusted + balances.Mine.Untrusted
+	return s
 }
 
+// getClientIP only honors the forwarding headers when the connection comes
+// from one of the TrustedProxies, anyone else could just set them to dodge
+// the rate limits. The result is normalized with normalizeIP.
 func (svc *Service) getClientIP(r *http.Request) string {
+	return normalizeIP(svc.rawClientIP(r))
+}
+
+func (svc *Service) rawClientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	if !svc.isTrustedProxy(remoteIP) {
+		return remoteIP
+	}
+
 	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
 		return ip
 	}
 
+	/*
+	 proxies append to X-Forwarded-For, so walk it from the right and take
+	 the first hop we don't trust, entries left of that are client supplied
+	*/
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if ip == "" {
+				continue
+			}
+			if i == 0 || !svc.isTrustedProxy(ip) {
+				return ip
+			}
 		}
 	}
 
@@ -233,11 +698,32 @@ func (svc *Service) getClientIP(r *http.Request) string {
 		return xri
 	}
 
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return remoteIP
+}
+
+func (svc *Service) isTrustedProxy(ip string) bool {
+	return ipInNets(ip, svc.cfg.TrustedProxies)
+}
+
+// rateLimitPrefix normalizes ip to the subnet rate limits are counted on, so
+// cycling through addresses of one /24 or /64 doesn't reset the limit
+func (svc *Service) rateLimitPrefix(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	bits := svc.cfg.RateLimitIPv6Prefix
+	if addr.Is4() {
+		bits = svc.cfg.RateLimitIPv4Prefix
+	}
+
+	prefix, err := addr.Prefix(bits)
 	if err != nil {
-		return r.RemoteAddr
+		return ip
 	}
-	return ip
+	return prefix.String()
 }
 
 func (svc *Service) StartService() *http.Server {
@@ -251,39 +737,75 @@ func (svc *Service) StartService() *http.Server {
 		http.NotFound(w, r)
 	})
 	mux.HandleFunc("/api/submit", svc.submitHandler)
+	mux.HandleFunc("/api/quota", svc.quotaHandler)
+	mux.HandleFunc("/api/donate-address", svc.donateAddressHandler)
+	mux.HandleFunc("/api/recent", svc.recentHandler)
+	mux.HandleFunc("/api/recent/stream", svc.recentStreamHandler)
+	mux.HandleFunc("/api/available", svc.availableHandler)
+	mux.HandleFunc("/api/verify-receipt", svc.verifyReceiptHandler)
 	mux.HandleFunc("/health", svc.healthHandler)
+	mux.HandleFunc("/ready", svc.readyHandler)
 
 	adminMux := http.NewServeMux()
-	adminMux.HandleFunc(svc.cfg.AdminPath+"/login", svc.adminLoginPageHandler)
+	adminMux.Handle(svc.cfg.AdminPath+"/login", svc.adminLoginRateLimitMiddleware(http.HandlerFunc(svc.adminLoginPageHandler)))
 	adminMux.Handle(svc.cfg.AdminPath+"/", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminDashboardHandler)))
-	adminMux.Handle(svc.cfg.AdminPath+"/logout", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminLogoutHandler)))
+	adminMux.Handle(svc.cfg.AdminPath+"/logout", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminLogoutHandler))))
 	adminMux.Handle(svc.cfg.AdminPath+"/balance", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminGetBalanceHandler)))
+	adminMux.Handle(svc.cfg.AdminPath+"/refresh-balance", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminRefreshBalanceHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/fee-estimate", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminFeeEstimateHandler)))
+	adminMux.Handle(svc.cfg.AdminPath+"/balance-history", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminBalanceHistoryHandler)))
 	adminMux.Handle(svc.cfg.AdminPath+"/getnewaddress", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminGetNewAddressHandler)))
-	adminMux.Handle(svc.cfg.AdminPath+"/sendfunds", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminSendFundsHandler)))
+	adminMux.Handle(svc.cfg.AdminPath+"/sendfunds", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminSendFundsHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/audit", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminAuditHandler)))
+	adminMux.Handle(svc.cfg.AdminPath+"/transaction", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminTransactionHandler)))
+	adminMux.Handle(svc.cfg.AdminPath+"/search", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminSearchHandler)))
 	adminMux.Handle(svc.cfg.AdminPath+"/utxos", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminGetUTXOsHandler)))
-	adminMux.Handle(svc.cfg.AdminPath+"/consolidate", svc.adminAuthMiddleware(http.HandlerFunc(svc.adminConsolidateUTXOsHandler)))
+	adminMux.Handle(svc.cfg.AdminPath+"/consolidate", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminConsolidateUTXOsHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/cancel", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminCancelHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/drain", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminDrainHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/rebroadcast", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminRebroadcastHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/settings", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminSettingsHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/rotate-2fa", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminRotate2FAHandler))))
+	adminMux.Handle(svc.cfg.AdminPath+"/rotate-2fa/confirm", svc.adminAuthMiddleware(svc.adminCSRFMiddleware(http.HandlerFunc(svc.adminConfirm2FAHandler))))
 
 	finalMux := http.NewServeMux()
 	finalMux.Handle("/", mux)
 	finalMux.Handle(svc.cfg.AdminPath+"/", svc.adminIPAllowlistMiddleware(adminMux))
 
+	/*
+	 behind a proxy at -base-path every route above moves under the prefix,
+	 handlers still see the unprefixed path
+	*/
+	var handler http.Handler = finalMux
+	if base := svc.cfg.BasePath; base != "" {
+		baseMux := http.NewServeMux()
+		baseMux.Handle(base+"/", http.StripPrefix(base, finalMux))
+		baseMux.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+		handler = baseMux
+	}
+
 	server := &http.Server{
-		Addr:    svc.cfg.ListenAddr,
-		Handler: metricsMiddleware(finalMux),
+		Addr:              svc.cfg.ListenAddr,
+		Handler:           metricsMiddleware(handler),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       svc.cfg.HTTPReadTimeout,
+		WriteTimeout:      svc.cfg.HTTPWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+		MaxHeaderBytes:    httpMaxHeaderBytes,
 	}
+	server.RegisterOnShutdown(svc.stopRecentStreams)
 
-	log.Printf("Starting HTTP server on http://%s", svc.cfg.ListenAddr)
-	log.Printf("Admin dashboard: http://%s%s", svc.cfg.ListenAddr, svc.cfg.AdminPath)
+	svc.logger.Info("starting http server", "addr", svc.cfg.ListenAddr, "base_path", svc.cfg.BasePath, "admin_path", svc.cfg.AdminPath)
 
 	return server
 }
 
 func (svc *Service) StartBalanceRefresher(ctx context.Context, wg *sync.WaitGroup) {
-	interval := 5 * time.Minute
-	log.Printf("Starting balance refresher with interval: %s", interval)
+	interval := svc.cfg.BalanceRefreshInterval
+	svc.logger.Info("starting balance refresher", "interval", interval)
 
 	// init once so balance is not empty
-	svc.walletBalance = svc.GetAvailableWalletBalance()
+	svc.refreshWalletBalance(ctx)
 
 	wg.Go(func() {
 		ticker := time.NewTicker(interval)
@@ -292,30 +814,117 @@ func (svc *Service) StartBalanceRefresher(ctx context.Context, wg *sync.WaitGrou
 		for {
 			select {
 			case <-ctx.Done():
-				log.Println("Balance refresher received shutdown signal")
+				svc.logger.Info("balance refresher received shutdown signal")
 				return
 			case <-ticker.C:
-				bal := svc.GetAvailableWalletBalance()
-				if bal > 0 {
-					svc.walletBalanceMtx.Lock()
-					svc.walletBalance = bal
-					svc.walletBalanceMtx.Unlock()
-				}
+				svc.refreshWalletBalance(ctx)
 			}
 		}
 	})
 }
 
+// refreshWalletBalance updates the cached balance and records a history
+// snapshot, an empty wallet is cached as 0 but an RPC error keeps the
+// previous value and is returned
+func (svc *Service) refreshWalletBalance(ctx context.Context) error {
+	bal, err := svc.GetAvailableWalletBalance(ctx)
+	if err != nil {
+		svc.logger.Error("failed to refresh wallet balance", "err", err)
+		return err
+	}
+
+	svc.walletBalanceMtx.Lock()
+	svc.walletBalance = bal
+	svc.walletBalanceMtx.Unlock()
+
+	// walletMtx keeps a payout from landing between the balance and its
+	// recordOutgoing, the webhook is posted after it's released
+	svc.walletMtx.Lock()
+	balances, err := svc.rpcClient.GetBalances(ctx)
+	var deposit float64
+	var found bool
+	if err == nil {
+		deposit, found = svc.checkDeposit(balances)
+	}
+	svc.walletMtx.Unlock()
+	if found {
+		svc.reportDeposit(deposit, balances)
+	}
+
+	// the cached value is fresh by now, a missing history point isn't worth
+	// failing the refresh for
+	if err != nil {
+		svc.logger.Error("failed to get balances for history", "err", err)
+		return nil
+	}
+	svc.recordBalanceSnapshot(balances)
+	return nil
+}
+
+// recordBalanceSnapshot stores the balances for /balance-history and drops
+// snapshots older than BalanceHistoryRetention
+func (svc *Service) recordBalanceSnapshot(balances *btc.Balances) {
+	if err := svc.db.Create(&db.BalanceSnapshot{
+		Trusted:  balances.Mine.Trusted,
+		Pending:  balances.Mine.Untrusted,
+		Immature: balances.Mine.Immature,
+	}).Error; err != nil {
+		svc.logger.Error("failed to save balance snapshot", "err", err)
+	}
+
+	if svc.cfg.BalanceHistoryRetention <= 0 {
+		return
+	}
+	deleted, err := db.DeleteBalanceSnapshotsBefore(svc.db, time.Now().Add(-svc.cfg.BalanceHistoryRetention))
+	if err != nil {
+		svc.logger.Error("failed to prune balance snapshots", "err", err)
+		return
+	}
+	if deleted > 0 {
+		svc.logger.Debug("pruned balance snapshots", "deleted", deleted)
+	}
+}
+
+// GetSpendableWalletBalance is the available balance minus payoutFloor, what
+// batches and the fast lane are allowed to pay out
+func (svc *Service) GetSpendableWalletBalance(ctx context.Context) (float64, error) {
+	bal, err := svc.GetAvailableWalletBalance(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return max(bal-svc.payoutFloor(), 0), nil
+}
+
+// payoutFloor is the balance automatic payouts stop at, the larger of
+// ReserveBalance and the min_balance setting. Admin sends and drains go by
+// their own checks and can still spend below it.
+func (svc *Service) payoutFloor() float64 {
+	return max(svc.cfg.ReserveBalance, svc.Settings().MinBalance)
+}
+
 func (svc *Service) GetCachedWalletBalance() float64 {
 	svc.walletBalanceMtx.RLock()
 	defer svc.walletBalanceMtx.RUnlock()
 	return svc.walletBalance
 }
 
+// ExplorerURL returns the mempool.space base url for the configured network,
+// or "" if there is no public explorer (regtest)
+func (svc *Service) ExplorerURL() string {
+	switch svc.cfg.Network {
+	case btc.NetworkSignet:
+		return "https://mempool.space/signet"
+	case btc.NetworkTestnet:
+		return "https://mempool.space/testnet"
+	}
+	return ""
+}
+
 func (svc *Service) GetEnabledAmountRanges() []AmountRange {
+	enabled := svc.Settings().EnabledAmountRanges
 	var ranges []AmountRange
 	for _, r := range AllAmountRanges {
-		if slices.Contains(svc.cfg.EnabledAmountRanges, r.ID) {
+		if slices.Contains(enabled, r.ID) {
 			ranges = append(ranges, r)
 		}
 	}
@@ -323,7 +932,7 @@ func (svc *Service) GetEnabledAmountRanges() []AmountRange {
 }
 
 func (svc *Service) GetAmountRangeByID(id int) *AmountRange {
-	for _, enabledID := range svc.cfg.EnabledAmountRanges {
+	for _, enabledID := range svc.Settings().EnabledAmountRanges {
 		if enabledID == id {
 			for _, r := range AllAmountRanges {
 				if r.ID == id {
@@ -334,3 +943,59 @@ func (svc *Service) GetAmountRangeByID(id int) *AmountRange {
 	}
 	return nil
 }
+
+// payoutAmount picks the amount for a request in r. In balance-scaled mode
+// the upper bound is pulled towards the minimum by the wallet's fill level:
+//
+//	ratio = clamp(balance / AmountTargetBalance, 0, 1)
+//	upper = MinBTC + (MaxBTC - MinBTC) * ratio
+//
+// and the amount is random in [MinBTC, upper) following AmountDistribution.
+// At or above the target this is the fixed-range behavior, an empty wallet
+// always pays MinBTC.
+func (svc *Service) payoutAmount(r AmountRange, balance float64) float64 {
+	span := r.MaxBTC - r.MinBTC
+	if svc.cfg.AmountMode == AmountModeBalanceScaled && svc.cfg.AmountTargetBalance > 0 {
+		ratio := min(max(balance/svc.cfg.AmountTargetBalance, 0), 1)
+		span *= ratio
+	}
+
+	rangeSats := int(span * 100_000_000)
+	if rangeSats <= 0 {
+		return r.MinBTC
+	}
+	sats := min(int(amountFraction(svc.cfg.AmountDistribution)*float64(rangeSats)), rangeSats-1)
+	return r.MinBTC + 0.00000001*float64(sats)
+}
+
+// exponentialRate is the decay of the exponential distribution over the
+// range, the density at the maximum is e^-3 (~5%) of the one at the minimum
+const exponentialRate = 3.0
+
+// cryptoSource feeds math/rand/v2 from crypto/rand, so payout amounts can't be
+// predicted from earlier ones
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	cryptorand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// safe for concurrent use, cryptoSource has no state
+var amountRand = rand.New(cryptoSource{})
+
+// amountFraction returns a random position in [0, 1) of an amount range
+func amountFraction(distribution string) float64 {
+	u := amountRand.Float64()
+	switch distribution {
+	case AmountDistributionTriangular:
+		// inverse of the cdf 1-(1-x)^2
+		return 1 - math.Sqrt(1-u)
+	case AmountDistributionExponential:
+		// inverse of the exponential cdf truncated to [0, 1)
+		return -math.Log(1-u*(1-math.Exp(-exponentialRate))) / exponentialRate
+	default:
+		return u
+	}
+}
@@ -1,22 +1,40 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/lnliz/faucet.coinbin.org/btc"
 	"github.com/lnliz/faucet.coinbin.org/db"
+	"github.com/lnliz/go-turnstile"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/xlzd/gotp"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -44,7 +62,7 @@ func newMockRPC() *mockRPC {
 	m := &mockRPC{handlers: make(map[string]func(json.RawMessage) (any, *rpcErr))}
 
 	m.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return map[string]any{"chain": "signet", "blocks": 100}, nil
+		return map[string]any{"chain": "signet", "blocks": 100, "headers": 100, "verificationprogress": 1.0}, nil
 	}
 	m.handlers["listwallets"] = func(_ json.RawMessage) (any, *rpcErr) {
 		return []string{"faucet"}, nil
@@ -66,9 +84,9 @@ func newMockRPC() *mockRPC {
 	}
 	m.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
 		return []btc.UTXO{
-			{TxID: "aaa", Vout: 0, Address: "tb1qaddr1", Amount: 0.0005, Confirmations: 10, Spendable: true},
-			{TxID: "bbb", Vout: 1, Address: "tb1qaddr2", Amount: 0.0003, Confirmations: 5, Spendable: true},
-			{TxID: "ccc", Vout: 0, Address: "tb1qaddr3", Amount: 1.5, Confirmations: 100, Spendable: true},
+			{TxID: "aaa", Vout: 0, Address: "tb1qaddr1", Amount: 0.0005, Confirmations: 10, Spendable: true, Safe: true},
+			{TxID: "bbb", Vout: 1, Address: "tb1qaddr2", Amount: 0.0003, Confirmations: 5, Spendable: true, Safe: true},
+			{TxID: "ccc", Vout: 0, Address: "tb1qaddr3", Amount: 1.5, Confirmations: 100, Spendable: true, Safe: true},
 		}, nil
 	}
 	m.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
@@ -83,6 +101,15 @@ func newMockRPC() *mockRPC {
 	m.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
 		return "mocktxid0000000000000000000000000000000000000000000000000000000000", nil
 	}
+	m.handlers["lockunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return true, nil
+	}
+	m.handlers["decoderawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"txid": "mocktxid0000000000000000000000000000000000000000000000000000000000",
+			"vin":  []map[string]any{{"txid": "ccc", "vout": 0}},
+		}, nil
+	}
 
 	return m
 }
@@ -94,7 +121,7 @@ func (m *mockRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	handler, ok := m.handlers[req.Method]
 	if !ok {
-		w.WriteHeader(200)
+		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]any{
 			"result": nil,
 			"error":  &rpcErr{Code: -32601, Message: "Method not found: " + req.Method},
@@ -105,7 +132,12 @@ func (m *mockRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	result, rpcError := handler(req.Params)
 	resp := map[string]any{"id": req.ID, "result": result, "error": rpcError}
-	w.WriteHeader(200)
+	// like bitcoind, errors come with a 500
+	if rpcError != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 	json.NewEncoder(w).Encode(resp)
 }
 
@@ -119,7 +151,9 @@ func testDB(t *testing.T) *gorm.DB {
 	if err != nil {
 		t.Fatal(err)
 	}
-	d.AutoMigrate(&db.Transaction{}, &db.AdminSession{})
+	if err := db.Migrate(d); err != nil {
+		t.Fatal(err)
+	}
 	return d
 }
 
@@ -131,22 +165,43 @@ func parseCIDR(s string) net.IPNet {
 func testConfig() *Config {
 	return &Config{
 		ListenAddr:                      ":0",
+		MaxRequestBodyBytes:             64 << 10,
 		MetricsAddr:                     "127.0.0.1:0",
 		DataDir:                         "/tmp/test",
+		Network:                         btc.NetworkSignet,
 		BitcoinCoreWalletName:           "faucet",
 		BatchInterval:                   time.Minute,
+		BatchSize:                       50,
+		BatchOrder:                      BatchOrderFIFO,
+		BatchMaxOutputs:                 1,
+		PartialBatch:                    DefaultPartialBatch,
+		StoreRawTx:                      true,
+		InsufficientFundsRetries:        3,
+		InsufficientFundsBackoff:        time.Minute,
+		OpReturn:                        DefaultOpReturn,
+		PayoutBreakerThreshold:          3,
+		PayoutBreakerCooldown:           time.Minute,
 		MinBalance:                      0.1,
 		AdminPassword:                   "testpass123",
 		AdminPath:                       "/admin",
 		AdminCookieSecret:               "01234567890123456789012345678901",
 		AdminAllowlist:                  []net.IPNet{parseCIDR("127.0.0.1/32")},
+		TrustedProxies:                  []net.IPNet{parseCIDR("192.0.2.0/24")}, // httptest.NewRequest's RemoteAddr
+		AdminSessionHours:               4,
+		AdminSessionMaxHours:            24,
 		MaxWithdrawalsPerIP24h:          2,
+		APIKeyMaxWithdrawals24h:         20,
+		MinSpendConfirmations:           1,
+		RateLimitIPv4Prefix:             32,
+		RateLimitIPv6Prefix:             64,
 		MaxDepositsPerAddress:           5,
+		RecentPayoutsMax:                50,
 		EnabledAmountRanges:             []int{1, 2, 3},
 		DefaultAmountRange:              2,
 		ConsolidationAmountThresholdBTC: 0.001,
 		MaxConsolidationUTXOs:           5,
 		MinConsolidationUTXOs:           2,
+		ConsolidationMinConfirmations:   1,
 	}
 }
 
@@ -185,6 +240,20 @@ func jsonBody(v any) *bytes.Buffer {
 	return bytes.NewBuffer(b)
 }
 
+// testAddress returns a signet address that passes validation and differs
+// for every i, for tests that need more than one request in flight
+func testAddress(i int) string {
+	return fmt.Sprintf("tb1qtest%034d", i)
+}
+
+// settleInFlight marks every queued or processing payout broadcast, so the
+// same address can submit again
+func settleInFlight(svc *Service) {
+	svc.db.Model(&db.Transaction{}).
+		Where("status IN ?", []string{db.TxnStatusPending, db.TxnStatusProcessing}).
+		Update("status", db.TxnStatusBroadcast)
+}
+
 func decodeJSON(t *testing.T, body io.Reader) map[string]any {
 	t.Helper()
 	var m map[string]any
@@ -217,6 +286,104 @@ func chdirToProjectRoot(t *testing.T) {
 	t.Cleanup(func() { os.Chdir("service") })
 }
 
+// ---------------------------------------------------------------------------
+// templates
+// ---------------------------------------------------------------------------
+
+func TestLoadTemplates_MissingDir(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	// tests run from service/, there is no templates dir here
+	if err := svc.LoadTemplates(); err == nil {
+		t.Error("expected parse error without templates dir")
+	}
+}
+
+func TestRenderTemplate_UsesCache(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	t.Chdir("..")
+	if err := svc.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir("service")
+
+	w := httptest.NewRecorder()
+	if err := svc.renderTemplate(w, "admin_login.html", map[string]any{}); err != nil {
+		t.Errorf("expected cached templates to render, got %v", err)
+	}
+}
+
+func TestRenderTemplate_DevTemplatesReparse(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.DevTemplates = true
+
+	t.Chdir("..")
+	if err := svc.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir("service")
+
+	w := httptest.NewRecorder()
+	if err := svc.renderTemplate(w, "admin_login.html", map[string]any{}); err == nil {
+		t.Error("expected dev mode to re-parse templates from disk")
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	t.Chdir("..")
+	if err := svc.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	svc.renderError(w, http.StatusBadGateway, "node <down>")
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected an html page, got %q", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "502 Bad Gateway") || !strings.Contains(body, "node &lt;down&gt;") {
+		t.Errorf("unexpected error page: %s", body)
+	}
+}
+
+func TestRenderError_PlainTextFallback(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	// tests run from service/, there is no templates dir here
+	w := httptest.NewRecorder()
+	svc.renderError(w, http.StatusInternalServerError, "try again later")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected plain text, got %q", ct)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != "try again later" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestRenderTemplate_FailureWritesNothing(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.templatesOnce.Do(func() {
+		fail := func() (string, error) { return "", errors.New("boom") }
+		svc.templates = template.Must(template.New("page.html").Funcs(template.FuncMap{"fail": fail}).Parse("partial output {{fail}}"))
+	})
+
+	w := httptest.NewRecorder()
+	if err := svc.renderTemplate(w, "page.html", map[string]any{}); err == nil {
+		t.Fatal("expected a render error")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected nothing written on a failed render, got %q", w.Body.String())
+	}
+}
+
 // ---------------------------------------------------------------------------
 // getClientIP tests
 // ---------------------------------------------------------------------------
@@ -233,12 +400,22 @@ func TestGetClientIP_CFConnectingIP(t *testing.T) {
 func TestGetClientIP_XForwardedFor(t *testing.T) {
 	svc, _ := testServiceFull(t)
 	r := httptest.NewRequest("GET", "/", nil)
-	r.Header.Set("X-Forwarded-For", "5.6.7.8, 9.10.11.12")
+	r.Header.Set("X-Forwarded-For", "5.6.7.8, 192.0.2.10")
 	if got := svc.getClientIP(r); got != "5.6.7.8" {
 		t.Errorf("expected 5.6.7.8, got %s", got)
 	}
 }
 
+func TestGetClientIP_XForwardedForSpoofedPrefix(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	// client sent "X-Forwarded-For: 1.1.1.1", the proxy appended the real address
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 9.10.11.12")
+	if got := svc.getClientIP(r); got != "9.10.11.12" {
+		t.Errorf("expected the address the proxy saw, 9.10.11.12, got %s", got)
+	}
+}
+
 func TestGetClientIP_XRealIP(t *testing.T) {
 	svc, _ := testServiceFull(t)
 	r := httptest.NewRequest("GET", "/", nil)
@@ -263,12 +440,113 @@ func TestGetClientIP_Priority(t *testing.T) {
 	r.Header.Set("CF-Connecting-IP", "1.1.1.1")
 	r.Header.Set("X-Forwarded-For", "2.2.2.2")
 	r.Header.Set("X-Real-IP", "3.3.3.3")
-	r.RemoteAddr = "4.4.4.4:1234"
 	if got := svc.getClientIP(r); got != "1.1.1.1" {
 		t.Errorf("CF-Connecting-IP should take priority, got %s", got)
 	}
 }
 
+func TestGetClientIP_SpoofedHeadersIgnored(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	for _, header := range []string{"CF-Connecting-IP", "X-Forwarded-For", "X-Real-IP"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "203.0.113.50:4444"
+		r.Header.Set(header, "1.2.3.4")
+		if got := svc.getClientIP(r); got != "203.0.113.50" {
+			t.Errorf("%s from an untrusted peer should be ignored, got %s", header, got)
+		}
+	}
+}
+
+func TestGetClientIP_NoTrustedProxies(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.TrustedProxies = nil
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	if got := svc.getClientIP(r); got != "192.0.2.1" {
+		t.Errorf("expected RemoteAddr without trusted proxies, got %s", got)
+	}
+}
+
+func TestGetClientIP_IPv6Normalized(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	tests := []struct {
+		header, value, want string
+	}{
+		{"X-Real-IP", "::1", "::1"},
+		{"X-Real-IP", "[::1]", "::1"},
+		{"X-Real-IP", "0:0:0:0:0:0:0:1", "::1"},
+		{"CF-Connecting-IP", "2001:0DB8:0000:0000:0000:0000:0000:0001", "2001:db8::1"},
+		{"X-Forwarded-For", "[2001:db8::1], 192.0.2.10", "2001:db8::1"},
+		{"X-Real-IP", "::ffff:10.0.0.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(tt.header, tt.value)
+		if got := svc.getClientIP(r); got != tt.want {
+			t.Errorf("%s %q: expected %s, got %s", tt.header, tt.value, tt.want, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[0:0:0:0:0:0:0:1]:4444"
+	if got := svc.getClientIP(r); got != "::1" {
+		t.Errorf("expected ::1 from RemoteAddr, got %s", got)
+	}
+}
+
+func TestSubmitHandler_IPv6RepresentationsShareRateLimit(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxWithdrawalsPerIP24h = 1
+	svc.cfg.RateLimitIPv6Prefix = 128
+
+	for i, ip := range []string{"2001:db8::1", "[2001:db8::1]", "2001:0db8:0:0:0:0:0:1"} {
+		body := jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"})
+		r := httptest.NewRequest("POST", "/api/submit", body)
+		r.Header.Set("X-Real-IP", ip)
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+
+		want := http.StatusOK
+		if i > 0 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d", ip, want, w.Code)
+		}
+	}
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.IPAddress != "2001:db8::1" {
+		t.Errorf("expected normalized ip stored, got %s", tx.IPAddress)
+	}
+}
+
+func TestSubmitHandler_SpoofedIPCantBypassRateLimit(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxWithdrawalsPerIP24h = 1
+
+	for i, spoofed := range []string{"1.1.1.1", "2.2.2.2"} {
+		body := jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"})
+		r := httptest.NewRequest("POST", "/api/submit", body)
+		r.RemoteAddr = "203.0.113.50:4444"
+		r.Header.Set("X-Forwarded-For", spoofed)
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+
+		want := http.StatusOK
+		if i > 0 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("request %d: expected %d, got %d", i, want, w.Code)
+		}
+	}
+}
+
 // ---------------------------------------------------------------------------
 // isAdminIP tests
 // ---------------------------------------------------------------------------
@@ -360,7 +638,7 @@ func TestValidateSessionCookie_WrongSecret(t *testing.T) {
 
 func TestGetEnabledAmountRanges(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.EnabledAmountRanges = []int{1, 3}
+	svc.settings.EnabledAmountRanges = []int{1, 3}
 
 	ranges := svc.GetEnabledAmountRanges()
 	if len(ranges) != 2 {
@@ -373,7 +651,7 @@ func TestGetEnabledAmountRanges(t *testing.T) {
 
 func TestGetAmountRangeByID(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.EnabledAmountRanges = []int{2, 3}
+	svc.settings.EnabledAmountRanges = []int{2, 3}
 
 	if r := svc.GetAmountRangeByID(2); r == nil || r.ID != 2 {
 		t.Error("expected range 2")
@@ -386,6 +664,88 @@ func TestGetAmountRangeByID(t *testing.T) {
 	}
 }
 
+func TestPayoutAmount_FixedRange(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AmountMode = AmountModeFixed
+	r := AmountRange{MinBTC: 0.001, MaxBTC: 0.002}
+
+	for i := 0; i < 100; i++ {
+		amount := svc.payoutAmount(r, 0)
+		if amount < r.MinBTC || amount >= r.MaxBTC {
+			t.Fatalf("amount %.8f outside [%.8f, %.8f)", amount, r.MinBTC, r.MaxBTC)
+		}
+	}
+}
+
+func TestPayoutAmount_BalanceScaled(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AmountMode = AmountModeBalanceScaled
+	svc.cfg.AmountTargetBalance = 10
+	r := AmountRange{MinBTC: 0.001, MaxBTC: 0.002}
+
+	if amount := svc.payoutAmount(r, 0); amount != r.MinBTC {
+		t.Errorf("empty wallet: expected %.8f, got %.8f", r.MinBTC, amount)
+	}
+	if amount := svc.payoutAmount(r, -1); amount != r.MinBTC {
+		t.Errorf("negative balance: expected %.8f, got %.8f", r.MinBTC, amount)
+	}
+
+	for i := 0; i < 100; i++ {
+		if amount := svc.payoutAmount(r, 5); amount < r.MinBTC || amount > 0.0015 {
+			t.Fatalf("half target: amount %.8f outside [0.001, 0.0015]", amount)
+		}
+		if amount := svc.payoutAmount(r, 50); amount < r.MinBTC || amount >= r.MaxBTC {
+			t.Fatalf("above target: amount %.8f outside [0.001, 0.002)", amount)
+		}
+	}
+}
+
+func TestPayoutAmount_Distributions(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	r := AmountRange{MinBTC: 0.001, MaxBTC: 0.002}
+
+	for distribution, maxMean := range map[string]float64{
+		AmountDistributionUniform:     0.55,
+		AmountDistributionTriangular:  0.4,
+		AmountDistributionExponential: 0.35,
+	} {
+		svc.cfg.AmountDistribution = distribution
+
+		sum := 0.0
+		const n = 10000
+		for range n {
+			amount := svc.payoutAmount(r, 0)
+			if amount < r.MinBTC || amount >= r.MaxBTC {
+				t.Fatalf("%s: amount %.8f outside [%.8f, %.8f)", distribution, amount, r.MinBTC, r.MaxBTC)
+			}
+			sum += (amount - r.MinBTC) / (r.MaxBTC - r.MinBTC)
+		}
+		if mean := sum / n; mean > maxMean || mean < 0.2 {
+			t.Errorf("%s: mean position %.3f in the range, expected at most %.2f", distribution, mean, maxMean)
+		}
+	}
+}
+
+func TestCryptoSource(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for range 100 {
+		seen[cryptoSource{}.Uint64()] = true
+	}
+	if len(seen) < 100 {
+		t.Errorf("expected 100 distinct values, got %d", len(seen))
+	}
+}
+
+func TestAmountFraction_Bounds(t *testing.T) {
+	for _, distribution := range []string{AmountDistributionUniform, AmountDistributionTriangular, AmountDistributionExponential} {
+		for range 10000 {
+			if f := amountFraction(distribution); f < 0 || f >= 1 {
+				t.Fatalf("%s: fraction %v outside [0, 1)", distribution, f)
+			}
+		}
+	}
+}
+
 // ---------------------------------------------------------------------------
 // GetCachedWalletBalance
 // ---------------------------------------------------------------------------
@@ -406,961 +766,6279 @@ func TestGetCachedWalletBalance(t *testing.T) {
 	}
 }
 
-// ---------------------------------------------------------------------------
-// health endpoint
-// ---------------------------------------------------------------------------
+func TestRefreshWalletBalance_EmptyWallet(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.walletBalance = 5.5
 
-func TestHealthHandler_OK(t *testing.T) {
-	svc, _ := testServiceFull(t)
-	r := httptest.NewRequest("GET", "/health", nil)
-	w := httptest.NewRecorder()
-	svc.healthHandler(w, r)
+	svc.refreshWalletBalance(t.Context())
 
-	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
-	}
-	if w.Body.String() != "ok" {
-		t.Errorf("expected 'ok', got %q", w.Body.String())
+	if got := svc.GetCachedWalletBalance(); got != 0 {
+		t.Errorf("expected empty wallet to be cached as 0, got %f", got)
 	}
 }
 
-func TestHealthHandler_RPCDown(t *testing.T) {
+func TestRefreshWalletBalance_RPCErrorKeepsValue(t *testing.T) {
 	mock := newMockRPC()
-	mock.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return nil, &rpcErr{Code: -1, Message: "connection refused"}
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -18, Message: "Requested wallet does not exist or is not loaded"}
 	}
 	rpcServer := httptest.NewServer(mock)
 	t.Cleanup(rpcServer.Close)
 	svc := testService(t, rpcServer)
+	svc.walletBalance = 5.5
 
-	r := httptest.NewRequest("GET", "/health", nil)
-	w := httptest.NewRecorder()
-	svc.healthHandler(w, r)
+	svc.refreshWalletBalance(t.Context())
 
-	if w.Code != http.StatusServiceUnavailable {
-		t.Errorf("expected 503, got %d", w.Code)
+	if got := svc.GetCachedWalletBalance(); got != 5.5 {
+		t.Errorf("expected previous balance to be kept on error, got %f", got)
 	}
-}
 
-// ---------------------------------------------------------------------------
-// submit endpoint
-// ---------------------------------------------------------------------------
+	if _, err := svc.GetAvailableWalletBalance(t.Context()); err == nil {
+		t.Error("expected GetAvailableWalletBalance to return the RPC error")
+	}
+}
 
-func TestSubmitHandler_MethodNotAllowed(t *testing.T) {
-	svc, _ := testServiceFull(t)
+func TestGetAvailableWalletBalance_MinSpendConfirmations(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []int
+		json.Unmarshal(params, &p)
+		utxos := []btc.UTXO{
+			{TxID: "deep", Amount: 1.0, Confirmations: 100, Spendable: true, Safe: true},
+			{TxID: "shallow", Amount: 0.5, Confirmations: 1, Spendable: true, Safe: true},
+			{TxID: "change", Amount: 0.25, Confirmations: 0, Spendable: true, Safe: true},
+			{TxID: "incoming", Amount: 2.0, Confirmations: 0, Spendable: true, Safe: false},
+			{TxID: "watchonly", Amount: 4.0, Confirmations: 50, Spendable: false, Safe: true},
+		}
+		var result []btc.UTXO
+		for _, u := range utxos {
+			if u.Confirmations >= p[0] {
+				result = append(result, u)
+			}
+		}
+		return result, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
 
-	r := httptest.NewRequest("GET", "/api/submit", nil)
-	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
+	for _, c := range []struct {
+		minConf  int
+		expected float64
+	}{
+		{0, 1.75},
+		{1, 1.5},
+		{6, 1.0},
+		{1000, 0},
+	} {
+		svc.cfg.MinSpendConfirmations = c.minConf
+		bal, err := svc.GetAvailableWalletBalance(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(bal-c.expected) > 1e-9 {
+			t.Errorf("min conf %d: expected %.8f, got %.8f", c.minConf, c.expected, bal)
+		}
+	}
 
-	if w.Code != http.StatusMethodNotAllowed {
-		t.Errorf("expected 405, got %d", w.Code)
+	svc.cfg.MinSpendConfirmations = 1
+	svc.refreshWalletBalance(t.Context())
+	if got := svc.GetCachedWalletBalance(); got != 1.5 {
+		t.Errorf("expected the cached balance to use the filtered figure, got %f", got)
 	}
 }
 
-func TestSubmitHandler_InvalidJSON(t *testing.T) {
+func TestRefreshWalletBalance_RecordsSnapshot(t *testing.T) {
 	svc, _ := testServiceFull(t)
+	svc.cfg.BalanceHistoryRetention = 24 * time.Hour
+	svc.db.Create(&db.BalanceSnapshot{CreatedAt: time.Now().Add(-48 * time.Hour), Trusted: 1})
 
-	r := httptest.NewRequest("POST", "/api/submit", strings.NewReader("not json"))
-	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
+	svc.refreshWalletBalance(t.Context())
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", w.Code)
+	var snapshots []db.BalanceSnapshot
+	svc.db.Find(&snapshots)
+	if len(snapshots) != 1 {
+		t.Fatalf("expected the old snapshot pruned and a new one saved, got %d", len(snapshots))
+	}
+	if s := snapshots[0]; s.Trusted != 10 || s.Pending != 1 || s.Immature != 0.5 {
+		t.Errorf("unexpected snapshot %+v", s)
 	}
 }
 
-func TestSubmitHandler_InvalidAddress(t *testing.T) {
+func TestAdminBalanceHistory(t *testing.T) {
 	svc, _ := testServiceFull(t)
+	now := time.Now()
+	svc.db.Create(&db.BalanceSnapshot{CreatedAt: now.Add(-10 * 24 * time.Hour), Trusted: 3})
+	svc.db.Create(&db.BalanceSnapshot{CreatedAt: now.Add(-2 * 24 * time.Hour), Trusted: 2})
+	svc.db.Create(&db.BalanceSnapshot{CreatedAt: now.Add(-time.Hour), Trusted: 1, Pending: 0.5})
 
-	body := jsonBody(map[string]any{"address": "invalid", "amount_range": 2})
-	r := httptest.NewRequest("POST", "/api/submit", body)
-	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/admin/balance-history"+query, nil)
+		w := httptest.NewRecorder()
+		svc.adminBalanceHistoryHandler(w, r)
+		return w
+	}
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", w.Code)
+	w := get("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
 	}
-	resp := decodeJSON(t, w.Body)
-	if resp["error"] == nil {
-		t.Error("expected error in response")
+	var resp struct {
+		Days      int `json:"days"`
+		Snapshots []struct {
+			Trusted float64 `json:"trusted"`
+			Total   float64 `json:"total"`
+		} `json:"snapshots"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Days != 7 || len(resp.Snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots in the default 7 days, got %+v", resp)
+	}
+	if resp.Snapshots[0].Trusted != 2 || resp.Snapshots[1].Total != 1.5 {
+		t.Errorf("unexpected series %+v", resp.Snapshots)
+	}
+
+	json.NewDecoder(get("?days=30").Body).Decode(&resp)
+	if len(resp.Snapshots) != 3 {
+		t.Errorf("expected 3 snapshots in 30 days, got %d", len(resp.Snapshots))
+	}
+
+	for _, q := range []string{"?days=0", "?days=abc", "?days=1000"} {
+		if w := get(q); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", q, w.Code)
+		}
 	}
 }
 
-func TestSubmitHandler_MainnetAddressRejected(t *testing.T) {
+// ---------------------------------------------------------------------------
+// donation address
+// ---------------------------------------------------------------------------
+
+func TestSetupDonationAddress_Configured(t *testing.T) {
 	svc, _ := testServiceFull(t)
+	svc.cfg.DonationAddress = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
 
-	body := jsonBody(map[string]any{"address": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", "amount_range": 2})
-	r := httptest.NewRequest("POST", "/api/submit", body)
-	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
+	if err := svc.SetupDonationAddress(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if svc.donationAddress != svc.cfg.DonationAddress {
+		t.Errorf("expected configured address, got %s", svc.donationAddress)
+	}
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", w.Code)
+	svc.cfg.DonationAddress = "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"
+	if err := svc.SetupDonationAddress(t.Context()); err == nil {
+		t.Error("expected error for mainnet address on signet")
 	}
 }
 
-func TestSubmitHandler_Success(t *testing.T) {
-	svc, _ := testServiceFull(t)
-
-	body := jsonBody(map[string]any{
-		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		"amount_range": 2,
-	})
-	r := httptest.NewRequest("POST", "/api/submit", body)
-	r.RemoteAddr = "127.0.0.1:1234"
-	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
-
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+func TestSetupDonationAddress_GeneratedOnce(t *testing.T) {
+	var calls atomic.Int32
+	mock := newMockRPC()
+	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) {
+		calls.Add(1)
+		return fmt.Sprintf("tb1qdonation%d", calls.Load()), nil
 	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
 
-	resp := decodeJSON(t, w.Body)
-	if resp["success"] != true {
-		t.Errorf("expected success=true, got %v", resp["success"])
+	if err := svc.SetupDonationAddress(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if svc.donationAddress != "tb1qdonation1" {
+		t.Errorf("expected generated address, got %s", svc.donationAddress)
 	}
 
-	var tx db.Transaction
-	svc.db.First(&tx)
-	if tx.Address != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
-		t.Errorf("unexpected address in db: %s", tx.Address)
+	// restart against the same db keeps the stored address
+	restarted := NewService(svc.cfg, svc.db)
+	restarted.rpcClient = svc.rpcClient
+	if err := restarted.SetupDonationAddress(t.Context()); err != nil {
+		t.Fatal(err)
 	}
-	if tx.Status != db.TxnStatusPending {
-		t.Errorf("expected pending status, got %s", tx.Status)
+	if restarted.donationAddress != "tb1qdonation1" {
+		t.Errorf("expected stored address after restart, got %s", restarted.donationAddress)
 	}
-	if tx.AmountBTC < 0.01 || tx.AmountBTC > 0.09 {
-		t.Errorf("amount %.8f out of range 2 bounds", tx.AmountBTC)
+	if calls.Load() != 1 {
+		t.Errorf("expected getnewaddress once, got %d", calls.Load())
+	}
+
+	// the stored address is not a settings override
+	if err := restarted.LoadSettings(); err != nil {
+		t.Errorf("expected settings to load, got %v", err)
 	}
 }
 
-func TestSubmitHandler_DefaultAmountRange(t *testing.T) {
+func TestDonateAddressHandler(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
-	body := jsonBody(map[string]any{
-		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		"amount_range": 999,
-	})
-	r := httptest.NewRequest("POST", "/api/submit", body)
-	r.RemoteAddr = "127.0.0.1:1234"
+	r := httptest.NewRequest("GET", "/api/donate-address", nil)
 	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
+	svc.donateAddressHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without address, got %d", w.Code)
+	}
 
+	svc.donationAddress = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+	w = httptest.NewRecorder()
+	svc.donateAddressHandler(w, r)
 	if w.Code != http.StatusOK {
-		t.Errorf("expected 200 (fallback to default range), got %d: %s", w.Code, w.Body.String())
+		t.Fatalf("expected 200, got %d", w.Code)
 	}
 
-	var tx db.Transaction
-	svc.db.Last(&tx)
-	if tx.AmountBTC < 0.01 || tx.AmountBTC > 0.09 {
-		t.Errorf("amount %.8f should be in default range 2", tx.AmountBTC)
+	resp := decodeJSON(t, w.Body)
+	if resp["address"] != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
+		t.Errorf("unexpected address: %v", resp["address"])
+	}
+	if resp["uri"] != "BITCOIN:TB1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KXPJZSX" {
+		t.Errorf("unexpected uri: %v", resp["uri"])
 	}
 }
 
-func TestSubmitHandler_RateLimitNonAdmin(t *testing.T) {
+func TestDonationURI_Base58KeepsCase(t *testing.T) {
+	if got := donationURI("mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn"); got != "bitcoin:mipcBbFg9gMiCh81Kj8tqqdgoZub1ZJRfn" {
+		t.Errorf("expected case preserved for base58, got %s", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// recent payouts
+// ---------------------------------------------------------------------------
+
+func TestRecentHandler(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.MaxWithdrawalsPerIP24h = 1
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("10.0.0.0/8")}
 
-	body := jsonBody(map[string]any{
-		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		"amount_range": 2,
-	})
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.001, IPAddress: "1.2.3.4", Status: db.TxnStatusBroadcast, OnchainTxnID: "aaa"})
+	svc.db.Create(&db.Transaction{Address: "tb1qpending0000000000000000000000000000", AmountBTC: 0.002, Status: db.TxnStatusPending})
 
-	r := httptest.NewRequest("POST", "/api/submit", body)
-	r.RemoteAddr = "192.168.1.1:1234"
+	r := httptest.NewRequest("GET", "/api/recent", nil)
 	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
+	svc.recentHandler(w, r)
 	if w.Code != http.StatusOK {
-		t.Fatalf("first request should succeed, got %d", w.Code)
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "1.2.3.4") {
+		t.Error("feed must not include the requester IP")
 	}
 
-	body2 := jsonBody(map[string]any{
-		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		"amount_range": 2,
-	})
-	r2 := httptest.NewRequest("POST", "/api/submit", body2)
-	r2.RemoteAddr = "192.168.1.1:1234"
-	w2 := httptest.NewRecorder()
-	svc.submitHandler(w2, r2)
-
-	if w2.Code != http.StatusTooManyRequests {
-		t.Errorf("expected 429 rate limit, got %d", w2.Code)
+	payouts := decodeJSON(t, w.Body)["payouts"].([]any)
+	if len(payouts) != 1 {
+		t.Fatalf("expected only the broadcast payout, got %d", len(payouts))
+	}
+	p := payouts[0].(map[string]any)
+	if p["address"] != "tb1qw508...xpjzsx" {
+		t.Errorf("unexpected address: %v", p["address"])
+	}
+	if p["txid"] != "aaa" || p["amount"] != 0.001 {
+		t.Errorf("unexpected payout: %v", p)
 	}
 }
 
-func TestSubmitHandler_AdminBypassesRateLimit(t *testing.T) {
+func TestRecentHandler_LimitCapped(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.MaxWithdrawalsPerIP24h = 1
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	svc.cfg.RecentPayoutsMax = 2
 
 	for i := range 3 {
-		body := jsonBody(map[string]any{
-			"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-			"amount_range": 2,
-		})
-		r := httptest.NewRequest("POST", "/api/submit", body)
-		r.RemoteAddr = "127.0.0.1:1234"
-		w := httptest.NewRecorder()
-		svc.submitHandler(w, r)
+		svc.db.Create(&db.Transaction{Address: fmt.Sprintf("tb1q%d", i), Status: db.TxnStatusBroadcast})
+	}
 
-		if w.Code != http.StatusOK {
-			t.Errorf("admin request %d should succeed, got %d: %s", i, w.Code, w.Body.String())
-		}
+	r := httptest.NewRequest("GET", "/api/recent?limit=100", nil)
+	w := httptest.NewRecorder()
+	svc.recentHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if n := len(decodeJSON(t, w.Body)["payouts"].([]any)); n != 2 {
+		t.Errorf("expected limit capped at 2, got %d", n)
+	}
+
+	r = httptest.NewRequest("GET", "/api/recent?limit=abc", nil)
+	w = httptest.NewRecorder()
+	svc.recentHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad limit, got %d", w.Code)
 	}
 }
 
-func TestSubmitHandler_AddressDepositLimit(t *testing.T) {
+func TestRecentHandler_Disabled(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.MaxDepositsPerAddress = 2
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	svc.cfg.RecentPayoutsMax = 0
 
-	addr := "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
-
-	for i := range 2 {
-		body := jsonBody(map[string]any{"address": addr, "amount_range": 2})
-		r := httptest.NewRequest("POST", "/api/submit", body)
-		r.RemoteAddr = "127.0.0.1:1234"
+	for _, h := range []http.HandlerFunc{svc.recentHandler, svc.recentStreamHandler} {
 		w := httptest.NewRecorder()
-		svc.submitHandler(w, r)
-		if w.Code != http.StatusOK {
-			t.Fatalf("request %d should succeed, got %d", i, w.Code)
+		h(w, httptest.NewRequest("GET", "/api/recent", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 when disabled, got %d", w.Code)
 		}
 	}
-
-	body := jsonBody(map[string]any{"address": addr, "amount_range": 2})
-	r := httptest.NewRequest("POST", "/api/submit", body)
-	r.RemoteAddr = "127.0.0.1:1234"
-	w := httptest.NewRecorder()
-	svc.submitHandler(w, r)
-
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400 address limit, got %d", w.Code)
-	}
-	resp := decodeJSON(t, w.Body)
-	if !strings.Contains(resp["error"].(string), "limit") {
-		t.Errorf("expected limit error, got: %s", resp["error"])
-	}
 }
 
-// ---------------------------------------------------------------------------
-// admin IP allowlist middleware (integration via full server)
-// ---------------------------------------------------------------------------
-
-func TestAdminIPAllowlist_Denied(t *testing.T) {
+func TestRecentStreamHandler(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("10.0.0.0/8")}
-	baseURL := startTestServer(t, svc)
 
-	resp, err := http.Get(baseURL + "/admin/login")
+	srv := httptest.NewServer(http.HandlerFunc(svc.recentStreamHandler))
+	defer srv.Close()
+	defer svc.stopRecentStreams()
+
+	resp, err := http.Get(srv.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusForbidden {
-		t.Errorf("expected 403 from non-allowed IP, got %d", resp.StatusCode)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
 	}
-}
 
-func TestAdminIPAllowlist_Allowed(t *testing.T) {
-	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
+	svc.publishPayout(newRecentPayout(db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.001}, "bbb"))
 
-	resp, err := http.Get(baseURL + "/admin/login")
-	if err != nil {
-		t.Fatal(err)
+	reader := bufio.NewReader(resp.Body)
+	event, _ := reader.ReadString('\n')
+	data, _ := reader.ReadString('\n')
+	if event != "event: payout\n" {
+		t.Errorf("unexpected event line %q", event)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected 200 from allowed IP, got %d", resp.StatusCode)
+	if !strings.Contains(data, `"txid":"bbb"`) || !strings.Contains(data, `"address":"tb1qw508...xpjzsx"`) {
+		t.Errorf("unexpected data line %q", data)
 	}
 }
 
-// ---------------------------------------------------------------------------
-// admin auth middleware
-// ---------------------------------------------------------------------------
-
-func TestAdminAuth_NoCookie(t *testing.T) {
+func TestRecentStreamHandler_OutlivesWriteTimeout(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
 
-	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(svc.recentStreamHandler))
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+	defer svc.stopRecentStreams()
 
-	resp, err := client.Get(baseURL + "/admin/")
+	resp, err := http.Get(srv.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusFound {
-		t.Errorf("expected 302 redirect to login, got %d", resp.StatusCode)
-	}
-	loc := resp.Header.Get("Location")
-	if !strings.Contains(loc, "/admin/login") {
-		t.Errorf("expected redirect to /admin/login, got %s", loc)
+	time.Sleep(150 * time.Millisecond)
+	svc.publishPayout(newRecentPayout(db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.001}, "ccc"))
+
+	event, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || event != "event: payout\n" {
+		t.Errorf("expected the stream to survive the write timeout, got %q, %v", event, err)
 	}
 }
 
-func TestAdminAuth_InvalidCookie(t *testing.T) {
+func TestSubscribeRecent_Limit(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
-
-	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}}
 
-	req, _ := http.NewRequest("GET", baseURL+"/admin/", nil)
-	req.AddCookie(&http.Cookie{Name: "admin_session", Value: "bad.cookie"})
-	resp, err := client.Do(req)
-	if err != nil {
-		t.Fatal(err)
+	for range maxRecentSubscribers {
+		if _, _, ok := svc.subscribeRecent(); !ok {
+			t.Fatal("expected subscription to succeed")
+		}
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusFound {
-		t.Errorf("expected 302 redirect, got %d", resp.StatusCode)
+	if _, _, ok := svc.subscribeRecent(); ok {
+		t.Error("expected subscription over the limit to fail")
 	}
 }
 
 // ---------------------------------------------------------------------------
-// admin login flow
+// health endpoint
 // ---------------------------------------------------------------------------
 
-func TestAdminLogin_GetPage(t *testing.T) {
+func TestHealthHandler_OK(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
+	r := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	svc.healthHandler(w, r)
 
-	resp, err := http.Get(baseURL + "/admin/login")
-	if err != nil {
-		t.Fatal(err)
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected 200, got %d", resp.StatusCode)
+	if w.Body.String() != "ok" {
+		t.Errorf("expected 'ok', got %q", w.Body.String())
 	}
 }
 
-func TestAdminLogin_WrongPassword(t *testing.T) {
-	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
-
-	resp, err := http.PostForm(baseURL+"/admin/login", url.Values{
-		"password": {"wrongpassword"},
-	})
-	if err != nil {
-		t.Fatal(err)
+func TestHealthHandler_RPCDown(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -1, Message: "connection refused"}
 	}
-	defer resp.Body.Close()
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
 
-	if resp.StatusCode != http.StatusUnauthorized {
-		t.Errorf("expected 401, got %d", resp.StatusCode)
+	r := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	svc.healthHandler(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
 	}
 }
 
-func TestAdminLogin_Success(t *testing.T) {
+func TestReadyHandler_OK(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
 
-	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}}
+	r := httptest.NewRequest("GET", "/ready", nil)
+	w := httptest.NewRecorder()
+	svc.readyHandler(w, r)
 
-	resp, err := client.PostForm(baseURL+"/admin/login", url.Values{
-		"password": {"testpass123"},
-	})
-	if err != nil {
-		t.Fatal(err)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusFound {
-		t.Errorf("expected 302 redirect after login, got %d", resp.StatusCode)
+	resp := decodeJSON(t, w.Body)
+	if resp["ready"] != true || resp["synced"] != true || resp["wallet_loaded"] != true || resp["db_ok"] != true {
+		t.Errorf("expected all checks to pass, got %v", resp)
 	}
+}
 
-	cookies := resp.Cookies()
-	found := false
-	for _, c := range cookies {
-		if c.Name == "admin_session" && c.Value != "" {
-			found = true
-			_, valid := svc.validateSessionCookie(c.Value)
-			if !valid {
-				t.Error("session cookie is not valid")
-			}
-		}
+func TestReadyHandler_Syncing(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"chain": "signet", "blocks": 50, "headers": 100, "verificationprogress": 0.42}, nil
 	}
-	if !found {
-		t.Error("expected admin_session cookie to be set")
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	r := httptest.NewRequest("GET", "/ready", nil)
+	w := httptest.NewRecorder()
+	svc.readyHandler(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	resp := decodeJSON(t, w.Body)
+	if resp["synced"] != false || resp["verification_progress"] != 0.42 {
+		t.Errorf("expected unsynced with progress 0.42, got %v", resp)
 	}
 
-	var count int64
-	svc.db.Model(&db.AdminSession{}).Count(&count)
-	if count != 1 {
-		t.Errorf("expected 1 session in db, got %d", count)
+	// liveness is unaffected by sync state
+	w = httptest.NewRecorder()
+	svc.healthHandler(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected /health 200 while syncing, got %d", w.Code)
 	}
 }
 
-func TestAdminLogin_MethodNotAllowed(t *testing.T) {
-	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
+func TestAvailableHandler(t *testing.T) {
+	mock := newMockRPC()
+	blocks := 100
+	mock.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"chain": "signet", "blocks": blocks, "headers": 100, "verificationprogress": 1.0}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.MaxBlockLag = 2
+	svc.cfg.UnavailableMessage = "paused"
+	svc.walletBalance = 10
 
-	req, _ := http.NewRequest("PUT", baseURL+"/admin/login", nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatal(err)
+	get := func() map[string]any {
+		t.Helper()
+		svc.availabilityAt = time.Time{}
+		w := httptest.NewRecorder()
+		svc.availableHandler(w, httptest.NewRequest("GET", "/api/available", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		return decodeJSON(t, w.Body)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusMethodNotAllowed {
-		t.Errorf("expected 405, got %d", resp.StatusCode)
+	if resp := get(); resp["available"] != true || resp["reasons"] != nil || resp["message"] != nil {
+		t.Errorf("expected available, got %v", resp)
 	}
-}
 
-// ---------------------------------------------------------------------------
-// admin logout
-// ---------------------------------------------------------------------------
+	blocks = 90
+	svc.walletBalance = 0
+	svc.breaker.Open = true
+	resp := get()
+	if resp["available"] != false || resp["message"] != "paused" {
+		t.Errorf("expected unavailable with the configured message, got %v", resp)
+	}
+	want := []any{unavailableNodeBehind, unavailableLowBalance, unavailablePayoutsPaused}
+	if fmt.Sprint(resp["reasons"]) != fmt.Sprint(want) {
+		t.Errorf("expected reasons %v, got %v", want, resp["reasons"])
+	}
+}
 
-func TestAdminLogout(t *testing.T) {
+func TestCheckAvailability_Cached(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
-	baseURL := startTestServer(t, svc)
-	cookie := adminLogin(t, svc)
+	svc.walletBalance = 10
 
-	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}}
+	if !svc.checkAvailability(t.Context()).Available {
+		t.Fatal("expected available")
+	}
+	svc.walletBalance = 0
+	if !svc.checkAvailability(t.Context()).Available {
+		t.Error("expected the cached answer within the TTL")
+	}
+	svc.availabilityAt = time.Now().Add(-availabilityCacheTTL)
+	if svc.checkAvailability(t.Context()).Available {
+		t.Error("expected a fresh check after the TTL")
+	}
+}
 
-	req, _ := http.NewRequest("GET", baseURL+"/admin/logout", nil)
-	req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
-	resp, err := client.Do(req)
-	if err != nil {
+func TestReadyHandler_WalletNotLoaded(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listwallets"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []string{"other"}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	r := httptest.NewRequest("GET", "/ready", nil)
+	w := httptest.NewRecorder()
+	svc.readyHandler(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	resp := decodeJSON(t, w.Body)
+	if resp["wallet_loaded"] != false {
+		t.Errorf("expected wallet_loaded=false, got %v", resp)
+	}
+}
+
+func walletSetupMock(loadErr *rpcErr) (*mockRPC, *atomic.Int32) {
+	var created atomic.Int32
+	mock := newMockRPC()
+	mock.handlers["listwallets"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []string{}, nil
+	}
+	mock.handlers["loadwallet"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, loadErr
+	}
+	mock.handlers["createwallet"] = func(_ json.RawMessage) (any, *rpcErr) {
+		created.Add(1)
+		return map[string]any{"name": "faucet"}, nil
+	}
+	return mock, &created
+}
+
+func TestSetupBitcoinCoreWallet_Creates(t *testing.T) {
+	mock, created := walletSetupMock(&rpcErr{Code: btc.RPCErrWalletNotFound, Message: "Path does not exist"})
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.CreateWallet = true
+
+	if err := svc.SetupBitcoinCoreWallet(t.Context()); err != nil {
 		t.Fatal(err)
 	}
-	defer resp.Body.Close()
+	if created.Load() != 1 {
+		t.Errorf("expected createwallet to be called once, got %d", created.Load())
+	}
+}
 
-	if resp.StatusCode != http.StatusFound {
-		t.Errorf("expected 302, got %d", resp.StatusCode)
+func TestSetupBitcoinCoreWallet_NoCreateFlag(t *testing.T) {
+	mock, created := walletSetupMock(&rpcErr{Code: btc.RPCErrWalletNotFound, Message: "Path does not exist"})
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	if err := svc.SetupBitcoinCoreWallet(t.Context()); err == nil || !strings.Contains(err.Error(), "-create-wallet") {
+		t.Errorf("expected load error mentioning -create-wallet, got %v", err)
+	}
+	if created.Load() != 0 {
+		t.Error("expected no createwallet without -create-wallet")
+	}
+}
+
+func TestSetupBitcoinCoreWallet_OtherLoadError(t *testing.T) {
+	mock, created := walletSetupMock(&rpcErr{Code: -4, Message: "Wallet file verification failed"})
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.CreateWallet = true
+
+	if err := svc.SetupBitcoinCoreWallet(t.Context()); err == nil {
+		t.Error("expected load error")
 	}
+	if created.Load() != 0 {
+		t.Error("expected no createwallet when the wallet exists but fails to load")
+	}
+}
 
-	for _, c := range resp.Cookies() {
-		if c.Name == "admin_session" && c.MaxAge == -1 {
-			break
-		}
+func TestCheckConsolidationTarget(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getaddressinfo"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		return map[string]any{"address": p[0], "ismine": p[0] == "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	if err := svc.CheckConsolidationTarget(t.Context()); err != nil {
+		t.Errorf("expected no check without a target, got %v", err)
 	}
 
-	var count int64
-	svc.db.Model(&db.AdminSession{}).Count(&count)
-	if count != 0 {
-		t.Errorf("expected session deleted, got %d sessions", count)
+	svc.cfg.ConsolidationTargetAddress = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+	if err := svc.CheckConsolidationTarget(t.Context()); err != nil {
+		t.Errorf("expected a wallet address to pass, got %v", err)
+	}
+
+	svc.cfg.ConsolidationTargetAddress = testAddress(1)
+	if err := svc.CheckConsolidationTarget(t.Context()); err == nil {
+		t.Error("expected an address outside the wallet to be rejected")
 	}
 }
 
-// ---------------------------------------------------------------------------
-// admin balance endpoint
-// ---------------------------------------------------------------------------
+func TestSetupBitcoinCoreWallet_CreateFails(t *testing.T) {
+	mock, _ := walletSetupMock(&rpcErr{Code: btc.RPCErrWalletNotFound, Message: "Path does not exist"})
+	mock.handlers["createwallet"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -4, Message: "Wallet creation not permitted"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.CreateWallet = true
 
-func TestAdminGetBalance(t *testing.T) {
+	err := svc.SetupBitcoinCoreWallet(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "failed to create wallet") {
+		t.Errorf("expected create error, got %v", err)
+	}
+}
+
+func TestCheckBitcoinNetwork(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	cookie := adminLogin(t, svc)
 
-	r := httptest.NewRequest("GET", "/admin/balance", nil)
-	r.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
-	w := httptest.NewRecorder()
+	if err := svc.CheckBitcoinNetwork(t.Context()); err != nil {
+		t.Errorf("expected signet node to match, got %v", err)
+	}
 
-	svc.adminGetBalanceHandler(w, r)
+	svc.cfg.Network = btc.NetworkRegtest
+	err := svc.CheckBitcoinNetwork(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "expected regtest") {
+		t.Errorf("expected chain mismatch error, got %v", err)
+	}
+}
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", w.Code)
+func TestCheckBitcoinConnection(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	status, err := svc.CheckBitcoinConnection(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BitcoinStatus{
+		Chain:                "signet",
+		Blocks:               100,
+		Headers:              100,
+		VerificationProgress: 1,
+		Wallet:               "faucet",
+		Balance:              btc.WalletBalance{Trusted: 10, Untrusted: 1, Immature: 0.5},
+		UTXOs:                3,
 	}
+	if *status != want {
+		t.Errorf("expected %+v, got %+v", want, *status)
+	}
+}
 
-	resp := decodeJSON(t, w.Body)
-	if resp["trusted"].(float64) != 10.0 {
-		t.Errorf("expected trusted=10, got %v", resp["trusted"])
+func TestCheckBitcoinConnection_WalletMissing(t *testing.T) {
+	mock, created := walletSetupMock(&rpcErr{Code: btc.RPCErrWalletNotFound, Message: "Path does not exist"})
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.CreateWallet = true
+
+	status, err := svc.CheckBitcoinConnection(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "createwallet") {
+		t.Errorf("expected a hint to create the wallet, got %v", err)
 	}
-	if resp["total"].(float64) != 11.5 {
-		t.Errorf("expected total=11.5, got %v", resp["total"])
+	if status == nil || status.Chain != "signet" {
+		t.Errorf("expected chain info despite the wallet error, got %+v", status)
+	}
+	if created.Load() != 0 {
+		t.Error("expected -check to never create the wallet")
 	}
 }
 
 // ---------------------------------------------------------------------------
-// admin get new address
+// error envelope
 // ---------------------------------------------------------------------------
 
-func TestAdminGetNewAddress(t *testing.T) {
-	svc, _ := testServiceFull(t)
-
-	r := httptest.NewRequest("GET", "/admin/getnewaddress", nil)
+func TestWriteJSONError_Legacy(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/submit", nil)
 	w := httptest.NewRecorder()
-	svc.adminGetNewAddressHandler(w, r)
+	writeJSONError(w, r, http.StatusTooManyRequests, errCodeRateLimited, "slow down")
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", w.Code)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
 	}
-
 	resp := decodeJSON(t, w.Body)
-	if resp["address"] == nil || resp["address"].(string) == "" {
-		t.Error("expected address in response")
+	if resp["error"] != "slow down" {
+		t.Errorf("expected bare error message, got %v", resp["error"])
 	}
 }
 
-// ---------------------------------------------------------------------------
-// admin send funds
-// ---------------------------------------------------------------------------
+func TestWriteJSONError_Envelope(t *testing.T) {
+	for _, accept := range []string{
+		ErrorEnvelopeMediaType,
+		"application/json, " + ErrorEnvelopeMediaType + ";q=0.9",
+	} {
+		r := httptest.NewRequest("POST", "/api/submit", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		writeJSONError(w, r, http.StatusTooManyRequests, errCodeRateLimited, "slow down")
 
-func TestAdminSendFunds_Success(t *testing.T) {
+		var resp struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%q: %v", accept, err)
+		}
+		if resp.Error.Code != "rate_limited" || resp.Error.Message != "slow down" {
+			t.Errorf("%q: unexpected envelope %+v", accept, resp.Error)
+		}
+	}
+}
+
+func TestSubmitHandler_ErrorEnvelope(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
-	body := jsonBody(map[string]any{
-		"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		"amount":  0.5,
-	})
-	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "notanaddress"}))
+	r.Header.Set("Accept", ErrorEnvelopeMediaType)
 	w := httptest.NewRecorder()
-	svc.adminSendFundsHandler(w, r)
+	svc.submitHandler(w, r)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
 	}
-
-	resp := decodeJSON(t, w.Body)
-	if resp["success"] != true {
-		t.Error("expected success=true")
+	var resp struct {
+		Error apiError `json:"error"`
 	}
-	if resp["txid"] == nil || resp["txid"].(string) == "" {
-		t.Error("expected txid in response")
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Error.Code != errCodeInvalidAddress || resp.Error.Message == "" {
+		t.Errorf("unexpected envelope %+v", resp.Error)
 	}
 }
 
-func TestAdminSendFunds_MethodNotAllowed(t *testing.T) {
+// ---------------------------------------------------------------------------
+// submit endpoint
+// ---------------------------------------------------------------------------
+
+func TestSubmitHandler_MethodNotAllowed(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
-	r := httptest.NewRequest("GET", "/admin/sendfunds", nil)
+	r := httptest.NewRequest("GET", "/api/submit", nil)
 	w := httptest.NewRecorder()
-	svc.adminSendFundsHandler(w, r)
+	svc.submitHandler(w, r)
 
 	if w.Code != http.StatusMethodNotAllowed {
 		t.Errorf("expected 405, got %d", w.Code)
 	}
 }
 
-func TestAdminSendFunds_InvalidJSON(t *testing.T) {
+func TestSubmitHandler_InvalidJSON(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
-	r := httptest.NewRequest("POST", "/admin/sendfunds", strings.NewReader("nope"))
+	r := httptest.NewRequest("POST", "/api/submit", strings.NewReader("not json"))
 	w := httptest.NewRecorder()
-	svc.adminSendFundsHandler(w, r)
+	svc.submitHandler(w, r)
 
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", w.Code)
 	}
 }
 
-func TestAdminSendFunds_InvalidAddress(t *testing.T) {
+func TestSubmitHandler_InvalidAddress(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
-	body := jsonBody(map[string]any{"address": "invalid_addr", "amount": 0.1})
-	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	body := jsonBody(map[string]any{"address": "invalid", "amount_range": 2})
+	r := httptest.NewRequest("POST", "/api/submit", body)
 	w := httptest.NewRecorder()
-	svc.adminSendFundsHandler(w, r)
+	svc.submitHandler(w, r)
 
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", w.Code)
 	}
+	resp := decodeJSON(t, w.Body)
+	if resp["error"] == nil {
+		t.Error("expected error in response")
+	}
 }
 
-func TestAdminSendFunds_ZeroAmount(t *testing.T) {
+func TestSubmitHandler_BodyTooLarge(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.MaxRequestBodyBytes = 1024
+
+	body := `{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", "message": "` + strings.Repeat("a", 2048) + `"}`
+	r := httptest.NewRequest("POST", "/api/submit", strings.NewReader(body))
+	r.Header.Set("Accept", ErrorEnvelopeMediaType)
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", w.Code)
+	}
+	resp := decodeJSON(t, w.Body)
+	if code := resp["error"].(map[string]any)["code"]; code != errCodeBodyTooLarge {
+		t.Errorf("expected %s, got %v", errCodeBodyTooLarge, code)
+	}
+	if c := db.GetTotalRequestCount(svc.db); c != 0 {
+		t.Errorf("expected nothing queued, got %d", c)
+	}
+
+	// the same limit applies to the admin endpoints
+	r = httptest.NewRequest("POST", "/admin/cancel", strings.NewReader(`{"id": 1, "totp_code": "`+strings.Repeat("1", 2048)+`"}`))
+	w = httptest.NewRecorder()
+	svc.adminCancelHandler(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 from the admin endpoint, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_Message(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
 	body := jsonBody(map[string]any{
 		"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		"amount":  0,
+		"message": " gm\x00 from\nsignet ",
 	})
-	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	r.RemoteAddr = "127.0.0.1:1234"
 	w := httptest.NewRecorder()
-	svc.adminSendFundsHandler(w, r)
+	svc.submitHandler(w, r)
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", w.Code)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.OpReturn != "gm fromsignet" {
+		t.Errorf("expected sanitized message, got %q", tx.OpReturn)
 	}
 }
 
-func TestAdminSendFunds_InsufficientBalance(t *testing.T) {
+func TestSubmitHandler_MessageTooLong(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
 	body := jsonBody(map[string]any{
 		"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		"amount":  99999.0,
+		"message": strings.Repeat("a", maxOpReturnMessageLen+1),
 	})
-	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	r := httptest.NewRequest("POST", "/api/submit", body)
 	w := httptest.NewRecorder()
-	svc.adminSendFundsHandler(w, r)
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	var count int64
+	svc.db.Model(&db.Transaction{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected nothing queued, got %d", count)
+	}
+}
+
+func TestSubmitHandler_MainnetAddressRejected(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{"address": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", "amount_range": 2})
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
 
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", w.Code)
 	}
-	resp := decodeJSON(t, w.Body)
-	if !strings.Contains(resp["error"].(string), "Insufficient") {
-		t.Errorf("expected insufficient balance error, got: %s", resp["error"])
+}
+
+func TestSubmitHandler_Success(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount_range": 2,
+	})
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["success"] != true {
+		t.Errorf("expected success=true, got %v", resp["success"])
+	}
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Address != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
+		t.Errorf("unexpected address in db: %s", tx.Address)
+	}
+	if tx.Status != db.TxnStatusPending {
+		t.Errorf("expected pending status, got %s", tx.Status)
+	}
+	if tx.AmountBTC < 0.01 || tx.AmountBTC > 0.09 {
+		t.Errorf("amount %.8f out of range 2 bounds", tx.AmountBTC)
+	}
+}
+
+func TestSubmitHandler_QueuePosition(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	// only pending rows count, in id order
+	svc.db.Create(&db.Transaction{Address: "tb1qa", Status: db.TxnStatusPending})
+	svc.db.Create(&db.Transaction{Address: "tb1qb", Status: db.TxnStatusBroadcast})
+	svc.db.Create(&db.Transaction{Address: "tb1qc", Status: db.TxnStatusPending})
+
+	r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}))
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := decodeJSON(t, w.Body)
+	if resp["pending_ahead"] != 2.0 {
+		t.Errorf("expected 2 ahead, got %v", resp["pending_ahead"])
+	}
+	var queued db.Transaction
+	svc.db.Last(&queued)
+	if resp["amount_btc"] != queued.AmountBTC || resp["message"] == nil || resp["success"] != true {
+		t.Errorf("expected success, message and amount_btc %v, got %v", queued.AmountBTC, resp)
+	}
+	if resp["batch_interval_seconds"] != 60.0 || resp["eta_seconds"] != 60.0 {
+		t.Errorf("expected a one batch eta of 60s, got %v", resp)
+	}
+
+	// a row added later isn't ahead of an earlier one
+	var first db.Transaction
+	svc.db.First(&first)
+	w = httptest.NewRecorder()
+	svc.writeQueuedResponse(w, &first)
+	if resp := decodeJSON(t, w.Body); resp["pending_ahead"] != 0.0 {
+		t.Errorf("expected nothing ahead of the oldest row, got %v", resp["pending_ahead"])
+	}
+}
+
+func TestWriteQueuedResponse_MultipleBatches(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	for i := 0; i < svc.cfg.BatchSize+5; i++ {
+		svc.db.Create(&db.Transaction{Address: fmt.Sprintf("tb1q%d", i), Status: db.TxnStatusPending})
+	}
+	tx := db.Transaction{Address: "tb1qlast", Status: db.TxnStatusPending}
+	svc.db.Create(&tx)
+
+	w := httptest.NewRecorder()
+	svc.writeQueuedResponse(w, &tx)
+	resp := decodeJSON(t, w.Body)
+	if resp["eta_seconds"] != 120.0 {
+		t.Errorf("expected to be paid in the second batch, got eta %v", resp["eta_seconds"])
+	}
+}
+
+func TestWriteQueuedResponse_SmallestFirst(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.BatchOrder = BatchOrderSmallestFirst
+
+	for _, amount := range []float64{0.05, 0.001, 0.01} {
+		svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: amount, Status: db.TxnStatusPending})
+	}
+	tx := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending}
+	svc.db.Create(&tx)
+
+	w := httptest.NewRecorder()
+	svc.writeQueuedResponse(w, &tx)
+	// 0.001 is smaller and the earlier 0.01 wins the tie, 0.05 waits behind
+	if resp := decodeJSON(t, w.Body); resp["pending_ahead"] != 2.0 {
+		t.Errorf("expected 2 ahead, got %v", resp["pending_ahead"])
+	}
+}
+
+func TestVerifyReceiptHandler(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	tx := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.0123, Status: db.TxnStatusPending}
+	svc.db.Create(&tx)
+
+	w := httptest.NewRecorder()
+	svc.writeQueuedResponse(w, &tx)
+	queued, _ := decodeJSON(t, w.Body)["receipt"].(map[string]any)
+	if queued["status"] != receiptStatusUnconfirmed || queued["txid"] != nil {
+		t.Errorf("expected an unconfirmed receipt without txid for a queued request, got %v", queued)
+	}
+	token, _ := queued["token"].(string)
+
+	verify := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/verify-receipt?receipt="+url.QueryEscape(token), nil)
+		r.Header.Set("Accept", ErrorEnvelopeMediaType)
+		w := httptest.NewRecorder()
+		svc.verifyReceiptHandler(w, r)
+		return w
+	}
+
+	w = verify(token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := decodeJSON(t, w.Body)
+	rc, _ := resp["receipt"].(map[string]any)
+	if resp["valid"] != true || rc["address"] != tx.Address || rc["amount_btc"] != 0.0123 || rc["status"] != receiptStatusUnconfirmed {
+		t.Errorf("expected the queued receipt back, got %v", resp)
+	}
+	if resp["message"] == nil {
+		t.Errorf("expected an unconfirmed receipt to say so, got %v", resp)
+	}
+
+	broadcast := svc.issueReceipt(&tx, "abc", time.Now())
+	if broadcast.Status != receiptStatusBroadcast {
+		t.Errorf("expected broadcast status with a txid, got %q", broadcast.Status)
+	}
+	w = verify(broadcast.Token)
+	resp = decodeJSON(t, w.Body)
+	rc, _ = resp["receipt"].(map[string]any)
+	if w.Code != http.StatusOK || rc["txid"] != "abc" || resp["message"] != nil {
+		t.Errorf("expected the broadcast receipt back, got %d %v", w.Code, resp)
+	}
+
+	// swapping in another payload keeps the old signature
+	other := svc.issueReceipt(&db.Transaction{Address: tx.Address, AmountBTC: 1}, "abc", time.Now())
+	payload, _, _ := strings.Cut(other.Token, ".")
+	_, sig, _ := strings.Cut(broadcast.Token, ".")
+	for _, bad := range []string{payload + "." + sig, broadcast.Token + "0", "nodot", ""} {
+		w := verify(bad)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %q, got %d", bad, w.Code)
+		}
+	}
+	if w := verify(payload + "." + sig); !strings.Contains(w.Body.String(), errCodeInvalidReceipt) {
+		t.Errorf("expected %s, got %s", errCodeInvalidReceipt, w.Body.String())
+	}
+
+	// a receipt from another faucet doesn't verify here
+	svc.cfg.AdminCookieSecret = "different_secret_01234567890123456789"
+	if w := verify(token); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 with another secret, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_BotCheck(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.BotCheck = true
+	svc.cfg.MinFormFillTime = 3 * time.Second
+	svc.cfg.MaxFormAge = time.Hour
+
+	old := svc.formToken(time.Now().Add(-time.Minute))
+	ts, _, _ := strings.Cut(old, ".")
+
+	cases := []struct {
+		name     string
+		website  string
+		token    string
+		wantCode int
+	}{
+		{"honeypot filled", "http://spam.example", old, http.StatusBadRequest},
+		{"missing token", "", "", http.StatusBadRequest},
+		{"forged signature", "", ts + ".deadbeef", http.StatusBadRequest},
+		{"too fast", "", svc.formToken(time.Now()), http.StatusBadRequest},
+		{"expired", "", svc.formToken(time.Now().Add(-2 * time.Hour)), http.StatusBadRequest},
+		{"human", "", old, http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := jsonBody(map[string]any{
+				"address":    "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+				"website":    tc.website,
+				"form_token": tc.token,
+			})
+			r := httptest.NewRequest("POST", "/api/submit", body)
+			w := httptest.NewRecorder()
+			svc.submitHandler(w, r)
+
+			if w.Code != tc.wantCode {
+				t.Errorf("expected %d, got %d: %s", tc.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if c := db.GetTotalRequestCount(svc.db); c != 1 {
+		t.Errorf("expected only the human submission to be queued, got %d", c)
+	}
+
+	stale := svc.formToken(time.Now().Add(-2 * time.Hour))
+	if err := svc.checkBot("", stale, time.Now()); !errors.Is(err, errFormExpired) {
+		t.Errorf("expected an expired token, got %v", err)
+	}
+	svc.cfg.MaxFormAge = 0
+	if err := svc.checkBot("", stale, time.Now()); err != nil {
+		t.Errorf("expected no expiry with -max-form-age=0, got %v", err)
+	}
+}
+
+func TestIndexHandler_BotCheckFields(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.BotCheck = true
+
+	t.Chdir("..")
+	if err := svc.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir("service")
+
+	w := httptest.NewRecorder()
+	svc.indexHandler(w, httptest.NewRequest("GET", "/", nil))
+
+	body := w.Body.String()
+	if !strings.Contains(body, `name="website"`) {
+		t.Error("expected honeypot field on the page")
+	}
+	m := regexp.MustCompile(`const formToken = '([^']+)'`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("expected form token on the page")
+	}
+	if err := svc.checkBot("", m[1], time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("expected rendered form token to verify, got %v", err)
+	}
+}
+
+func TestIndexHandler_PayoutInfo(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.walletBalance = 1.5
+
+	t.Chdir("..")
+	if err := svc.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir("service")
+
+	w := httptest.NewRecorder()
+	svc.indexHandler(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+
+	ranges := svc.GetEnabledAmountRanges()
+	want := fmt.Sprintf("Payouts between %s and %s sBTC", formatBTC(ranges[0].MinBTC), formatBTC(ranges[len(ranges)-1].MaxBTC))
+	if !strings.Contains(body, want) {
+		t.Errorf("expected %q on the page", want)
+	}
+	remaining := fmt.Sprintf("~%d payouts remaining", int64(svc.estimatedPayoutsRemaining(1.5-svc.payoutFloor())))
+	if !strings.Contains(body, remaining) {
+		t.Errorf("expected %q on the page", remaining)
+	}
+	if !strings.Contains(body, "wallet balance: 1.5 sBTC") {
+		t.Error("expected the trimmed wallet balance in the footer")
+	}
+}
+
+func TestFormatBTC(t *testing.T) {
+	for amount, want := range map[float64]string{
+		0:           "0",
+		1:           "1",
+		1.5:         "1.5",
+		0.00000001:  "0.00000001",
+		0.123456789: "0.12345679",
+		21000000:    "21000000",
+		-0.25:       "-0.25",
+	} {
+		if got := formatBTC(amount); got != want {
+			t.Errorf("formatBTC(%v) = %q, want %q", amount, got, want)
+		}
+	}
+
+	if got := btcToSats(0.00012345); got != 12345 {
+		t.Errorf("expected 12345 sats, got %d", got)
+	}
+}
+
+func TestSubmitHandler_AddressLists(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	dir := t.TempDir()
+	svc.cfg.AddressDenylistFile = filepath.Join(dir, "deny.txt")
+	svc.cfg.AddressAllowlistFile = filepath.Join(dir, "allow.txt")
+	os.WriteFile(svc.cfg.AddressDenylistFile, []byte("# abuse\nTB1QRP33G0Q5C5TXSP9ARYSRX4K6ZDKFS4NCE4XJ0GDCCCEFVPYSXF3Q0SL5K7\n\n"), 0600)
+	os.WriteFile(svc.cfg.AddressAllowlistFile, []byte("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx\ntb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7\n"), 0600)
+	if err := svc.LoadAddressLists(); err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(address string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": address}))
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	w := submit("tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7")
+	if w.Code != http.StatusForbidden || !strings.Contains(decodeJSON(t, w.Body)["error"].(string), "blocked") {
+		t.Errorf("expected denylisted address to be blocked, got %d", w.Code)
+	}
+
+	w = submit("tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c")
+	if w.Code != http.StatusForbidden || !strings.Contains(decodeJSON(t, w.Body)["error"].(string), "allowlist") {
+		t.Errorf("expected address missing from allowlist to be refused, got %d", w.Code)
+	}
+
+	if w := submit("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"); w.Code != http.StatusOK {
+		t.Errorf("expected allowlisted address to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLoadAddressLists_Reload(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	svc.cfg.AddressDenylistFile = filepath.Join(t.TempDir(), "deny.txt")
+	os.WriteFile(svc.cfg.AddressDenylistFile, []byte("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx\n"), 0600)
+	if err := svc.LoadAddressLists(); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.checkAddressLists("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"); !errors.Is(err, errAddressDenied) {
+		t.Fatalf("expected denied, got %v", err)
+	}
+
+	// a failed reload keeps the lists in use
+	os.Remove(svc.cfg.AddressDenylistFile)
+	if err := svc.LoadAddressLists(); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if err := svc.checkAddressLists("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"); !errors.Is(err, errAddressDenied) {
+		t.Errorf("expected previous denylist to stay active, got %v", err)
+	}
+
+	os.WriteFile(svc.cfg.AddressDenylistFile, []byte(""), 0600)
+	if err := svc.LoadAddressLists(); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.checkAddressLists("tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"); err != nil {
+		t.Errorf("expected address accepted after reload, got %v", err)
+	}
+}
+
+func TestParseAPIKey(t *testing.T) {
+	if k := ParseAPIKey("ci:secret"); k.ID != "ci" || k.Key != "secret" {
+		t.Errorf("unexpected key %+v", k)
+	}
+	k := ParseAPIKey(" secret ")
+	if k.Key != "secret" || !strings.HasPrefix(k.ID, "key-") || strings.Contains(k.ID, "secret") {
+		t.Errorf("unexpected key %+v", k)
+	}
+	if ParseAPIKey("secret").ID != k.ID {
+		t.Error("expected a stable ID for a bare key")
+	}
+}
+
+func TestSubmitHandler_APIKey(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.CaptchaSecret = "turnstile-secret"
+	svc.cfg.APIKeys = []APIKey{{ID: "ci", Key: "secret-key"}}
+	svc.cfg.APIKeyMaxWithdrawals24h = 2
+
+	submit := func(auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}))
+		r.RemoteAddr = "198.51.100.1:1234"
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	// invalid keys fall through to the normal Turnstile check
+	for _, auth := range []string{"", "Bearer wrong-key", "Basic secret-key"} {
+		if w := submit(auth); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", auth, w.Code)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := submit("Bearer secret-key"); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		settleInFlight(svc)
+	}
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.APIKeyID != "ci" {
+		t.Errorf("expected api key id ci, got %q", tx.APIKeyID)
+	}
+
+	if w := submit("Bearer secret-key"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 once the key limit is used up, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_Priority(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.APIKeys = []APIKey{{ID: "ci", Key: "secret-key"}}
+
+	submitted := 0
+	submit := func(remoteAddr, apiKey, priority string) *httptest.ResponseRecorder {
+		submitted++
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": testAddress(submitted), "priority": priority}))
+		r.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			r.Header.Set(apiKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	// browser requests are always normal
+	if w := submit("198.51.100.1:1234", "", "high"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var tx db.Transaction
+	svc.db.Last(&tx)
+	if tx.Priority != db.TxnPriorityNormal {
+		t.Errorf("expected a request without key to be normal, got %d", tx.Priority)
+	}
+
+	w := submit("198.51.100.2:1234", "secret-key", "high")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	tx = db.Transaction{}
+	svc.db.Last(&tx)
+	if tx.Priority != db.TxnPriorityHigh {
+		t.Errorf("expected high priority with an API key, got %d", tx.Priority)
+	}
+	if resp := decodeJSON(t, w.Body); resp["pending_ahead"] != 0.0 {
+		t.Errorf("expected nothing ahead of a high priority request, got %v", resp["pending_ahead"])
+	}
+
+	w = submit("198.51.100.2:1234", "secret-key", "low")
+	tx = db.Transaction{}
+	svc.db.Last(&tx)
+	if tx.Priority != db.TxnPriorityLow {
+		t.Errorf("expected low priority, got %d", tx.Priority)
+	}
+	if resp := decodeJSON(t, w.Body); resp["pending_ahead"] != 2.0 {
+		t.Errorf("expected the normal and high requests ahead of a low one, got %v", resp["pending_ahead"])
+	}
+
+	if w := submit("198.51.100.2:1234", "secret-key", "urgent"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown priority, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_APIKeyRateLimitSeparateFromIP(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.APIKeys = []APIKey{{ID: "ci", Key: "secret-key"}}
+	svc.cfg.APIKeyMaxWithdrawals24h = 5
+
+	// the IP is already at its browser limit
+	for i := 0; i < svc.cfg.MaxWithdrawalsPerIP24h; i++ {
+		svc.db.Create(&db.Transaction{Address: "tb1qother", IPAddress: "198.51.100.1", IPPrefix: "198.51.100.1/32", Status: db.TxnStatusBroadcast})
+	}
+
+	r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}))
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set("Authorization", "Bearer secret-key")
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSubmitHandler_FastLane(t *testing.T) {
+	mock := newMockRPC()
+	var createParams json.RawMessage
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		createParams = params
+		return "rawhex000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.FastLane = true
+	svc.cfg.APIKeys = []APIKey{{ID: "ci", Key: "secret-key"}}
+
+	submit := func(remoteAddr, apiKey string, payload map[string]any) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(payload))
+		r.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			r.Header.Set(apiKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	w := submit("198.51.100.1:1234", "secret-key", map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := decodeJSON(t, w.Body)
+	if resp["txid"] == nil {
+		t.Errorf("expected txid in response, got %v", resp)
+	}
+	if rc, _ := resp["receipt"].(map[string]any); rc["status"] != receiptStatusBroadcast || rc["txid"] != resp["txid"] {
+		t.Errorf("expected a broadcast receipt for the fast lane payout, got %v", resp["receipt"])
+	}
+	if strings.Contains(string(createParams), `"data"`) {
+		t.Errorf("fast lane payout shouldn't have an OP_RETURN output: %s", createParams)
+	}
+
+	var tx db.Transaction
+	svc.db.Last(&tx)
+	if resp["amount_btc"] != tx.AmountBTC {
+		t.Errorf("expected amount_btc %v in response, got %v", tx.AmountBTC, resp["amount_btc"])
+	}
+	if tx.Status != db.TxnStatusBroadcast || tx.OnchainTxnID == "" {
+		t.Errorf("expected broadcast with txid, got status=%s txid=%q", tx.Status, tx.OnchainTxnID)
+	}
+
+	// admin IP, no key
+	submit("127.0.0.1:1234", "", map[string]any{"address": "tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7"})
+	var adminTx db.Transaction
+	svc.db.Last(&adminTx)
+	if adminTx.ID == tx.ID || adminTx.Status != db.TxnStatusBroadcast {
+		t.Errorf("admin IP: expected a new broadcast row, got id=%d status=%s", adminTx.ID, adminTx.Status)
+	}
+
+	for name, c := range map[string]struct {
+		remoteAddr, apiKey, message string
+	}{
+		"wrong key":    {"198.51.100.2:1234", "wrong-key", ""},
+		"no key":       {"198.51.100.3:1234", "", ""},
+		"with message": {"198.51.100.4:1234", "secret-key", "hello"},
+	} {
+		settleInFlight(svc)
+		w := submit(c.remoteAddr, c.apiKey, map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", "message": c.message})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", name, w.Code, w.Body.String())
+		}
+		var queued db.Transaction
+		svc.db.Last(&queued)
+		if queued.Status != db.TxnStatusPending {
+			t.Errorf("%s: expected pending, got %s", name, queued.Status)
+		}
+	}
+}
+
+func TestSubmitHandler_FastLaneFallsBackToQueue(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.FastLane = true
+	svc.cfg.APIKeys = []APIKey{{ID: "ci", Key: "secret-key"}}
+	svc.cfg.ReserveBalance = 11
+
+	r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}))
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set(apiKeyHeader, "secret-key")
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusPending {
+		t.Errorf("expected pending when the balance doesn't cover it, got %s", tx.Status)
+	}
+}
+
+func TestSubmitHandler_FastLaneInsufficientFunds(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["fundrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: btc.RPCErrWalletInsufficientFunds, Message: "Insufficient funds"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.FastLane = true
+	svc.cfg.APIKeys = []APIKey{{ID: "ci", Key: "secret-key"}}
+
+	r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}))
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set(apiKeyHeader, "secret-key")
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusPending {
+		t.Errorf("expected the payout to be queued, got %s", tx.Status)
+	}
+}
+
+func TestSendImmediate_Unavailable(t *testing.T) {
+	mock := newMockRPC()
+	var funded int
+	mock.handlers["fundrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		funded++
+		return map[string]any{"hex": "fundedhex000", "fee": 0.00001}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.FastLane = true
+	// 1.5008 in safe utxos, 1 spendable
+	svc.cfg.ReserveBalance = 0.5008
+
+	tx := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.9999999, Status: db.TxnStatusProcessing}
+	svc.db.Create(&tx)
+
+	// covers the amount but not the fee
+	if _, err := svc.sendImmediate(t.Context(), &tx); !errors.Is(err, errFastLaneUnavailable) {
+		t.Errorf("expected errFastLaneUnavailable without room for the fee, got %v", err)
+	}
+
+	tx.AmountBTC = 0.001
+	svc.walletMtx.Lock()
+	_, err := svc.sendImmediate(t.Context(), &tx)
+	svc.walletMtx.Unlock()
+	if !errors.Is(err, errFastLaneUnavailable) {
+		t.Errorf("expected errFastLaneUnavailable while the wallet is busy, got %v", err)
+	}
+	if funded != 0 {
+		t.Errorf("expected nothing funded, got %d", funded)
+	}
+
+	if _, err := svc.sendImmediate(t.Context(), &tx); err != nil {
+		t.Errorf("expected the send to go through once the wallet is free, got %v", err)
+	}
+}
+
+func TestSubmitHandler_FastLaneDisabled(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.APIKeys = []APIKey{{ID: "ci", Key: "secret-key"}}
+
+	r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}))
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set(apiKeyHeader, "secret-key")
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusPending {
+		t.Errorf("expected pending with fast lane off, got %s", tx.Status)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// mockTurnstile answers siteverify with resp instead of calling Cloudflare
+func mockTurnstile(svc *Service, resp map[string]any) {
+	svc.captcha.(*turnstileVerifier).client.HttpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := json.Marshal(resp)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(b)),
+		}, nil
+	})}
+}
+
+func TestCheckTurnstileResponse(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	v := svc.captcha.(*turnstileVerifier)
+
+	if err := v.check(&turnstile.TurnstileResponse{Success: true, Hostname: "evil.example"}); err != nil {
+		t.Errorf("expected any hostname to pass when unconfigured, got %v", err)
+	}
+
+	svc.cfg.CaptchaExpectedHostname = "faucet.coinbin.org"
+	svc.cfg.TurnstileExpectedAction = "submit"
+
+	for _, c := range []struct {
+		hostname, action string
+		ok               bool
+	}{
+		{"faucet.coinbin.org", "submit", true},
+		{"Faucet.Coinbin.org", "submit", true},
+		{"evil.example", "submit", false},
+		{"", "submit", false},
+		{"faucet.coinbin.org", "login", false},
+		{"faucet.coinbin.org", "", false},
+	} {
+		err := v.check(&turnstile.TurnstileResponse{Success: true, Hostname: c.hostname, Action: c.action})
+		if (err == nil) != c.ok {
+			t.Errorf("hostname=%q action=%q: expected ok=%v, got %v", c.hostname, c.action, c.ok, err)
+		}
+	}
+}
+
+func TestSubmitHandler_TurnstileHostnameMismatch(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.CaptchaSecret = "turnstile-secret"
+	svc.cfg.CaptchaExpectedHostname = "faucet.coinbin.org"
+
+	submit := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{
+			"address":         "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"turnstile_token": "token",
+		}))
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	mockTurnstile(svc, map[string]any{"success": true, "hostname": "other-site.example"})
+	if w := submit(); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a token from another site, got %d", w.Code)
+	}
+
+	mockTurnstile(svc, map[string]any{"success": true, "hostname": "faucet.coinbin.org"})
+	if w := submit(); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestNewCaptchaVerifier(t *testing.T) {
+	cfg := testConfig()
+	if _, ok := newCaptchaVerifier(cfg, slog.Default()).(*turnstileVerifier); !ok {
+		t.Error("expected turnstile by default")
+	}
+	cfg.CaptchaProvider = CaptchaProviderHCaptcha
+	if _, ok := newCaptchaVerifier(cfg, slog.Default()).(*hcaptchaVerifier); !ok {
+		t.Error("expected hcaptcha")
+	}
+}
+
+func TestHCaptchaVerifier(t *testing.T) {
+	cfg := testConfig()
+	cfg.CaptchaProvider = CaptchaProviderHCaptcha
+	cfg.CaptchaSecret = "hcaptcha-secret"
+	cfg.CaptchaSiteKey = "site-key"
+
+	var form url.Values
+	var resp map[string]any
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	v := newCaptchaVerifier(cfg, slog.Default()).(*hcaptchaVerifier)
+	v.endpoint = srv.URL
+
+	resp = map[string]any{"success": true, "hostname": "faucet.coinbin.org"}
+	ok, err := v.Verify("token")
+	if err != nil || !ok {
+		t.Fatalf("expected success, got ok=%v err=%v", ok, err)
+	}
+	if form.Get("secret") != "hcaptcha-secret" || form.Get("response") != "token" || form.Get("sitekey") != "site-key" {
+		t.Errorf("unexpected form: %v", form)
+	}
+
+	resp = map[string]any{"success": false, "error-codes": []string{"invalid-input-response"}}
+	if ok, err := v.Verify("token"); err != nil || ok {
+		t.Errorf("expected rejection, got ok=%v err=%v", ok, err)
+	}
+
+	cfg.CaptchaExpectedHostname = "faucet.coinbin.org"
+	resp = map[string]any{"success": true, "hostname": "other-site.example"}
+	if ok, err := v.Verify("token"); err != nil || ok {
+		t.Errorf("expected hostname mismatch to be rejected, got ok=%v err=%v", ok, err)
+	}
+
+	status = http.StatusInternalServerError
+	if _, err := v.Verify("token"); err == nil {
+		t.Error("expected an error for a non-200 response")
+	}
+}
+
+func TestSubmitHandler_HCaptcha(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.CaptchaProvider = CaptchaProviderHCaptcha
+	svc.cfg.CaptchaSecret = "hcaptcha-secret"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"success": r.FormValue("response") == "good-token"})
+	}))
+	defer srv.Close()
+	v := newCaptchaVerifier(svc.cfg, svc.logger).(*hcaptchaVerifier)
+	v.endpoint = srv.URL
+	svc.captcha = v
+
+	submit := func(token string) int {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{
+			"address":       "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"captcha_token": token,
+		}))
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w.Code
+	}
+
+	if code := submit("bad-token"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a rejected token, got %d", code)
+	}
+	if code := submit("good-token"); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+}
+
+func TestSubmitHandler_MaxLifetimePerAddress(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.MaxLifetimePerAddress = 0.05
+	// an empty cached balance makes balance-scaled mode pay exactly the
+	// range minimum, 0.01 for range 2
+	svc.cfg.AmountMode = AmountModeBalanceScaled
+	svc.cfg.AmountTargetBalance = 10
+
+	const address = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+	submit := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": address, "amount_range": 2}))
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	svc.db.Create(&db.Transaction{Address: address, AmountBTC: 1.0, Status: db.TxnStatusFailed})
+	prior := db.Transaction{Address: address, AmountBTC: 0.04, Status: db.TxnStatusBroadcast}
+	svc.db.Create(&prior)
+
+	// 0.04 + 0.01 lands exactly on the cap
+	if w := submit(); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 at the cap, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := submit()
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 over the cap, got %d", w.Code)
+	}
+	if resp := decodeJSON(t, w.Body); !strings.Contains(resp["error"].(string), "lifetime limit") {
+		t.Errorf("expected lifetime limit error, got %v", resp)
+	}
+
+	// one satoshi over
+	svc.db.Where("address = ? AND status = ?", address, db.TxnStatusPending).Delete(&db.Transaction{})
+	svc.db.Model(&prior).Update("amount_btc", 0.04000001)
+	if w := submit(); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 one satoshi over the cap, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_TurnstileMetrics(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.CaptchaSecret = "turnstile-secret"
+
+	submit := func(token string) {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{
+			"address":         "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"turnstile_token": token,
+		}))
+		r.RemoteAddr = "127.0.0.1:1234"
+		svc.submitHandler(httptest.NewRecorder(), r)
+	}
+	count := func(result string) float64 {
+		return testutil.ToFloat64(FaucetTurnstileVerifications.WithLabelValues(result))
+	}
+
+	success, failure, errored := count("success"), count("failure"), count("error")
+
+	mockTurnstile(svc, map[string]any{"success": true})
+	submit("token")
+	mockTurnstile(svc, map[string]any{"success": false, "error-codes": []string{"invalid-input-response"}})
+	submit("token")
+	submit("")
+	svc.captcha.(*turnstileVerifier).client.HttpClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})}
+	submit("token")
+
+	if got := count("success") - success; got != 1 {
+		t.Errorf("expected 1 success, got %v", got)
+	}
+	if got := count("failure") - failure; got != 2 {
+		t.Errorf("expected 2 failures, got %v", got)
+	}
+	if got := count("error") - errored; got != 1 {
+		t.Errorf("expected 1 error, got %v", got)
+	}
+}
+
+func TestTurnstileMetrics_RegisteredWhenDisabled(t *testing.T) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := map[string]bool{}
+	for _, f := range families {
+		if f.GetName() != "faucet_turnstile_verifications_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				results[l.GetValue()] = true
+			}
+		}
+	}
+	for _, r := range []string{"success", "failure", "error"} {
+		if !results[r] {
+			t.Errorf("expected a %s series to be exported", r)
+		}
+	}
+}
+
+func TestSubmitHandler_RegtestAddress(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.Network = btc.NetworkRegtest
+
+	for addr, wantCode := range map[string]int{
+		"bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080": http.StatusOK,
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx":   http.StatusBadRequest,
+	} {
+		body := jsonBody(map[string]any{"address": addr})
+		r := httptest.NewRequest("POST", "/api/submit", body)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+
+		if w.Code != wantCode {
+			t.Errorf("%s: expected %d, got %d: %s", addr, wantCode, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSubmitHandler_DefaultAmountRange(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount_range": 999,
+	})
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 (fallback to default range), got %d: %s", w.Code, w.Body.String())
+	}
+
+	var tx db.Transaction
+	svc.db.Last(&tx)
+	if tx.AmountBTC < 0.01 || tx.AmountBTC > 0.09 {
+		t.Errorf("amount %.8f should be in default range 2", tx.AmountBTC)
+	}
+}
+
+func TestSubmitHandler_ExactAmount(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	submit := func(amount any) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{
+			"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"amount_range": 2,
+			"amount":       amount,
+		}))
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	for _, amount := range []float64{0.009, 0.0900001, 0, -0.05} {
+		w := submit(amount)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", amount, w.Code)
+			continue
+		}
+		if resp := decodeJSON(t, w.Body); !strings.Contains(resp["error"].(string), "between 0.01000000 and 0.09000000") {
+			t.Errorf("%v: unexpected error %v", amount, resp)
+		}
+	}
+
+	// sub-satoshi digits are rounded off
+	if w := submit(0.012345678); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var tx db.Transaction
+	svc.db.Last(&tx)
+	if tx.AmountBTC != 0.01234568 {
+		t.Errorf("expected the exact amount 0.01234568, got %.8f", tx.AmountBTC)
+	}
+
+	settleInFlight(svc)
+	if w := submit(0.09); w.Code != http.StatusOK {
+		t.Errorf("expected the range maximum to be allowed, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_RateLimitNonAdmin(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxWithdrawalsPerIP24h = 1
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("10.0.0.0/8")}
+
+	body := jsonBody(map[string]any{
+		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount_range": 2,
+	})
+
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	r.RemoteAddr = "192.168.1.1:1234"
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request should succeed, got %d", w.Code)
+	}
+
+	body2 := jsonBody(map[string]any{
+		"address":      "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount_range": 2,
+	})
+	r2 := httptest.NewRequest("POST", "/api/submit", body2)
+	r2.RemoteAddr = "192.168.1.1:1234"
+	w2 := httptest.NewRecorder()
+	svc.submitHandler(w2, r2)
+
+	if w2.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 rate limit, got %d", w2.Code)
+	}
+}
+
+func TestRateLimitPrefix(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.RateLimitIPv4Prefix = 24
+	svc.cfg.RateLimitIPv6Prefix = 64
+
+	for ip, want := range map[string]string{
+		"192.168.1.77":            "192.168.1.0/24",
+		"::ffff:192.168.1.77":     "192.168.1.0/24",
+		"2001:db8:1:2:aaaa::1":    "2001:db8:1:2::/64",
+		"2001:db8:1:2:ffff::9999": "2001:db8:1:2::/64",
+		"not-an-ip":               "not-an-ip",
+	} {
+		if got := svc.rateLimitPrefix(ip); got != want {
+			t.Errorf("rateLimitPrefix(%s) = %s, want %s", ip, got, want)
+		}
+	}
+
+	svc.cfg.RateLimitIPv4Prefix = 32
+	if got := svc.rateLimitPrefix("192.168.1.77"); got != "192.168.1.77/32" {
+		t.Errorf("expected exact /32, got %s", got)
+	}
+}
+
+func TestSubmitHandler_RateLimitSubnet(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		first  string
+		second string
+	}{
+		{"ipv4 /24", "203.0.113.10", "203.0.113.200"},
+		{"ipv6 /64", "2001:db8:1:2::1", "2001:db8:1:2:ffff::2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, _ := testServiceFull(t)
+			svc.settings.MaxWithdrawalsPerIP24h = 1
+			svc.cfg.RateLimitIPv4Prefix = 24
+
+			submit := func(ip string) int {
+				body := jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"})
+				r := httptest.NewRequest("POST", "/api/submit", body)
+				r.Header.Set("X-Real-IP", ip)
+				w := httptest.NewRecorder()
+				svc.submitHandler(w, r)
+				return w.Code
+			}
+
+			if code := submit(tc.first); code != http.StatusOK {
+				t.Fatalf("first request should succeed, got %d", code)
+			}
+			if code := submit(tc.second); code != http.StatusTooManyRequests {
+				t.Errorf("expected 429 for an address in the same subnet, got %d", code)
+			}
+
+			var tx db.Transaction
+			svc.db.First(&tx)
+			if tx.IPPrefix != svc.rateLimitPrefix(tc.first) {
+				t.Errorf("expected stored prefix %s, got %s", svc.rateLimitPrefix(tc.first), tx.IPPrefix)
+			}
+		})
+	}
+}
+
+func TestSubmitHandler_RateLimitLegacyRows(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxWithdrawalsPerIP24h = 1
+
+	// recorded before ip_prefix existed
+	svc.db.Create(&db.Transaction{Address: "tb1qother", IPAddress: "198.51.100.5", Status: db.TxnStatusBroadcast})
+
+	body := jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"})
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	r.Header.Set("X-Real-IP", "198.51.100.5")
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_AdminBypassesRateLimit(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxWithdrawalsPerIP24h = 1
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+
+	for i := range 3 {
+		body := jsonBody(map[string]any{
+			"address":      testAddress(i),
+			"amount_range": 2,
+		})
+		r := httptest.NewRequest("POST", "/api/submit", body)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("admin request %d should succeed, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+}
+
+func quotaRequest(t *testing.T, svc *Service, ip string) map[string]any {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/api/quota", nil)
+	r.Header.Set("X-Real-IP", ip)
+	w := httptest.NewRecorder()
+	svc.quotaHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	return decodeJSON(t, w.Body)
+}
+
+func TestQuotaHandler(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxWithdrawalsPerIP24h = 2
+
+	resp := quotaRequest(t, svc, "203.0.113.5")
+	if resp["used"] != 0.0 || resp["remaining"] != 2.0 || resp["limit"] != 2.0 || resp["resets_at"] != nil {
+		t.Errorf("unexpected quota for a fresh IP: %v", resp)
+	}
+
+	oldest := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	svc.db.Create(&db.Transaction{Address: "tb1qa", IPAddress: "203.0.113.5", Status: db.TxnStatusBroadcast, CreatedAt: oldest})
+	svc.db.Create(&db.Transaction{Address: "tb1qb", IPAddress: "203.0.113.5", Status: db.TxnStatusPending, CreatedAt: time.Now().Add(-time.Hour)})
+	// outside the window
+	svc.db.Create(&db.Transaction{Address: "tb1qc", IPAddress: "203.0.113.5", Status: db.TxnStatusBroadcast, CreatedAt: time.Now().Add(-25 * time.Hour)})
+
+	resp = quotaRequest(t, svc, "203.0.113.5")
+	if resp["used"] != 2.0 || resp["remaining"] != 0.0 {
+		t.Errorf("expected 2 used, 0 remaining, got %v", resp)
+	}
+	if want := oldest.Add(24 * time.Hour).UTC().Format(time.RFC3339); resp["resets_at"] != want {
+		t.Errorf("expected resets_at %s, got %v", want, resp["resets_at"])
+	}
+	if resp["unlimited"] != false {
+		t.Errorf("expected limited quota, got %v", resp)
+	}
+}
+
+func TestQuotaHandler_Admin(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("198.51.100.0/24")}
+
+	resp := quotaRequest(t, svc, "198.51.100.7")
+	if resp["unlimited"] != true {
+		t.Errorf("expected unlimited quota for admin IP, got %v", resp)
+	}
+	if _, ok := resp["remaining"]; ok {
+		t.Errorf("expected no remaining count for admin IP, got %v", resp)
+	}
+}
+
+func TestQuotaHandler_MethodNotAllowed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("POST", "/api/quota", nil)
+	w := httptest.NewRecorder()
+	svc.quotaHandler(w, r)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_QueueFull(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.MaxQueueDepth = 2
+
+	submitted := 0
+	submit := func() *httptest.ResponseRecorder {
+		submitted++
+		body := jsonBody(map[string]any{"address": testAddress(submitted), "amount_range": 2})
+		r := httptest.NewRequest("POST", "/api/submit", body)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	for i := range 2 {
+		if w := submit(); w.Code != http.StatusOK {
+			t.Fatalf("request %d should succeed, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	w := submit()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the queue is full, got %d", w.Code)
+	}
+	if resp := decodeJSON(t, w.Body); !strings.Contains(resp["error"].(string), "capacity") {
+		t.Errorf("expected capacity error, got %v", resp)
+	}
+	if got := testutil.ToFloat64(FaucetQueueDepth); got != 2 {
+		t.Errorf("expected queue depth 2, got %v", got)
+	}
+
+	// draining the queue lets requests through again
+	svc.db.Model(&db.Transaction{}).Where("status = ?", db.TxnStatusPending).Update("status", db.TxnStatusBroadcast)
+	if w := submit(); w.Code != http.StatusOK {
+		t.Errorf("expected 200 after the queue drained, got %d", w.Code)
+	}
+}
+
+func TestSubmitHandler_AddressDepositLimit(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxDepositsPerAddress = 2
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+
+	addr := "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+
+	for i := range 2 {
+		body := jsonBody(map[string]any{"address": addr, "amount_range": 2})
+		r := httptest.NewRequest("POST", "/api/submit", body)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d should succeed, got %d", i, w.Code)
+		}
+		settleInFlight(svc)
+	}
+
+	body := jsonBody(map[string]any{"address": addr, "amount_range": 2})
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 address limit, got %d", w.Code)
+	}
+	resp := decodeJSON(t, w.Body)
+	if !strings.Contains(resp["error"].(string), "limit") {
+		t.Errorf("expected limit error, got: %s", resp["error"])
+	}
+}
+
+func TestSubmitHandler_RequestInProgress(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	addr := "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+
+	submit := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": addr}))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Accept", ErrorEnvelopeMediaType)
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		return w
+	}
+
+	if w := submit("198.51.100.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// a different IP doesn't get around it, neither does the row being sent
+	for _, status := range []string{db.TxnStatusPending, db.TxnStatusProcessing} {
+		svc.db.Model(&db.Transaction{}).Where("address = ?", addr).Update("status", status)
+		w := submit("198.51.100.2:1234")
+		if w.Code != http.StatusConflict {
+			t.Fatalf("%s: expected 409, got %d: %s", status, w.Code, w.Body.String())
+		}
+		if code := decodeJSON(t, w.Body)["error"].(map[string]any)["code"]; code != errCodeRequestInProgress {
+			t.Errorf("%s: expected %s, got %s", status, errCodeRequestInProgress, code)
+		}
+	}
+
+	settleInFlight(svc)
+	if w := submit("198.51.100.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 once the earlier payout went out, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSubmitHandler_ConcurrentDuplicates(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.settings.MaxDepositsPerAddress = 100
+	svc.settings.MaxWithdrawalsPerIP24h = 100
+
+	// every goroutine has to share the single in-memory db connection
+	sqlDB, _ := svc.db.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	// widens the gap between the in-flight check and the insert
+	svc.db.Callback().Create().Before("gorm:begin_transaction").Register("test:slow_create", func(*gorm.DB) {
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	const n = 10
+	codes := make([]int, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			<-start
+			r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"}))
+			r.RemoteAddr = fmt.Sprintf("198.51.100.%d:1234", i+1)
+			w := httptest.NewRecorder()
+			svc.submitHandler(w, r)
+			codes[i] = w.Code
+		})
+	}
+	close(start)
+	wg.Wait()
+
+	accepted := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			accepted++
+		case http.StatusConflict:
+		default:
+			t.Errorf("request %d: expected 200 or 409, got %d", i, code)
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("expected exactly one request accepted, got %d", accepted)
+	}
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusPending); c != 1 {
+		t.Errorf("expected one pending row, got %d", c)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	var l loginLimiter
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("192.0.2.1", 3, now); !ok {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.allow("192.0.2.1", 3, now.Add(10*time.Second))
+	if ok {
+		t.Error("expected the 4th request in the window to be limited")
+	}
+	if retryAfter != 50*time.Second {
+		t.Errorf("expected retry after 50s, got %v", retryAfter)
+	}
+	if ok, _ := l.allow("192.0.2.2", 3, now); !ok {
+		t.Error("expected other IPs to have their own count")
+	}
+
+	if ok, _ := l.allow("192.0.2.1", 3, now.Add(adminLoginRateWindow)); !ok {
+		t.Error("expected a new window to reset the count")
+	}
+	// the next sweep drops the finished window of the other IP
+	l.allow("192.0.2.1", 3, now.Add(adminLoginRateWindow+time.Second))
+	if _, found := l.windows["192.0.2.2"]; found {
+		t.Error("expected finished windows to be swept")
+	}
+}
+
+func TestAdminLoginRateLimitMiddleware(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminLoginRateLimit = 2
+	handler := svc.adminLoginRateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	codes := []int{}
+	for _, method := range []string{"GET", "POST", "GET"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/admin/login", nil))
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("expected Retry-After on 429")
+		}
+	}
+	if !slices.Equal(codes, []int{200, 200, 429}) {
+		t.Errorf("expected GET and POST to share the limit, got %v", codes)
+	}
+
+	svc.cfg.AdminLoginRateLimit = 0
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/login", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected no limit when disabled, got %d", w.Code)
+	}
+}
+
+func TestStartService_Timeouts(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.HTTPReadTimeout = 15 * time.Second
+	svc.cfg.HTTPWriteTimeout = time.Minute
+
+	chdirToProjectRoot(t)
+	server := svc.StartService()
+	if server.ReadTimeout != 15*time.Second || server.WriteTimeout != time.Minute {
+		t.Errorf("expected configured timeouts, got read %v write %v", server.ReadTimeout, server.WriteTimeout)
+	}
+	if server.ReadHeaderTimeout == 0 || server.IdleTimeout == 0 || server.MaxHeaderBytes == 0 {
+		t.Error("expected header timeout, idle timeout and header size limit to be set")
+	}
+}
+
+func TestStartService_BasePath(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.BasePath = "/faucet"
+	baseURL := startTestServer(t, svc)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := client.Get(baseURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for path, want := range map[string]int{
+		"/faucet/health":                 http.StatusOK,
+		"/faucet/static/img/favicon.ico": http.StatusOK,
+		"/health":                        http.StatusNotFound,
+		"/faucet/nope":                   http.StatusNotFound,
+		"/faucet":                        http.StatusMovedPermanently,
+		"/faucet/admin/login":            http.StatusOK,
+		"/admin/login":                   http.StatusNotFound,
+	} {
+		if resp := get(path); resp.StatusCode != want {
+			t.Errorf("%s: expected %d, got %d", path, want, resp.StatusCode)
+		}
+	}
+
+	if loc := get("/faucet/admin/").Header.Get("Location"); loc != "/faucet/admin/login" {
+		t.Errorf("expected redirect to the prefixed login page, got %q", loc)
+	}
+
+	resp := get("/faucet/")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `href="/faucet/static/img/favicon.ico"`) {
+		t.Errorf("expected the index page to link prefixed paths, got %d", resp.StatusCode)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin IP allowlist middleware (integration via full server)
+// ---------------------------------------------------------------------------
+
+func TestAdminIPAllowlist_Denied(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("10.0.0.0/8")}
+	baseURL := startTestServer(t, svc)
+
+	resp, err := http.Get(baseURL + "/admin/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 from non-allowed IP, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminIPAllowlist_Allowed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+
+	resp, err := http.Get(baseURL + "/admin/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 from allowed IP, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminIPAllowlist_IPv6Equivalent(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("::1/128")}
+	handler := svc.adminIPAllowlistMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, ip := range []string{"::1", "[::1]", "0:0:0:0:0:0:0:1"} {
+		r := httptest.NewRequest("GET", "/admin/login", nil)
+		r.Header.Set("X-Real-IP", ip)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", ip, w.Code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin auth middleware
+// ---------------------------------------------------------------------------
+
+func TestAdminAuth_NoCookie(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(baseURL + "/admin/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected 302 redirect to login, got %d", resp.StatusCode)
+	}
+	loc := resp.Header.Get("Location")
+	if !strings.Contains(loc, "/admin/login") {
+		t.Errorf("expected redirect to /admin/login, got %s", loc)
+	}
+}
+
+func TestAdminAuth_InvalidCookie(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	req, _ := http.NewRequest("GET", baseURL+"/admin/", nil)
+	req.AddCookie(&http.Cookie{Name: "admin_session", Value: "bad.cookie"})
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected 302 redirect, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminAuth_SlidesSessionExpiry(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.db.Create(&db.AdminSession{
+		SessionID: "slide-session",
+		IPAddress: "127.0.0.1",
+		ExpiresAt: time.Now().Add(30 * time.Minute),
+	})
+
+	handler := svc.adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/admin/", nil)
+	r.AddCookie(&http.Cookie{Name: "admin_session", Value: svc.signCookie("slide-session")})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var session db.AdminSession
+	svc.db.Where("session_id = ?", "slide-session").First(&session)
+	if time.Until(session.ExpiresAt) < 3*time.Hour {
+		t.Errorf("expected expiry extended to ~4h, got %s", time.Until(session.ExpiresAt))
+	}
+
+	found := false
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "admin_session" && c.MaxAge > 3*60*60 {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected refreshed admin_session cookie")
+	}
+}
+
+func TestAdminAuth_NoRefreshWhenRecent(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	cookie := adminLogin(t, svc)
+
+	handler := svc.adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/admin/", nil)
+	r.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("expected no cookie refresh for a freshly extended session")
+	}
+}
+
+func TestAdminAuth_SessionCappedAtMax(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	createdAt := time.Now().Add(-23 * time.Hour)
+	svc.db.Create(&db.AdminSession{
+		SessionID: "old-session",
+		IPAddress: "127.0.0.1",
+		CreatedAt: createdAt,
+		ExpiresAt: time.Now().Add(10 * time.Minute),
+	})
+
+	handler := svc.adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/admin/", nil)
+	r.AddCookie(&http.Cookie{Name: "admin_session", Value: svc.signCookie("old-session")})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var session db.AdminSession
+	svc.db.Where("session_id = ?", "old-session").First(&session)
+	maxExpiresAt := createdAt.Add(24 * time.Hour)
+	if session.ExpiresAt.After(maxExpiresAt.Add(time.Second)) {
+		t.Errorf("expected expiry capped at %s, got %s", maxExpiresAt, session.ExpiresAt)
+	}
+}
+
+func TestAdminAuth_ExpiredSession(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.db.Create(&db.AdminSession{
+		SessionID: "expired-session",
+		IPAddress: "127.0.0.1",
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	handler := svc.adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/admin/", nil)
+	r.AddCookie(&http.Cookie{Name: "admin_session", Value: svc.signCookie("expired-session")})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Errorf("expected 302 redirect for expired session, got %d", w.Code)
+	}
+
+	var session db.AdminSession
+	svc.db.Where("session_id = ?", "expired-session").First(&session)
+	if session.ExpiresAt.After(time.Now()) {
+		t.Error("expired session must not be extended")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin login flow
+// ---------------------------------------------------------------------------
+
+func TestAdminLogin_GetPage(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+
+	resp, err := http.Get(baseURL + "/admin/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminLogin_WrongPassword(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+
+	resp, err := http.PostForm(baseURL+"/admin/login", url.Values{
+		"password": {"wrongpassword"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminLogin_Success(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.PostForm(baseURL+"/admin/login", url.Values{
+		"password": {"testpass123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected 302 redirect after login, got %d", resp.StatusCode)
+	}
+
+	cookies := resp.Cookies()
+	found := false
+	for _, c := range cookies {
+		if c.Name == "admin_session" && c.Value != "" {
+			found = true
+			_, valid := svc.validateSessionCookie(c.Value)
+			if !valid {
+				t.Error("session cookie is not valid")
+			}
+		}
+	}
+	if !found {
+		t.Error("expected admin_session cookie to be set")
+	}
+
+	var count int64
+	svc.db.Model(&db.AdminSession{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected 1 session in db, got %d", count)
+	}
+}
+
+func TestAdminLogin_MethodNotAllowed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+
+	req, _ := http.NewRequest("PUT", baseURL+"/admin/login", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", resp.StatusCode)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin logout
+// ---------------------------------------------------------------------------
+
+func TestAdminLogout(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.AdminAllowlist = []net.IPNet{parseCIDR("127.0.0.1/32")}
+	baseURL := startTestServer(t, svc)
+	cookie := adminLogin(t, svc)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	form := url.Values{"csrf_token": {svc.csrfToken("test-session-id")}}
+	req, _ := http.NewRequest("POST", baseURL+"/admin/logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected 302, got %d", resp.StatusCode)
+	}
+
+	for _, c := range resp.Cookies() {
+		if c.Name == "admin_session" && c.MaxAge == -1 {
+			break
+		}
+	}
+
+	var count int64
+	svc.db.Model(&db.AdminSession{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected session deleted, got %d sessions", count)
+	}
+}
+
+func TestAdminLogout_GetNotAllowed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+	cookie := adminLogin(t, svc)
+
+	req, _ := http.NewRequest("GET", baseURL+"/admin/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", resp.StatusCode)
+	}
+
+	var count int64
+	svc.db.Model(&db.AdminSession{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected session to survive GET logout, got %d sessions", count)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin CSRF protection
+// ---------------------------------------------------------------------------
+
+func TestAdminCSRF_ForgedRequestDenied(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+	cookie := adminLogin(t, svc)
+
+	for _, endpoint := range []string{"/admin/sendfunds", "/admin/consolidate", "/admin/logout"} {
+		req, _ := http.NewRequest("POST", baseURL+endpoint, jsonBody(map[string]any{
+			"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"amount":  0.01,
+		}))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected 403 without CSRF token, got %d", endpoint, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminCSRF_WrongSessionToken(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+	cookie := adminLogin(t, svc)
+
+	req, _ := http.NewRequest("POST", baseURL+"/admin/consolidate", jsonBody(map[string]any{}))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", svc.csrfToken("some-other-session"))
+	req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for token from another session, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminCSRF_ValidTokenAccepted(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+	cookie := adminLogin(t, svc)
+
+	req, _ := http.NewRequest("POST", baseURL+"/admin/consolidate", jsonBody(map[string]any{}))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", svc.csrfToken("test-session-id"))
+	req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 with valid CSRF token, got %d", resp.StatusCode)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin dashboard
+// ---------------------------------------------------------------------------
+
+func TestAdminDashboard_Renders(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+	cookie := adminLogin(t, svc)
+
+	svc.db.Create(&db.Transaction{
+		Address:       "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC:     0.05,
+		Status:        db.TxnStatusBroadcast,
+		OnchainTxnID:  "mocktxid0000000000000000000000000000000000000000000000000000000000",
+		FundingInputs: `[{"txid":"fundinginput0000000000000000000000000000000000000000000000000000","vout":3}]`,
+	})
+
+	req, _ := http.NewRequest("GET", baseURL+"/admin/", nil)
+	req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), svc.csrfToken("test-session-id")) {
+		t.Error("expected CSRF token embedded in dashboard")
+	}
+	if !strings.Contains(string(body), "fundinginput...:3") {
+		t.Error("expected funding input listed in dashboard")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin balance endpoint
+// ---------------------------------------------------------------------------
+
+func TestAdminGetBalance(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.ReserveBalance = 0.5
+	cookie := adminLogin(t, svc)
+
+	r := httptest.NewRequest("GET", "/admin/balance", nil)
+	r.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+	w := httptest.NewRecorder()
+
+	svc.adminGetBalanceHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["trusted"].(float64) != 10.0 {
+		t.Errorf("expected trusted=10, got %v", resp["trusted"])
+	}
+	if resp["total"].(float64) != 11.5 {
+		t.Errorf("expected total=11.5, got %v", resp["total"])
+	}
+	// safe utxos minus the reserve, not trusted+pending
+	if math.Abs(resp["spendable"].(float64)-1.0008) > 1e-9 {
+		t.Errorf("expected spendable=1.0008, got %v", resp["spendable"])
+	}
+}
+
+func TestAdminFeeEstimate(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["estimatesmartfee"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []int
+		json.Unmarshal(params, &p)
+		switch p[0] {
+		case 1:
+			return map[string]any{"feerate": 0.00005, "blocks": 1}, nil
+		case 3:
+			return map[string]any{"feerate": 0.00004, "blocks": 3}, nil
+		}
+		return map[string]any{"errors": []string{"Insufficient data or no feerate found"}, "blocks": 0}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	r := httptest.NewRequest("GET", "/admin/fee-estimate", nil)
+	w := httptest.NewRecorder()
+	svc.adminFeeEstimateHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var resp struct {
+		Estimates            []feeEstimate `json:"estimates"`
+		Floor                float64       `json:"floor"`
+		PayoutFeeRate        float64       `json:"payout_fee_rate"`
+		AdminSendFeeRate     float64       `json:"admin_send_fee_rate"`
+		ConsolidationFeeRate float64       `json:"consolidation_fee_rate"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	want := []feeEstimate{
+		{ConfTarget: 1, FeeRate: 5},
+		{ConfTarget: 3, FeeRate: 4},
+		{ConfTarget: 6, Error: "no fee estimate available: Insufficient data or no feerate found"},
+	}
+	if len(resp.Estimates) != len(want) {
+		t.Fatalf("expected %d estimates, got %+v", len(want), resp.Estimates)
+	}
+	for i, e := range resp.Estimates {
+		if e.ConfTarget != want[i].ConfTarget || e.Error != want[i].Error || math.Abs(e.FeeRate-want[i].FeeRate) > 1e-9 {
+			t.Errorf("estimate %d: expected %+v, got %+v", i, want[i], e)
+		}
+	}
+	if resp.Floor != btc.FeeSatsPerVBLowerLimit || resp.PayoutFeeRate != payoutFeeSatsPerVB || resp.AdminSendFeeRate != adminSendFeeSatsPerVB {
+		t.Errorf("unexpected applied rates %+v", resp)
+	}
+	// no estimate for 144 blocks either, falls back to the consolidation default
+	if resp.ConsolidationFeeRate != btc.ConsolidationFeeRateSatsPerVB {
+		t.Errorf("expected consolidation fallback rate, got %v", resp.ConsolidationFeeRate)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin get new address
+// ---------------------------------------------------------------------------
+
+func TestAdminGetNewAddress(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("GET", "/admin/getnewaddress", nil)
+	w := httptest.NewRecorder()
+	svc.adminGetNewAddressHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["address"] == nil || resp["address"].(string) == "" {
+		t.Error("expected address in response")
+	}
+}
+
+func TestAdminGetNewAddress_Label(t *testing.T) {
+	mock := newMockRPC()
+	var label string
+	mock.handlers["getnewaddress"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []any
+		json.Unmarshal(params, &p)
+		label, _ = p[0].(string)
+		return "tb1qnewaddress000000000000000000000000000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.AddressLabelTemplate = DefaultAddressLabelTemplate
+
+	svc.adminGetNewAddressHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/getnewaddress", nil))
+	if want := "deposit-" + time.Now().UTC().Format(time.DateOnly); label != want {
+		t.Errorf("expected label %q, got %q", want, label)
+	}
+}
+
+func TestNewAddress_KeypoolRanOut(t *testing.T) {
+	var refills atomic.Int32
+	mock := newMockRPC()
+	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) {
+		if refills.Load() == 0 {
+			return nil, &rpcErr{Code: btc.RPCErrWalletKeypoolRanOut, Message: "Error: Keypool ran out, please call keypoolrefill first"}
+		}
+		return "tb1qrefilled", nil
+	}
+	mock.handlers["keypoolrefill"] = func(_ json.RawMessage) (any, *rpcErr) {
+		refills.Add(1)
+		return nil, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	before := testutil.ToFloat64(FaucetKeypoolExhausted.WithLabelValues("deposit"))
+	address, err := svc.newAddress(t.Context(), "deposit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "tb1qrefilled" || refills.Load() != 1 {
+		t.Errorf("expected an address after one refill, got %q after %d refills", address, refills.Load())
+	}
+	if got := testutil.ToFloat64(FaucetKeypoolExhausted.WithLabelValues("deposit")) - before; got != 1 {
+		t.Errorf("expected exhaustion counted once, got %v", got)
+	}
+
+	// a refill that fails leaves the original error
+	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: btc.RPCErrWalletKeypoolRanOut, Message: "Error: Keypool ran out, please call keypoolrefill first"}
+	}
+	mock.handlers["keypoolrefill"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -13, Message: "Error: Please enter the wallet passphrase with walletpassphrase first."}
+	}
+	refillErrors := testutil.ToFloat64(FaucetKeypoolRefillErrors)
+	if _, err := svc.newAddress(t.Context(), "consolidation"); !btc.IsKeypoolRanOut(err) {
+		t.Errorf("expected keypool error, got %v", err)
+	}
+	if got := testutil.ToFloat64(FaucetKeypoolRefillErrors) - refillErrors; got != 1 {
+		t.Errorf("expected a refill error counted, got %v", got)
+	}
+}
+
+func TestAddressLabel(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	for tmpl, want := range map[string]string{
+		"":                        "",
+		"faucet":                  "faucet",
+		"{purpose}":               "consolidation",
+		"faucet/{purpose}/{date}": "faucet/consolidation/" + time.Now().UTC().Format(time.DateOnly),
+	} {
+		svc.cfg.AddressLabelTemplate = tmpl
+		if got := svc.addressLabel("consolidation"); got != want {
+			t.Errorf("%q: expected %q, got %q", tmpl, want, got)
+		}
+	}
+
+	svc.cfg.AddressLabelTemplate = "{time}"
+	if got := svc.addressLabel("deposit"); len(got) != 6 {
+		t.Errorf("expected hhmmss, got %q", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin send funds
+// ---------------------------------------------------------------------------
+
+func TestAdminSendFunds_Success(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount":  0.5,
+	})
+	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["success"] != true {
+		t.Error("expected success=true")
+	}
+	if resp["txid"] == nil || resp["txid"].(string) == "" {
+		t.Error("expected txid in response")
+	}
+	if resp["fee"] != 0.00001 {
+		t.Errorf("expected fee 0.00001 in response, got %v", resp["fee"])
+	}
+
+	// the public page shouldn't wait for the next refresh to show the send
+	want, _ := svc.GetAvailableWalletBalance(t.Context())
+	if got := svc.GetCachedWalletBalance(); got != want {
+		t.Errorf("expected cached balance refreshed to %f after the send, got %f", want, got)
+	}
+}
+
+func TestAdminRefreshBalance(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.walletBalance = 42
+
+	r := httptest.NewRequest("POST", "/admin/refresh-balance", nil)
+	w := httptest.NewRecorder()
+	svc.adminRefreshBalanceHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	want, _ := svc.GetAvailableWalletBalance(t.Context())
+	if got := svc.GetCachedWalletBalance(); got != want {
+		t.Errorf("expected cached balance %f, got %f", want, got)
+	}
+	if resp := decodeJSON(t, w.Body); resp["balance"] != want {
+		t.Errorf("expected balance %f in response, got %v", want, resp["balance"])
+	}
+
+	r = httptest.NewRequest("GET", "/admin/refresh-balance", nil)
+	w = httptest.NewRecorder()
+	svc.adminRefreshBalanceHandler(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestAdminRefreshBalance_RPCError(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -18, Message: "Requested wallet does not exist or is not loaded"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.walletBalance = 5.5
+
+	r := httptest.NewRequest("POST", "/admin/refresh-balance", nil)
+	w := httptest.NewRecorder()
+	svc.adminRefreshBalanceHandler(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	if got := svc.GetCachedWalletBalance(); got != 5.5 {
+		t.Errorf("expected previous balance kept, got %f", got)
+	}
+}
+
+func TestAdminSendFunds_FeeRate(t *testing.T) {
+	cases := []struct {
+		name    string
+		feeRate any
+		want    float64
+	}{
+		{"default", nil, btc.FeeSatsPerVBLowerLimit * 1.10},
+		{"custom", 25.5, 25.5},
+		{"below relay minimum", 0.05, btc.FeeSatsPerVBLowerLimit * 1.10},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var fundOptions map[string]any
+			mock := newMockRPC()
+			mock.handlers["fundrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+				var p []json.RawMessage
+				json.Unmarshal(params, &p)
+				json.Unmarshal(p[1], &fundOptions)
+				return map[string]any{"hex": "fundedhex000", "fee": 0.00001}, nil
+			}
+			rpcServer := httptest.NewServer(mock)
+			t.Cleanup(rpcServer.Close)
+			svc := testService(t, rpcServer)
+
+			req := map[string]any{
+				"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+				"amount":  0.5,
+			}
+			if tc.feeRate != nil {
+				req["fee_rate"] = tc.feeRate
+			}
+			r := httptest.NewRequest("POST", "/admin/sendfunds", jsonBody(req))
+			w := httptest.NewRecorder()
+			svc.adminSendFundsHandler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			resp := decodeJSON(t, w.Body)
+			if resp["fee_rate"] != tc.want {
+				t.Errorf("expected fee_rate %v in response, got %v", tc.want, resp["fee_rate"])
+			}
+			if want := fmt.Sprintf("%.8f", tc.want); fundOptions["fee_rate"] != want {
+				t.Errorf("expected fundrawtransaction fee_rate %s, got %v", want, fundOptions["fee_rate"])
+			}
+		})
+	}
+}
+
+func TestAdminSendFunds_FeeRateTooHigh(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address":  "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount":   0.5,
+		"fee_rate": 5000,
+	})
+	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminSendFunds_MethodNotAllowed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("GET", "/admin/sendfunds", nil)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestAdminSendFunds_InvalidJSON(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("POST", "/admin/sendfunds", strings.NewReader("nope"))
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestAdminSendFunds_InvalidAddress(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{"address": "invalid_addr", "amount": 0.1})
+	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestAdminSendFunds_OpReturnTooLong(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address":   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount":    0.1,
+		"op_return": strings.Repeat("x", btc.MaxOpReturnBytes+1),
+	})
+	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestAdminSendFunds_ZeroAmount(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount":  0,
+	})
+	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestAdminSendFunds_DustBoundary(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	send := func(amount float64) *httptest.ResponseRecorder {
+		body := jsonBody(map[string]any{
+			"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"amount":  amount,
+		})
+		r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+		w := httptest.NewRecorder()
+		svc.adminSendFundsHandler(w, r)
+		return w
+	}
+
+	w := send(btc.DustLimitBTC - 0.00000001)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 below dust limit, got %d", w.Code)
+	}
+	if resp := decodeJSON(t, w.Body); !strings.Contains(resp["error"].(string), "dust") {
+		t.Errorf("expected dust error, got %v", resp)
+	}
+
+	if w := send(btc.DustLimitBTC); w.Code != http.StatusOK {
+		t.Errorf("expected 200 at the dust limit, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminSendFunds_FeeExceedsBalance(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	send := func(amount float64) *httptest.ResponseRecorder {
+		body := jsonBody(map[string]any{
+			"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"amount":  amount,
+		})
+		r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+		w := httptest.NewRecorder()
+		svc.adminSendFundsHandler(w, r)
+		return w
+	}
+
+	// 1.5008 BTC confirmed in the mock's utxos, nothing left for the fee
+	w := send(1.5008)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 when the fee doesn't fit, got %d", w.Code)
+	}
+	if resp := decodeJSON(t, w.Body); !strings.Contains(resp["error"].(string), "estimated fee") {
+		t.Errorf("expected fee error, got %v", resp)
+	}
+
+	if w := send(1.5007); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with room for the fee, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminSendFunds_Reserve(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	// 1.5008 BTC confirmed in the mock's utxos
+	svc.cfg.ReserveBalance = 0.5
+
+	send := func(force bool) *httptest.ResponseRecorder {
+		body := jsonBody(map[string]any{
+			"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			"amount":  1.2,
+			"force":   force,
+		})
+		r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+		w := httptest.NewRecorder()
+		svc.adminSendFundsHandler(w, r)
+		return w
+	}
+
+	w := send(false)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without force, got %d", w.Code)
+	}
+	if resp := decodeJSON(t, w.Body); !strings.Contains(resp["error"].(string), "reserve") {
+		t.Errorf("expected reserve error, got %v", resp)
+	}
+
+	if w := send(true); w.Code != http.StatusOK {
+		t.Errorf("expected 200 with force, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminSendFunds_InsufficientBalance(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount":  99999.0,
+	})
+	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	resp := decodeJSON(t, w.Body)
+	if !strings.Contains(resp["error"].(string), "Insufficient") {
+		t.Errorf("expected insufficient balance error, got: %s", resp["error"])
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin settings
+// ---------------------------------------------------------------------------
+
+func TestAdminSettings_Update(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"enabled_amount_ranges":      []int{1, 2},
+		"default_amount_range":       1,
+		"max_withdrawals_per_ip_24h": 7,
+	})
+	r := httptest.NewRequest("POST", "/admin/settings", body)
+	w := httptest.NewRecorder()
+	svc.adminSettingsHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	s := svc.Settings()
+	if !slices.Equal(s.EnabledAmountRanges, []int{1, 2}) || s.DefaultAmountRange != 1 || s.MaxWithdrawalsPerIP24h != 7 {
+		t.Errorf("settings not applied: %+v", s)
+	}
+	if s.MinBalance != 0.1 || s.MaxDepositsPerAddress != 5 {
+		t.Errorf("omitted fields should keep their values: %+v", s)
+	}
+
+	// a fresh service on the same db picks the overrides up
+	other := NewService(testConfig(), svc.db)
+	if err := other.LoadSettings(); err != nil {
+		t.Fatalf("LoadSettings: %v", err)
+	}
+	if got := other.Settings(); !slices.Equal(got.EnabledAmountRanges, []int{1, 2}) || got.MaxWithdrawalsPerIP24h != 7 {
+		t.Errorf("overrides not persisted: %+v", got)
+	}
+}
+
+func TestAdminSettings_Invalid(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	for _, req := range []map[string]any{
+		{"default_amount_range": 4},
+		{"enabled_amount_ranges": []int{}},
+		{"enabled_amount_ranges": []int{2, 9}},
+		{"min_balance": -1},
+		{"max_withdrawals_per_ip_24h": 0},
+	} {
+		r := httptest.NewRequest("POST", "/admin/settings", jsonBody(req))
+		w := httptest.NewRecorder()
+		svc.adminSettingsHandler(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", req, w.Code)
+		}
+	}
+
+	if got := svc.Settings(); !slices.Equal(got.EnabledAmountRanges, []int{1, 2, 3}) || got.DefaultAmountRange != 2 {
+		t.Errorf("settings changed by invalid request: %+v", got)
+	}
+}
+
+func TestAdminSettings_Requires2FA(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.Admin2FASecret = "JBSWY3DPEHPK3PXP"
+
+	body := jsonBody(map[string]any{"max_withdrawals_per_ip_24h": 9})
+	r := httptest.NewRequest("POST", "/admin/settings", body)
+	w := httptest.NewRecorder()
+	svc.adminSettingsHandler(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+	if svc.Settings().MaxWithdrawalsPerIP24h != 2 {
+		t.Error("settings should be unchanged")
+	}
+}
+
+func TestSubmitHandler_UsesLiveSettings(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	if err := svc.UpdateSettings(Settings{
+		EnabledAmountRanges:    []int{3},
+		DefaultAmountRange:     3,
+		MinBalance:             0.1,
+		MaxWithdrawalsPerIP24h: 2,
+		MaxDepositsPerAddress:  5,
+	}); err != nil {
+		t.Fatalf("UpdateSettings: %v", err)
+	}
+
+	body := jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", "amount_range": 1})
+	r := httptest.NewRequest("POST", "/api/submit", body)
+	w := httptest.NewRecorder()
+	svc.submitHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.AmountBTC < 0.1 || tx.AmountBTC > 0.9 {
+		t.Errorf("disabled range should fall back to new default 3, got %.8f", tx.AmountBTC)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin transaction detail
+// ---------------------------------------------------------------------------
+
+func TestAdminTransaction_Broadcast(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["gettransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"txid": "onchain123", "confirmations": 4, "blockhash": "0000blockhash"}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	tx := db.Transaction{
+		Address:       "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC:     0.02,
+		FeeBTC:        0.00001,
+		Status:        db.TxnStatusBroadcast,
+		OnchainTxnID:  "onchain123",
+		FundingInputs: `[{"txid":"ccc","vout":0}]`,
+	}
+	svc.db.Create(&tx)
+
+	r := httptest.NewRequest("GET", fmt.Sprintf("/admin/transaction?id=%d", tx.ID), nil)
+	w := httptest.NewRecorder()
+	svc.adminTransactionHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["status"] != db.TxnStatusBroadcast || resp["onchain_txn_id"] != "onchain123" {
+		t.Errorf("unexpected db fields: %v", resp)
+	}
+	if resp["confirmations"].(float64) != 4 || resp["blockhash"] != "0000blockhash" {
+		t.Errorf("expected live confirmations and blockhash, got %v", resp)
+	}
+	if inputs := resp["funding_inputs"].([]any); len(inputs) != 1 {
+		t.Errorf("expected 1 funding input, got %v", inputs)
+	}
+}
+
+func TestAdminTransaction_Failed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	tx := db.Transaction{
+		Address:  "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		Status:   db.TxnStatusFailed,
+		ErrorMsg: "fundrawtransaction failed: Insufficient funds",
+	}
+	svc.db.Create(&tx)
+
+	r := httptest.NewRequest("GET", fmt.Sprintf("/admin/transaction?id=%d", tx.ID), nil)
+	w := httptest.NewRecorder()
+	svc.adminTransactionHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	resp := decodeJSON(t, w.Body)
+	if resp["error_msg"] != tx.ErrorMsg {
+		t.Errorf("expected error_msg, got %v", resp)
+	}
+	if _, ok := resp["confirmations"]; ok {
+		t.Error("failed transactions shouldn't be looked up onchain")
+	}
+}
+
+func TestAdminTransaction_NotFound(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	for id, want := range map[string]int{"999": http.StatusNotFound, "abc": http.StatusBadRequest} {
+		r := httptest.NewRequest("GET", "/admin/transaction?id="+id, nil)
+		w := httptest.NewRecorder()
+		svc.adminTransactionHandler(w, r)
+
+		if w.Code != want {
+			t.Errorf("id=%s: expected %d, got %d", id, want, w.Code)
+		}
+	}
+}
+
+func TestAdminTransaction_RequiresAuth(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(baseURL + "/admin/transaction?id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected 302 redirect to login, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminSearch(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	const txid = "aabbccddeeff00112233445566778899aabbccddeeff00112233445566778899"
+	svc.db.Create(&db.Transaction{Address: "tb1qa", Status: db.TxnStatusBroadcast, OnchainTxnID: txid})
+	svc.db.Create(&db.Transaction{Address: "tb1qb", Status: db.TxnStatusBroadcast, OnchainTxnID: txid})
+	svc.db.Create(&db.Transaction{Address: "tb1qa", Status: db.TxnStatusPending})
+
+	search := func(query string) (int, []any) {
+		r := httptest.NewRequest("GET", "/admin/search?"+query, nil)
+		w := httptest.NewRecorder()
+		svc.adminSearchHandler(w, r)
+		txns, _ := decodeJSON(t, w.Body)["transactions"].([]any)
+		return w.Code, txns
+	}
+
+	// a batched txid matches every payout in it, case doesn't matter
+	code, txns := search("txid=" + strings.ToUpper(txid))
+	if code != http.StatusOK || len(txns) != 2 {
+		t.Fatalf("expected 2 rows for the txid, got %d %v", code, txns)
+	}
+	if first := txns[0].(map[string]any); first["address"] != "tb1qb" || first["onchain_txn_id"] != txid {
+		t.Errorf("expected newest first, got %v", first)
+	}
+
+	if code, txns := search("address=tb1qa"); code != http.StatusOK || len(txns) != 2 {
+		t.Errorf("expected 2 rows for the address, got %d %v", code, txns)
+	}
+
+	for query, want := range map[string]int{
+		"txid=" + strings.Repeat("0", 64): http.StatusNotFound,
+		"address=tb1qnone":                http.StatusNotFound,
+		"":                                http.StatusBadRequest,
+		"txid=" + txid + "&address=tb1qa": http.StatusBadRequest,
+	} {
+		if code, _ := search(query); code != want {
+			t.Errorf("%q: expected %d, got %d", query, want, code)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin UTXOs
+// ---------------------------------------------------------------------------
+
+func TestAdminGetUTXOs(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("GET", "/admin/utxos", nil)
+	w := httptest.NewRecorder()
+	svc.adminGetUTXOsHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	resp := decodeJSON(t, w.Body)
+	utxos, ok := resp["utxos"].([]any)
+	if !ok {
+		t.Fatal("expected utxos array")
+	}
+	if len(utxos) != 3 {
+		t.Errorf("expected 3 utxos, got %d", len(utxos))
+	}
+
+	first := utxos[0].(map[string]any)
+	second := utxos[1].(map[string]any)
+	if first["confirmations"].(float64) > second["confirmations"].(float64) {
+		t.Error("utxos should be sorted by confirmations ascending")
+	}
+}
+
+func TestAdminGetUTXOs_AddressFilter(t *testing.T) {
+	mock := newMockRPC()
+	all := mock.handlers["listunspent"]
+	var filter []string
+	mock.handlers["listunspent"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		filter = nil
+		if len(p) > 2 {
+			json.Unmarshal(p[2], &filter)
+		}
+		return all(params)
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	const a1, a2 = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", "tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7"
+	r := httptest.NewRequest("GET", "/admin/utxos?address="+a1+","+a2, nil)
+	w := httptest.NewRecorder()
+	svc.adminGetUTXOsHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !slices.Equal(filter, []string{a1, a2}) {
+		t.Errorf("expected the addresses passed to listunspent, got %v", filter)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/utxos", nil)
+	svc.adminGetUTXOsHandler(httptest.NewRecorder(), r)
+	if filter != nil {
+		t.Errorf("expected no filter without ?address, got %v", filter)
+	}
+
+	r = httptest.NewRequest("GET", "/admin/utxos?address=not-an-address", nil)
+	w = httptest.NewRecorder()
+	svc.adminGetUTXOsHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid address, got %d", w.Code)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin consolidate
+// ---------------------------------------------------------------------------
+
+func TestAdminConsolidate_Success(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{})
+	r := httptest.NewRequest("POST", "/admin/consolidate", body)
+	w := httptest.NewRecorder()
+	svc.adminConsolidateUTXOsHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["success"] != true {
+		t.Errorf("expected success=true, got %v", resp)
+	}
+	if resp["count"].(float64) != 2 {
+		t.Errorf("expected 2 consolidated utxos, got %v", resp["count"])
+	}
+}
+
+func TestAdminConsolidate_MethodNotAllowed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("GET", "/admin/consolidate", nil)
+	w := httptest.NewRecorder()
+	svc.adminConsolidateUTXOsHandler(w, r)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestAdminConsolidate_InvalidJSON(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("POST", "/admin/consolidate", strings.NewReader("bad"))
+	w := httptest.NewRecorder()
+	svc.adminConsolidateUTXOsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestAdminConsolidate_NoSmallUTXOs(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "aaa", Amount: 5.0, Confirmations: 10, Spendable: true, Safe: true},
+		}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	body := jsonBody(map[string]any{})
+	r := httptest.NewRequest("POST", "/admin/consolidate", body)
+	w := httptest.NewRecorder()
+	svc.adminConsolidateUTXOsHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["message"] == nil || !strings.Contains(resp["message"].(string), "No UTXOs") {
+		t.Errorf("expected skip message, got: %v", resp)
+	}
+}
+
+func TestAdminConsolidate_BelowMinUTXOs(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "aaa", Amount: 0.0005, Confirmations: 10, Spendable: true, Safe: true},
+		}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	body := jsonBody(map[string]any{})
+	r := httptest.NewRequest("POST", "/admin/consolidate", body)
+	w := httptest.NewRecorder()
+	svc.adminConsolidateUTXOsHandler(w, r)
+
+	resp := decodeJSON(t, w.Body)
+	if resp["message"] == nil || !strings.Contains(resp["message"].(string), "need at least") {
+		t.Errorf("expected min utxo skip, got: %v", resp)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin cancel
+// ---------------------------------------------------------------------------
+
+func cancelRequest(svc *Service, id uint) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/cancel", jsonBody(map[string]any{"id": id}))
+	w := httptest.NewRecorder()
+	svc.adminCancelHandler(w, r)
+	return w
+}
+
+func TestAdminCancel_Pending(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	tx := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending}
+	svc.db.Create(&tx)
+
+	if w := cancelRequest(svc, tx.ID); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	svc.db.First(&tx, tx.ID)
+	if tx.Status != db.TxnStatusCancelled {
+		t.Errorf("expected cancelled, got %s", tx.Status)
+	}
+
+	svc.processBatch(context.Background())
+	svc.db.First(&tx, tx.ID)
+	if tx.Status != db.TxnStatusCancelled || tx.OnchainTxnID != "" {
+		t.Errorf("expected batch to skip cancelled row, got %s %s", tx.Status, tx.OnchainTxnID)
+	}
+}
+
+func TestAdminCancel_NotCancellable(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	broadcast := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", Status: db.TxnStatusBroadcast, OnchainTxnID: "abc"}
+	svc.db.Create(&broadcast)
+	withTxid := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", Status: db.TxnStatusProcessing, OnchainTxnID: "def"}
+	svc.db.Create(&withTxid)
+
+	for _, tx := range []db.Transaction{broadcast, withTxid} {
+		if w := cancelRequest(svc, tx.ID); w.Code != http.StatusConflict {
+			t.Errorf("expected 409 for %s row, got %d", tx.Status, w.Code)
+		}
+		var got db.Transaction
+		svc.db.First(&got, tx.ID)
+		if got.Status != tx.Status {
+			t.Errorf("expected status %s unchanged, got %s", tx.Status, got.Status)
+		}
+	}
+
+	if w := cancelRequest(svc, 9999); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown id, got %d", w.Code)
+	}
+}
+
+func TestAdminCancel_Requires2FA(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.Admin2FASecret = "JBSWY3DPEHPK3PXP"
+
+	tx := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", Status: db.TxnStatusPending}
+	svc.db.Create(&tx)
+
+	if w := cancelRequest(svc, tx.ID); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+	svc.db.First(&tx, tx.ID)
+	if tx.Status != db.TxnStatusPending {
+		t.Errorf("expected pending, got %s", tx.Status)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin 2FA rotation
+// ---------------------------------------------------------------------------
+
+func rotate2FARequest(svc *Service, handler http.HandlerFunc, code string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/rotate-2fa", jsonBody(map[string]any{"totp_code": code}))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestRotate2FA(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	oldSecret := "JBSWY3DPEHPK3PXP"
+	svc.cfg.Admin2FASecret = oldSecret
+	oldCode := gotp.NewDefaultTOTP(oldSecret).Now()
+
+	w := rotate2FARequest(svc, svc.adminRotate2FAHandler, oldCode)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := decodeJSON(t, w.Body)
+	newSecret, _ := resp["secret"].(string)
+	if !gotp.IsSecretValid(newSecret) || newSecret == oldSecret {
+		t.Fatalf("expected a fresh base32 secret, got %q", newSecret)
+	}
+	if uri, _ := resp["provisioning_uri"].(string); !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, newSecret) {
+		t.Errorf("unexpected provisioning uri %q", uri)
+	}
+
+	// nothing changes until the new secret is confirmed
+	if !svc.verify2FA(oldCode) {
+		t.Error("old secret should still work before confirmation")
+	}
+	if w := rotate2FARequest(svc, svc.adminConfirm2FAHandler, oldCode); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a code from the old secret to be rejected, got %d", w.Code)
+	}
+	if !svc.verify2FA(oldCode) {
+		t.Error("old secret should still work after a failed confirmation")
+	}
+
+	newCode := gotp.NewDefaultTOTP(newSecret).Now()
+	if w := rotate2FARequest(svc, svc.adminConfirm2FAHandler, newCode); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !svc.verify2FA(newCode) {
+		t.Error("new secret should be active")
+	}
+	if svc.verify2FA(oldCode) {
+		t.Error("old secret should no longer work")
+	}
+	if w := rotate2FARequest(svc, svc.adminConfirm2FAHandler, newCode); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 once the rotation is done, got %d", w.Code)
+	}
+
+	// survives a restart and wins over the flag
+	restarted := NewService(svc.cfg, svc.db)
+	if err := restarted.Load2FASecret(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.verify2FA(newCode) || restarted.verify2FA(oldCode) {
+		t.Error("expected the stored secret to override -admin-2fa-secret")
+	}
+	if err := restarted.LoadSettings(); err != nil {
+		t.Errorf("stored secret shouldn't break settings: %v", err)
+	}
+
+	if entry := lastAuditLog(t, svc); entry.Action != AuditActionRotate2FA || entry.Outcome != db.AuditOutcomeSuccess {
+		t.Errorf("expected successful rotate_2fa audit entry, got %+v", entry)
+	}
+}
+
+func TestRotate2FA_RequiresCurrentCode(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.Admin2FASecret = "JBSWY3DPEHPK3PXP"
+
+	if w := rotate2FARequest(svc, svc.adminRotate2FAHandler, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+	if svc.pending2FA != nil {
+		t.Error("no secret should be pending")
+	}
+}
+
+func TestRotate2FA_EnablesWhenOff(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	w := rotate2FARequest(svc, svc.adminRotate2FAHandler, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if svc.require2FA() {
+		t.Error("2FA shouldn't be required before confirmation")
+	}
+
+	secret, _ := decodeJSON(t, w.Body)["secret"].(string)
+	if w := rotate2FARequest(svc, svc.adminConfirm2FAHandler, gotp.NewDefaultTOTP(secret).Now()); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if !svc.require2FA() {
+		t.Error("2FA should be required after confirmation")
+	}
+}
+
+func TestConfirm2FA_Expired(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	secret := gotp.RandomSecret(admin2FASecretBytes)
+	svc.pending2FA = &pending2FASecret{secret: secret, expiresAt: time.Now().Add(-time.Second)}
+
+	if w := rotate2FARequest(svc, svc.adminConfirm2FAHandler, gotp.NewDefaultTOTP(secret).Now()); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+	if svc.require2FA() {
+		t.Error("an expired secret must not be activated")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin drain
+// ---------------------------------------------------------------------------
+
+func TestAdminDrain_Success(t *testing.T) {
+	var createParams []json.RawMessage
+	mock := newMockRPC()
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		json.Unmarshal(params, &createParams)
+		return "rawhex000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	body := jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"})
+	r := httptest.NewRequest("POST", "/admin/drain", body)
+	w := httptest.NewRecorder()
+	svc.adminDrainHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := decodeJSON(t, w.Body)
+	if resp["count"].(float64) != 3 {
+		t.Errorf("expected all 3 utxos drained, got %v", resp["count"])
+	}
+	if resp["amount"].(float64) != 1.5008 {
+		t.Errorf("expected 1.5008 drained, got %v", resp["amount"])
+	}
+
+	var inputs []map[string]any
+	json.Unmarshal(createParams[0], &inputs)
+	if len(inputs) != 3 {
+		t.Errorf("expected 3 inputs, got %d", len(inputs))
+	}
+	var outputs map[string]string
+	json.Unmarshal(createParams[1], &outputs)
+	if _, ok := outputs["tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"]; !ok || len(outputs) != 1 {
+		t.Errorf("expected a single output to the destination, got %v", outputs)
+	}
+}
+
+func TestAdminDrain_InvalidAddress(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{"address": "bc1qmainnet"})
+	r := httptest.NewRequest("POST", "/admin/drain", body)
+	w := httptest.NewRecorder()
+	svc.adminDrainHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestAdminDrain_DustBalance(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "aaa", Amount: 0.000001, Confirmations: 10, Spendable: true, Safe: true},
+			{TxID: "bbb", Amount: 5.0, Confirmations: 10, Spendable: false},
+		}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	body := jsonBody(map[string]any{"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"})
+	r := httptest.NewRequest("POST", "/admin/drain", body)
+	w := httptest.NewRecorder()
+	svc.adminDrainHandler(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	resp := decodeJSON(t, w.Body)
+	if !strings.Contains(resp["error"].(string), "dust") {
+		t.Errorf("expected dust error, got %v", resp)
+	}
+}
+
+func TestAdminDrain_MethodNotAllowed(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("GET", "/admin/drain", nil)
+	w := httptest.NewRecorder()
+	svc.adminDrainHandler(w, r)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestAdminRebroadcast(t *testing.T) {
+	var mu sync.Mutex
+	var sentHex []string
+	mock := newMockRPC()
+	mock.handlers["gettransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		confirmations := 0
+		if p[0] == "confirmed" {
+			confirmations = 3
+		}
+		return map[string]any{"txid": p[0], "confirmations": confirmations}, nil
+	}
+	mock.handlers["sendrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		mu.Lock()
+		sentHex = append(sentHex, p[0])
+		mu.Unlock()
+		if p[0] == "hex-conflicted" {
+			return nil, &rpcErr{Code: -25, Message: "bad-txns-inputs-missingorspent"}
+		}
+		return "txid", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, tx := range []db.Transaction{
+		// a batch of two counts once
+		{OnchainTxnID: "dropped", RawTx: "hex-dropped"},
+		{OnchainTxnID: "dropped", RawTx: "hex-dropped"},
+		{OnchainTxnID: "confirmed", RawTx: "hex-confirmed"},
+		{OnchainTxnID: "conflicted", RawTx: "hex-conflicted"},
+		// sent before raw_tx was stored
+		{OnchainTxnID: "legacy"},
+	} {
+		tx.Address = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+		tx.Status = db.TxnStatusBroadcast
+		tx.ProcessingAt = &old
+		svc.db.Create(&tx)
+	}
+	recent := time.Now()
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", Status: db.TxnStatusBroadcast, OnchainTxnID: "recent", RawTx: "hex-recent", ProcessingAt: &recent})
+
+	svc.cfg.Admin2FASecret = "JBSWY3DPEHPK3PXP"
+	r := httptest.NewRequest("POST", "/admin/rebroadcast", jsonBody(map[string]any{"totp_code": "000000"}))
+	w := httptest.NewRecorder()
+	svc.adminRebroadcastHandler(w, r)
+	if w.Code != http.StatusUnauthorized || len(sentHex) != 0 {
+		t.Fatalf("expected 401 without a valid 2FA code and nothing sent, got %d after %v", w.Code, sentHex)
+	}
+
+	svc.cfg.Admin2FASecret = ""
+	r = httptest.NewRequest("POST", "/admin/rebroadcast", jsonBody(map[string]any{"min_age_minutes": 60}))
+	w = httptest.NewRecorder()
+	svc.adminRebroadcastHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := decodeJSON(t, w.Body)
+	if resp["rebroadcast"] != 1.0 || resp["confirmed"] != 1.0 || resp["failed"] != 1.0 {
+		t.Errorf("expected 1 rebroadcast, 1 confirmed and 1 failed, got %v", resp)
+	}
+	if !slices.Equal(sentHex, []string{"hex-dropped", "hex-conflicted"}) {
+		t.Errorf("expected only the old unconfirmed transactions sent, got %v", sentHex)
+	}
+
+	r = httptest.NewRequest("POST", "/admin/rebroadcast", jsonBody(map[string]any{"min_age_minutes": -1}))
+	w = httptest.NewRecorder()
+	svc.adminRebroadcastHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative age, got %d", w.Code)
+	}
+}
+
+func TestRebroadcastUnconfirmed_RevivesExpired(t *testing.T) {
+	var sentHex []string
+	mock := newMockRPC()
+	mock.handlers["gettransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		confirmations := 0
+		if p[0] == "confirmed" {
+			confirmations = 3
+		}
+		return map[string]any{"txid": p[0], "confirmations": confirmations}, nil
+	}
+	mock.handlers["sendrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		sentHex = append(sentHex, p[0])
+		if p[0] == "hex-conflicted" {
+			return nil, &rpcErr{Code: -25, Message: "bad-txns-inputs-missingorspent"}
+		}
+		return "txid", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	old := time.Now().Add(-2 * time.Hour)
+	expiredMsg := "transaction dropped from mempool without confirming"
+	for _, tx := range []db.Transaction{
+		{OnchainTxnID: "dropped", RawTx: "hex-dropped"},
+		{OnchainTxnID: "confirmed", RawTx: "hex-confirmed"},
+		{OnchainTxnID: "conflicted", RawTx: "hex-conflicted"},
+	} {
+		tx.Address = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+		tx.Status = db.TxnStatusExpired
+		tx.ErrorMsg = expiredMsg
+		tx.ProcessingAt = &old
+		svc.db.Create(&tx)
+	}
+	// expired for some other reason, nothing to send
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", Status: db.TxnStatusExpired, ProcessingAt: &old})
+
+	result, err := svc.RebroadcastUnconfirmed(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rebroadcast != 1 || result.Confirmed != 1 || result.Failed != 1 {
+		t.Errorf("expected 1 rebroadcast, 1 confirmed and 1 failed, got %+v", result)
+	}
+	if !slices.Equal(sentHex, []string{"hex-dropped", "hex-conflicted"}) {
+		t.Errorf("expected the expired unconfirmed transactions sent, got %v", sentHex)
+	}
+
+	for txid, want := range map[string]string{
+		"dropped":    db.TxnStatusBroadcast,
+		"confirmed":  db.TxnStatusBroadcast,
+		"conflicted": db.TxnStatusExpired,
+	} {
+		var tx db.Transaction
+		svc.db.Where("onchain_txn_id = ?", txid).First(&tx)
+		if tx.Status != want {
+			t.Errorf("%s: expected status %s, got %s", txid, want, tx.Status)
+		}
+		if want == db.TxnStatusBroadcast && tx.ErrorMsg != "" {
+			t.Errorf("%s: expected the expiry message cleared, got %q", txid, tx.ErrorMsg)
+		}
+		if want == db.TxnStatusExpired && tx.ErrorMsg != expiredMsg {
+			t.Errorf("%s: expected the expiry message kept, got %q", txid, tx.ErrorMsg)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// ConsolidateUTXOs logic
+// ---------------------------------------------------------------------------
+
+func TestConsolidateUTXOs_SkipsDust(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "dust1", Amount: 0.000001, Confirmations: 6, Spendable: true, Safe: true},
+			{TxID: "dust2", Amount: 0.000002, Confirmations: 6, Spendable: true, Safe: true},
+			{TxID: "ok1", Amount: 0.0005, Confirmations: 6, Spendable: true, Safe: true},
+			{TxID: "ok2", Amount: 0.0003, Confirmations: 6, Spendable: true, Safe: true},
+		}, nil
+	}
+	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return "tb1qconsolidated", nil
+	}
+	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "raw", nil }
+	mock.handlers["signrawtransactionwithwallet"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"hex": "signed", "complete": true}, nil
+	}
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "txid123", nil }
+
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	result, err := svc.ConsolidateUTXOs(t.Context())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Count != 2 {
+		t.Errorf("expected 2 UTXOs consolidated (dust excluded), got %d", result.Count)
+	}
+}
+
+func TestConsolidateUTXOs_SkipsUnspendable(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "a", Amount: 0.0005, Spendable: false},
+			{TxID: "b", Amount: 0.0003, Spendable: false},
+		}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	result, err := svc.ConsolidateUTXOs(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SkipReason == "" {
+		t.Error("expected skip due to unspendable UTXOs")
+	}
+}
+
+func TestConsolidateUTXOs_RespectsMax(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		var utxos []btc.UTXO
+		for i := range 10 {
+			utxos = append(utxos, btc.UTXO{
+				TxID: fmt.Sprintf("tx%d", i), Amount: 0.0005, Confirmations: 6, Spendable: true, Safe: true,
+			})
+		}
+		return utxos, nil
+	}
+	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) { return "tb1q", nil }
+	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "r", nil }
+	mock.handlers["signrawtransactionwithwallet"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"hex": "s", "complete": true}, nil
+	}
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "txid", nil }
+
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.MaxConsolidationUTXOs = 3
+
+	result, err := svc.ConsolidateUTXOs(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Count != 3 {
+		t.Errorf("expected max 3, got %d", result.Count)
+	}
+}
+
+func consolidationFeeMock(t *testing.T, feeRateBTCPerKvB float64) (*mockRPC, *[]json.RawMessage) {
+	t.Helper()
+	var createParams []json.RawMessage
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "a", Amount: 0.0005, Confirmations: 6, Spendable: true, Safe: true},
+			{TxID: "b", Amount: 0.0003, Confirmations: 6, Spendable: true, Safe: true},
+		}, nil
+	}
+	mock.handlers["estimatesmartfee"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"feerate": feeRateBTCPerKvB, "blocks": 144}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		json.Unmarshal(params, &createParams)
+		return "raw", nil
+	}
+	return mock, &createParams
+}
+
+// consolidationOutputBTC returns the amount paid to the consolidation address
+func consolidationOutputBTC(t *testing.T, createParams []json.RawMessage) float64 {
+	t.Helper()
+	var outputs map[string]string
+	json.Unmarshal(createParams[1], &outputs)
+	for k, v := range outputs {
+		if k == "data" {
+			continue
+		}
+		var amount float64
+		fmt.Sscanf(v, "%f", &amount)
+		return amount
+	}
+	t.Fatal("no consolidation output")
+	return 0
+}
+
+func TestConsolidateUTXOs_UsesEstimatedFee(t *testing.T) {
+	// 0.00002 BTC/kvB = 2 sat/vB
+	mock, createParams := consolidationFeeMock(t, 0.00002)
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	// (10.5 + 2*148 + 2*31) vB * 2 sat/vB = 737 sats
+	got := consolidationOutputBTC(t, *createParams)
+	if fmt.Sprintf("%.8f", got) != "0.00079263" {
+		t.Errorf("expected output 0.00079263 after a 737 sat fee, got %.8f", got)
+	}
+}
+
+func TestConsolidateUTXOs_FeeRateOverride(t *testing.T) {
+	mock, createParams := consolidationFeeMock(t, 0.00002)
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.ConsolidationFeeRate = 4
+
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := consolidationOutputBTC(t, *createParams)
+	if fmt.Sprintf("%.8f", got) != "0.00078526" {
+		t.Errorf("expected output 0.00078526 after a 1474 sat fee, got %.8f", got)
+	}
+}
+
+func TestConsolidateUTXOs_NoOpReturn(t *testing.T) {
+	mock, createParams := consolidationFeeMock(t, 0.00002)
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.OpReturn = ""
+
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	var outputs map[string]string
+	json.Unmarshal((*createParams)[1], &outputs)
+	if _, ok := outputs["data"]; ok {
+		t.Errorf("expected no OP_RETURN output, got %v", outputs)
+	}
+
+	// (10.5 + 2*148 + 1*31) vB * 2 sat/vB = 675 sats
+	got := consolidationOutputBTC(t, *createParams)
+	if fmt.Sprintf("%.8f", got) != "0.00079325" {
+		t.Errorf("expected output 0.00079325 after a 675 sat fee, got %.8f", got)
+	}
+}
+
+func TestConsolidateUTXOs_TargetAddress(t *testing.T) {
+	mock, createParams := consolidationFeeMock(t, 0.00002)
+	var newAddressCalls atomic.Int32
+	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) {
+		newAddressCalls.Add(1)
+		return "tb1qnewaddress000000000000000000000000000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.ConsolidationTargetAddress = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	var outputs map[string]string
+	json.Unmarshal((*createParams)[1], &outputs)
+	if _, ok := outputs[svc.cfg.ConsolidationTargetAddress]; !ok {
+		t.Errorf("expected output to the target address, got %v", outputs)
+	}
+	if n := newAddressCalls.Load(); n != 0 {
+		t.Errorf("expected no getnewaddress with a target address, got %d calls", n)
+	}
+
+	// default stays a fresh address
+	svc.cfg.ConsolidationTargetAddress = ""
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	outputs = nil
+	json.Unmarshal((*createParams)[1], &outputs)
+	if _, ok := outputs["tb1qnewaddress000000000000000000000000000"]; !ok || newAddressCalls.Load() != 1 {
+		t.Errorf("expected output to a new address, got %v", outputs)
+	}
+}
+
+func TestConsolidateUTXOs_FeeExceedsAmount(t *testing.T) {
+	// 0.01 BTC/kvB = 1000 sat/vB, way more than the inputs are worth
+	mock, _ := consolidationFeeMock(t, 0.01)
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	_, err := svc.ConsolidateUTXOs(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "too small to cover fees") {
+		t.Errorf("expected fee error, got %v", err)
+	}
+}
+
+func TestConsolidateUTXOs_Metrics(t *testing.T) {
+	mock, _ := consolidationFeeMock(t, 0.00002)
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	consolidationsBefore := testutil.ToFloat64(FaucetConsolidations)
+	utxosBefore := testutil.ToFloat64(FaucetConsolidationUTXOs)
+	errorsBefore := testutil.ToFloat64(FaucetConsolidationErrors)
+
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(FaucetConsolidations) - consolidationsBefore; got != 1 {
+		t.Errorf("expected 1 consolidation, got %v", got)
+	}
+	if got := testutil.ToFloat64(FaucetConsolidationUTXOs) - utxosBefore; got != 2 {
+		t.Errorf("expected 2 utxos consolidated, got %v", got)
+	}
+	if ts := testutil.ToFloat64(FaucetLastConsolidation); time.Since(time.Unix(int64(ts), 0)) > time.Minute {
+		t.Errorf("expected a recent last consolidation timestamp, got %v", ts)
+	}
+
+	// nothing to do is a skip, not an error
+	svc.cfg.MinConsolidationUTXOs = 10
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(FaucetConsolidations) - consolidationsBefore; got != 1 {
+		t.Errorf("expected skipped run not to count, got %v consolidations", got)
+	}
+
+	svc.cfg.MinConsolidationUTXOs = 1
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -26, Message: "min relay fee not met"}
+	}
+	if _, err := svc.ConsolidateUTXOs(t.Context()); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := testutil.ToFloat64(FaucetConsolidationErrors) - errorsBefore; got != 1 {
+		t.Errorf("expected 1 consolidation error, got %v", got)
+	}
+	if got := testutil.ToFloat64(FaucetConsolidations) - consolidationsBefore; got != 1 {
+		t.Errorf("expected failed run not to count, got %v consolidations", got)
+	}
+}
+
+func TestConsolidateUTXOs_SkipsUnconfirmedAndUnsafe(t *testing.T) {
+	var createParams []json.RawMessage
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "zeroconf", Amount: 0.0001, Confirmations: 0, Spendable: true, Safe: true},
+			{TxID: "unsafe", Amount: 0.0001, Confirmations: 0, Spendable: true, Safe: false},
+			{TxID: "young", Amount: 0.0002, Confirmations: 2, Spendable: true, Safe: true},
+			{TxID: "old", Amount: 0.0005, Confirmations: 50, Spendable: true, Safe: true},
+			{TxID: "older", Amount: 0.0009, Confirmations: 900, Spendable: true, Safe: true},
+		}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		json.Unmarshal(params, &createParams)
+		return "raw", nil
+	}
+
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.ConsolidationMinConfirmations = 2
+	svc.cfg.MaxConsolidationUTXOs = 2
+
+	result, err := svc.ConsolidateUTXOs(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Count != 2 {
+		t.Fatalf("expected 2 UTXOs consolidated, got %d (%s)", result.Count, result.SkipReason)
+	}
+
+	var inputs []btc.Outpoint
+	json.Unmarshal(createParams[0], &inputs)
+	var got []string
+	for _, in := range inputs {
+		got = append(got, in.TxID)
+	}
+	if !slices.Equal(got, []string{"older", "old"}) {
+		t.Errorf("expected the most confirmed utxos [older old], got %v", got)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// batch processor
+// ---------------------------------------------------------------------------
+
+func TestProcessBatch_NoPending(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.processBatch(context.Background())
+
+	var count int64
+	svc.db.Model(&db.Transaction{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no transactions, got %d", count)
+	}
+}
+
+func TestProcessBatch_SendsTransactions(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		IPAddress: "1.2.3.4",
+		AmountBTC: 0.05,
+		Status:    db.TxnStatusPending,
+	})
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		IPAddress: "1.2.3.5",
+		AmountBTC: 0.03,
+		Status:    db.TxnStatusPending,
+	})
+
+	svc.processBatch(context.Background())
+
+	var txns []db.Transaction
+	svc.db.Find(&txns)
+
+	for _, tx := range txns {
+		if tx.Status != db.TxnStatusBroadcast {
+			t.Errorf("expected broadcast, got %s for tx %d", tx.Status, tx.ID)
+		}
+		if tx.OnchainTxnID == "" {
+			t.Errorf("expected onchain txid for tx %d", tx.ID)
+		}
+		inputs := tx.FundingInputList()
+		if len(inputs) != 1 || inputs[0].TxID != "ccc" {
+			t.Errorf("expected funding input ccc:0 for tx %d, got %+v", tx.ID, inputs)
+		}
+		if tx.FeeBTC != 0.00001 {
+			t.Errorf("expected fee 0.00001 for tx %d, got %f", tx.ID, tx.FeeBTC)
+		}
+		if tx.RawTx != "signedhex000" {
+			t.Errorf("expected the signed hex stored for tx %d, got %q", tx.ID, tx.RawTx)
+		}
+	}
+}
+
+func TestSendPayoutGroup_FinishesAfterCancel(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	tx := db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		IPAddress: "1.2.3.4",
+		AmountBTC: 0.05,
+		Status:    db.TxnStatusProcessing,
+	}
+	svc.db.Create(&tx)
+
+	/* shutdown cancels the batch ctx, a send that already started must not
+	   be abandoned half way */
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	results := svc.sendPayoutGroup(ctx, []db.Transaction{tx})
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if results[0].err != nil {
+		t.Fatalf("expected send to finish, got: %v", results[0].err)
+	}
+	if results[0].sent == nil || results[0].sent.TxID == "" {
+		t.Errorf("expected txid, got %+v", results[0].sent)
+	}
+}
+
+func TestProcessBatch_StoreRawTxDisabled(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.StoreRawTx = false
+
+	tx := db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		IPAddress: "1.2.3.4",
+		AmountBTC: 0.05,
+		Status:    db.TxnStatusPending,
+	}
+	svc.db.Create(&tx)
+
+	svc.processBatch(t.Context())
+
+	svc.db.First(&tx, tx.ID)
+	if tx.Status != db.TxnStatusBroadcast || tx.OnchainTxnID == "" {
+		t.Errorf("expected the payout sent anyway, got %s %q", tx.Status, tx.OnchainTxnID)
+	}
+	if tx.RawTx != "" {
+		t.Errorf("expected no raw tx stored with -store-raw-tx=false, got %q", tx.RawTx)
+	}
+}
+
+func TestProcessBatch_CancelledBeforeBroadcast(t *testing.T) {
+	mock := newMockRPC()
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	// both rows in one transaction
+	svc.cfg.BatchMaxOutputs = 10
+
+	cancelled := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", IPAddress: "1.2.3.4", AmountBTC: 0.01, Status: db.TxnStatusPending}
+	other := db.Transaction{Address: testAddress(1), IPAddress: "1.2.3.5", AmountBTC: 0.02, Status: db.TxnStatusPending}
+	svc.db.Create(&cancelled)
+	svc.db.Create(&other)
+
+	// an admin cancels one of the rows while the batch is being signed
+	sign := mock.handlers["signrawtransactionwithwallet"]
+	mock.handlers["signrawtransactionwithwallet"] = func(params json.RawMessage) (any, *rpcErr) {
+		svc.db.Model(&db.Transaction{}).Where("id = ?", cancelled.ID).Update("status", db.TxnStatusCancelled)
+		return sign(params)
+	}
+	broadcasts := 0
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		broadcasts++
+		return "mocktxid", nil
+	}
+
+	svc.processBatch(t.Context())
+
+	if broadcasts != 0 {
+		t.Errorf("expected nothing broadcast after a cancel, got %d", broadcasts)
+	}
+	svc.db.First(&cancelled, cancelled.ID)
+	if cancelled.Status != db.TxnStatusCancelled || cancelled.OnchainTxnID != "" {
+		t.Errorf("expected the cancelled row left alone, got %s %q", cancelled.Status, cancelled.OnchainTxnID)
+	}
+	svc.db.First(&other, other.ID)
+	if other.Status != db.TxnStatusPending || other.OnchainTxnID != "" {
+		t.Errorf("expected the other row back in the queue without a txid, got %s %q", other.Status, other.OnchainTxnID)
+	}
+}
+
+func TestProcessBatch_CancelledDuringFailedSend(t *testing.T) {
+	mock := newMockRPC()
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	tx := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", IPAddress: "1.2.3.4", AmountBTC: 0.01, Status: db.TxnStatusPending}
+	svc.db.Create(&tx)
+
+	mock.handlers["fundrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		svc.db.Model(&db.Transaction{}).Where("id = ?", tx.ID).Update("status", db.TxnStatusCancelled)
+		return nil, &rpcErr{Code: -4, Message: "Transaction too large"}
+	}
+
+	svc.processBatch(t.Context())
+
+	svc.db.First(&tx, tx.ID)
+	if tx.Status != db.TxnStatusCancelled {
+		t.Errorf("expected the cancel to stick after the failed send, got %s", tx.Status)
+	}
+}
+
+func TestProcessBatch_HighPriorityFirst(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.BatchSize = 1
+
+	older := db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		IPAddress: "1.2.3.4",
+		AmountBTC: 0.01,
+		Status:    db.TxnStatusPending,
+	}
+	svc.db.Create(&older)
+	high := db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		IPAddress: "1.2.3.5",
+		AmountBTC: 0.01,
+		Status:    db.TxnStatusPending,
+		APIKeyID:  "ci",
+		Priority:  db.TxnPriorityHigh,
+	}
+	svc.db.Create(&high)
+
+	svc.processBatch(t.Context())
+
+	svc.db.First(&older, older.ID)
+	svc.db.First(&high, high.ID)
+	if high.Status != db.TxnStatusBroadcast {
+		t.Errorf("expected the high priority request paid first, got %s", high.Status)
+	}
+	if older.Status != db.TxnStatusPending {
+		t.Errorf("expected the older normal request to wait, got %s", older.Status)
+	}
+
+	svc.processBatch(t.Context())
+	svc.db.First(&older, older.ID)
+	if older.Status != db.TxnStatusBroadcast {
+		t.Errorf("expected the normal request paid in the next batch, got %s", older.Status)
+	}
+}
+
+func TestProcessBatch_OpReturnMessage(t *testing.T) {
+	var mu sync.Mutex
+	var opReturns []string
+	mock := newMockRPC()
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		var outputs map[string]any
+		json.Unmarshal(p[1], &outputs)
+		data, _ := hex.DecodeString(outputs["data"].(string))
+		mu.Lock()
+		opReturns = append(opReturns, string(data))
+		mu.Unlock()
+		return "rawhex", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 0.01,
+		Status:    db.TxnStatusPending,
+		OpReturn:  "gm",
+	})
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 0.01,
+		Status:    db.TxnStatusPending,
+	})
+
+	svc.processBatch(context.Background())
+
+	slices.Sort(opReturns)
+	want := []string{DefaultOpReturn, "gm"}
+	if !slices.Equal(opReturns, want) {
+		t.Errorf("expected op_returns %v, got %v", want, opReturns)
+	}
+}
+
+func TestProcessBatch_NoOpReturn(t *testing.T) {
+	var mu sync.Mutex
+	var outputs []map[string]any
+	mock := newMockRPC()
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		var o map[string]any
+		json.Unmarshal(p[1], &o)
+		mu.Lock()
+		outputs = append(outputs, o)
+		mu.Unlock()
+		return "rawhex", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.OpReturn = ""
+
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 0.01,
+		Status:    db.TxnStatusPending,
+	})
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 0.01,
+		Status:    db.TxnStatusPending,
+		OpReturn:  "gm",
+	})
+
+	svc.processBatch(context.Background())
+
+	withData := 0
+	for _, o := range outputs {
+		if _, ok := o["data"]; ok {
+			withData++
+		}
+	}
+	if len(outputs) != 2 || withData != 1 {
+		t.Errorf("expected only the user message to add an OP_RETURN, got %v", outputs)
+	}
+}
+
+func TestProcessBatch_NoOpReturnAddresses(t *testing.T) {
+	var mu sync.Mutex
+	var outputs []map[string]any
+	mock := newMockRPC()
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		var o map[string]any
+		json.Unmarshal(p[1], &o)
+		mu.Lock()
+		outputs = append(outputs, o)
+		mu.Unlock()
+		return "rawhex", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.BatchMaxOutputs = 1
+	svc.cfg.NoOpReturnAddresses = []string{"TB1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KXPJZSX", "tb1qrp33*"}
+
+	for address, message := range map[string]string{
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx":                     "gm",
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7": "",
+		"tb1q0xcqpzrky6eff2g52qdye53xkk9jxkvrh6yhyw":                     "",
+		"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c": "gm",
+	} {
+		svc.db.Create(&db.Transaction{Address: address, AmountBTC: 0.01, Status: db.TxnStatusPending, OpReturn: message})
+	}
+
+	svc.processBatch(context.Background())
+
+	if len(outputs) != 4 {
+		t.Fatalf("expected 4 transactions, got %d", len(outputs))
+	}
+	for _, o := range outputs {
+		_, hasData := o["data"]
+		matched := o["tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"] != nil ||
+			o["tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7"] != nil
+		if hasData == matched {
+			t.Errorf("expected OP_RETURN only for unlisted addresses, got %v", o)
+		}
+	}
+}
+
+func TestProcessBatch_ConcurrentSendsSerialized(t *testing.T) {
+	// a send is in flight from funding until its broadcast returns
+	var inFlight, maxInFlight atomic.Int32
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	fund := mock.handlers["fundrawtransaction"]
+	mock.handlers["fundrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		n := inFlight.Add(1)
+		for {
+			cur := maxInFlight.Load()
+			if n <= cur || maxInFlight.CompareAndSwap(cur, n) {
+				break
+			}
+		}
+		return fund(params)
+	}
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		defer inFlight.Add(-1)
+		time.Sleep(20 * time.Millisecond)
+		return "mocktxid0000000000000000000000000000000000000000000000000000000000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.BatchConcurrency = 4
+
+	for i := range 8 {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			IPAddress: fmt.Sprintf("1.2.3.%d", i),
+			AmountBTC: 0.01,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	// an admin send racing the batch has to wait its turn as well
+	var admin sync.WaitGroup
+	admin.Go(func() {
+		svc.walletMtx.Lock()
+		defer svc.walletMtx.Unlock()
+		svc.rpcClient.SendToAddressWithOpReturn(t.Context(), "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", 0.01, 2, "")
+	})
+
+	svc.processBatch(context.Background())
+	admin.Wait()
+
+	var count int64
+	svc.db.Model(&db.Transaction{}).Where("status = ?", db.TxnStatusBroadcast).Count(&count)
+	if count != 8 {
+		t.Errorf("expected 8 broadcast, got %d", count)
+	}
+	if maxInFlight.Load() != 1 {
+		t.Errorf("expected wallet sends to never overlap, max in flight was %d", maxInFlight.Load())
+	}
+}
+
+func TestProcessBatch_InsufficientBalance(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 0.0001, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 100.0,
+		Status:    db.TxnStatusPending,
+	})
+
+	svc.processBatch(context.Background())
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusPending {
+		t.Errorf("expected still pending (insufficient balance), got %s", tx.Status)
+	}
+}
+
+func TestProcessBatch_RespectsReserve(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	// 1.5008 BTC confirmed in the mock's utxos, 1 BTC left after the reserve
+	svc.cfg.ReserveBalance = 0.5008
+
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.6, Status: db.TxnStatusPending})
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.6, Status: db.TxnStatusPending})
+
+	svc.processBatch(context.Background())
+
+	var txns []db.Transaction
+	svc.db.Order("id ASC").Find(&txns)
+	if txns[0].Status != db.TxnStatusBroadcast || txns[1].Status != db.TxnStatusPending {
+		t.Errorf("expected only the first payout to fit above the reserve, got %s, %s", txns[0].Status, txns[1].Status)
+	}
+}
+
+func TestProcessBatch_StopsAtMinBalance(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	// 1.5008 BTC confirmed in the mock's utxos, 1 BTC left above min balance
+	svc.settings.MinBalance = 0.5008
+
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.6, Status: db.TxnStatusPending})
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.6, Status: db.TxnStatusPending})
+
+	svc.processBatch(context.Background())
+
+	var txns []db.Transaction
+	svc.db.Order("id ASC").Find(&txns)
+	if txns[0].Status != db.TxnStatusBroadcast || txns[1].Status != db.TxnStatusPending {
+		t.Errorf("expected only the first payout to fit above min balance, got %s, %s", txns[0].Status, txns[1].Status)
+	}
+}
+
+func TestPayoutFloor(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	svc.cfg.ReserveBalance = 0.2
+	svc.settings.MinBalance = 0.1
+	if got := svc.payoutFloor(); got != 0.2 {
+		t.Errorf("expected reserve to win, got %v", got)
+	}
+
+	svc.settings.MinBalance = 0.5
+	if got := svc.payoutFloor(); got != 0.5 {
+		t.Errorf("expected min balance to win, got %v", got)
+	}
+
+	spendable, err := svc.GetSpendableWalletBalance(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(spendable-1.0008) > 1e-9 {
+		t.Errorf("expected 1.0008 spendable above the floor, got %v", spendable)
+	}
+}
+
+func TestProcessBatch_PartialBatchFIFO(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{{TxID: "aaa", Amount: 0.1, Confirmations: 3, Spendable: true, Safe: true}}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.settings.MinBalance = 0
+	// out of the box a short balance pays what it can in FIFO order
+	svc.cfg.PartialBatch = DefaultPartialBatch
+
+	for _, amount := range []float64{0.05, 0.04, 0.05, 0.001} {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			AmountBTC: amount,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	svc.processBatch(context.Background())
+
+	var txns []db.Transaction
+	svc.db.Order("id ASC").Find(&txns)
+	expected := []string{db.TxnStatusBroadcast, db.TxnStatusBroadcast, db.TxnStatusPending, db.TxnStatusPending}
+	for i, tx := range txns {
+		if tx.Status != expected[i] {
+			t.Errorf("tx %d: expected %s, got %s", i, expected[i], tx.Status)
+		}
+	}
+}
+
+func TestProcessBatch_PartialBatchSmallestFirst(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{{TxID: "aaa", Amount: 0.1, Confirmations: 3, Spendable: true, Safe: true}}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.settings.MinBalance = 0
+	svc.cfg.BatchOrder = BatchOrderSmallestFirst
+
+	for _, amount := range []float64{0.05, 0.04, 0.05, 0.001} {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			AmountBTC: amount,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	svc.processBatch(context.Background())
+
+	// 0.001, 0.04 and the older 0.05 fit, the second 0.05 waits
+	var txns []db.Transaction
+	svc.db.Order("id ASC").Find(&txns)
+	expected := []string{db.TxnStatusBroadcast, db.TxnStatusBroadcast, db.TxnStatusPending, db.TxnStatusBroadcast}
+	for i, tx := range txns {
+		if tx.Status != expected[i] {
+			t.Errorf("tx %d: expected %s, got %s", i, expected[i], tx.Status)
+		}
+	}
+}
+
+func TestProcessBatch_PartialBatchLargestFirst(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{{TxID: "aaa", Amount: 0.1, Confirmations: 3, Spendable: true, Safe: true}}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.settings.MinBalance = 0
+	svc.cfg.BatchOrder = BatchOrderLargestFirst
+
+	for _, amount := range []float64{0.02, 0.09, 0.01, 0.005} {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			AmountBTC: amount,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	svc.processBatch(context.Background())
+
+	// 0.09 goes first, 0.02 no longer fits but the smaller ones after it do
+	var txns []db.Transaction
+	svc.db.Order("id ASC").Find(&txns)
+	expected := []string{db.TxnStatusPending, db.TxnStatusBroadcast, db.TxnStatusBroadcast, db.TxnStatusPending}
+	for i, tx := range txns {
+		if tx.Status != expected[i] {
+			t.Errorf("tx %d: expected %s, got %s", i, expected[i], tx.Status)
+		}
+	}
+}
+
+func TestProcessBatch_BatchSize(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.BatchSize = 2
+
+	for range 3 {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			AmountBTC: 0.001,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	svc.processBatch(context.Background())
+
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusPending); c != 1 {
+		t.Errorf("expected 1 left for the next batch, got %d", c)
+	}
+}
+
+func TestBatchProcessor_FlushThreshold(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.BatchInterval = time.Hour
+	svc.cfg.BatchFlushThreshold = 3
+
+	// the processor goroutine has to share the single in-memory db connection
+	sqlDB, _ := svc.db.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	svc.StartBatchProcessor(ctx, &wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	submit := func(i int) {
+		r := httptest.NewRequest("POST", "/api/submit", jsonBody(map[string]any{"address": testAddress(i)}))
+		r.RemoteAddr = fmt.Sprintf("198.51.100.%d:1234", i)
+		w := httptest.NewRecorder()
+		svc.submitHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("submit %d: expected 200, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	submit(1)
+	submit(2)
+	time.Sleep(50 * time.Millisecond)
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusPending); c != 2 {
+		t.Fatalf("expected both to wait for the tick below the threshold, got %d pending", c)
+	}
+
+	submit(3)
+	deadline := time.Now().Add(2 * time.Second)
+	for db.GetTransactionCount(svc.db, db.TxnStatusBroadcast) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the burst to be flushed before the hourly tick, %d pending", db.GetTransactionCount(svc.db, db.TxnStatusPending))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSignalBatchFlush_Disabled(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	for range 5 {
+		svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", Status: db.TxnStatusPending})
+	}
+	svc.signalBatchFlush()
+
+	select {
+	case <-svc.batchFlush:
+		t.Error("expected no flush without a threshold")
+	default:
+	}
+}
+
+func TestProcessBatch_AllOrNothing(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{{TxID: "aaa", Amount: 0.1, Confirmations: 3, Spendable: true, Safe: true}}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.settings.MinBalance = 0
+	svc.cfg.PartialBatch = false
+
+	for _, amount := range []float64{0.05, 0.04, 0.05} {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			AmountBTC: amount,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	svc.processBatch(context.Background())
+
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusPending); c != 3 {
+		t.Errorf("expected all 3 still pending, got %d", c)
+	}
+}
+
+func TestProcessBatch_RPCFailure(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -1, Message: "wallet locked"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 0.05,
+		Status:    db.TxnStatusPending,
+	})
+
+	svc.processBatch(context.Background())
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusFailed {
+		t.Errorf("expected failed after RPC error, got %s", tx.Status)
+	}
+	if tx.ErrorMsg == "" {
+		t.Error("expected error message to be recorded")
+	}
+}
+
+func TestProcessBatch_InsufficientFundsRetries(t *testing.T) {
+	var fundCalls atomic.Int32
+	mock := newMockRPC()
+	mock.handlers["fundrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		fundCalls.Add(1)
+		return nil, &rpcErr{Code: btc.RPCErrWalletError, Message: "Insufficient funds"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.InsufficientFundsRetries = 2
+
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 0.05,
+		Status:    db.TxnStatusPending,
+	})
+
+	svc.processBatch(context.Background())
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusPending || tx.RetryCount != 1 {
+		t.Fatalf("expected pending with 1 retry, got %s with %d", tx.Status, tx.RetryCount)
+	}
+	if tx.NextRetryAt == nil || time.Until(*tx.NextRetryAt) < 50*time.Second {
+		t.Errorf("expected a retry about a minute out, got %v", tx.NextRetryAt)
+	}
+	if tx.ErrorMsg == "" {
+		t.Error("expected the last error to be recorded")
+	}
+
+	// still backing off
+	svc.processBatch(context.Background())
+	if n := fundCalls.Load(); n != 1 {
+		t.Errorf("expected the payout to wait for its retry time, got %d fund calls", n)
+	}
+
+	svc.db.Model(&tx).Update("next_retry_at", time.Now().Add(-time.Second))
+	svc.processBatch(context.Background())
+
+	var retried db.Transaction
+	svc.db.First(&retried)
+	if retried.Status != db.TxnStatusPending || retried.RetryCount != 2 {
+		t.Fatalf("expected pending with 2 retries, got %s with %d", retried.Status, retried.RetryCount)
+	}
+	if d := time.Until(*retried.NextRetryAt); d < 110*time.Second {
+		t.Errorf("expected the backoff to double, got %v", d)
+	}
+
+	svc.db.Model(&retried).Update("next_retry_at", time.Now().Add(-time.Second))
+	svc.processBatch(context.Background())
+
+	var final db.Transaction
+	svc.db.First(&final)
+	if final.Status != db.TxnStatusFailed {
+		t.Errorf("expected failed once retries ran out, got %s", final.Status)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.InsufficientFundsBackoff = time.Minute
+
+	for retries, want := range map[int]time.Duration{
+		0:   time.Minute,
+		1:   2 * time.Minute,
+		3:   8 * time.Minute,
+		10:  1024 * time.Minute,
+		11:  maxRetryBackoff,
+		64:  maxRetryBackoff,
+		200: maxRetryBackoff,
+	} {
+		if got := svc.retryBackoff(retries); got != want {
+			t.Errorf("%d retries: expected %v, got %v", retries, want, got)
+		}
+	}
+
+	svc.cfg.InsufficientFundsBackoff = 0
+	if got := svc.retryBackoff(5); got != 0 {
+		t.Errorf("expected no backoff when disabled, got %v", got)
+	}
+}
+
+func TestProcessBatch_OtherErrorsDontRetry(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["fundrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: btc.RPCErrWalletError, Message: "Transaction too large"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	svc.db.Create(&db.Transaction{
+		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		AmountBTC: 0.05,
+		Status:    db.TxnStatusPending,
+	})
+
+	svc.processBatch(context.Background())
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusFailed || tx.RetryCount != 0 {
+		t.Errorf("expected failed without retry, got %s with %d", tx.Status, tx.RetryCount)
+	}
+}
+
+func batchDurationCount(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := FaucetBatchDuration.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestProcessBatch_Metrics(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		if strings.Contains(string(params), "tb1qbadaddress") {
+			return nil, &rpcErr{Code: -5, Message: "Invalid Bitcoin address: tb1qbadaddress"}
+		}
+		return "rawhex000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+
+	sentBefore := testutil.ToFloat64(FaucetBatchSent)
+	failedBefore := testutil.ToFloat64(FaucetBatchFailed)
+	batchesBefore := batchDurationCount(t)
+
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending})
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending})
+	svc.db.Create(&db.Transaction{Address: "tb1qbadaddress", AmountBTC: 0.01, Status: db.TxnStatusPending})
+
+	before := time.Now().Unix()
+	svc.processBatch(context.Background())
+
+	if got := testutil.ToFloat64(FaucetBatchSent) - sentBefore; got != 2 {
+		t.Errorf("expected 2 sent, got %v", got)
+	}
+	if got := testutil.ToFloat64(FaucetBatchFailed) - failedBefore; got != 1 {
+		t.Errorf("expected 1 failed, got %v", got)
+	}
+	if got := batchDurationCount(t) - batchesBefore; got != 1 {
+		t.Errorf("expected 1 batch duration observation, got %d", got)
+	}
+	if got := testutil.ToFloat64(FaucetBatchLastSuccess); got < float64(before) {
+		t.Errorf("expected last success timestamp to be updated, got %v", got)
+	}
+}
+
+func TestProcessBatch_ShutdownAfterCurrentSend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var sends atomic.Int32
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		// shutdown signal arrives while the first send is in flight
+		sends.Add(1)
+		cancel()
+		return "rawhex000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.BatchConcurrency = 1
+
+	for range 3 {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			AmountBTC: 0.01,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	svc.processBatch(ctx)
+
+	if n := sends.Load(); n != 1 {
+		t.Errorf("expected only the in-flight send to run, got %d", n)
+	}
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusBroadcast); c != 1 {
+		t.Errorf("expected the in-flight send to finish, got %d broadcast", c)
+	}
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusPending); c != 2 {
+		t.Errorf("expected the rest back to pending, got %d", c)
+	}
+}
+
+func TestProcessBatch_CircuitBreaker(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: -28, Message: "Loading block index"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	t.Cleanup(func() { FaucetPayoutsPaused.Set(0) })
+
+	for range 5 {
+		svc.db.Create(&db.Transaction{
+			Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+			AmountBTC: 0.01,
+			Status:    db.TxnStatusPending,
+		})
+	}
+
+	svc.processBatch(context.Background())
+
+	if !svc.PayoutBreaker().Open {
+		t.Fatal("expected breaker to open after 3 consecutive failures")
+	}
+	if got := testutil.ToFloat64(FaucetPayoutsPaused); got != 1 {
+		t.Errorf("expected faucet_payouts_paused 1, got %v", got)
+	}
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusFailed); c != 3 {
+		t.Errorf("expected 3 failed, got %d", c)
+	}
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusPending); c != 2 {
+		t.Errorf("expected the rest back to pending, got %d", c)
+	}
+
+	// cooldown not over yet, nothing is attempted
+	svc.processBatch(context.Background())
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusPending); c != 2 {
+		t.Errorf("expected batch to be skipped while paused, got %d pending", c)
+	}
+}
+
+func TestGroupPayouts(t *testing.T) {
+	txns := []db.Transaction{
+		{Address: "tb1qa"},
+		{Address: "tb1qb"},
+		{Address: "tb1qa"},
+		{Address: "tb1qc", OpReturn: "hello"},
+		{Address: "tb1qd"},
+		{Address: "tb1qe"},
+	}
+
+	groups := groupPayouts(txns, 3)
+
+	var got [][]string
+	for _, g := range groups {
+		var addrs []string
+		for _, tx := range g {
+			addrs = append(addrs, tx.Address+tx.OpReturn)
+		}
+		got = append(got, addrs)
+	}
+
+	want := [][]string{
+		{"tb1qa", "tb1qb", "tb1qd"},
+		{"tb1qa", "tb1qe"},
+		{"tb1qchello"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected groups %v, got %v", want, got)
+	}
+
+	if groups := groupPayouts(txns, 1); len(groups) != len(txns) {
+		t.Errorf("expected one group per payout with max 1, got %d", len(groups))
+	}
+}
+
+func TestProcessBatch_MultiOutput(t *testing.T) {
+	var mu sync.Mutex
+	var created []map[string]string
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		var outputs map[string]string
+		json.Unmarshal(p[1], &outputs)
+		mu.Lock()
+		created = append(created, outputs)
+		mu.Unlock()
+		return "rawhex000", nil
+	}
+	mock.handlers["fundrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"hex": "fundedhex000", "fee": 0.00003}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.BatchMaxOutputs = 10
+
+	for _, addr := range []string{
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7",
+		"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c",
+	} {
+		svc.db.Create(&db.Transaction{Address: addr, AmountBTC: 0.01, Status: db.TxnStatusPending})
+	}
+
+	svc.processBatch(context.Background())
+
+	if len(created) != 1 {
+		t.Fatalf("expected a single transaction, got %d", len(created))
+	}
+	if len(created[0]) != 4 {
+		t.Errorf("expected 3 payouts and an OP_RETURN output, got %v", created[0])
+	}
+
+	var txns []db.Transaction
+	svc.db.Find(&txns)
+	for _, tx := range txns {
+		if tx.Status != db.TxnStatusBroadcast {
+			t.Errorf("expected broadcast, got %s for tx %d", tx.Status, tx.ID)
+		}
+		if tx.OnchainTxnID != txns[0].OnchainTxnID {
+			t.Errorf("expected all payouts to share a txid, got %s and %s", tx.OnchainTxnID, txns[0].OnchainTxnID)
+		}
+		if math.Abs(tx.FeeBTC-0.00001) > 1e-12 {
+			t.Errorf("expected fee share 0.00001 for tx %d, got %.8f", tx.ID, tx.FeeBTC)
+		}
+	}
+}
+
+func TestProcessBatch_MultiOutputInvalidAddressFallback(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{
+			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+		}, nil
+	}
+	mock.handlers["createrawtransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []json.RawMessage
+		json.Unmarshal(params, &p)
+		var outputs map[string]string
+		json.Unmarshal(p[1], &outputs)
+		if _, ok := outputs["tb1qbadaddress"]; ok {
+			return nil, &rpcErr{Code: -5, Message: "Invalid Bitcoin address: tb1qbadaddress"}
+		}
+		return "rawhex000", nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.BatchMaxOutputs = 10
+
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending})
+	svc.db.Create(&db.Transaction{Address: "tb1qbadaddress", AmountBTC: 0.01, Status: db.TxnStatusPending})
+
+	svc.processBatch(context.Background())
+
+	var good, bad db.Transaction
+	svc.db.Where("address = ?", "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx").First(&good)
+	svc.db.Where("address = ?", "tb1qbadaddress").First(&bad)
+	if good.Status != db.TxnStatusBroadcast {
+		t.Errorf("expected valid payout to be sent on its own, got %s", good.Status)
+	}
+	if bad.Status != db.TxnStatusFailed {
+		t.Errorf("expected invalid payout to fail, got %s", bad.Status)
+	}
+}
+
+func TestPayoutsAllowed_HealthCheck(t *testing.T) {
+	healthy := false
+	mock := newMockRPC()
+	mock.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
+		if !healthy {
+			return nil, &rpcErr{Code: -28, Message: "Loading block index"}
+		}
+		return map[string]any{"chain": "signet", "blocks": 100, "headers": 100}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	t.Cleanup(func() { FaucetPayoutsPaused.Set(0) })
+
+	for range 3 {
+		svc.recordSendResult(fmt.Errorf("connection refused"))
+	}
+	if !svc.PayoutBreaker().Open {
+		t.Fatal("expected breaker to be open")
+	}
+
+	svc.breaker.RetryAt = time.Now().Add(-time.Second)
+	if svc.payoutsAllowed(t.Context()) {
+		t.Error("expected payouts to stay paused while the health check fails")
+	}
+	if !svc.PayoutBreaker().RetryAt.After(time.Now()) {
+		t.Error("expected a failed health check to restart the cooldown")
+	}
+
+	healthy = true
+	svc.breaker.RetryAt = time.Now().Add(-time.Second)
+	if !svc.payoutsAllowed(t.Context()) {
+		t.Error("expected payouts to resume after a successful health check")
+	}
+	if st := svc.PayoutBreaker(); st.Open || st.ConsecutiveFailures != 0 {
+		t.Errorf("expected breaker reset, got %+v", st)
+	}
+	if got := testutil.ToFloat64(FaucetPayoutsPaused); got != 0 {
+		t.Errorf("expected faucet_payouts_paused 0, got %v", got)
 	}
 }
 
-// ---------------------------------------------------------------------------
-// admin UTXOs
-// ---------------------------------------------------------------------------
-
-func TestAdminGetUTXOs(t *testing.T) {
-	svc, _ := testServiceFull(t)
-
-	r := httptest.NewRequest("GET", "/admin/utxos", nil)
-	w := httptest.NewRecorder()
-	svc.adminGetUTXOsHandler(w, r)
+func TestProcessBatch_InvalidAddressesDontTripBreaker(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return nil, &rpcErr{Code: btc.RPCErrInvalidAddressOrKey, Message: "Invalid Bitcoin address"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.PayoutBreakerThreshold = 3
+	t.Cleanup(func() { FaucetPayoutsPaused.Set(0) })
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", w.Code)
+	// bad checksums pass the regex check at submit and only fail at the node
+	for i := range 5 {
+		svc.db.Create(&db.Transaction{Address: testAddress(i), AmountBTC: 0.01, Status: db.TxnStatusPending})
 	}
+	svc.processBatch(t.Context())
 
-	resp := decodeJSON(t, w.Body)
-	utxos, ok := resp["utxos"].([]any)
-	if !ok {
-		t.Fatal("expected utxos array")
+	if st := svc.PayoutBreaker(); st.Open || st.ConsecutiveFailures != 0 {
+		t.Errorf("expected invalid addresses to leave the breaker closed, got %+v", st)
 	}
-	if len(utxos) != 3 {
-		t.Errorf("expected 3 utxos, got %d", len(utxos))
+	if c := db.GetTransactionCount(svc.db, db.TxnStatusFailed); c != 5 {
+		t.Errorf("expected all 5 payouts failed, got %d", c)
 	}
 
-	first := utxos[0].(map[string]any)
-	second := utxos[1].(map[string]any)
-	if first["confirmations"].(float64) > second["confirmations"].(float64) {
-		t.Error("utxos should be sorted by confirmations ascending")
+	svc.recordSendResult(&btc.RPCError{Code: btc.RPCErrWalletInsufficientFunds, Message: "Insufficient funds"})
+	svc.recordSendResult(btc.ErrOpReturnTooLong)
+	if st := svc.PayoutBreaker(); st.ConsecutiveFailures != 0 {
+		t.Errorf("expected payout errors not to count, got %+v", st)
+	}
+	svc.recordSendResult(&btc.RPCError{Code: btc.RPCErrInWarmup, Message: "Loading block index"})
+	if st := svc.PayoutBreaker(); st.ConsecutiveFailures != 1 {
+		t.Errorf("expected a node that isn't ready to count, got %+v", st)
 	}
 }
 
-// ---------------------------------------------------------------------------
-// admin consolidate
-// ---------------------------------------------------------------------------
-
-func TestAdminConsolidate_Success(t *testing.T) {
+func TestRecordSendResult_SuccessResets(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
-	body := jsonBody(map[string]any{})
-	r := httptest.NewRequest("POST", "/admin/consolidate", body)
-	w := httptest.NewRecorder()
-	svc.adminConsolidateUTXOsHandler(w, r)
+	svc.recordSendResult(fmt.Errorf("timeout"))
+	svc.recordSendResult(fmt.Errorf("timeout"))
+	svc.recordSendResult(nil)
+	svc.recordSendResult(fmt.Errorf("timeout"))
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	if st := svc.PayoutBreaker(); st.Open || st.ConsecutiveFailures != 1 {
+		t.Errorf("expected 1 consecutive failure and closed breaker, got %+v", st)
 	}
 
-	resp := decodeJSON(t, w.Body)
-	if resp["success"] != true {
-		t.Errorf("expected success=true, got %v", resp)
+	svc.cfg.PayoutBreakerThreshold = 0
+	for range 10 {
+		svc.recordSendResult(fmt.Errorf("timeout"))
 	}
-	if resp["count"].(float64) != 2 {
-		t.Errorf("expected 2 consolidated utxos, got %v", resp["count"])
+	if svc.PayoutBreaker().Open {
+		t.Error("expected a disabled breaker to never open")
 	}
 }
 
-func TestAdminConsolidate_MethodNotAllowed(t *testing.T) {
-	svc, _ := testServiceFull(t)
+// ---------------------------------------------------------------------------
+// startup reconciliation
+// ---------------------------------------------------------------------------
 
-	r := httptest.NewRequest("GET", "/admin/consolidate", nil)
-	w := httptest.NewRecorder()
-	svc.adminConsolidateUTXOsHandler(w, r)
+func TestReconcileTransactions(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["gettransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		switch p[0] {
+		case "seentxid":
+			return map[string]any{"txid": p[0], "confirmations": 0}, nil
+		case "conflictedtxid":
+			return map[string]any{"txid": p[0], "confirmations": -1}, nil
+		case "flakytxid":
+			return nil, &rpcErr{Code: -28, Message: "Loading wallet"}
+		}
+		return nil, &rpcErr{Code: -5, Message: "Invalid or non-wallet transaction id"}
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
 
-	if w.Code != http.StatusMethodNotAllowed {
-		t.Errorf("expected 405, got %d", w.Code)
+	rows := map[string]*db.Transaction{
+		"notxid":     {Status: db.TxnStatusProcessing},
+		"seen":       {Status: db.TxnStatusProcessing, OnchainTxnID: "seentxid"},
+		"conflicted": {Status: db.TxnStatusProcessing, OnchainTxnID: "conflictedtxid"},
+		"unknown":    {Status: db.TxnStatusProcessing, OnchainTxnID: "unknowntxid"},
+		"flaky":      {Status: db.TxnStatusProcessing, OnchainTxnID: "flakytxid"},
+		"untouched":  {Status: db.TxnStatusBroadcast, OnchainTxnID: "unknowntxid"},
+	}
+	for _, tx := range rows {
+		tx.Address = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+		tx.AmountBTC = 0.01
+		svc.db.Create(tx)
 	}
-}
 
-func TestAdminConsolidate_InvalidJSON(t *testing.T) {
-	svc, _ := testServiceFull(t)
+	result, err := svc.ReconcileTransactions(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	r := httptest.NewRequest("POST", "/admin/consolidate", strings.NewReader("bad"))
-	w := httptest.NewRecorder()
-	svc.adminConsolidateUTXOsHandler(w, r)
+	want := ReconcileResult{Pending: 2, Broadcast: 1, Failed: 1, Skipped: 1}
+	if *result != want {
+		t.Errorf("expected %+v, got %+v", want, *result)
+	}
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", w.Code)
+	expected := map[string]string{
+		"notxid":     db.TxnStatusPending,
+		"seen":       db.TxnStatusBroadcast,
+		"conflicted": db.TxnStatusFailed,
+		"unknown":    db.TxnStatusPending,
+		"flaky":      db.TxnStatusProcessing,
+		"untouched":  db.TxnStatusBroadcast,
+	}
+	for name, status := range expected {
+		var tx db.Transaction
+		svc.db.First(&tx, rows[name].ID)
+		if tx.Status != status {
+			t.Errorf("%s: expected %s, got %s", name, status, tx.Status)
+		}
+		if status == db.TxnStatusFailed && tx.ErrorMsg == "" {
+			t.Errorf("%s: expected error message", name)
+		}
+		if status == db.TxnStatusPending && tx.OnchainTxnID != "" {
+			t.Errorf("%s: expected requeued row without txid, got %s", name, tx.OnchainTxnID)
+		}
 	}
 }
 
-func TestAdminConsolidate_NoSmallUTXOs(t *testing.T) {
+func TestProcessBatch_RecordsTxIDBeforeBroadcast(t *testing.T) {
 	mock := newMockRPC()
-	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return []btc.UTXO{
-			{TxID: "aaa", Amount: 5.0, Confirmations: 10, Spendable: true},
-		}, nil
-	}
 	rpcServer := httptest.NewServer(mock)
 	t.Cleanup(rpcServer.Close)
 	svc := testService(t, rpcServer)
 
-	body := jsonBody(map[string]any{})
-	r := httptest.NewRequest("POST", "/admin/consolidate", body)
-	w := httptest.NewRecorder()
-	svc.adminConsolidateUTXOsHandler(w, r)
+	tx := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending}
+	svc.db.Create(&tx)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", w.Code)
+	var recorded string
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		var row db.Transaction
+		svc.db.First(&row, tx.ID)
+		recorded = row.OnchainTxnID
+		return "mocktxid0000000000000000000000000000000000000000000000000000000000", nil
 	}
 
-	resp := decodeJSON(t, w.Body)
-	if resp["message"] == nil || !strings.Contains(resp["message"].(string), "No UTXOs") {
-		t.Errorf("expected skip message, got: %v", resp)
+	svc.processBatch(context.Background())
+
+	if recorded != "mocktxid0000000000000000000000000000000000000000000000000000000000" {
+		t.Errorf("expected txid on the row before the broadcast, got %q", recorded)
 	}
 }
 
-func TestAdminConsolidate_BelowMinUTXOs(t *testing.T) {
+func TestProcessBatch_EarlierAttemptNotResent(t *testing.T) {
 	mock := newMockRPC()
-	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return []btc.UTXO{
-			{TxID: "aaa", Amount: 0.0005, Confirmations: 10, Spendable: true},
-		}, nil
+	mock.handlers["gettransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		switch p[0] {
+		case "senttxid":
+			return map[string]any{"txid": p[0], "confirmations": 1}, nil
+		case "flakytxid":
+			return nil, &rpcErr{Code: -28, Message: "Loading wallet"}
+		}
+		return nil, &rpcErr{Code: -5, Message: "Invalid or non-wallet transaction id"}
+	}
+	var broadcasts atomic.Int32
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		broadcasts.Add(1)
+		return "mocktxid0000000000000000000000000000000000000000000000000000000000", nil
 	}
 	rpcServer := httptest.NewServer(mock)
 	t.Cleanup(rpcServer.Close)
 	svc := testService(t, rpcServer)
 
-	body := jsonBody(map[string]any{})
-	r := httptest.NewRequest("POST", "/admin/consolidate", body)
-	w := httptest.NewRecorder()
-	svc.adminConsolidateUTXOsHandler(w, r)
-
-	resp := decodeJSON(t, w.Body)
-	if resp["message"] == nil || !strings.Contains(resp["message"].(string), "need at least") {
-		t.Errorf("expected min utxo skip, got: %v", resp)
-	}
-}
+	sent := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending, OnchainTxnID: "senttxid"}
+	unsent := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending, OnchainTxnID: "unknowntxid"}
+	flaky := db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending, OnchainTxnID: "flakytxid"}
+	svc.db.Create(&sent)
+	svc.db.Create(&unsent)
+	svc.db.Create(&flaky)
 
-// ---------------------------------------------------------------------------
-// ConsolidateUTXOs logic
-// ---------------------------------------------------------------------------
+	svc.processBatch(context.Background())
 
-func TestConsolidateUTXOs_SkipsDust(t *testing.T) {
-	mock := newMockRPC()
-	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return []btc.UTXO{
-			{TxID: "dust1", Amount: 0.000001, Spendable: true},
-			{TxID: "dust2", Amount: 0.000002, Spendable: true},
-			{TxID: "ok1", Amount: 0.0005, Spendable: true},
-			{TxID: "ok2", Amount: 0.0003, Spendable: true},
-		}, nil
+	if n := broadcasts.Load(); n != 1 {
+		t.Errorf("expected only the never broadcast attempt to be sent, got %d broadcasts", n)
 	}
-	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return "tb1qconsolidated", nil
+
+	expected := map[uint]struct{ status, txid string }{
+		sent.ID:   {db.TxnStatusBroadcast, "senttxid"},
+		unsent.ID: {db.TxnStatusBroadcast, "mocktxid0000000000000000000000000000000000000000000000000000000000"},
+		flaky.ID:  {db.TxnStatusPending, "flakytxid"},
 	}
-	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "raw", nil }
-	mock.handlers["signrawtransactionwithwallet"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return map[string]any{"hex": "signed", "complete": true}, nil
+	for id, want := range expected {
+		var row db.Transaction
+		svc.db.First(&row, id)
+		if row.Status != want.status || row.OnchainTxnID != want.txid {
+			t.Errorf("txn %d: expected %s/%s, got %s/%s", id, want.status, want.txid, row.Status, row.OnchainTxnID)
+		}
 	}
-	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "txid123", nil }
+}
 
-	rpcServer := httptest.NewServer(mock)
-	t.Cleanup(rpcServer.Close)
-	svc := testService(t, rpcServer)
+func TestReconcileTransactions_NothingStuck(t *testing.T) {
+	svc, _ := testServiceFull(t)
 
-	result, err := svc.ConsolidateUTXOs()
+	result, err := svc.ReconcileTransactions(t.Context())
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatal(err)
 	}
-	if result.Count != 2 {
-		t.Errorf("expected 2 UTXOs consolidated (dust excluded), got %d", result.Count)
+	if *result != (ReconcileResult{}) {
+		t.Errorf("expected nothing reconciled, got %+v", *result)
 	}
 }
 
-func TestConsolidateUTXOs_SkipsUnspendable(t *testing.T) {
-	mock := newMockRPC()
-	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return []btc.UTXO{
-			{TxID: "a", Amount: 0.0005, Spendable: false},
-			{TxID: "b", Amount: 0.0003, Spendable: false},
-		}, nil
+func TestResetStaleProcessing(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.StaleProcessingTimeout = 15 * time.Minute
+
+	old := time.Now().Add(-time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	rows := map[string]*db.Transaction{
+		"stale":     {Status: db.TxnStatusProcessing, ProcessingAt: &old},
+		"recent":    {Status: db.TxnStatusProcessing, ProcessingAt: &recent},
+		"signed":    {Status: db.TxnStatusProcessing, ProcessingAt: &old, OnchainTxnID: "signedtxid"},
+		"legacy":    {Status: db.TxnStatusProcessing, CreatedAt: old},
+		"broadcast": {Status: db.TxnStatusBroadcast, ProcessingAt: &old, OnchainTxnID: "sometxid"},
+	}
+	for _, tx := range rows {
+		tx.Address = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+		tx.AmountBTC = 0.01
+		svc.db.Create(tx)
 	}
-	rpcServer := httptest.NewServer(mock)
-	t.Cleanup(rpcServer.Close)
-	svc := testService(t, rpcServer)
 
-	result, err := svc.ConsolidateUTXOs()
+	before := testutil.ToFloat64(FaucetStaleProcessingReset)
+	reset, err := svc.resetStaleProcessing()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if result.SkipReason == "" {
-		t.Error("expected skip due to unspendable UTXOs")
+	if reset != 2 {
+		t.Errorf("expected 2 rows reset, got %d", reset)
+	}
+	if got := testutil.ToFloat64(FaucetStaleProcessingReset) - before; got != 2 {
+		t.Errorf("expected metric to grow by 2, got %v", got)
+	}
+
+	want := map[string]string{
+		"stale":     db.TxnStatusPending,
+		"legacy":    db.TxnStatusPending,
+		"recent":    db.TxnStatusProcessing,
+		"signed":    db.TxnStatusProcessing,
+		"broadcast": db.TxnStatusBroadcast,
+	}
+	for name, tx := range rows {
+		var got db.Transaction
+		svc.db.First(&got, tx.ID)
+		if got.Status != want[name] {
+			t.Errorf("%s: expected status %s, got %s", name, want[name], got.Status)
+		}
+	}
+
+	svc.cfg.StaleProcessingTimeout = 0
+	svc.db.Model(&db.Transaction{}).Where("id = ?", rows["stale"].ID).Update("status", db.TxnStatusProcessing)
+	if reset, _ := svc.resetStaleProcessing(); reset != 0 {
+		t.Errorf("expected nothing reset when disabled, got %d", reset)
 	}
 }
 
-func TestConsolidateUTXOs_RespectsMax(t *testing.T) {
+// ---------------------------------------------------------------------------
+// broadcast expiry
+// ---------------------------------------------------------------------------
+
+func TestCheckExpiredBroadcasts(t *testing.T) {
 	mock := newMockRPC()
-	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
-		var utxos []btc.UTXO
-		for i := range 10 {
-			utxos = append(utxos, btc.UTXO{
-				TxID: fmt.Sprintf("tx%d", i), Amount: 0.0005, Spendable: true,
-			})
+	mock.handlers["gettransaction"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		confirmations := 0
+		switch p[0] {
+		case "confirmedtxid":
+			confirmations = 3
+		case "conflictedtxid":
+			confirmations = -1
 		}
-		return utxos, nil
+		return map[string]any{"txid": p[0], "confirmations": confirmations}, nil
 	}
-	mock.handlers["getnewaddress"] = func(_ json.RawMessage) (any, *rpcErr) { return "tb1q", nil }
-	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "r", nil }
-	mock.handlers["signrawtransactionwithwallet"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return map[string]any{"hex": "s", "complete": true}, nil
+	mock.handlers["getmempoolentry"] = func(params json.RawMessage) (any, *rpcErr) {
+		var p []string
+		json.Unmarshal(params, &p)
+		if p[0] == "waitingtxid" {
+			return map[string]any{"vsize": 141}, nil
+		}
+		return nil, &rpcErr{Code: -5, Message: "Transaction not in mempool"}
 	}
-	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) { return "txid", nil }
-
 	rpcServer := httptest.NewServer(mock)
 	t.Cleanup(rpcServer.Close)
 	svc := testService(t, rpcServer)
-	svc.cfg.MaxConsolidationUTXOs = 3
-
-	result, err := svc.ConsolidateUTXOs()
+	svc.cfg.BroadcastExpiry = time.Hour
+
+	stale := time.Now().Add(-90 * time.Minute)
+	sent := time.Now().Add(-10 * time.Minute)
+	rows := map[string]*db.Transaction{
+		"dropped1":   {OnchainTxnID: "droppedtxid", CreatedAt: stale},
+		"dropped2":   {OnchainTxnID: "droppedtxid", CreatedAt: stale},
+		"conflicted": {OnchainTxnID: "conflictedtxid", CreatedAt: stale},
+		"waiting":    {OnchainTxnID: "waitingtxid", CreatedAt: stale},
+		"confirmed":  {OnchainTxnID: "confirmedtxid", CreatedAt: stale},
+		"recent":     {OnchainTxnID: "recenttxid", CreatedAt: time.Now().Add(-10 * time.Minute)},
+		"old":        {OnchainTxnID: "oldtxid", CreatedAt: time.Now().Add(-3 * time.Hour)},
+		// queued for a while, the clock starts when it was sent
+		"queued":   {OnchainTxnID: "queuedtxid", CreatedAt: stale, ProcessingAt: &sent},
+		"sentLate": {OnchainTxnID: "sentlatetxid", CreatedAt: time.Now().Add(-3 * time.Hour), ProcessingAt: &stale},
+	}
+	for _, tx := range rows {
+		tx.Address = "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"
+		tx.AmountBTC = 0.01
+		tx.Status = db.TxnStatusBroadcast
+		svc.db.Create(tx)
+	}
+
+	n, err := svc.checkExpiredBroadcasts(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if result.Count != 3 {
-		t.Errorf("expected max 3, got %d", result.Count)
+	if n != 4 {
+		t.Errorf("expected 4 expired, got %d", n)
+	}
+
+	for name, want := range map[string]string{
+		"queued":     db.TxnStatusBroadcast,
+		"sentLate":   db.TxnStatusExpired,
+		"dropped1":   db.TxnStatusExpired,
+		"dropped2":   db.TxnStatusExpired,
+		"conflicted": db.TxnStatusExpired,
+		"waiting":    db.TxnStatusBroadcast,
+		"confirmed":  db.TxnStatusBroadcast,
+		"recent":     db.TxnStatusBroadcast,
+		"old":        db.TxnStatusBroadcast,
+	} {
+		var tx db.Transaction
+		svc.db.First(&tx, rows[name].ID)
+		if tx.Status != want {
+			t.Errorf("%s: expected %s, got %s", name, want, tx.Status)
+		}
 	}
 }
 
 // ---------------------------------------------------------------------------
-// batch processor
+// metrics endpoint
 // ---------------------------------------------------------------------------
 
-func TestProcessBatch_NoPending(t *testing.T) {
+func TestMetricsHandler(t *testing.T) {
 	svc, _ := testServiceFull(t)
-	svc.processBatch()
 
-	var count int64
-	svc.db.Model(&db.Transaction{}).Count(&count)
-	if count != 0 {
-		t.Errorf("expected no transactions, got %d", count)
+	handler := svc.MetricsHandler()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, "faucet_wallet_balance_btc") {
+		t.Error("expected faucet_wallet_balance_btc metric")
+	}
+	if !strings.Contains(body, "faucet_transactions_count") {
+		t.Error("expected faucet_transactions_count metric")
+	}
+	if !strings.Contains(body, "faucet_bitcoin_healthy") {
+		t.Error("expected faucet_bitcoin_healthy metric")
+	}
+	if !strings.Contains(body, "faucet_total_fees_paid_btc") {
+		t.Error("expected faucet_total_fees_paid_btc metric")
 	}
 }
 
-func TestProcessBatch_SendsTransactions(t *testing.T) {
+func TestMetricsHandler_AuthToken(t *testing.T) {
 	svc, _ := testServiceFull(t)
+	svc.cfg.MetricsAuthToken = "scrape-token"
+	handler := svc.MetricsHandler()
 
-	svc.db.Create(&db.Transaction{
-		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		IPAddress: "1.2.3.4",
-		AmountBTC: 0.05,
-		Status:    db.TxnStatusPending,
-	})
-	svc.db.Create(&db.Transaction{
-		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		IPAddress: "1.2.3.5",
-		AmountBTC: 0.03,
-		Status:    db.TxnStatusPending,
-	})
-
-	svc.processBatch()
-
-	var txns []db.Transaction
-	svc.db.Find(&txns)
+	for name, c := range map[string]struct {
+		setAuth func(r *http.Request)
+		want    int
+	}{
+		"no auth":        {func(r *http.Request) {}, http.StatusUnauthorized},
+		"wrong bearer":   {func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		"wrong password": {func(r *http.Request) { r.SetBasicAuth("prometheus", "nope") }, http.StatusUnauthorized},
+		"bearer":         {func(r *http.Request) { r.Header.Set("Authorization", "Bearer scrape-token") }, http.StatusOK},
+		"basic auth":     {func(r *http.Request) { r.SetBasicAuth("prometheus", "scrape-token") }, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		c.setAuth(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
 
-	for _, tx := range txns {
-		if tx.Status != db.TxnStatusBroadcast {
-			t.Errorf("expected broadcast, got %s for tx %d", tx.Status, tx.ID)
+		if w.Code != c.want {
+			t.Errorf("%s: expected %d, got %d", name, c.want, w.Code)
 		}
-		if tx.OnchainTxnID == "" {
-			t.Errorf("expected onchain txid for tx %d", tx.ID)
+		if c.want == http.StatusUnauthorized && strings.Contains(w.Body.String(), "faucet_wallet_balance_btc") {
+			t.Errorf("%s: metrics served without auth", name)
 		}
 	}
 }
 
-func TestProcessBatch_InsufficientBalance(t *testing.T) {
-	mock := newMockRPC()
-	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return map[string]any{
-			"mine": map[string]any{"trusted": 0.0001, "untrusted_pending": 0.0, "immature": 0.0},
-		}, nil
+func TestMetricsHandler_LowBalance(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	svc.walletBalance = 0.05
+	svc.CollectMetrics(t.Context())
+	if got := testutil.ToFloat64(FaucetWalletBalanceBelowThreshold); got != 1 {
+		t.Errorf("expected below threshold 1, got %v", got)
 	}
-	rpcServer := httptest.NewServer(mock)
-	t.Cleanup(rpcServer.Close)
-	svc := testService(t, rpcServer)
+	// no payouts yet, default range 2 averages 0.05
+	if got := testutil.ToFloat64(FaucetEstimatedPayoutsRemaining); got != 1 {
+		t.Errorf("expected 1 payout remaining, got %v", got)
+	}
+
+	svc.db.Create(&db.Transaction{Address: "tb1qa", AmountBTC: 0.01, Status: db.TxnStatusBroadcast})
+	svc.walletBalance = 0.5
+	svc.CollectMetrics(t.Context())
+	if got := testutil.ToFloat64(FaucetWalletBalanceBelowThreshold); got != 0 {
+		t.Errorf("expected below threshold 0, got %v", got)
+	}
+	if got := testutil.ToFloat64(FaucetEstimatedPayoutsRemaining); got != 50 {
+		t.Errorf("expected 50 payouts remaining, got %v", got)
+	}
+}
+
+func TestMetrics_OldestPendingTransaction(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	svc.CollectMetrics(t.Context())
+	if got := testutil.ToFloat64(FaucetOldestPendingTransactionSeconds); got != 0 {
+		t.Errorf("expected 0 for an empty queue, got %v", got)
+	}
+
+	svc.db.Create(&db.Transaction{Address: "tb1qa", Status: db.TxnStatusBroadcast, CreatedAt: time.Now().Add(-3 * time.Hour)})
+	svc.db.Create(&db.Transaction{Address: "tb1qb", Status: db.TxnStatusPending, CreatedAt: time.Now().Add(-time.Hour)})
+	svc.db.Create(&db.Transaction{Address: "tb1qc", Status: db.TxnStatusPending})
+
+	svc.CollectMetrics(t.Context())
+	if got := testutil.ToFloat64(FaucetOldestPendingTransactionSeconds); got < 3600 || got > 3660 {
+		t.Errorf("expected about an hour, got %v", got)
+	}
+}
 
-	svc.db.Create(&db.Transaction{
-		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		AmountBTC: 100.0,
-		Status:    db.TxnStatusPending,
-	})
+func TestMetrics_RequestCounts(t *testing.T) {
+	svc, _ := testServiceFull(t)
 
-	svc.processBatch()
+	svc.db.Create(&db.Transaction{Address: "tb1qa", Status: db.TxnStatusBroadcast, CreatedAt: time.Now().Add(-72 * time.Hour)})
+	svc.db.Create(&db.Transaction{Address: "tb1qa", Status: db.TxnStatusBroadcast})
+	svc.db.Create(&db.Transaction{Address: "tb1qb", Status: db.TxnStatusPending})
 
-	var tx db.Transaction
-	svc.db.First(&tx)
-	if tx.Status != db.TxnStatusPending {
-		t.Errorf("expected still pending (insufficient balance), got %s", tx.Status)
+	svc.CollectMetrics(t.Context())
+
+	if got := testutil.ToFloat64(FaucetRequestsTotal); got != 3 {
+		t.Errorf("expected 3 requests total, got %v", got)
+	}
+	if got := testutil.ToFloat64(FaucetRequestsLast24h); got != 2 {
+		t.Errorf("expected 2 requests in the last 24h, got %v", got)
+	}
+	if got := testutil.ToFloat64(FaucetUniqueAddressesTotal); got != 2 {
+		t.Errorf("expected 2 unique addresses, got %v", got)
 	}
 }
 
-func TestProcessBatch_RPCFailure(t *testing.T) {
+func TestMetrics_OldestUnconfirmedUTXO(t *testing.T) {
+	var calls atomic.Int32
+	received := time.Now().Add(-10 * time.Minute).Unix()
 	mock := newMockRPC()
-	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return map[string]any{
-			"mine": map[string]any{"trusted": 100.0, "untrusted_pending": 0.0, "immature": 0.0},
+	mock.handlers["listunspent"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return []btc.UTXO{
+			{TxID: "confirmed", Amount: 1.0, Confirmations: 3, Spendable: true, Safe: true},
+			{TxID: "pending", Vout: 0, Amount: 0.1, Confirmations: 0, Spendable: true, Safe: true},
+			{TxID: "pending", Vout: 1, Amount: 0.2, Confirmations: 0, Spendable: true, Safe: true},
 		}, nil
 	}
-	mock.handlers["createrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
-		return nil, &rpcErr{Code: -1, Message: "wallet locked"}
+	mock.handlers["gettransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		calls.Add(1)
+		return map[string]any{"txid": "pending", "confirmations": 0, "time": received, "timereceived": received}, nil
 	}
 	rpcServer := httptest.NewServer(mock)
 	t.Cleanup(rpcServer.Close)
 	svc := testService(t, rpcServer)
 
-	svc.db.Create(&db.Transaction{
-		Address:   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
-		AmountBTC: 0.05,
-		Status:    db.TxnStatusPending,
-	})
-
-	svc.processBatch()
+	svc.CollectMetrics(t.Context())
+	svc.CollectMetrics(t.Context())
 
-	var tx db.Transaction
-	svc.db.First(&tx)
-	if tx.Status != db.TxnStatusFailed {
-		t.Errorf("expected failed after RPC error, got %s", tx.Status)
+	if got := testutil.ToFloat64(FaucetOldestUnconfirmedUTXOSeconds); got < 600 || got > 660 {
+		t.Errorf("expected ~600s, got %v", got)
 	}
-	if tx.ErrorMsg == "" {
-		t.Error("expected error message to be recorded")
+	if calls.Load() != 1 {
+		t.Errorf("expected receive time to be cached, gettransaction called %d times", calls.Load())
 	}
 }
 
-// ---------------------------------------------------------------------------
-// metrics endpoint
-// ---------------------------------------------------------------------------
+func TestMetrics_OldestUnconfirmedUTXO_None(t *testing.T) {
+	svc, _ := testServiceFull(t)
 
-func TestMetricsHandler(t *testing.T) {
+	svc.unconfirmedSeen = map[string]time.Time{"gone": time.Now().Add(-time.Hour)}
+	svc.CollectMetrics(t.Context())
+
+	if got := testutil.ToFloat64(FaucetOldestUnconfirmedUTXOSeconds); got != 0 {
+		t.Errorf("expected 0 without unconfirmed utxos, got %v", got)
+	}
+	if len(svc.unconfirmedSeen) != 0 {
+		t.Errorf("expected confirmed txids to be pruned, got %v", svc.unconfirmedSeen)
+	}
+}
+
+func TestStartMetricsHttpServer(t *testing.T) {
 	svc, _ := testServiceFull(t)
 
-	handler := svc.MetricsHandler()
-	r := httptest.NewRequest("GET", "/metrics", nil)
-	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, r)
+	server, err := svc.StartMetricsHttpServer()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", w.Code)
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "faucet_build_info") {
+		t.Errorf("expected metrics from own server, got %d", resp.StatusCode)
 	}
 
-	body := w.Body.String()
-	if !strings.Contains(body, "faucet_wallet_balance_btc") {
-		t.Error("expected faucet_wallet_balance_btc metric")
+	resp, err = http.Get("http://" + server.Addr + "/")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(body, "faucet_transactions_count") {
-		t.Error("expected faucet_transactions_count metric")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 outside /metrics, got %d", resp.StatusCode)
 	}
-	if !strings.Contains(body, "faucet_bitcoin_healthy") {
-		t.Error("expected faucet_bitcoin_healthy metric")
+
+	// a second service in the same process gets its own mux
+	other, _ := testServiceFull(t)
+	otherServer, err := other.StartMetricsHttpServer()
+	if err != nil {
+		t.Fatalf("expected second metrics server to start, got %v", err)
+	}
+	otherServer.Shutdown(context.Background())
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + server.Addr + "/metrics"); err == nil {
+		t.Error("expected metrics server to be stopped")
+	}
+}
+
+func TestStartMetricsHttpServer_BindError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	svc, _ := testServiceFull(t)
+	svc.cfg.MetricsAddr = ln.Addr().String()
+
+	if _, err := svc.StartMetricsHttpServer(); err == nil {
+		t.Error("expected bind error for a port in use")
 	}
 }
 
@@ -1426,7 +7104,7 @@ func TestIntegration_SubmitAndProcess(t *testing.T) {
 		t.Fatalf("expected 1 pending, got %d", pending)
 	}
 
-	svc.processBatch()
+	svc.processBatch(context.Background())
 
 	var broadcast int64
 	svc.db.Model(&db.Transaction{}).Where("status = ?", db.TxnStatusBroadcast).Count(&broadcast)
@@ -1553,3 +7231,408 @@ func TestFullServer_AdminCIDRAllowlist(t *testing.T) {
 		t.Errorf("expected 200 (127.0.0.1 in 127.0.0.0/8), got %d", resp.StatusCode)
 	}
 }
+
+// ---------------------------------------------------------------------------
+// logging
+// ---------------------------------------------------------------------------
+
+func TestNewLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogFormatJSON, "info")
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+
+	logger.Debug("hidden")
+	logger.Info("sent transaction", "txid", "abc", "amount_btc", 0.01)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected debug to be filtered, got %d lines: %s", len(lines), buf.String())
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("expected json log line, got %q: %v", lines[0], err)
+	}
+	if entry["msg"] != "sent transaction" || entry["txid"] != "abc" || entry["level"] != "INFO" {
+		t.Errorf("unexpected log entry: %v", entry)
+	}
+}
+
+func TestNewLogger_TextDebug(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogFormatText, "debug")
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+
+	logger.Debug("bitcoin rpc call", "method", "getbalances")
+	if !strings.Contains(buf.String(), "method=getbalances") {
+		t.Errorf("expected text debug line, got %q", buf.String())
+	}
+}
+
+func TestNewLogger_Invalid(t *testing.T) {
+	if _, err := NewLogger(io.Discard, "xml", "info"); err == nil {
+		t.Error("expected error for invalid format")
+	}
+	if _, err := NewLogger(io.Discard, LogFormatJSON, "loud"); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// admin audit log
+// ---------------------------------------------------------------------------
+
+func lastAuditLog(t *testing.T, svc *Service) db.AuditLog {
+	t.Helper()
+	var entry db.AuditLog
+	if err := svc.db.Order("id DESC").First(&entry).Error; err != nil {
+		t.Fatalf("expected an audit log entry: %v", err)
+	}
+	return entry
+}
+
+func TestAudit_FailedLogin(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("POST", "/admin/login", strings.NewReader(url.Values{"password": {"wrong"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.RemoteAddr = "203.0.113.9:5555"
+	w := httptest.NewRecorder()
+	svc.adminLoginHandler(w, r)
+
+	entry := lastAuditLog(t, svc)
+	if entry.Action != AuditActionLogin || entry.Outcome != db.AuditOutcomeDenied {
+		t.Errorf("expected denied login, got %+v", entry)
+	}
+	if entry.IPAddress != "203.0.113.9" || entry.UserAgent != "curl/8.0" {
+		t.Errorf("expected source ip and user agent, got %+v", entry)
+	}
+	if strings.Contains(entry.Detail, "wrong") {
+		t.Errorf("attempted password must not be recorded, got %q", entry.Detail)
+	}
+}
+
+func TestAudit_SuccessfulLogin(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("POST", "/admin/login", strings.NewReader(url.Values{"password": {"testpass123"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	svc.adminLoginHandler(w, r)
+
+	if entry := lastAuditLog(t, svc); entry.Action != AuditActionLogin || entry.Outcome != db.AuditOutcomeSuccess {
+		t.Errorf("expected successful login, got %+v", entry)
+	}
+}
+
+func TestAudit_SendFunds(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	body := jsonBody(map[string]any{
+		"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"amount":  0.5,
+	})
+	r := httptest.NewRequest("POST", "/admin/sendfunds", body)
+	w := httptest.NewRecorder()
+	svc.adminSendFundsHandler(w, r)
+
+	entry := lastAuditLog(t, svc)
+	if entry.Action != AuditActionSend || entry.Outcome != db.AuditOutcomeSuccess {
+		t.Errorf("expected successful send, got %+v", entry)
+	}
+	if !strings.Contains(entry.Detail, "amount=0.50000000") || !strings.Contains(entry.Detail, "txid=") {
+		t.Errorf("expected amount and txid in detail, got %q", entry.Detail)
+	}
+}
+
+func TestAudit_Denied2FA(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.Admin2FASecret = "JBSWY3DPEHPK3PXP"
+
+	r := httptest.NewRequest("POST", "/admin/drain", jsonBody(map[string]any{
+		"address":   "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		"totp_code": "000000",
+	}))
+	w := httptest.NewRecorder()
+	svc.adminDrainHandler(w, r)
+
+	if entry := lastAuditLog(t, svc); entry.Action != AuditActionDrain || entry.Outcome != db.AuditOutcomeDenied {
+		t.Errorf("expected denied drain, got %+v", entry)
+	}
+}
+
+func TestAudit_SettingsChange(t *testing.T) {
+	svc, _ := testServiceFull(t)
+
+	r := httptest.NewRequest("POST", "/admin/settings", jsonBody(map[string]any{"min_balance": 0.25}))
+	w := httptest.NewRecorder()
+	svc.adminSettingsHandler(w, r)
+
+	entry := lastAuditLog(t, svc)
+	if entry.Action != AuditActionSettings || entry.Outcome != db.AuditOutcomeSuccess {
+		t.Errorf("expected successful settings change, got %+v", entry)
+	}
+	if !strings.Contains(entry.Detail, `"min_balance":0.25`) {
+		t.Errorf("expected new settings in detail, got %q", entry.Detail)
+	}
+}
+
+func TestAdminAudit_Page(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+	cookie := adminLogin(t, svc)
+
+	for i := range auditPageSize + 5 {
+		svc.db.Create(&db.AuditLog{Action: AuditActionSend, Outcome: db.AuditOutcomeSuccess, Detail: fmt.Sprintf("entry-%03d", i)})
+	}
+
+	get := func(query string) (int, string) {
+		req, _ := http.NewRequest("GET", baseURL+"/admin/audit"+query, nil)
+		req.AddCookie(&http.Cookie{Name: "admin_session", Value: cookie})
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if !strings.Contains(body, fmt.Sprintf("entry-%03d", auditPageSize+4)) || strings.Contains(body, "entry-000") {
+		t.Error("expected the newest entries on the first page")
+	}
+	if !strings.Contains(body, "Page 1 of 2") {
+		t.Error("expected pagination info")
+	}
+
+	code, body = get("?page=2")
+	if code != http.StatusOK || !strings.Contains(body, "entry-000") {
+		t.Errorf("expected the oldest entries on page 2, got %d", code)
+	}
+
+	if code, _ := get("?page=0"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid page, got %d", code)
+	}
+}
+
+func TestAdminAudit_RequiresAuth(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	baseURL := startTestServer(t, svc)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(baseURL + "/admin/audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected redirect to login, got %d", resp.StatusCode)
+	}
+}
+
+func TestCheckNodeSynced(t *testing.T) {
+	for _, c := range []struct {
+		name            string
+		progress        float64
+		blocks, headers int64
+		ok              bool
+	}{
+		{"caught up", 1.0, 100, 100, true},
+		{"within lag", 0.99995, 98, 100, true},
+		{"syncing", 0.95, 100, 100, false},
+		{"behind headers", 1.0, 97, 100, false},
+	} {
+		mock := newMockRPC()
+		mock.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
+			return map[string]any{"chain": "signet", "blocks": c.blocks, "headers": c.headers, "verificationprogress": c.progress}, nil
+		}
+		rpcServer := httptest.NewServer(mock)
+		svc := testService(t, rpcServer)
+		svc.cfg.MinSyncProgress = 0.9999
+		svc.cfg.MaxBlockLag = 2
+
+		if err := svc.checkNodeSynced(t.Context()); (err == nil) != c.ok {
+			t.Errorf("%s: expected ok=%v, got %v", c.name, c.ok, err)
+		}
+		rpcServer.Close()
+	}
+}
+
+func TestProcessBatch_SkipsWhenNodeBehind(t *testing.T) {
+	mock := newMockRPC()
+	mock.handlers["getblockchaininfo"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"chain": "signet", "blocks": 90, "headers": 100, "verificationprogress": 0.999}, nil
+	}
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.MaxBlockLag = 2
+
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", AmountBTC: 0.01, Status: db.TxnStatusPending})
+	skipped := testutil.ToFloat64(FaucetBatchSkippedNodeBehind)
+
+	svc.processBatch(context.Background())
+
+	var tx db.Transaction
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusPending {
+		t.Errorf("expected the payout to stay pending, got %s", tx.Status)
+	}
+	if got := testutil.ToFloat64(FaucetBatchSkippedNodeBehind) - skipped; got != 1 {
+		t.Errorf("expected 1 skipped batch, got %v", got)
+	}
+
+	svc.cfg.MaxBlockLag = 0
+	svc.processBatch(context.Background())
+	svc.db.First(&tx)
+	if tx.Status != db.TxnStatusBroadcast {
+		t.Errorf("expected the payout to go out with the check disabled, got %s", tx.Status)
+	}
+}
+
+func TestCheckDeposit(t *testing.T) {
+	svc, _ := testServiceFull(t)
+	svc.cfg.DepositAlertThreshold = 0.01
+
+	var hooks []map[string]any
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		hooks = append(hooks, body)
+	}))
+	t.Cleanup(hook.Close)
+	svc.cfg.DepositWebhookURL = hook.URL
+
+	balances := func(trusted, pending float64) *btc.Balances {
+		return &btc.Balances{Mine: btc.WalletBalance{Trusted: trusted, Untrusted: pending}}
+	}
+	check := func(b *btc.Balances) {
+		if deposit, found := svc.checkDeposit(b); found {
+			svc.reportDeposit(deposit, b)
+		}
+	}
+	deposits := testutil.ToFloat64(FaucetDeposits)
+
+	// the first refresh only sets the baseline
+	check(balances(1, 0))
+	// an incoming transaction shows up as pending
+	check(balances(1, 0.5))
+	// it confirms, nothing new
+	check(balances(1.5, 0))
+	// a payout of 0.3 and a deposit of 0.2 in the same cycle
+	svc.recordOutgoing(0.3)
+	check(balances(1.4, 0))
+	// a payout alone, change still unconfirmed
+	svc.recordOutgoing(0.1)
+	check(balances(1.2, 0.1))
+	// below the threshold
+	check(balances(1.305, 0))
+
+	if got := testutil.ToFloat64(FaucetDeposits) - deposits; got != 2 {
+		t.Errorf("expected 2 deposits, got %v", got)
+	}
+	if len(hooks) != 2 {
+		t.Fatalf("expected 2 webhook calls, got %d", len(hooks))
+	}
+	if hooks[0]["event"] != "deposit" || math.Abs(hooks[0]["amount_btc"].(float64)-0.5) > 1e-9 {
+		t.Errorf("unexpected first webhook: %v", hooks[0])
+	}
+	if math.Abs(hooks[1]["amount_btc"].(float64)-0.2) > 1e-9 {
+		t.Errorf("expected the payout to be added back, got %v", hooks[1])
+	}
+}
+
+func TestCheckDeposit_RefreshDuringPayout(t *testing.T) {
+	mock := newMockRPC()
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.DepositAlertThreshold = 0.01
+
+	var mtx sync.Mutex
+	trusted := 10.0
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return map[string]any{"mine": map[string]any{"trusted": trusted}}, nil
+	}
+
+	// a balance refresh fires right as the payout leaves the wallet
+	refreshed := make(chan struct{})
+	mock.handlers["sendrawtransaction"] = func(_ json.RawMessage) (any, *rpcErr) {
+		mtx.Lock()
+		trusted -= 0.5 + 0.00001
+		mtx.Unlock()
+		go func() {
+			svc.refreshWalletBalance(context.Background())
+			close(refreshed)
+		}()
+		// give it the chance to finish before the send returns, it can't
+		// while the payout holds walletMtx
+		select {
+		case <-refreshed:
+		case <-time.After(50 * time.Millisecond):
+		}
+		return "mocktxid", nil
+	}
+
+	svc.refreshWalletBalance(t.Context())
+	svc.db.Create(&db.Transaction{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", IPAddress: "1.2.3.4", AmountBTC: 0.5, Status: db.TxnStatusPending})
+	deposits := testutil.ToFloat64(FaucetDeposits)
+
+	svc.processBatch(t.Context())
+	<-refreshed
+	svc.refreshWalletBalance(t.Context())
+
+	if got := testutil.ToFloat64(FaucetDeposits) - deposits; got != 0 {
+		t.Errorf("expected our own payout not to count as a deposit, got %v", got)
+	}
+}
+
+func TestRefreshWalletBalance_WebhookWithoutWalletLock(t *testing.T) {
+	mock := newMockRPC()
+	rpcServer := httptest.NewServer(mock)
+	t.Cleanup(rpcServer.Close)
+	svc := testService(t, rpcServer)
+	svc.cfg.DepositAlertThreshold = 0.01
+
+	trusted := 10.0
+	mock.handlers["getbalances"] = func(_ json.RawMessage) (any, *rpcErr) {
+		return map[string]any{"mine": map[string]any{"trusted": trusted}}, nil
+	}
+
+	// a slow webhook mustn't hold up payouts
+	var lockFree, called bool
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if svc.walletMtx.TryLock() {
+			lockFree = true
+			svc.walletMtx.Unlock()
+		}
+	}))
+	t.Cleanup(hook.Close)
+	svc.cfg.DepositWebhookURL = hook.URL
+
+	svc.refreshWalletBalance(t.Context())
+	trusted = 11
+	svc.refreshWalletBalance(t.Context())
+
+	if !called {
+		t.Fatal("expected the deposit webhook to be posted")
+	}
+	if !lockFree {
+		t.Error("expected walletMtx to be released while the webhook is posted")
+	}
+}
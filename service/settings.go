@@ -0,0 +1,224 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/lnliz/faucet.coinbin.org/db"
+)
+
+// Settings are the payout and rate limit values admins can change at runtime,
+// they start out from the flags and are overridden by the settings table
+type Settings struct {
+	EnabledAmountRanges    []int   `json:"enabled_amount_ranges"`
+	DefaultAmountRange     int     `json:"default_amount_range"`
+	MinBalance             float64 `json:"min_balance"`
+	MaxWithdrawalsPerIP24h int     `json:"max_withdrawals_per_ip_24h"`
+	MaxDepositsPerAddress  int     `json:"max_deposits_per_address"`
+}
+
+func (s Settings) RangeEnabled(id int) bool {
+	return slices.Contains(s.EnabledAmountRanges, id)
+}
+
+func settingsFromConfig(cfg *Config) Settings {
+	return Settings{
+		EnabledAmountRanges:    slices.Clone(cfg.EnabledAmountRanges),
+		DefaultAmountRange:     cfg.DefaultAmountRange,
+		MinBalance:             cfg.MinBalance,
+		MaxWithdrawalsPerIP24h: cfg.MaxWithdrawalsPerIP24h,
+		MaxDepositsPerAddress:  cfg.MaxDepositsPerAddress,
+	}
+}
+
+func (s Settings) Validate() error {
+	if len(s.EnabledAmountRanges) == 0 {
+		return fmt.Errorf("at least one amount range must be enabled")
+	}
+	for _, id := range s.EnabledAmountRanges {
+		if !slices.ContainsFunc(AllAmountRanges, func(r AmountRange) bool { return r.ID == id }) {
+			return fmt.Errorf("invalid amount range: %d", id)
+		}
+	}
+	if !slices.Contains(s.EnabledAmountRanges, s.DefaultAmountRange) {
+		return fmt.Errorf("default amount range %d is not enabled", s.DefaultAmountRange)
+	}
+	if s.MinBalance < 0 {
+		return fmt.Errorf("min balance can't be negative")
+	}
+	if s.MaxWithdrawalsPerIP24h < 1 {
+		return fmt.Errorf("max withdrawals per IP must be at least 1")
+	}
+	if s.MaxDepositsPerAddress < 1 {
+		return fmt.Errorf("max deposits per address must be at least 1")
+	}
+	return nil
+}
+
+// toValues encodes every field as its own settings row, keyed by json name
+func (s Settings) toValues() (map[string]string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(fields))
+	for k, v := range fields {
+		values[k] = string(v)
+	}
+	return values, nil
+}
+
+func (svc *Service) Settings() Settings {
+	svc.settingsMtx.RLock()
+	defer svc.settingsMtx.RUnlock()
+	s := svc.settings
+	s.EnabledAmountRanges = slices.Clone(s.EnabledAmountRanges)
+	return s
+}
+
+// LoadSettings applies the overrides stored in the settings table on top of
+// the flag values
+func (svc *Service) LoadSettings() error {
+	values, err := db.GetSettings(svc.db)
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %w", err)
+	}
+	delete(values, donationAddressSetting)
+	delete(values, admin2FASecretSetting)
+	if len(values) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]json.RawMessage, len(values))
+	for k, v := range values {
+		fields[k] = json.RawMessage(v)
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	s := svc.Settings()
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("failed to decode settings: %w", err)
+	}
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("invalid stored settings: %w", err)
+	}
+
+	svc.settingsMtx.Lock()
+	svc.settings = s
+	svc.settingsMtx.Unlock()
+
+	svc.logger.Info("loaded settings overrides", "count", len(values))
+	return nil
+}
+
+// UpdateSettings validates and persists s, the in-memory values only change
+// once the db write went through
+func (svc *Service) UpdateSettings(s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	values, err := s.toValues()
+	if err != nil {
+		return err
+	}
+	if err := db.SaveSettings(svc.db, values); err != nil {
+		return fmt.Errorf("failed to save settings: %w", err)
+	}
+
+	svc.settingsMtx.Lock()
+	svc.settings = s
+	svc.settingsMtx.Unlock()
+	return nil
+}
+
+func (svc *Service) adminSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		EnabledAmountRanges    []int    `json:"enabled_amount_ranges"`
+		DefaultAmountRange     *int     `json:"default_amount_range"`
+		MinBalance             *float64 `json:"min_balance"`
+		MaxWithdrawalsPerIP24h *int     `json:"max_withdrawals_per_ip_24h"`
+		MaxDepositsPerAddress  *int     `json:"max_deposits_per_address"`
+		TOTPCode               string   `json:"totp_code"`
+	}
+
+	if !svc.decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if svc.require2FA() {
+		if !svc.verify2FA(req.TOTPCode) {
+			svc.audit(r, AuditActionSettings, db.AuditOutcomeDenied, "")
+			writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code")
+			return
+		}
+	}
+
+	/*
+	 only the fields present in the request are changed
+	*/
+	s := svc.Settings()
+	if req.EnabledAmountRanges != nil {
+		s.EnabledAmountRanges = req.EnabledAmountRanges
+	}
+	if req.DefaultAmountRange != nil {
+		s.DefaultAmountRange = *req.DefaultAmountRange
+	}
+	if req.MinBalance != nil {
+		s.MinBalance = *req.MinBalance
+	}
+	if req.MaxWithdrawalsPerIP24h != nil {
+		s.MaxWithdrawalsPerIP24h = *req.MaxWithdrawalsPerIP24h
+	}
+	if req.MaxDepositsPerAddress != nil {
+		s.MaxDepositsPerAddress = *req.MaxDepositsPerAddress
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := s.Validate(); err != nil {
+		svc.audit(r, AuditActionSettings, db.AuditOutcomeFailure, "invalid: "+err.Error())
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidSettings, err.Error())
+		return
+	}
+
+	if err := svc.UpdateSettings(s); err != nil {
+		svc.logger.Error("failed to update settings", "err", err)
+		svc.audit(r, AuditActionSettings, db.AuditOutcomeFailure, "err="+err.Error())
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to save settings")
+		return
+	}
+
+	if b, err := json.Marshal(s); err == nil {
+		svc.audit(r, AuditActionSettings, db.AuditOutcomeSuccess, string(b))
+	}
+	svc.logger.Info("admin updated settings",
+		"enabled_amount_ranges", s.EnabledAmountRanges,
+		"default_amount_range", s.DefaultAmountRange,
+		"min_balance", s.MinBalance,
+		"max_withdrawals_per_ip_24h", s.MaxWithdrawalsPerIP24h,
+		"max_deposits_per_address", s.MaxDepositsPerAddress)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":  true,
+		"settings": s,
+		"message":  "Settings updated",
+	})
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lnliz/faucet.coinbin.org/db"
+	"github.com/xlzd/gotp"
+)
+
+const (
+	// settings table key a rotated 2FA secret is kept under, once set it
+	// overrides -admin-2fa-secret
+	admin2FASecretSetting = "admin_2fa_secret"
+
+	// how long a freshly generated secret waits for its confirmation code
+	pending2FATTL = 10 * time.Minute
+
+	// 160 bits, what authenticator apps expect from RFC 4226
+	admin2FASecretBytes = 20
+
+	admin2FAIssuer = "faucet.coinbin.org"
+)
+
+type pending2FASecret struct {
+	secret    string
+	expiresAt time.Time
+}
+
+func normalize2FASecret(secret string) string {
+	return strings.ToUpper(strings.TrimSpace(secret))
+}
+
+// admin2FASecret is the secret codes are checked against, the rotated one if
+// there is one and -admin-2fa-secret otherwise. Empty means 2FA is off.
+func (svc *Service) admin2FASecret() string {
+	svc.totpMtx.RLock()
+	defer svc.totpMtx.RUnlock()
+	if svc.totpSecret != "" {
+		return svc.totpSecret
+	}
+	return normalize2FASecret(svc.cfg.Admin2FASecret)
+}
+
+func (svc *Service) require2FA() bool {
+	return svc.admin2FASecret() != ""
+}
+
+// verify2FA checks code against the active secret, an empty code never passes
+func (svc *Service) verify2FA(code string) bool {
+	secret := svc.admin2FASecret()
+	if secret == "" || code == "" {
+		return false
+	}
+	return gotp.NewDefaultTOTP(secret).Verify(code, time.Now().Unix())
+}
+
+// Load2FASecret picks up a secret rotated from the dashboard, it takes
+// precedence over -admin-2fa-secret
+func (svc *Service) Load2FASecret() error {
+	values, err := db.GetSettings(svc.db)
+	if err != nil {
+		return fmt.Errorf("failed to load 2FA secret: %w", err)
+	}
+	v, ok := values[admin2FASecretSetting]
+	if !ok {
+		return nil
+	}
+
+	var secret string
+	if err := json.Unmarshal([]byte(v), &secret); err != nil {
+		return fmt.Errorf("failed to decode 2FA secret: %w", err)
+	}
+	if !gotp.IsSecretValid(secret) {
+		return fmt.Errorf("stored 2FA secret is not valid base32")
+	}
+
+	svc.totpMtx.Lock()
+	svc.totpSecret = secret
+	svc.totpMtx.Unlock()
+
+	svc.logger.Info("using 2FA secret rotated from the dashboard, -admin-2fa-secret is ignored")
+	return nil
+}
+
+// adminRotate2FAHandler generates a new secret and hands it to the admin to
+// scan. It is not used for anything until adminConfirm2FAHandler saw a code
+// from it, so a botched scan can't lock anyone out.
+func (svc *Service) adminRotate2FAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		TOTPCode string `json:"totp_code"`
+	}
+	if !svc.decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if svc.require2FA() && !svc.verify2FA(req.TOTPCode) {
+		svc.audit(r, AuditActionRotate2FA, db.AuditOutcomeDenied, "")
+		writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code")
+		return
+	}
+
+	secret := gotp.RandomSecret(admin2FASecretBytes)
+	if secret == "" {
+		svc.logger.Error("failed to generate 2FA secret")
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to generate 2FA secret")
+		return
+	}
+
+	expiresAt := time.Now().Add(pending2FATTL)
+	svc.totpMtx.Lock()
+	svc.pending2FA = &pending2FASecret{secret: secret, expiresAt: expiresAt}
+	svc.totpMtx.Unlock()
+
+	svc.audit(r, AuditActionRotate2FA, db.AuditOutcomeSuccess, "new secret generated, waiting for confirmation")
+	svc.logger.Info("admin started 2FA rotation", "expires_at", expiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":          true,
+		"secret":           secret,
+		"provisioning_uri": gotp.NewDefaultTOTP(secret).ProvisioningUri("admin ("+svc.cfg.Network+")", admin2FAIssuer),
+		"expires_at":       expiresAt,
+		"message":          "Add the new secret to your authenticator and confirm with a code from it",
+	})
+}
+
+// adminConfirm2FAHandler activates the pending secret once the admin proved
+// they can generate codes for it, and stores it so it survives a restart
+func (svc *Service) adminConfirm2FAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		TOTPCode string `json:"totp_code"`
+	}
+	if !svc.decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	svc.totpMtx.Lock()
+	defer svc.totpMtx.Unlock()
+
+	pending := svc.pending2FA
+	if pending == nil || time.Now().After(pending.expiresAt) {
+		svc.pending2FA = nil
+		writeJSONError(w, r, http.StatusBadRequest, errCodeInvalidRequest, "No 2FA rotation in progress, generate a new secret first")
+		return
+	}
+
+	if req.TOTPCode == "" || !gotp.NewDefaultTOTP(pending.secret).Verify(req.TOTPCode, time.Now().Unix()) {
+		svc.audit(r, AuditActionRotate2FA, db.AuditOutcomeDenied, "confirmation code didn't match the new secret")
+		writeJSONError(w, r, http.StatusUnauthorized, errCodeInvalid2FA, "Invalid 2FA code for the new secret")
+		return
+	}
+
+	encoded, _ := json.Marshal(pending.secret)
+	if err := db.SaveSettings(svc.db, map[string]string{admin2FASecretSetting: string(encoded)}); err != nil {
+		svc.logger.Error("failed to save 2FA secret", "err", err)
+		svc.audit(r, AuditActionRotate2FA, db.AuditOutcomeFailure, "err="+err.Error())
+		writeJSONError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to save 2FA secret")
+		return
+	}
+
+	svc.totpSecret = pending.secret
+	svc.pending2FA = nil
+
+	svc.audit(r, AuditActionRotate2FA, db.AuditOutcomeSuccess, "new secret active")
+	svc.logger.Info("admin rotated 2FA secret")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success": true,
+		"message": "2FA secret rotated, the old one no longer works",
+	})
+}